@@ -0,0 +1,236 @@
+package ethpool
+
+import (
+	"time"
+
+	"github.com/gladiusio/legion/frameworks/ethpool/valuestore"
+)
+
+// Defaults used when the Config fields are zero
+const (
+	DefaultPingTimeout      = 2 * time.Second
+	DefaultAlpha            = 3
+	DefaultLookupRPCTimeout = time.Second
+	DefaultLookupTimeout    = 10 * time.Second
+
+	DefaultMaintenanceInterval = time.Minute
+	DefaultRefreshInterval     = 15 * time.Minute
+	DefaultStaleAfter          = 15 * time.Minute
+	DefaultRepublishInterval   = time.Hour
+
+	DefaultMaxValueSize           = 64 * 1024
+	DefaultMaxValueTTL            = 24 * time.Hour
+	DefaultValueRepublishInterval = time.Hour
+	DefaultMaxStoredValues        = 4096
+	DefaultMaxValuesPerPublisher  = 64
+
+	DefaultFreshnessWindow      = 30 * time.Second
+	DefaultReplayCacheSize      = 1 << 16
+	DefaultReplayCachePerSigner = 1 << 10
+	DefaultKeyCacheSize         = 4096
+	DefaultRequestTimeout       = 10 * time.Second
+	DefaultHandlerQueueSize     = 256
+	DefaultHandlerWorkers       = 1
+
+	DefaultResolveTimeout     = 5 * time.Second
+	DefaultResolveNegativeTTL = 30 * time.Second
+)
+
+// Config configures the framework, any field left as its zero value uses
+// the default
+type Config struct {
+	// BucketSize is K, the most peers kept in each bucket of the routing
+	// table, zero uses DefaultBucketSize
+	BucketSize int
+
+	// ReplacementCacheSize is how many peers that didn't fit in a full bucket
+	// are remembered, so they can replace peers that stop answering. Zero uses
+	// the bucket size.
+	ReplacementCacheSize int
+
+	// PingTimeout is how long the least recently seen peer in a full bucket
+	// has to answer a ping before it is evicted for a newer peer
+	PingTimeout time.Duration
+
+	// Alpha is how many lookup requests are in flight at once during a lookup
+	Alpha int
+
+	// LookupRPCTimeout is how long a peer has to answer a single lookup
+	// request before it's skipped
+	LookupRPCTimeout time.Duration
+
+	// LookupTimeout is the longest a whole lookup can take
+	LookupTimeout time.Duration
+
+	// DisableMaintenance turns off the background loop that keeps the routing
+	// table fresh while legion is running
+	DisableMaintenance bool
+
+	// MaintenanceInterval is how often the maintenance loop runs
+	MaintenanceInterval time.Duration
+
+	// RefreshInterval is how long a bucket can go untouched before it's
+	// refreshed with a lookup for a random ID in its range
+	RefreshInterval time.Duration
+
+	// StaleAfter is how long a peer in the routing table can go unseen
+	// before it's pinged, and evicted if it doesn't answer
+	StaleAfter time.Duration
+
+	// RepublishInterval is how often we look up our own ID, which lets the
+	// peers closest to us know we're still here
+	RepublishInterval time.Duration
+
+	// Store holds the values we store for the DHT, use a persistent one to
+	// keep them across restarts. If nil an in memory store is used. The
+	// framework doesn't close the store.
+	Store valuestore.Store
+
+	// MaxStoredValues and MaxValuesPerPublisher cap how many values other
+	// publishers can store with us, in total and for each publisher. They
+	// only apply to the in memory store used when Store is nil, a store
+	// passed in sets its own limits.
+	MaxStoredValues       int
+	MaxValuesPerPublisher int
+
+	// MaxValueSize is the largest value in bytes we store or return
+	MaxValueSize int
+
+	// MaxValueTTL is the longest a value can be stored for before it expires
+	MaxValueTTL time.Duration
+
+	// ValueRepublishInterval is how often the values we published are stored
+	// on the closest peers again until they expire
+	ValueRepublishInterval time.Duration
+
+	// Capabilities are announced in our peer record, so peers can tell which
+	// protocols we speak before connecting
+	Capabilities []string
+
+	// FreshnessWindow is how far a signed message's timestamp can be from
+	// our clock before it's rejected, it also bounds clock skew between peers
+	FreshnessWindow time.Duration
+
+	// ReplayCacheSize is how many message nonces can be remembered at once to
+	// reject replays. Nonces are kept until they leave the freshness window,
+	// and messages are rejected while the cache is full.
+	ReplayCacheSize int
+
+	// ReplayCachePerSigner is how many of those nonces can be from one
+	// signer, so a single peer can't fill the cache for everyone. Its
+	// messages are rejected once it has used its share.
+	ReplayCachePerSigner int
+
+	// KeyCacheSize is how many peers' public keys are remembered for
+	// SendEncryptedMessage, the oldest is forgotten first
+	KeyCacheSize int
+
+	// RequestTimeout is how long Request waits for a reply when its context
+	// has no deadline, including the lookup to find the recipient
+	RequestTimeout time.Duration
+
+	// HandlerQueueSize is how many messages of each type can wait for a
+	// handler before more are dropped
+	HandlerQueueSize int
+
+	// HandlerWorkers is how many messages of each type are handled at once,
+	// with more than one messages of a type can be handled out of order
+	HandlerWorkers int
+
+	// DisableResolve makes SendMessage fail for recipients that aren't in the
+	// routing table instead of looking them up
+	DisableResolve bool
+
+	// ResolveDepth is the most hops a lookup for a recipient follows, zero
+	// doesn't limit them
+	ResolveDepth int
+
+	// ResolveTimeout is how long a lookup for a recipient can take
+	ResolveTimeout time.Duration
+
+	// ResolveNegativeTTL is how long a recipient that wasn't found fails
+	// without being looked up again, a negative value doesn't remember them
+	ResolveNegativeTTL time.Duration
+}
+
+// withDefaults returns a copy of the config with the zero fields set to their
+// defaults
+func (c *Config) withDefaults() Config {
+	conf := Config{}
+	if c != nil {
+		conf = *c
+	}
+	if conf.BucketSize <= 0 {
+		conf.BucketSize = DefaultBucketSize
+	}
+	if conf.ReplacementCacheSize <= 0 {
+		conf.ReplacementCacheSize = conf.BucketSize
+	}
+	if conf.PingTimeout <= 0 {
+		conf.PingTimeout = DefaultPingTimeout
+	}
+	if conf.Alpha <= 0 {
+		conf.Alpha = DefaultAlpha
+	}
+	if conf.LookupRPCTimeout <= 0 {
+		conf.LookupRPCTimeout = DefaultLookupRPCTimeout
+	}
+	if conf.LookupTimeout <= 0 {
+		conf.LookupTimeout = DefaultLookupTimeout
+	}
+	if conf.MaintenanceInterval <= 0 {
+		conf.MaintenanceInterval = DefaultMaintenanceInterval
+	}
+	if conf.RefreshInterval <= 0 {
+		conf.RefreshInterval = DefaultRefreshInterval
+	}
+	if conf.StaleAfter <= 0 {
+		conf.StaleAfter = DefaultStaleAfter
+	}
+	if conf.RepublishInterval <= 0 {
+		conf.RepublishInterval = DefaultRepublishInterval
+	}
+	if conf.MaxStoredValues <= 0 {
+		conf.MaxStoredValues = DefaultMaxStoredValues
+	}
+	if conf.MaxValuesPerPublisher <= 0 {
+		conf.MaxValuesPerPublisher = DefaultMaxValuesPerPublisher
+	}
+	if conf.MaxValueSize <= 0 {
+		conf.MaxValueSize = DefaultMaxValueSize
+	}
+	if conf.MaxValueTTL <= 0 {
+		conf.MaxValueTTL = DefaultMaxValueTTL
+	}
+	if conf.ValueRepublishInterval <= 0 {
+		conf.ValueRepublishInterval = DefaultValueRepublishInterval
+	}
+	if conf.FreshnessWindow <= 0 {
+		conf.FreshnessWindow = DefaultFreshnessWindow
+	}
+	if conf.ReplayCacheSize <= 0 {
+		conf.ReplayCacheSize = DefaultReplayCacheSize
+	}
+	if conf.ReplayCachePerSigner <= 0 {
+		conf.ReplayCachePerSigner = DefaultReplayCachePerSigner
+	}
+	if conf.KeyCacheSize <= 0 {
+		conf.KeyCacheSize = DefaultKeyCacheSize
+	}
+	if conf.RequestTimeout <= 0 {
+		conf.RequestTimeout = DefaultRequestTimeout
+	}
+	if conf.HandlerQueueSize <= 0 {
+		conf.HandlerQueueSize = DefaultHandlerQueueSize
+	}
+	if conf.HandlerWorkers <= 0 {
+		conf.HandlerWorkers = DefaultHandlerWorkers
+	}
+	if conf.ResolveTimeout <= 0 {
+		conf.ResolveTimeout = DefaultResolveTimeout
+	}
+	if conf.ResolveNegativeTTL == 0 {
+		conf.ResolveNegativeTTL = DefaultResolveNegativeTTL
+	}
+	return conf
+}
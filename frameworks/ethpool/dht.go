@@ -0,0 +1,423 @@
+package ethpool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gladiusio/legion/frameworks/ethpool/protobuf"
+	"github.com/gladiusio/legion/frameworks/ethpool/valuestore"
+	"github.com/gladiusio/legion/network"
+	"github.com/gladiusio/legion/utils"
+)
+
+// Errors returned by the key/value store
+var (
+	ErrValueNotFound = errors.New("ethpool: value not found")
+	ErrValueTooLarge = errors.New("ethpool: value is too large")
+	ErrNotStored     = errors.New("ethpool: no peer stored the value")
+)
+
+// Value is a value stored in the DHT under a key by a publisher
+type Value struct {
+	Key       []byte
+	Data      []byte
+	Publisher common.Address
+	Published time.Time
+	Expires   time.Time
+}
+
+// keyID returns the ID a key is stored closest to
+func keyID(key []byte) ID {
+	return ID{EthAddress: crypto.Keccak256(key)[12:]}
+}
+
+// Put signs the value and stores it under the key on the K closest peers to
+// the key, it expires after the ttl. A ttl of zero, or one longer than
+// MaxValueTTL, uses MaxValueTTL. We keep the value and republish it until it
+// expires, even if no peer stored it, in which case ErrNotStored is returned.
+func (f *Framework) Put(ctx context.Context, key, data []byte, ttl time.Duration) error {
+	if len(data) > f.config.MaxValueSize {
+		return ErrValueTooLarge
+	}
+	if ttl <= 0 || ttl > f.config.MaxValueTTL {
+		ttl = f.config.MaxValueTTL
+	}
+
+	now := time.Now()
+	v := &protobuf.Value{
+		Key:       key,
+		Data:      data,
+		Publisher: f.selfID().EthAddress,
+		Published: now.UnixNano(),
+		Expires:   now.Add(ttl).UnixNano(),
+	}
+	if err := f.signValue(v); err != nil {
+		return err
+	}
+
+	record, err := makeRecord(v, true)
+	if err != nil {
+		return err
+	}
+	if err := f.store.Put(record); err != nil {
+		return err
+	}
+
+	return f.replicate(ctx, v)
+}
+
+// Get finds the values stored under the key, the newest one from each
+// publisher, newest first. Values that aren't signed by their publisher or
+// whose publisher isn't in the pool are ignored.
+func (f *Framework) Get(ctx context.Context, key []byte) ([]*Value, error) {
+	found := make(map[common.Address]*Value)
+	done := false
+	var mux sync.Mutex
+	collect := func(v *protobuf.Value) {
+		value, err := f.checkValue(v, time.Now())
+		if err != nil || !bytes.Equal(v.Key, key) {
+			return
+		}
+
+		mux.Lock()
+		defer mux.Unlock()
+		if done {
+			return
+		}
+		if existing, ok := found[value.Publisher]; !ok || existing.Published.Before(value.Published) {
+			found[value.Publisher] = value
+		}
+	}
+
+	for _, v := range f.localValues(key) {
+		collect(v)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.config.LookupTimeout)
+	defer cancel()
+
+	query := func(ctx context.Context, id ID) ([]*ID, bool, error) {
+		values, peers, err := f.requestFindValue(ctx, id, key)
+		for _, v := range values {
+			collect(v)
+		}
+		return peers, false, err
+	}
+	f.iterate(ctx, keyID(key), f.config.BucketSize, 0, query)
+
+	// Queries still in flight when the lookup finished can't add values
+	mux.Lock()
+	done = true
+	values := make([]*Value, 0, len(found))
+	for _, v := range found {
+		values = append(values, v)
+	}
+	mux.Unlock()
+
+	if len(values) == 0 {
+		return nil, ErrValueNotFound
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Published.After(values[j].Published) })
+
+	return values, nil
+}
+
+// replicate stores the value on the K closest peers to its key
+func (f *Framework) replicate(ctx context.Context, v *protobuf.Value) error {
+	ctx, cancel := context.WithTimeout(ctx, f.config.LookupTimeout)
+	defer cancel()
+
+	result, _ := f.lookup(ctx, keyID(v.Key), f.config.BucketSize, false, 0)
+
+	body, err := (&protobuf.StoreRequest{Value: v}).Marshal()
+	if err != nil {
+		return err
+	}
+
+	var stored int32
+	var wg sync.WaitGroup
+	for _, id := range result.Closest {
+		wg.Add(1)
+		go func(id ID) {
+			defer wg.Done()
+			if f.requestStore(ctx, id, body) == nil {
+				atomic.AddInt32(&stored, 1)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	if stored == 0 {
+		return ErrNotStored
+	}
+	return nil
+}
+
+// republishValues stores the unexpired values we published on the closest
+// peers again, so they stay replicated as peers come and go
+func (f *Framework) republishValues(ctx context.Context) {
+	records, err := f.store.All()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, r := range records {
+		if ctx.Err() != nil {
+			return
+		}
+		if !r.Local || r.Expired(now) {
+			continue
+		}
+
+		v := &protobuf.Value{}
+		if v.Unmarshal(r.Value) != nil {
+			continue
+		}
+		f.replicate(ctx, v)
+	}
+}
+
+// requestStore asks the peer to store the value in the store request body
+func (f *Framework) requestStore(ctx context.Context, id ID, body []byte) error {
+	m, err := f.makeLegionSignedMessage("dht.store", recipientOf(id), body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.config.LookupRPCTimeout)
+	defer cancel()
+
+	reply, err := f.l.RequestContext(ctx, m, utils.LegionAddressFromString(id.NetworkAddress))
+	if err != nil {
+		return err
+	}
+
+	dhtMessage, err := f.decodeReply(reply, id)
+	if err != nil {
+		return err
+	}
+	resp := &protobuf.StoreResponse{}
+	if err := resp.Unmarshal(dhtMessage.Body); err != nil {
+		return err
+	}
+	if !resp.Stored {
+		return errors.New("ethpool: peer refused to store the value")
+	}
+
+	return nil
+}
+
+// requestFindValue asks the peer for the values it stores under the key, and
+// the peers it knows closest to the key
+func (f *Framework) requestFindValue(ctx context.Context, id ID, key []byte) ([]*protobuf.Value, []*ID, error) {
+	body, err := (&protobuf.FindValueRequest{Key: key}).Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := f.makeLegionSignedMessage("dht.find_value", recipientOf(id), body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.config.LookupRPCTimeout)
+	defer cancel()
+
+	reply, err := f.l.RequestContext(ctx, m, utils.LegionAddressFromString(id.NetworkAddress))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dhtMessage, err := f.decodeReply(reply, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp := &protobuf.FindValueResponse{}
+	if err := resp.Unmarshal(dhtMessage.Body); err != nil {
+		return nil, nil, err
+	}
+
+	return resp.Values, f.mergePeers(resp.Peers, resp.Records), nil
+}
+
+// handleStore stores the value in a store request if it's valid, and isn't
+// older than the one we have from the same publisher
+func (f *Framework) handleStore(ctx *network.MessageContext, signer common.Address, body []byte) {
+	stored := false
+
+	req := &protobuf.StoreRequest{}
+	if req.Unmarshal(body) == nil && req.Value != nil {
+		stored = f.storeValue(req.Value) == nil
+	}
+
+	respBytes, err := (&protobuf.StoreResponse{Stored: stored}).Marshal()
+	if err != nil {
+		return
+	}
+	m, err := f.makeLegionSignedMessage("dht.store_response", signer.Hex(), respBytes)
+	if err != nil {
+		return
+	}
+	ctx.Reply(m)
+}
+
+// storeValue checks the value and puts it in our store
+func (f *Framework) storeValue(v *protobuf.Value) error {
+	now := time.Now()
+	value, err := f.checkValue(v, now)
+	if err != nil {
+		return err
+	}
+	if value.Expires.After(now.Add(f.config.MaxValueTTL)) {
+		return errors.New("ethpool: value ttl is too long")
+	}
+
+	records, err := f.store.Get(v.Key)
+	if err != nil {
+		return err
+	}
+	local := false
+	for _, r := range records {
+		if bytes.Equal(r.Publisher, v.Publisher) {
+			if r.Published.After(value.Published) {
+				return errors.New("ethpool: a newer value is already stored")
+			}
+			local = r.Local && r.Published.Equal(value.Published)
+		}
+	}
+
+	record, err := makeRecord(v, local)
+	if err != nil {
+		return err
+	}
+	return f.store.Put(record)
+}
+
+// handleFindValue replies with the values we store under the key, and the
+// peers we know closest to it
+func (f *Framework) handleFindValue(ctx *network.MessageContext, signer common.Address, body []byte) {
+	req := &protobuf.FindValueRequest{}
+	if req.Unmarshal(body) != nil {
+		return
+	}
+
+	resp := &protobuf.FindValueResponse{Values: f.localValues(req.Key)}
+	resp.Peers, resp.Records = f.closestPeers(keyID(req.Key))
+
+	respBytes, err := resp.Marshal()
+	if err != nil {
+		return
+	}
+	m, err := f.makeLegionSignedMessage("dht.find_value_response", signer.Hex(), respBytes)
+	if err != nil {
+		return
+	}
+	ctx.Reply(m)
+}
+
+// localValues returns the unexpired values in our store under the key
+func (f *Framework) localValues(key []byte) []*protobuf.Value {
+	records, err := f.store.Get(key)
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	values := make([]*protobuf.Value, 0, len(records))
+	for _, r := range records {
+		if r.Expired(now) {
+			continue
+		}
+		v := &protobuf.Value{}
+		if v.Unmarshal(r.Value) == nil {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// signValue signs the value with our key
+func (f *Framework) signValue(v *protobuf.Value) error {
+	v.Signature = nil
+	b, err := v.Marshal()
+	if err != nil {
+		return err
+	}
+
+	sig, err := crypto.Sign(crypto.Keccak256(b), f.key)
+	if err != nil {
+		return err
+	}
+	v.Signature = sig
+
+	return nil
+}
+
+// checkValue makes sure the value is signed by its publisher, the publisher
+// is in the pool, it isn't too large and it hasn't expired
+func (f *Framework) checkValue(v *protobuf.Value, now time.Time) (*Value, error) {
+	if len(v.Data) > f.config.MaxValueSize {
+		return nil, ErrValueTooLarge
+	}
+	if len(v.Signature) != 65 {
+		return nil, errors.New("ethpool: value signature has the wrong length")
+	}
+
+	unsigned := *v
+	unsigned.Signature = nil
+	b, err := unsigned.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	hash := crypto.Keccak256(b)
+
+	pubKey, err := crypto.SigToPub(hash, v.Signature)
+	if err != nil {
+		return nil, err
+	}
+	addr := crypto.PubkeyToAddress(*pubKey)
+	if !bytes.Equal(addr.Bytes(), v.Publisher) || !crypto.VerifySignature(crypto.CompressPubkey(pubKey), hash, v.Signature[:64]) {
+		return nil, errors.New("ethpool: value is not signed by its publisher")
+	}
+
+	if !f.addressValidator(addr) {
+		return nil, errors.New("ethpool: value publisher is not in the pool")
+	}
+
+	value := &Value{
+		Key:       v.Key,
+		Data:      v.Data,
+		Publisher: addr,
+		Published: time.Unix(0, v.Published),
+		Expires:   time.Unix(0, v.Expires),
+	}
+	if !now.Before(value.Expires) {
+		return nil, errors.New("ethpool: value has expired")
+	}
+
+	return value, nil
+}
+
+// makeRecord returns the store record for the value
+func makeRecord(v *protobuf.Value, local bool) (valuestore.Record, error) {
+	b, err := v.Marshal()
+	if err != nil {
+		return valuestore.Record{}, err
+	}
+
+	return valuestore.Record{
+		Key:       v.Key,
+		Publisher: v.Publisher,
+		Value:     b,
+		Published: time.Unix(0, v.Published),
+		Expires:   time.Unix(0, v.Expires),
+		Local:     local,
+	}, nil
+}
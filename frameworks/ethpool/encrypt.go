@@ -0,0 +1,88 @@
+package ethpool
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/gogo/protobuf/proto"
+)
+
+// ErrNoPublicKey is returned when a message can't be encrypted because we
+// don't know the recipient's public key
+var ErrNoPublicKey = errors.New("ethpool: no public key known for the recipient")
+
+// SendEncryptedMessage is like SendMessage, but the body is encrypted to the
+// recipient's public key so only the recipient can read it. Public keys are
+// learned from the signatures on messages the recipient sent us, if we don't
+// have it yet the recipient is pinged for a signed pong first. The receiver
+// decrypts the body before it's delivered.
+func (f *Framework) SendEncryptedMessage(recipient common.Address, messageType string, body proto.Message) error {
+	return f.sendMessage(recipient, messageType, body, true)
+}
+
+// encryptTo encrypts the body to the public key of the peer with ECIES
+func (f *Framework) encryptTo(id ID, body []byte) ([]byte, error) {
+	pubKey, ok := f.keys.get(id.EthereumAddress())
+	if !ok {
+		// A pong is signed, so the reply teaches us the key
+		if err := f.ping(id); err != nil {
+			return nil, ErrNoPublicKey
+		}
+		if pubKey, ok = f.keys.get(id.EthereumAddress()); !ok {
+			return nil, ErrNoPublicKey
+		}
+	}
+
+	encrypted, err := ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(pubKey), body, nil, nil)
+	if err != nil {
+		return nil, errors.New("ethpool: could not encrypt message body")
+	}
+	return encrypted, nil
+}
+
+// decrypt decrypts a body that was encrypted to our public key
+func (f *Framework) decrypt(body []byte) ([]byte, error) {
+	return ecies.ImportECDSA(f.key).Decrypt(body, nil, nil)
+}
+
+func newKeyCache(size int) *keyCache {
+	return &keyCache{addresses: make([]common.Address, size), keys: make(map[common.Address]*ecdsa.PublicKey, size)}
+}
+
+// keyCache remembers the public keys of the most recent peers to sign a
+// message to us, once it's full the oldest is forgotten
+type keyCache struct {
+	addresses []common.Address
+	next      int
+	keys      map[common.Address]*ecdsa.PublicKey
+	mux       sync.RWMutex
+}
+
+// add stores the public key of the address
+func (c *keyCache) add(addr common.Address, pubKey *ecdsa.PublicKey) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if _, ok := c.keys[addr]; ok {
+		return
+	}
+
+	if old := c.addresses[c.next]; old != (common.Address{}) {
+		delete(c.keys, old)
+	}
+	c.addresses[c.next] = addr
+	c.keys[addr] = pubKey
+	c.next = (c.next + 1) % len(c.addresses)
+}
+
+// get returns the public key of the address if we have it
+func (c *keyCache) get(addr common.Address) (*ecdsa.PublicKey, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	pubKey, ok := c.keys[addr]
+	return pubKey, ok
+}
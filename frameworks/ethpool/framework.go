@@ -1,7 +1,9 @@
 package ethpool
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"errors"
 	"sync"
 
@@ -10,14 +12,14 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/gladiusio/legion/frameworks/ethpool/protobuf"
+	"github.com/gladiusio/legion/frameworks/ethpool/valuestore"
 	"github.com/gladiusio/legion/network"
 	"github.com/gladiusio/legion/utils"
 
+	"github.com/gladiusio/legion/network/config"
 	"github.com/gladiusio/legion/network/transport"
 	"github.com/gogo/protobuf/proto"
 
-	"sort"
-
 	log "github.com/gladiusio/legion/logger"
 
 	"time"
@@ -28,17 +30,52 @@ type IncomingMessage struct {
 	Sender *protobuf.ID
 	Body   []byte
 	Type   string
+
+	// Signer is the verified address that signed the message
+	Signer common.Address
+
+	// Context is the message as it was received from the network
+	Context *network.MessageContext
+}
+
+// Decode unmarshals the body of the message into the protobuf message
+func (m *IncomingMessage) Decode(body proto.Message) error {
+	return proto.Unmarshal(m.Body, body)
 }
 
 // New returns a Framework that uses the specified function to check if an address is valid, if
 // nil all addresses will be considered valid
 func New(addressValidator func(common.Address) bool, privKey *ecdsa.PrivateKey) *Framework {
-	return &Framework{
+	return NewWithConfig(addressValidator, privKey, nil)
+}
+
+// NewWithConfig is like New but tunes the framework with the config, if nil
+// the defaults are used
+func NewWithConfig(addressValidator func(common.Address) bool, privKey *ecdsa.PrivateKey, conf *Config) *Framework {
+	f := &Framework{
 		key:              privKey,
 		addressValidator: addressValidator,
+		config:           conf.withDefaults(),
 		messageChan:      make(chan *IncomingMessage),
-		idMap:            &sync.Map{},
+		evicting:         make(map[string]struct{}),
+		handlers:         make(map[string]*handlerQueue),
+		resolving:        make(map[common.Address]*resolveCall),
+		notFound:         make(map[common.Address]time.Time),
+	}
+	f.lookupPeer = f.findPeer
+	f.Handle("", nil)
+	f.replays = newReplayCache(f.config.ReplayCacheSize, f.config.ReplayCachePerSigner)
+	f.keys = newKeyCache(f.config.KeyCacheSize)
+
+	f.store = f.config.Store
+	if f.store == nil {
+		f.store = valuestore.NewMemoryStoreWithLimits(valuestore.Limits{
+			MaxRecords:             f.config.MaxStoredValues,
+			MaxRecordsPerPublisher: f.config.MaxValuesPerPublisher,
+		})
 	}
+
+	return f
 }
 
 // Framework is a framework for interacting with other peers using ethereum signatures and a kademlia style DHT,
@@ -52,26 +89,61 @@ type Framework struct {
 
 	l *network.Legion
 
+	config Config
+
+	// The values we store for the DHT
+	store valuestore.Store
+
+	// The nonces of recently received messages
+	replays *replayCache
+
+	// The public keys of peers that have sent us signed messages
+	keys *keyCache
+
 	// Our Kademlia DHT
 	router *RoutingTable
 
+	// The peers being pinged to see if they should be evicted from a bucket
+	evicting    map[string]struct{}
+	evictingMux sync.Mutex
+
+	// Stops the maintenance loop, and is closed once it returns
+	stopMaintenance context.CancelFunc
+	maintenanceDone chan struct{}
+	maintenanceMux  sync.Mutex
+
 	// Private key to sign messages
 	key *ecdsa.PrivateKey
 
-	// The ID of this node
-	self *ID
+	// The ID of this node, our signed peer record, and the network addresses
+	// we had before with when they changed
+	self              *ID
+	record            *protobuf.PeerRecord
+	previousAddresses map[string]time.Time
+	selfMux           sync.RWMutex
 
 	messageChan chan *IncomingMessage
 
-	// Keep track of ID's and network addresses in an efficient way
-	idMap *sync.Map
+	// The queues of the message handlers, by message type
+	handlers    map[string]*handlerQueue
+	handlersMux sync.RWMutex
+
+	// The lookups for recipients that aren't in the routing table, and when
+	// the ones that weren't found failed
+	lookupPeer func(ctx context.Context, target common.Address, depth int) (*LookupResult, error)
+	resolving  map[common.Address]*resolveCall
+	notFound   map[common.Address]time.Time
+	resolveMux sync.Mutex
 
 	// Hooks
 	disconnectHook func(common.Address)
 }
 
 // Assert the type is correct
-var _ network.Framework = (*Framework)(nil)
+var _ network.AddressFramework = (*Framework)(nil)
+
+// idKey stores the ID of the peer that sent a message on the legion peer
+var idKey = network.NewAttachmentKey("ethpool.id")
 
 // Configure is used to set up our keystore, and block until we are ready to send/receive messages
 func (f *Framework) Configure(l *network.Legion) error {
@@ -82,47 +154,29 @@ func (f *Framework) Configure(l *network.Legion) error {
 	}
 	f.self = id
 
-	f.router = CreateRoutingTable(*id)
+	// Start the sequence at the current time so it keeps increasing across
+	// restarts, each change increments it
+	record, err := f.newPeerRecord(id.NetworkAddress, uint64(time.Now().Unix()))
+	if err != nil {
+		return err
+	}
+	f.record = record
+
+	f.router = CreateRoutingTableWithSize(*id, f.config.BucketSize, f.config.ReplacementCacheSize)
 
 	return nil
 }
 
 // ValidateMessage is called before any message is passed to the framework NewMessage()
 func (f *Framework) ValidateMessage(ctx *network.MessageContext) bool {
-	sm := &protobuf.SignedDHTMessage{}
-	err := sm.Unmarshal(ctx.Message.Body)
+	m, addr, err := decodeSignedMessage(ctx.Message.Body)
 	if err != nil {
 		return false
 	}
 
-	// Hash message
-	hash := crypto.Keccak256(sm.DhtMessage)
-
-	// Get the public key and address
-	pubKey, err := crypto.SigToPub(hash, sm.Signature)
-	if err != nil {
-		return false
-	}
-	addr := crypto.PubkeyToAddress(*pubKey)
-
-	// Verify the signature
-	if !crypto.VerifySignature(crypto.CompressPubkey(pubKey), hash, sm.Signature[:64]) {
-		return false
-	}
-
-	m := &protobuf.DHTMessage{}
-	err = m.Unmarshal(sm.DhtMessage)
-	if err != nil {
-		return false
-	}
-
-	// Make sure there isn't a nil sender
-	if m.GetSender() == nil {
-		return false
-	}
-
-	// Make sure the sender matches the DHT message
-	if !bytes.Equal(m.GetSender().EthAddress, addr.Bytes()) {
+	// Make sure it isn't a replay of a message meant for something else
+	if err := f.checkEnvelope(m, addr, ctx.Message.Type); err != nil {
+		log.Debug().Field("err", err.Error()).Field("sender", ctx.Sender.String()).Log("ethpool: rejected message")
 		return false
 	}
 
@@ -137,13 +191,23 @@ func (f *Framework) ValidateMessage(ctx *network.MessageContext) bool {
 	return f.addressValidator(addr)
 }
 
+// MessagePriorities sends DHT traffic ahead of other messages, since lookups
+// and pings are latency sensitive
+func (f *Framework) MessagePriorities() map[string]config.Priority {
+	return map[string]config.Priority{"dht.": config.PriorityHigh}
+}
+
 // Bootstrap will ping any connected nodes with a DHT message
 func (f *Framework) Bootstrap() {
-	m, err := f.makeLegionSignedMessage("dht.ping", []byte{})
-	if err != nil {
-		return
-	}
-	f.l.Broadcast(m)
+	// Each message is signed for its recipient, so every peer gets its own
+	f.l.Peers().Range(func(p *network.Peer) bool {
+		m, err := f.makeLegionSignedMessage("dht.ping", p.Remote().String(), []byte{})
+		if err != nil {
+			return false
+		}
+		f.l.Broadcast(m, p.Remote())
+		return true
+	})
 }
 
 // RegisterPeerDisconnectHook runs the specified funtion when a peer disconnects
@@ -152,17 +216,26 @@ func (f *Framework) RegisterPeerDisconnectHook(onDisconnect func(common.Address)
 }
 
 // SendMessage will send a signed version of the message to specified recipient
-// it will error if the recipient can't be connected to or found
+// it will error if the recipient can't be connected to or found. A recipient
+// that isn't in the routing table is looked up first, unless DisableResolve
+// is set.
 func (f *Framework) SendMessage(recipient common.Address, messageType string, body proto.Message) error {
-	toFind := ID{EthAddress: recipient.Bytes()}
-	peers := f.router.FindClosestPeers(toFind, 1)
+	return f.sendMessage(recipient, messageType, body, false)
+}
 
-	if len(peers) != 1 {
-		return errors.New("ethpool: could not find peer in routing table, try finding it first")
-	}
+// sendMessage signs and sends the message to the recipient, encrypting the
+// body to its public key if encrypt is true
+func (f *Framework) sendMessage(recipient common.Address, messageType string, body proto.Message, encrypt bool) error {
+	id, ok := f.routedPeer(recipient)
+	if !ok {
+		if f.config.DisableResolve {
+			return errors.New("ethpool: could not find peer in routing table, try finding it first")
+		}
 
-	if !bytes.Equal(peers[0].EthAddress, toFind.EthAddress) {
-		return errors.New("ethpool: could not find peer in routing table, try finding it first")
+		var err error
+		if id, err = f.resolve(context.Background(), recipient); err != nil {
+			return err
+		}
 	}
 
 	bodyBytes, err := proto.Marshal(body)
@@ -170,19 +243,27 @@ func (f *Framework) SendMessage(recipient common.Address, messageType string, bo
 		return errors.New("ethpool: could not marshal message body")
 	}
 
-	m, err := f.makeLegionSignedMessage(messageType, bodyBytes)
+	if encrypt {
+		bodyBytes, err = f.encryptTo(id, bodyBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	la := utils.LegionAddressFromString(id.NetworkAddress)
+
+	m, err := f.makeSignedMessage(messageType, recipientOf(id), bodyBytes, encrypt)
 	if err != nil {
 		return errors.New("ethpool: could not make legion signed message")
 	}
 
-	la := utils.LegionAddressFromString(peers[0].NetworkAddress)
-
 	f.l.Broadcast(m, la)
 
 	return nil
 }
 
-// RecieveMessageChan returns a channel that receives messages
+// RecieveMessageChan returns a channel that receives messages of every type
+// without a handler, unless the default handler is replaced
 func (f *Framework) RecieveMessageChan() chan *IncomingMessage {
 	return f.messageChan
 }
@@ -199,26 +280,32 @@ func (f *Framework) Address() common.Address {
 
 // NewMessage is called when a message is received by the network
 func (f *Framework) NewMessage(ctx *network.MessageContext) {
-	sm := &protobuf.SignedDHTMessage{}
-	err := sm.Unmarshal(ctx.Message.Body)
+	dhtMessage, pubKey, err := recoverSignedMessage(ctx.Message.Body)
 	if err != nil {
 		return
 	}
+	signer := crypto.PubkeyToAddress(*pubKey)
+	f.keys.add(signer, pubKey)
 
-	// Check to see if the signed Ethereum Address matches sender
-	dhtMessage := &protobuf.DHTMessage{}
-	err = dhtMessage.Unmarshal(sm.DhtMessage)
-	if err != nil {
-		return
+	// Decrypt the body before it's handled
+	if dhtMessage.Encrypted {
+		dhtMessage.Body, err = f.decrypt(dhtMessage.Body)
+		if err != nil {
+			log.Debug().Field("err", err.Error()).Field("sender", ctx.Sender.String()).Log("ethpool: could not decrypt message")
+			return
+		}
 	}
 
-	// Update our router and ID map on all messages
-	f.router.Update(ID(*dhtMessage.Sender))
-	f.idMap.Store(ctx.Sender, ID(*dhtMessage.Sender))
+	// Update our router and the ID attached to the peer on all messages
+	f.updateSender(dhtMessage, signer)
+	if ctx.Peer != nil {
+		ctx.Peer.Attach(idKey, ID(*dhtMessage.Sender))
+	}
+	ctx.Legion.SetPeerIdentity(ctx.Sender, common.BytesToAddress(dhtMessage.Sender.EthAddress).Hex())
 
 	// Kademlia methods
 	if ctx.Message.Type == "dht.ping" {
-		m, err := f.makeLegionSignedMessage("dht.pong", []byte{})
+		m, err := f.makeLegionSignedMessage("dht.pong", signer.Hex(), []byte{})
 		if err != nil {
 			return
 		}
@@ -227,44 +314,83 @@ func (f *Framework) NewMessage(ctx *network.MessageContext) {
 	} else if ctx.Message.Type == "dht.pong" {
 		f.handlePong()
 	} else if ctx.Message.Type == "dht.lookup_request" {
-		lookupRequestBytes, err := getDHTMessageBody(ctx.Message.Body)
+		target, err := decodeLookupRequest(dhtMessage.Body)
 		if err != nil {
 			return
 		}
 
-		lookupRequest := &protobuf.LookupRequest{}
-		err = lookupRequest.Unmarshal(lookupRequestBytes)
-		if err != nil {
-			return
-		}
-
-		resp := &protobuf.LookupResponse{}
-
 		// Find the closest peers
-		for _, peer := range f.router.FindClosestPeers(ID(*lookupRequest.Target), SearchSzie) {
-			id := protobuf.ID(peer)
-			resp.Peers = append(resp.Peers, &id)
-		}
+		resp := &protobuf.LookupResponse{}
+		resp.Peers, resp.Records = f.closestPeers(target)
 
 		respBytes, err := resp.Marshal()
 		if err != nil {
 			return
 		}
 
-		m, err := f.makeLegionSignedMessage("dht.lookup_response", respBytes)
+		m, err := f.makeLegionSignedMessage("dht.lookup_response", signer.Hex(), respBytes)
 		if err != nil {
 			return
 		}
 		ctx.Reply(m)
 
-	} else { // Send everything else to the receive channel
-		f.messageChan <- &IncomingMessage{Sender: dhtMessage.Sender, Body: dhtMessage.GetBody(), Type: ctx.Message.Type}
+	} else if ctx.Message.Type == "dht.store" {
+		f.handleStore(ctx, signer, dhtMessage.Body)
+	} else if ctx.Message.Type == "dht.find_value" {
+		f.handleFindValue(ctx, signer, dhtMessage.Body)
+	} else { // Everything else is queued for the handler of its type
+		m := &IncomingMessage{
+			Sender:  dhtMessage.Sender,
+			Body:    dhtMessage.GetBody(),
+			Type:    ctx.Message.Type,
+			Signer:  signer,
+			Context: ctx,
+		}
+		f.dispatch(m)
 	}
 }
 
+// AddressChanged is called when legion's advertised address changes, so our
+// ID is updated to be reachable at the new address
+func (f *Framework) AddressChanged(ctx *network.NetworkContext) {
+	f.selfMux.Lock()
+	defer f.selfMux.Unlock()
+
+	// Messages signed for the old address can still arrive for a while
+	now := time.Now()
+	for address, changed := range f.previousAddresses {
+		if now.Sub(changed) > f.config.FreshnessWindow {
+			delete(f.previousAddresses, address)
+		}
+	}
+	if f.previousAddresses == nil {
+		f.previousAddresses = make(map[string]time.Time)
+	}
+	f.previousAddresses[f.self.NetworkAddress] = now
+
+	f.self = &ID{
+		EthAddress:     f.self.EthAddress,
+		NetworkAddress: ctx.Legion.Me().String(),
+	}
+
+	// A newer record lets peers replace our old address
+	record, err := f.newPeerRecord(f.self.NetworkAddress, f.record.Seq+1)
+	if err != nil {
+		log.Warn().Field("err", err.Error()).Log("ethpool: could not sign a new peer record")
+		return
+	}
+	f.record = record
+}
+
+func (f *Framework) selfID() *ID {
+	f.selfMux.RLock()
+	defer f.selfMux.RUnlock()
+	return f.self
+}
+
 // PeerDisconnect is called when a peer is deleted
 func (f *Framework) PeerDisconnect(ctx *network.PeerContext) {
-	id, exists := f.idMap.Load(ctx.Peer.Remote())
+	id, exists := ctx.Peer.Attachment(idKey)
 	if exists {
 		f.router.RemovePeer((id).(ID))
 		if f.disconnectHook != nil {
@@ -273,27 +399,101 @@ func (f *Framework) PeerDisconnect(ctx *network.PeerContext) {
 	}
 }
 
-func getDHTMessageBody(body []byte) ([]byte, error) {
+// decodeSignedMessage decodes a signed DHT message and checks that it was
+// signed by the sender it claims to be from, returning the signer's address
+func decodeSignedMessage(body []byte) (*protobuf.DHTMessage, common.Address, error) {
+	m, pubKey, err := recoverSignedMessage(body)
+	if err != nil {
+		return nil, common.Address{}, err
+	}
+	return m, crypto.PubkeyToAddress(*pubKey), nil
+}
+
+// recoverSignedMessage is like decodeSignedMessage but returns the signer's
+// public key
+func recoverSignedMessage(body []byte) (*protobuf.DHTMessage, *ecdsa.PublicKey, error) {
 	sm := &protobuf.SignedDHTMessage{}
 	err := sm.Unmarshal(body)
 	if err != nil {
-		return nil, errors.New("does not look like signed message")
+		return nil, nil, errors.New("does not look like signed message")
+	}
+
+	if len(sm.Signature) != 65 {
+		return nil, nil, errors.New("signature has the wrong length")
+	}
+
+	// Hash message
+	hash := crypto.Keccak256(sm.DhtMessage)
+
+	// Get the public key and address
+	pubKey, err := crypto.SigToPub(hash, sm.Signature)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr := crypto.PubkeyToAddress(*pubKey)
+
+	// Verify the signature
+	if !crypto.VerifySignature(crypto.CompressPubkey(pubKey), hash, sm.Signature[:64]) {
+		return nil, nil, errors.New("invalid signature")
 	}
 
-	// Check to see if the signed Ethereum Address matches sender
 	m := &protobuf.DHTMessage{}
 	err = m.Unmarshal(sm.DhtMessage)
 	if err != nil {
-		return nil, errors.New("signed message body does not look like dht message")
+		return nil, nil, errors.New("signed message body does not look like dht message")
+	}
+
+	// Make sure there isn't a nil sender
+	if m.GetSender() == nil {
+		return nil, nil, errors.New("dht message has no sender")
+	}
+
+	// Make sure the sender matches the DHT message
+	if !bytes.Equal(m.GetSender().EthAddress, addr.Bytes()) {
+		return nil, nil, errors.New("dht message sender is not the signer")
 	}
 
-	return m.Body, nil
+	return m, pubKey, nil
 }
 
-func (f *Framework) makeLegionSignedMessage(mType string, m []byte) (*transport.Message, error) {
+// decodeLookupRequest returns the target of a lookup request body
+func decodeLookupRequest(body []byte) (ID, error) {
+	lookupRequest := &protobuf.LookupRequest{}
+	err := lookupRequest.Unmarshal(body)
+	if err != nil {
+		return ID{}, err
+	}
+
+	if lookupRequest.Target == nil {
+		return ID{}, errors.New("lookup request has no target")
+	}
+
+	return ID(*lookupRequest.Target), nil
+}
+
+// makeLegionSignedMessage signs the body along with the type, recipient, time
+// and a nonce, so it can't be replayed to another peer or as another type
+func (f *Framework) makeLegionSignedMessage(mType string, recipient string, m []byte) (*transport.Message, error) {
+	return f.makeSignedMessage(mType, recipient, m, false)
+}
+
+// makeSignedMessage is like makeLegionSignedMessage, but marks the body as
+// encrypted if it is
+func (f *Framework) makeSignedMessage(mType string, recipient string, m []byte, encrypted bool) (*transport.Message, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.New("ethpool_framework: could not make a nonce")
+	}
+
 	dhtMessage := &protobuf.DHTMessage{
-		Body:   m,
-		Sender: (*protobuf.ID)(f.self),
+		Body:         m,
+		Sender:       (*protobuf.ID)(f.selfID()),
+		SenderRecord: f.selfRecord(),
+		Type:         mType,
+		Timestamp:    time.Now().UnixNano(),
+		Recipient:    recipient,
+		Nonce:        nonce,
+		Encrypted:    encrypted,
 	}
 
 	dhtBytes, err := dhtMessage.Marshal()
@@ -321,45 +521,69 @@ func (f *Framework) makeLegionSignedMessage(mType string, m []byte) (*transport.
 	return f.l.NewMessage(mType, signedBytes), nil
 }
 
+// handlePong looks up our own ID once a peer answers our bootstrap ping, which
+// fills the routing table with the peers closest to us
 func (f *Framework) handlePong() {
-	// Find peers from all the closest remotes
-	peers, err := f.findPeers(*f.self, SearchSzie)
-	if err != nil {
-		return
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.config.LookupTimeout)
+	defer cancel()
+	f.lookup(ctx, *f.selfID(), SearchSzie, false, 0)
+}
 
-	for _, p := range peers {
-		f.router.Update(*p)
+// updatePeer adds the peer to the routing table. If its bucket is full the
+// least recently seen peer in the bucket is pinged, and only if it doesn't
+// answer is it replaced by the newest peer in the replacement cache.
+func (f *Framework) updatePeer(id ID) {
+	oldest, full := f.router.Update(id)
+	if full {
+		go f.pingOrEvict(oldest)
 	}
 }
 
-// FindPeer attempts to load the the given peer into the routing table by searching up to depth,
-// returns an error if not found
-func (f *Framework) FindPeer(target common.Address, depth int) error {
-	toFind := ID{EthAddress: target.Bytes()}
-	peers := f.router.FindClosestPeers(toFind, 1)
+// pingOrEvict pings the peer and removes it from the routing table if it
+// doesn't answer, or moves it to the front of its bucket if it does
+func (f *Framework) pingOrEvict(id ID) {
+	key := id.AddressHex()
+	f.evictingMux.Lock()
+	if _, pinging := f.evicting[key]; pinging {
+		f.evictingMux.Unlock()
+		return
+	}
+	f.evicting[key] = struct{}{}
+	f.evictingMux.Unlock()
+
+	defer func() {
+		f.evictingMux.Lock()
+		delete(f.evicting, key)
+		f.evictingMux.Unlock()
+	}()
 
-	// If we already have it in the routing table, return
-	if len(peers) == 1 && bytes.Equal(peers[0].EthAddress, toFind.EthAddress) {
-		return nil
+	if err := f.ping(id); err != nil {
+		log.Debug().Field("peer", id.String()).Field("err", err.Error()).Log("ethpool: evicting unresponsive peer")
+		f.router.RemovePeer(id)
+		return
 	}
 
-	for i := 0; i < depth; i++ {
-		closest, err := f.findPeers(toFind, SearchSzie)
-		if err != nil {
-			return err
-		}
+	f.router.Update(id)
+}
 
-		for _, peerID := range closest {
-			if toFind.Equals(*peerID) {
-				return nil
-			}
+// ping sends a dht.ping to the peer and waits for it to answer with a pong
+// signed by the same address
+func (f *Framework) ping(id ID) error {
+	m, err := f.makeLegionSignedMessage("dht.ping", recipientOf(id), []byte{})
+	if err != nil {
+		return err
+	}
 
-			f.router.Update(*peerID)
-		}
+	reply, err := f.l.Request(m, f.config.PingTimeout, utils.LegionAddressFromString(id.NetworkAddress))
+	if err != nil {
+		return err
+	}
+	if reply.Type != "dht.pong" {
+		return errors.New("ethpool: ping was not answered with a pong")
 	}
 
-	return errors.New("ethpool: could not find peer")
+	_, err = f.decodeReply(reply, id)
+	return err
 }
 
 // HasPeer returns whether or not the target can be found in the routing table
@@ -368,80 +592,26 @@ func (f *Framework) HasPeer(target common.Address) bool {
 	return f.router.PeerExists(toFind)
 }
 
-// Find the peers closest to the ethereum address given
-func (f *Framework) findPeers(target ID, count int) ([]*ID, error) {
-	// Get our currently connected peers and ask them for the closest to the target
-	wg, mux := &sync.WaitGroup{}, sync.Mutex{}
-	peers := make([]*ID, 0)
-
-	for _, peerID := range f.router.FindClosestPeers(target, count) {
-		wg.Add(1)
-		go func(remote ID) {
-			defer wg.Done()
-			remoteClosest, err := f.performLookup(target, remote)
-			if err != nil {
-				return
-			}
-
-			mux.Lock()
-			peers = append(peers, remoteClosest...)
-			mux.Unlock()
-		}(peerID)
-	}
-
-	wg.Wait()
-
-	// Sort resulting peers by XOR distance.
-	sort.Slice(peers, func(i, j int) bool {
-		left := peers[i].Xor(target)
-		right := peers[j].Xor(target)
-		return left.Less(right)
-	})
-
-	// Cut off list of results to only have the routing table focus on the
-	// #dht.BucketSize closest peers to the current node.
-	if len(peers) > SearchSzie {
-		peers = peers[:SearchSzie]
-	}
-
-	return peers, nil
-
-}
-
-func (f *Framework) performLookup(target, lookupPeer ID) ([]*ID, error) {
-	// Create the request
+// makeLookupRequest creates a signed request to the recipient for the peers
+// closest to the target
+func (f *Framework) makeLookupRequest(recipient string, target ID) (*transport.Message, error) {
 	tID := protobuf.ID(target)
 	lookupRequest := &protobuf.LookupRequest{Target: &tID}
 	b, err := lookupRequest.Marshal()
 	if err != nil {
 		return nil, err
 	}
-	m, err := f.makeLegionSignedMessage("dht.lookup_request", b)
-	if err != nil {
-		return nil, err
-	}
-
-	incoming, err := f.l.Request(m, time.Second, utils.LegionAddressFromString(lookupPeer.NetworkAddress))
-	if err != nil {
-		log.Warn().Field("err", err.Error()).Field("peer", lookupPeer.EthereumAddress()).Log("Request for lookup was not returned")
-		return nil, err
-	}
-
-	responseBytes, err := getDHTMessageBody(incoming.Body)
-	if err != nil {
-		return nil, err
-	}
+	return f.makeLegionSignedMessage("dht.lookup_request", recipient, b)
+}
 
+// parseLookupResponse returns the peers in the body of a reply to a lookup
+// request
+func (f *Framework) parseLookupResponse(body []byte) ([]*ID, error) {
 	lookupResponse := &protobuf.LookupResponse{}
-	err = lookupResponse.Unmarshal(responseBytes)
+	err := lookupResponse.Unmarshal(body)
 	if err != nil {
 		return nil, err
 	}
-	// Convert the type
-	peers := make([]*ID, len(lookupResponse.GetPeers()))
-	for i, id := range lookupResponse.GetPeers() {
-		peers[i] = (*ID)(id)
-	}
 
-	return peers, nil
+	return f.mergePeers(lookupResponse.GetPeers(), lookupResponse.GetRecords()), nil
 }
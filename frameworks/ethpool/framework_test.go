@@ -1,12 +1,18 @@
 package ethpool
 
 import (
+	"bytes"
+	"context"
+	"errors"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/gladiusio/legion/frameworks/ethpool/protobuf"
 	"github.com/gladiusio/legion/network"
 	"github.com/gladiusio/legion/network/config"
+	"github.com/gladiusio/legion/network/transport"
 	"github.com/gladiusio/legion/utils"
+	"github.com/gogo/protobuf/proto"
 
 	"sync"
 	"testing"
@@ -172,3 +178,620 @@ func BenchmarkMessages(b *testing.B) {
 		_ = <-receiveChan
 	}
 }
+
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func newTestFramework(t *testing.T, port uint16, conf *Config) (*Framework, *network.Legion) {
+	privKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewWithConfig(func(common.Address) bool { return true }, privKey, conf)
+	l := network.NewLegion(makeConfig(port), f)
+	go l.Listen()
+	l.Started()
+	return f, l
+}
+
+func TestPingBeforeEvict(t *testing.T) {
+	conf := &Config{BucketSize: 1, PingTimeout: 500 * time.Millisecond}
+	f, l1 := newTestFramework(t, 7100, conf)
+	defer l1.Stop()
+	other, l2 := newTestFramework(t, 7101, conf)
+	defer l2.Stop()
+
+	// Both IDs land in the same bucket, but nothing listens at the dead one
+	alive := *other.selfID()
+	deadAddr := append([]byte{}, alive.EthAddress...)
+	deadAddr[len(deadAddr)-1] ^= 1
+	dead := ID{EthAddress: deadAddr, NetworkAddress: "localhost:7102"}
+	bucket := alive.Xor(*f.selfID()).PrefixLen()
+
+	// The oldest peer answers the ping, so the newcomer waits in the cache
+	f.updatePeer(alive)
+	f.updatePeer(dead)
+	if !waitFor(func() bool { return len(f.router.Replacements(bucket)) == 1 }) {
+		t.Fatal("newcomer should be put in the replacement cache")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !f.router.PeerExists(alive) || f.router.PeerExists(dead) {
+		t.Error("a peer that answers the ping should not be evicted")
+	}
+
+	// Make the dead peer the oldest, now the newcomer replaces it
+	f.router.RemovePeer(alive)
+	if !f.router.PeerExists(dead) {
+		t.Fatal("the replacement should have been promoted")
+	}
+	f.updatePeer(alive)
+	if !waitFor(func() bool { return f.router.PeerExists(alive) && !f.router.PeerExists(dead) }) {
+		t.Error("a peer that doesn't answer the ping should be replaced")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	// Each framework only knows the next one, so a lookup walks the chain
+	frameworks := make([]*Framework, 5)
+	for i := range frameworks {
+		f, l := newTestFramework(t, 7110+uint16(i), &Config{LookupRPCTimeout: 200 * time.Millisecond})
+		defer l.Stop()
+		frameworks[i] = f
+	}
+	for i := 0; i < len(frameworks)-1; i++ {
+		frameworks[i].router.Update(*frameworks[i+1].selfID())
+	}
+	f := frameworks[0]
+	target := frameworks[4].selfID().EthereumAddress()
+
+	// Paths longer than the depth aren't followed
+	result, err := f.findPeer(context.Background(), target, 2)
+	if err != ErrPeerNotFound || result.Contacted != 2 {
+		t.Errorf("lookup should stop at depth 2, got: %v, contacted %d", err, result.Contacted)
+	}
+
+	// Peers that answered were added to the routing table, so the next
+	// lookup starts two hops further along. A dead peer is skipped.
+	f.router.Update(ID{EthAddress: make([]byte, 20), NetworkAddress: "localhost:7119"})
+	result, err = f.Lookup(context.Background(), target, SearchSzie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Closest) == 0 || result.Closest[0].EthereumAddress() != target {
+		t.Fatalf("target should be the closest peer, got: %v", result.Closest)
+	}
+	if result.PathLength != 2 || result.Failed != 1 || result.Contacted != 5 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	if err := f.FindPeer(target, 0); err != nil || !f.HasPeer(target) {
+		t.Errorf("target should be in the routing table, got: %v", err)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	conf := &Config{
+		PingTimeout:         200 * time.Millisecond,
+		MaintenanceInterval: 20 * time.Millisecond,
+		RefreshInterval:     20 * time.Millisecond,
+		StaleAfter:          20 * time.Millisecond,
+		RepublishInterval:   20 * time.Millisecond,
+	}
+	f, l1 := newTestFramework(t, 7120, conf)
+	other, l2 := newTestFramework(t, 7121, &Config{DisableMaintenance: true})
+	defer l2.Stop()
+
+	// The dead peer is evicted once it goes stale, and the other peer learns
+	// about us from our pings and republished ID
+	dead := ID{EthAddress: make([]byte, 20), NetworkAddress: "localhost:7129"}
+	f.router.Update(dead)
+	f.router.Update(*other.selfID())
+	if !waitFor(func() bool { return !f.router.PeerExists(dead) }) {
+		t.Error("stale peer that doesn't answer should be evicted")
+	}
+	if !f.router.PeerExists(*other.selfID()) {
+		t.Error("stale peer that answers should be kept")
+	}
+	if !waitFor(func() bool { return other.router.PeerExists(*f.selfID()) }) {
+		t.Error("other peer should have learned about us")
+	}
+
+	l1.Stop()
+	select {
+	case <-f.maintenanceDone:
+	default:
+		t.Error("maintenance loop should have stopped")
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	frameworks := make([]*Framework, 4)
+	for i := range frameworks {
+		f, l := newTestFramework(t, 7130+uint16(i), &Config{LookupRPCTimeout: 200 * time.Millisecond})
+		defer l.Stop()
+		frameworks[i] = f
+	}
+	for _, f := range frameworks[1:] {
+		frameworks[0].router.Update(*f.selfID())
+		f.router.Update(*frameworks[0].selfID())
+	}
+	publisher := frameworks[1]
+
+	if err := publisher.Put(context.Background(), []byte("key"), []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// The value was replicated, so any peer can find it
+	values, err := frameworks[3].Get(context.Background(), []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 1 || string(values[0].Data) != "value" || values[0].Publisher != publisher.Address() {
+		t.Errorf("unexpected values: %+v", values)
+	}
+	if records, _ := frameworks[2].store.Get([]byte("key")); len(records) != 1 || records[0].Local {
+		t.Error("value should be replicated to every peer")
+	}
+
+	// A newer value from the same publisher replaces the old one
+	publisher.Put(context.Background(), []byte("key"), []byte("newer"), time.Minute)
+	values, err = frameworks[2].Get(context.Background(), []byte("key"))
+	if err != nil || len(values) != 1 || string(values[0].Data) != "newer" {
+		t.Errorf("expected the newer value, got: %+v, %v", values, err)
+	}
+
+	if _, err := frameworks[3].Get(context.Background(), []byte("missing")); err != ErrValueNotFound {
+		t.Errorf("expected ErrValueNotFound, got: %v", err)
+	}
+}
+
+func TestValueValidation(t *testing.T) {
+	f, l := newTestFramework(t, 7140, &Config{MaxValueSize: 8})
+	defer l.Stop()
+
+	now := time.Now()
+	v := &protobuf.Value{Key: []byte("key"), Data: []byte("value"), Publisher: f.selfID().EthAddress, Published: now.UnixNano(), Expires: now.Add(time.Minute).UnixNano()}
+	f.signValue(v)
+	if _, err := f.checkValue(v, now); err != nil {
+		t.Fatalf("signed value should be valid: %v", err)
+	}
+	if _, err := f.checkValue(v, now.Add(time.Hour)); err == nil {
+		t.Error("expired value should be rejected")
+	}
+
+	tampered := *v
+	tampered.Data = []byte("other")
+	if _, err := f.checkValue(&tampered, now); err == nil {
+		t.Error("tampered value should be rejected")
+	}
+
+	if err := f.Put(context.Background(), []byte("key"), []byte("too large"), 0); err != ErrValueTooLarge {
+		t.Errorf("expected ErrValueTooLarge, got: %v", err)
+	}
+
+	// With no peers the value is kept to be republished later
+	if err := f.Put(context.Background(), []byte("key"), []byte("value"), 0); err != ErrNotStored {
+		t.Errorf("expected ErrNotStored, got: %v", err)
+	}
+	if values, err := f.Get(context.Background(), []byte("key")); err != nil || len(values) != 1 {
+		t.Errorf("value should be found locally, got: %v", err)
+	}
+}
+
+func TestPeerRecords(t *testing.T) {
+	f, l1 := newTestFramework(t, 7150, &Config{Capabilities: []string{"test/1"}})
+	defer l1.Stop()
+	other, l2 := newTestFramework(t, 7151, nil)
+	defer l2.Stop()
+
+	// Records are signed by their address and can't be changed
+	r := f.selfRecord()
+	if err := verifyPeerRecord(r); err != nil {
+		t.Fatalf("our record should verify: %v", err)
+	}
+	tampered := *r
+	tampered.NetworkAddresses = []string{"localhost:9999"}
+	if verifyPeerRecord(&tampered) == nil {
+		t.Error("tampered record should not verify")
+	}
+
+	// Our record is sent with every message
+	if err := other.ping(*f.selfID()); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { _, ok := f.PeerRecord(other.Address()); return ok }) {
+		t.Fatal("record of the peer that pinged us should be stored")
+	}
+	if got, ok := other.PeerRecord(f.Address()); !ok || len(got.Capabilities) != 1 || got.Capabilities[0] != "test/1" {
+		t.Errorf("record from the pong should be stored with its capabilities, got: %+v", got)
+	}
+
+	// A newer record replaces the address, an older one doesn't
+	moved, _ := f.newPeerRecord("localhost:7159", r.Seq+1)
+	other.router.UpdateRecord(moved)
+	other.router.UpdateRecord(r)
+	if peers := other.router.FindClosestPeers(*f.selfID(), 1); len(peers) != 1 || peers[0].NetworkAddress != "localhost:7159" {
+		t.Errorf("newer record should replace the address, got: %v", peers)
+	}
+
+	// A reply has to be signed by the peer we asked
+	m, _ := other.makeLegionSignedMessage("dht.pong", f.selfID().NetworkAddress, nil)
+	if _, err := f.decodeReply(m, *f.selfID()); err == nil {
+		t.Error("reply signed by another peer should be rejected")
+	}
+}
+
+func TestReplayProtection(t *testing.T) {
+	f, l1 := newTestFramework(t, 7160, &Config{FreshnessWindow: time.Minute})
+	defer l1.Stop()
+	other, l2 := newTestFramework(t, 7161, nil)
+	defer l2.Stop()
+
+	decode := func(m *transport.Message) (*protobuf.DHTMessage, common.Address) {
+		dhtMessage, signer, err := decodeSignedMessage(m.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dhtMessage, signer
+	}
+
+	m, _ := other.makeLegionSignedMessage("dht.ping", f.selfID().NetworkAddress, nil)
+	dhtMessage, signer := decode(m)
+	if err := f.checkEnvelope(dhtMessage, signer, "dht.ping"); err != nil {
+		t.Fatalf("fresh message should be accepted, got: %v", err)
+	}
+	if err := f.checkEnvelope(dhtMessage, signer, "dht.ping"); err != ErrReplayed {
+		t.Errorf("replayed message should be rejected, got: %v", err)
+	}
+
+	m, _ = other.makeLegionSignedMessage("dht.ping", f.selfID().NetworkAddress, nil)
+	dhtMessage, signer = decode(m)
+	if err := f.checkEnvelope(dhtMessage, signer, "dht.store"); err != ErrWrongType {
+		t.Errorf("message signed as another type should be rejected, got: %v", err)
+	}
+
+	m, _ = other.makeLegionSignedMessage("dht.ping", "localhost:7169", nil)
+	dhtMessage, signer = decode(m)
+	if err := f.checkEnvelope(dhtMessage, signer, "dht.ping"); err != ErrWrongRecipient {
+		t.Errorf("message signed for another peer should be rejected, got: %v", err)
+	}
+
+	// Messages can be bound to our Ethereum address instead
+	m, _ = other.makeLegionSignedMessage("dht.ping", recipientOf(*f.selfID()), nil)
+	dhtMessage, signer = decode(m)
+	if err := f.checkEnvelope(dhtMessage, signer, "dht.ping"); err != nil {
+		t.Errorf("message signed for our Ethereum address should be accepted, got: %v", err)
+	}
+	m, _ = other.makeLegionSignedMessage("dht.ping", other.Address().Hex(), nil)
+	dhtMessage, signer = decode(m)
+	if err := f.checkEnvelope(dhtMessage, signer, "dht.ping"); err != ErrWrongRecipient {
+		t.Errorf("message signed for another Ethereum address should be rejected, got: %v", err)
+	}
+
+	// Our old address is accepted for a window after it changes
+	old := f.selfID().NetworkAddress
+	f.selfMux.Lock()
+	f.previousAddresses = map[string]time.Time{old: time.Now(), "localhost:7168": time.Now().Add(-2 * time.Minute)}
+	f.self = &ID{EthAddress: f.self.EthAddress, NetworkAddress: "localhost:7167"}
+	f.selfMux.Unlock()
+	for recipient, want := range map[string]error{old: nil, "localhost:7167": nil, "localhost:7168": ErrWrongRecipient} {
+		m, _ = other.makeLegionSignedMessage("dht.ping", recipient, nil)
+		dhtMessage, signer = decode(m)
+		if err := f.checkEnvelope(dhtMessage, signer, "dht.ping"); err != want {
+			t.Errorf("message signed for %s: expected %v, got: %v", recipient, want, err)
+		}
+	}
+	f.selfMux.Lock()
+	f.self = &ID{EthAddress: f.self.EthAddress, NetworkAddress: old}
+	f.selfMux.Unlock()
+
+	for _, offset := range []time.Duration{-2 * time.Minute, 2 * time.Minute} {
+		m, _ = other.makeLegionSignedMessage("dht.ping", f.selfID().NetworkAddress, nil)
+		dhtMessage, signer = decode(m)
+		dhtMessage.Timestamp = time.Now().Add(offset).UnixNano()
+		if err := f.checkEnvelope(dhtMessage, signer, "dht.ping"); err != ErrStale {
+			t.Errorf("message sent %v from now should be rejected, got: %v", offset, err)
+		}
+	}
+
+	// Replies are checked too
+	m, _ = other.makeLegionSignedMessage("dht.pong", f.selfID().NetworkAddress, nil)
+	if _, err := f.decodeReply(m, *other.selfID()); err != nil {
+		t.Fatalf("reply should be accepted, got: %v", err)
+	}
+	if _, err := f.decodeReply(m, *other.selfID()); err != ErrReplayed {
+		t.Errorf("replayed reply should be rejected, got: %v", err)
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	c := newReplayCache(2, 10)
+	now := time.Now()
+	for _, key := range []string{"a", "b"} {
+		if err := c.check("signer", key, now.Add(time.Minute), now); err != nil {
+			t.Errorf("%s should not be seen yet, got: %v", key, err)
+		}
+	}
+	if err := c.check("signer", "a", now.Add(time.Minute), now); err != ErrReplayed {
+		t.Errorf("a should be seen, got: %v", err)
+	}
+
+	// Fresh nonces are never forgotten to make room
+	if err := c.check("signer", "c", now.Add(time.Minute), now); err != ErrReplayCacheFull {
+		t.Errorf("a full cache of fresh nonces should reject new ones, got: %v", err)
+	}
+	if err := c.check("signer", "a", now.Add(time.Minute), now); err != ErrReplayed {
+		t.Errorf("a should still be seen, got: %v", err)
+	}
+
+	// Once they leave the window they are
+	later := now.Add(2 * time.Minute)
+	if err := c.check("signer", "c", later.Add(time.Minute), later); err != nil {
+		t.Errorf("c should be accepted once the others expired, got: %v", err)
+	}
+	if err := c.check("signer", "a", later.Add(time.Minute), later); err != nil {
+		t.Errorf("a should be forgotten once it expired, got: %v", err)
+	}
+
+	// One signer can't fill the cache for everyone
+	c = newReplayCache(10, 2)
+	for _, nonce := range []string{"a", "b"} {
+		c.check("busy", nonce, now.Add(time.Minute), now)
+	}
+	if err := c.check("busy", "c", now.Add(time.Minute), now); err != ErrReplayCacheFull {
+		t.Errorf("signer over its share should be rejected, got: %v", err)
+	}
+	if err := c.check("quiet", "a", now.Add(time.Minute), now); err != nil {
+		t.Errorf("other signers should still be accepted, got: %v", err)
+	}
+	if err := c.check("busy", "c", later.Add(time.Minute), later); err != nil {
+		t.Errorf("signer should get its share back once its nonces expired, got: %v", err)
+	}
+}
+
+func TestEncryptedMessaging(t *testing.T) {
+	f, l1 := newTestFramework(t, 7170, nil)
+	defer l1.Stop()
+	other, l2 := newTestFramework(t, 7171, &Config{PingTimeout: 500 * time.Millisecond})
+	defer l2.Stop()
+
+	// The key of a peer that never signed anything to us can't be learned
+	deadKey, _ := crypto.GenerateKey()
+	dead := ID{EthAddress: crypto.PubkeyToAddress(deadKey.PublicKey).Bytes(), NetworkAddress: "localhost:7179"}
+	other.router.Update(dead)
+	if err := other.SendEncryptedMessage(dead.EthereumAddress(), "secret", &protobuf.Empty{}); err != ErrNoPublicKey {
+		t.Errorf("message to a peer with an unknown key should fail, got: %v", err)
+	}
+
+	// Only the recipient can read the body
+	other.router.Update(*f.selfID())
+	plain := []byte("only for f")
+	encrypted, err := other.encryptTo(*f.selfID(), plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, plain) {
+		t.Error("encrypted body should not contain the plaintext")
+	}
+	if _, err := other.decrypt(encrypted); err == nil {
+		t.Error("only the recipient should be able to decrypt the body")
+	}
+	if got, err := f.decrypt(encrypted); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("recipient should decrypt the body, got: %q, %v", got, err)
+	}
+
+	// The body is decrypted before it's delivered
+	sent := &protobuf.ID{NetworkAddress: "hidden"}
+	if err := other.SendEncryptedMessage(f.Address(), "secret", sent); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-f.RecieveMessageChan():
+		got := &protobuf.ID{}
+		if err := got.Unmarshal(m.Body); err != nil || m.Type != "secret" || got.NetworkAddress != "hidden" {
+			t.Errorf("received message should be decrypted, got: %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("recipient never got the message")
+	}
+}
+
+func TestRequest(t *testing.T) {
+	server, l1 := newTestFramework(t, 7180, nil)
+	defer l1.Stop()
+	relay, l2 := newTestFramework(t, 7181, nil)
+	defer l2.Stop()
+	client, l3 := newTestFramework(t, 7182, nil)
+	defer l3.Stop()
+
+	server.HandleRequest("echo", func(req *IncomingMessage) (proto.Message, error) {
+		body := &protobuf.ID{}
+		if err := req.Decode(body); err != nil {
+			return nil, err
+		}
+		return &protobuf.ID{NetworkAddress: body.NetworkAddress + " back", EthAddress: req.Sender.EthAddress}, nil
+	})
+	server.HandleRequest("fail", func(req *IncomingMessage) (proto.Message, error) {
+		return nil, errors.New("no thanks")
+	})
+
+	// The client only knows the relay, so the server has to be looked up
+	relay.router.Update(*server.selfID())
+	client.router.Update(*relay.selfID())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply, err := client.Request(ctx, server.Address(), "echo", &protobuf.ID{NetworkAddress: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &protobuf.ID{}
+	if err := reply.Decode(got); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != "echo_response" || got.NetworkAddress != "hello back" || !bytes.Equal(got.EthAddress, client.Address().Bytes()) {
+		t.Errorf("unexpected reply: %+v, %+v", reply, got)
+	}
+	if !bytes.Equal(reply.Sender.EthAddress, server.Address().Bytes()) {
+		t.Errorf("reply should be from the server, was from: %x", reply.Sender.EthAddress)
+	}
+	if reply.Signer != server.Address() {
+		t.Errorf("reply should carry the verified signer, got: %s", reply.Signer.Hex())
+	}
+
+	// Requests go through the handler queue of their type, which counts them
+	// once the handler returns
+	for i := 0; i < 50 && server.HandlerStats()["echo"].Handled == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := server.HandlerStats()["echo"]; stats.Handled != 1 {
+		t.Errorf("request should be handled by the echo queue, stats: %+v", stats)
+	}
+
+	_, err = client.Request(ctx, server.Address(), "fail", &protobuf.Empty{})
+	if remote, ok := err.(*RemoteError); !ok || remote.Message != "no thanks" {
+		t.Errorf("handler error should be returned, got: %v", err)
+	}
+
+	unknownKey, _ := crypto.GenerateKey()
+	if _, err := client.Request(ctx, crypto.PubkeyToAddress(unknownKey.PublicKey), "echo", &protobuf.Empty{}); err != ErrPeerNotFound {
+		t.Errorf("request to an unknown peer should fail, got: %v", err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	f, l1 := newTestFramework(t, 7190, &Config{HandlerQueueSize: 1, HandlerWorkers: 1})
+	defer l1.Stop()
+	other, l2 := newTestFramework(t, 7191, nil)
+	defer l2.Stop()
+	other.router.Update(*f.selfID())
+
+	typed := make(chan *IncomingMessage, 1)
+	f.Handle("typed", func(m *IncomingMessage) { typed <- m })
+
+	other.SendMessage(f.Address(), "typed", &protobuf.Empty{})
+	select {
+	case m := <-typed:
+		if m.Signer != other.Address() || m.Context == nil || m.Context.Message.Type != "typed" {
+			t.Errorf("message should carry the signer and context, got: %+v", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("handler never got the message")
+	}
+
+	// Types without a handler still go to the channel
+	other.SendMessage(f.Address(), "untyped", &protobuf.Empty{})
+	select {
+	case m := <-f.RecieveMessageChan():
+		if m.Type != "untyped" {
+			t.Errorf("unexpected message on the channel: %s", m.Type)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("default handler never sent the message to the channel")
+	}
+
+	// With the worker stuck and the queue full, more messages are dropped
+	unblock := make(chan struct{})
+	f.Handle("slow", func(*IncomingMessage) { <-unblock })
+	for i := 0; i < 5; i++ {
+		other.SendMessage(f.Address(), "slow", &protobuf.Empty{})
+	}
+	if !waitFor(func() bool { return f.HandlerStats()["slow"].Dropped >= 3 }) {
+		t.Errorf("messages over the queue size should be dropped, stats: %+v", f.HandlerStats()["slow"])
+	}
+	close(unblock)
+	if !waitFor(func() bool { s := f.HandlerStats()["slow"]; return s.Handled > 0 && s.Handled+s.Dropped == 5 }) {
+		t.Errorf("queued messages should be handled, stats: %+v", f.HandlerStats()["slow"])
+	}
+
+	// Removing the handler sends the type to the default handler again
+	f.Handle("typed", nil)
+	if _, ok := f.HandlerStats()["typed"]; ok {
+		t.Error("removed handler should have no stats")
+	}
+	other.SendMessage(f.Address(), "typed", &protobuf.Empty{})
+	select {
+	case m := <-f.RecieveMessageChan():
+		if m.Type != "typed" {
+			t.Errorf("unexpected message on the channel: %s", m.Type)
+		}
+	case <-typed:
+		t.Error("removed handler should not get messages")
+	case <-time.After(2 * time.Second):
+		t.Fatal("message never reached the default handler")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	server, l1 := newTestFramework(t, 7200, nil)
+	defer l1.Stop()
+	relay, l2 := newTestFramework(t, 7201, nil)
+	defer l2.Stop()
+	client, l3 := newTestFramework(t, 7202, &Config{ResolveNegativeTTL: time.Minute})
+	defer l3.Stop()
+
+	// The client only knows the relay, so the server is looked up when sending
+	relay.router.Update(*server.selfID())
+	client.router.Update(*relay.selfID())
+	if err := client.SendMessage(server.Address(), "hello", &protobuf.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-server.RecieveMessageChan():
+		if m.Type != "hello" {
+			t.Errorf("unexpected message: %s", m.Type)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server never got the message")
+	}
+
+	// Concurrent sends to an unknown peer share one lookup
+	var lookups int
+	var lookupsMux sync.Mutex
+	release := make(chan struct{})
+	client.lookupPeer = func(ctx context.Context, target common.Address, depth int) (*LookupResult, error) {
+		lookupsMux.Lock()
+		lookups++
+		lookupsMux.Unlock()
+		<-release
+		return client.findPeer(ctx, target, depth)
+	}
+
+	unknownKey, _ := crypto.GenerateKey()
+	unknown := crypto.PubkeyToAddress(unknownKey.PublicKey)
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() { errs <- client.SendMessage(unknown, "hello", &protobuf.Empty{}) }()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 5; i++ {
+		if err := <-errs; err != ErrPeerNotFound {
+			t.Errorf("send to an unknown peer should fail, got: %v", err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("concurrent sends should share one lookup, there were %d", lookups)
+	}
+
+	// The failure is remembered
+	if err := client.SendMessage(unknown, "hello", &protobuf.Empty{}); err != ErrPeerNotFound || lookups != 1 {
+		t.Errorf("peer that wasn't found should fail without a lookup, got: %v after %d lookups", err, lookups)
+	}
+
+	// Without resolving the routing table has to have the peer
+	noResolve, l4 := newTestFramework(t, 7203, &Config{DisableResolve: true})
+	defer l4.Stop()
+	noResolve.router.Update(*relay.selfID())
+	if err := noResolve.SendMessage(server.Address(), "hello", &protobuf.Empty{}); err == nil {
+		t.Error("send to a peer not in the routing table should fail with resolving disabled")
+	}
+}
@@ -0,0 +1,98 @@
+package ethpool
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gladiusio/legion/frameworks/ethpool/protobuf"
+)
+
+// signedBody returns a valid signed DHT message carrying body
+func signedBody(tb testing.TB, body []byte) []byte {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sender := &protobuf.ID{EthAddress: crypto.PubkeyToAddress(key.PublicKey).Bytes(), NetworkAddress: "localhost:7000"}
+	dhtBytes, err := (&protobuf.DHTMessage{Sender: sender, Body: body}).Marshal()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sig, err := crypto.Sign(crypto.Keccak256(dhtBytes), key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b, err := (&protobuf.SignedDHTMessage{DhtMessage: dhtBytes, Signature: sig}).Marshal()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+func lookupSeeds(tb testing.TB) (request, response []byte) {
+	target := &protobuf.ID{EthAddress: make([]byte, 20), NetworkAddress: "localhost:7001"}
+	request, err := (&protobuf.LookupRequest{Target: target}).Marshal()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	response, err = (&protobuf.LookupResponse{Peers: []*protobuf.ID{target, target}}).Marshal()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return request, response
+}
+
+func FuzzDecodeSignedMessage(f *testing.F) {
+	request, response := lookupSeeds(f)
+	f.Add(signedBody(f, nil))
+	f.Add(signedBody(f, request))
+	f.Add(signedBody(f, response))
+	f.Add([]byte{0x12, 0x01, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, addr, err := decodeSignedMessage(data)
+		if err != nil {
+			return
+		}
+		if m.GetSender() == nil || addr.Hex() != ID(*m.Sender).EthereumAddress().Hex() {
+			t.Fatal("decoded message is not from its signer")
+		}
+	})
+}
+
+func FuzzDecodeLookupRequest(f *testing.F) {
+	request, _ := lookupSeeds(f)
+	f.Add(request)
+	f.Add([]byte{})
+	f.Add([]byte{0x0a, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeLookupRequest(data)
+	})
+}
+
+func FuzzParseLookupResponse(f *testing.F) {
+	request, response := lookupSeeds(f)
+	f.Add(response)
+	f.Add(request)
+	f.Add(signedBody(f, response))
+	withRecords, _ := (&protobuf.LookupResponse{Records: []*protobuf.PeerRecord{{EthAddress: make([]byte, 20), NetworkAddresses: []string{"localhost:7000"}, Signature: make([]byte, 65)}}}).Marshal()
+	f.Add(withRecords)
+
+	// Enough of a framework to check records against its routing table
+	fw := New(nil, nil)
+	fw.self = &ID{EthAddress: make([]byte, 20)}
+	fw.router = CreateRoutingTable(*fw.self)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		peers, err := fw.parseLookupResponse(data)
+		if err != nil {
+			return
+		}
+		for _, p := range peers {
+			if p == nil {
+				t.Fatal("nil peer in lookup response")
+			}
+		}
+	})
+}
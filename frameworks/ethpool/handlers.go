@@ -0,0 +1,121 @@
+package ethpool
+
+import (
+	"sync/atomic"
+
+	log "github.com/gladiusio/legion/logger"
+)
+
+// HandlerStats are the counts for the queue of a message type
+type HandlerStats struct {
+	// Queued is how many messages are waiting for a worker
+	Queued int
+
+	// Handled is how many messages the handler has been called with
+	Handled uint64
+
+	// Dropped is how many messages were dropped because the queue was full
+	Dropped uint64
+}
+
+// Handle registers the handler for messages of the type, replacing any handler
+// already registered for it. Each type has its own queue of HandlerQueueSize
+// messages handled by HandlerWorkers goroutines, once it's full new messages
+// of the type are dropped. Passing a nil handler removes it, the messages
+// already queued are still handled.
+//
+// The empty type registers the default handler, which gets the messages of
+// every type without a handler. It sends them to RecieveMessageChan until
+// it's replaced, and a nil handler restores that.
+func (f *Framework) Handle(messageType string, handler func(*IncomingMessage)) {
+	f.handlersMux.Lock()
+	defer f.handlersMux.Unlock()
+
+	if handler == nil && messageType == "" {
+		handler = f.sendToChan
+	}
+
+	q, exists := f.handlers[messageType]
+	switch {
+	case handler == nil && exists:
+		delete(f.handlers, messageType)
+		close(q.messages)
+	case handler == nil:
+	case exists:
+		q.setHandler(handler)
+	default:
+		f.handlers[messageType] = newHandlerQueue(handler, f.config.HandlerQueueSize, f.config.HandlerWorkers)
+	}
+}
+
+// HandlerStats returns the stats of the queue for each message type that has
+// a handler, the default handler's are under the empty type
+func (f *Framework) HandlerStats() map[string]HandlerStats {
+	f.handlersMux.RLock()
+	defer f.handlersMux.RUnlock()
+
+	stats := make(map[string]HandlerStats, len(f.handlers))
+	for messageType, q := range f.handlers {
+		stats[messageType] = HandlerStats{
+			Queued:  len(q.messages),
+			Handled: atomic.LoadUint64(&q.handled),
+			Dropped: atomic.LoadUint64(&q.dropped),
+		}
+	}
+	return stats
+}
+
+// dispatch queues the message for the handler of its type, or the default
+// handler if there isn't one
+func (f *Framework) dispatch(m *IncomingMessage) {
+	f.handlersMux.RLock()
+	defer f.handlersMux.RUnlock()
+
+	q, ok := f.handlers[m.Type]
+	if !ok {
+		q = f.handlers[""]
+	}
+
+	select {
+	case q.messages <- m:
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+		log.Debug().Field("type", m.Type).Log("ethpool: handler queue is full, dropping message")
+	}
+}
+
+// sendToChan is the default handler, it sends the message to the receive
+// channel
+func (f *Framework) sendToChan(m *IncomingMessage) {
+	f.messageChan <- m
+}
+
+func newHandlerQueue(handler func(*IncomingMessage), size, workers int) *handlerQueue {
+	q := &handlerQueue{messages: make(chan *IncomingMessage, size)}
+	q.handler.Store(handler)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// handlerQueue holds the messages of a type until a worker passes them to the
+// handler, the workers return once it's closed and empty
+type handlerQueue struct {
+	handler  atomic.Value
+	messages chan *IncomingMessage
+
+	handled uint64
+	dropped uint64
+}
+
+func (q *handlerQueue) setHandler(handler func(*IncomingMessage)) {
+	q.handler.Store(handler)
+}
+
+func (q *handlerQueue) work() {
+	for m := range q.messages {
+		q.handler.Load().(func(*IncomingMessage))(m)
+		atomic.AddUint64(&q.handled, 1)
+	}
+}
@@ -0,0 +1,262 @@
+package ethpool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gladiusio/legion/utils"
+)
+
+// ErrPeerNotFound is returned when a lookup ends without reaching the peer
+var ErrPeerNotFound = errors.New("ethpool: could not find peer")
+
+// LookupResult describes the outcome of an iterative lookup
+type LookupResult struct {
+	// Closest are the peers closest to the target that answered, closest
+	// first
+	Closest []ID
+
+	// Found is true if the peer with the target address answered
+	Found bool
+
+	// PathLength is how many hops from our routing table the closest peer
+	// was learned, zero if it was already in the routing table
+	PathLength int
+
+	// Contacted is how many peers were sent a lookup request, and Failed is
+	// how many of those didn't answer
+	Contacted int
+	Failed    int
+
+	// Duration is how long the lookup took
+	Duration time.Duration
+}
+
+// candidate is a peer in the shortlist of a lookup
+type candidate struct {
+	id       ID
+	hops     int
+	queried  bool
+	failed   bool
+	answered bool
+}
+
+// lookupReply is the answer of a single lookup request
+type lookupReply struct {
+	c     *candidate
+	peers []*ID
+	stop  bool
+	err   error
+}
+
+// lookupQuery asks a peer during a lookup, it returns the peers closer to the
+// target the peer knows about, and stop to end the lookup early
+type lookupQuery func(ctx context.Context, id ID) (peers []*ID, stop bool, err error)
+
+// Lookup finds the count peers closest to the target address, asking the
+// closest peers we know about for closer ones until the results stop getting
+// closer. If the context is done first the peers found so far are returned
+// along with the context's error.
+func (f *Framework) Lookup(ctx context.Context, target common.Address, count int) (*LookupResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.config.LookupTimeout)
+	defer cancel()
+	return f.lookup(ctx, ID{EthAddress: target.Bytes()}, count, false, 0)
+}
+
+// FindPeerContext looks up the peer with the target address and loads it into
+// the routing table, it returns ErrPeerNotFound if the lookup converges
+// without reaching it
+func (f *Framework) FindPeerContext(ctx context.Context, target common.Address) (*LookupResult, error) {
+	return f.findPeer(ctx, target, 0)
+}
+
+// FindPeer attempts to load the the given peer into the routing table with a lookup that follows
+// paths up to depth hops long, returns an error if not found
+func (f *Framework) FindPeer(target common.Address, depth int) error {
+	_, err := f.findPeer(context.Background(), target, depth)
+	return err
+}
+
+func (f *Framework) findPeer(ctx context.Context, target common.Address, depth int) (*LookupResult, error) {
+	toFind := ID{EthAddress: target.Bytes()}
+	peers := f.router.FindClosestPeers(toFind, 1)
+
+	// If we already have it in the routing table, return
+	if len(peers) == 1 && bytes.Equal(peers[0].EthAddress, toFind.EthAddress) {
+		return &LookupResult{Closest: peers, Found: true}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.config.LookupTimeout)
+	defer cancel()
+
+	result, err := f.lookup(ctx, toFind, SearchSzie, true, depth)
+	if err == nil && !result.Found {
+		err = ErrPeerNotFound
+	}
+	return result, err
+}
+
+// lookup runs an iterative lookup for the count closest peers to the target,
+// it stops as soon as the target answers if stopAtTarget is set
+func (f *Framework) lookup(ctx context.Context, target ID, count int, stopAtTarget bool, maxHops int) (*LookupResult, error) {
+	query := func(ctx context.Context, id ID) ([]*ID, bool, error) {
+		peers, err := f.requestLookup(ctx, id, target)
+		return peers, stopAtTarget && bytes.Equal(id.EthAddress, target.EthAddress), err
+	}
+	return f.iterate(ctx, target, count, maxHops, query)
+}
+
+// iterate asks the peers closest to the target with the query for closer
+// peers, with up to alpha queries in flight. It stops once the closest count
+// peers in the shortlist have all been asked, or as soon as a query says to
+// stop, which sets Found in the result. Peers learned more than maxHops from
+// the routing table aren't asked, zero doesn't limit the hops. Every peer
+// that answers is added to the routing table.
+func (f *Framework) iterate(ctx context.Context, target ID, count int, maxHops int, query lookupQuery) (*LookupResult, error) {
+	start := time.Now()
+	result := &LookupResult{}
+	self := f.selfID()
+
+	var shortlist []*candidate
+	seen := map[string]bool{self.AddressHex(): true}
+	add := func(id ID, hops int) {
+		if len(id.EthAddress) != len(self.EthAddress) || seen[id.AddressHex()] {
+			return
+		}
+		seen[id.AddressHex()] = true
+		shortlist = append(shortlist, &candidate{id: id, hops: hops})
+	}
+	for _, id := range f.router.FindClosestPeers(target, count) {
+		add(id, 0)
+	}
+
+	var err error
+	replies := make(chan lookupReply, f.config.Alpha)
+	inFlight := 0
+
+L:
+	for {
+		sort.SliceStable(shortlist, func(i, j int) bool {
+			return shortlist[i].id.Xor(target).Less(shortlist[j].id.Xor(target))
+		})
+
+		for _, c := range f.nextCandidates(shortlist, count, maxHops, f.config.Alpha-inFlight) {
+			c.queried = true
+			inFlight++
+			result.Contacted++
+			go func(c *candidate) {
+				peers, stop, err := query(ctx, c.id)
+				replies <- lookupReply{c: c, peers: peers, stop: stop, err: err}
+			}(c)
+		}
+
+		// Every one of the closest peers has been asked, so we've converged
+		if inFlight == 0 {
+			break
+		}
+
+		select {
+		case r := <-replies:
+			inFlight--
+			if r.err != nil {
+				r.c.failed = true
+				result.Failed++
+				continue
+			}
+
+			r.c.answered = true
+			f.updatePeer(r.c.id)
+			if r.stop {
+				result.Found = true
+				break L
+			}
+
+			for _, id := range r.peers {
+				add(*id, r.c.hops+1)
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+			break L
+		}
+	}
+
+	for _, c := range shortlist {
+		if c.answered && len(result.Closest) < count {
+			result.Closest = append(result.Closest, c.id)
+			if len(result.Closest) == 1 {
+				result.PathLength = c.hops
+			}
+		}
+	}
+	result.Duration = time.Since(start)
+	f.router.Touch(target)
+
+	return result, err
+}
+
+// nextCandidates returns up to n peers to ask next, chosen from the count
+// closest peers in the sorted shortlist that haven't failed. Peers that legion
+// has marked as degraded are only chosen after healthy ones.
+func (f *Framework) nextCandidates(shortlist []*candidate, count, maxHops, n int) []*candidate {
+	healthy := make([]*candidate, 0, n)
+	degraded := make([]*candidate, 0)
+
+	considered := 0
+	for _, c := range shortlist {
+		if considered == count {
+			break
+		}
+		if c.failed {
+			continue
+		}
+		considered++
+
+		if c.queried || (maxHops > 0 && c.hops >= maxHops) {
+			continue
+		}
+		if f.degraded(c.id) {
+			degraded = append(degraded, c)
+		} else {
+			healthy = append(healthy, c)
+		}
+	}
+
+	next := append(healthy, degraded...)
+	if len(next) > n {
+		next = next[:n]
+	}
+	return next
+}
+
+// requestLookup asks the peer for the peers it knows closest to the target
+func (f *Framework) requestLookup(ctx context.Context, id ID, target ID) ([]*ID, error) {
+	m, err := f.makeLookupRequest(recipientOf(id), target)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.config.LookupRPCTimeout)
+	defer cancel()
+
+	reply, err := f.l.RequestContext(ctx, m, utils.LegionAddressFromString(id.NetworkAddress))
+	if err != nil {
+		return nil, err
+	}
+
+	dhtMessage, err := f.decodeReply(reply, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.parseLookupResponse(dhtMessage.Body)
+}
+
+// degraded returns true if legion has marked the peer as degraded
+func (f *Framework) degraded(id ID) bool {
+	stats, ok := f.l.PeerStats(utils.LegionAddressFromString(id.NetworkAddress))
+	return ok && stats.Degraded
+}
@@ -0,0 +1,121 @@
+package ethpool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/network"
+)
+
+// Startup starts the routing table maintenance loop
+func (f *Framework) Startup(ctx *network.NetworkContext) {
+	if f.config.DisableMaintenance {
+		return
+	}
+
+	f.maintenanceMux.Lock()
+	defer f.maintenanceMux.Unlock()
+	if f.stopMaintenance != nil {
+		return
+	}
+
+	mctx, cancel := context.WithCancel(context.Background())
+	f.stopMaintenance = cancel
+	f.maintenanceDone = make(chan struct{})
+	go f.maintain(mctx, f.maintenanceDone)
+}
+
+// Close stops the maintenance loop and waits for it to return
+func (f *Framework) Close(ctx *network.NetworkContext) {
+	f.maintenanceMux.Lock()
+	defer f.maintenanceMux.Unlock()
+	if f.stopMaintenance == nil {
+		return
+	}
+
+	f.stopMaintenance()
+	<-f.maintenanceDone
+	f.stopMaintenance = nil
+}
+
+// maintain keeps the routing table fresh until the context is done. Buckets
+// that haven't been touched are refreshed, peers that haven't been seen are
+// pinged, and our own ID is republished. Expired values are dropped and the
+// values we published are republished.
+func (f *Framework) maintain(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(f.config.MaintenanceInterval)
+	defer ticker.Stop()
+
+	lastRepublish, lastValueRepublish := time.Now(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		f.refreshBuckets(ctx)
+		f.pingStalePeers(ctx)
+		f.store.DeleteExpired(time.Now())
+
+		if time.Since(lastRepublish) >= f.config.RepublishInterval {
+			f.republish(ctx)
+			lastRepublish = time.Now()
+		}
+
+		if time.Since(lastValueRepublish) >= f.config.ValueRepublishInterval {
+			f.republishValues(ctx)
+			lastValueRepublish = time.Now()
+		}
+	}
+}
+
+// refreshBuckets looks up a random ID in the range of each bucket that
+// hasn't been touched within the refresh interval
+func (f *Framework) refreshBuckets(ctx context.Context) {
+	for _, bucket := range f.router.StaleBuckets(time.Now().Add(-f.config.RefreshInterval)) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		lctx, cancel := context.WithTimeout(ctx, f.config.LookupTimeout)
+		f.lookup(lctx, f.router.RandomID(bucket), SearchSzie, false, 0)
+		cancel()
+	}
+}
+
+// pingStalePeers pings the peers that haven't been seen within StaleAfter,
+// alpha at a time, and evicts the ones that don't answer
+func (f *Framework) pingStalePeers(ctx context.Context) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, f.config.Alpha)
+
+	for _, id := range f.router.StalePeers(time.Now().Add(-f.config.StaleAfter)) {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+
+		wg.Add(1)
+		go func(id ID) {
+			defer wg.Done()
+			f.pingOrEvict(id)
+			<-sem
+		}(id)
+	}
+
+	wg.Wait()
+}
+
+// republish looks up our own ID, the peers asked along the way add us to
+// their routing tables
+func (f *Framework) republish(ctx context.Context) {
+	lctx, cancel := context.WithTimeout(ctx, f.config.LookupTimeout)
+	defer cancel()
+	f.lookup(lctx, *f.selfID(), SearchSzie, false, 0)
+}
@@ -31,7 +31,7 @@ func (m *SignedDHTMessage) Reset()         { *m = SignedDHTMessage{} }
 func (m *SignedDHTMessage) String() string { return proto.CompactTextString(m) }
 func (*SignedDHTMessage) ProtoMessage()    {}
 func (*SignedDHTMessage) Descriptor() ([]byte, []int) {
-	return fileDescriptor_dhtmessages_3cd6fb7dcd5a169f, []int{0}
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{0}
 }
 func (m *SignedDHTMessage) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -87,7 +87,7 @@ func (m *ID) Reset()         { *m = ID{} }
 func (m *ID) String() string { return proto.CompactTextString(m) }
 func (*ID) ProtoMessage()    {}
 func (*ID) Descriptor() ([]byte, []int) {
-	return fileDescriptor_dhtmessages_3cd6fb7dcd5a169f, []int{1}
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{1}
 }
 func (m *ID) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -130,11 +130,112 @@ func (m *ID) GetNetworkAddress() string {
 	return ""
 }
 
+// PeerRecord is a node's own signed announcement of how to reach it, a
+// record with a higher sequence number replaces older ones
+type PeerRecord struct {
+	EthAddress       []byte   `protobuf:"bytes,1,opt,name=ethAddress,proto3" json:"ethAddress,omitempty"`
+	NetworkAddresses []string `protobuf:"bytes,2,rep,name=networkAddresses" json:"networkAddresses,omitempty"`
+	Seq              uint64   `protobuf:"varint,3,opt,name=seq,proto3" json:"seq,omitempty"`
+	// Unix time in nanoseconds the record was created
+	Timestamp    int64    `protobuf:"varint,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Capabilities []string `protobuf:"bytes,5,rep,name=capabilities" json:"capabilities,omitempty"`
+	// Signature by the node of the record with an empty signature
+	Signature            []byte   `protobuf:"bytes,6,opt,name=signature,proto3" json:"signature,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *PeerRecord) Reset()         { *m = PeerRecord{} }
+func (m *PeerRecord) String() string { return proto.CompactTextString(m) }
+func (*PeerRecord) ProtoMessage()    {}
+func (*PeerRecord) Descriptor() ([]byte, []int) {
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{2}
+}
+func (m *PeerRecord) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *PeerRecord) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_PeerRecord.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (dst *PeerRecord) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PeerRecord.Merge(dst, src)
+}
+func (m *PeerRecord) XXX_Size() int {
+	return m.Size()
+}
+func (m *PeerRecord) XXX_DiscardUnknown() {
+	xxx_messageInfo_PeerRecord.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PeerRecord proto.InternalMessageInfo
+
+func (m *PeerRecord) GetEthAddress() []byte {
+	if m != nil {
+		return m.EthAddress
+	}
+	return nil
+}
+
+func (m *PeerRecord) GetNetworkAddresses() []string {
+	if m != nil {
+		return m.NetworkAddresses
+	}
+	return nil
+}
+
+func (m *PeerRecord) GetSeq() uint64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+func (m *PeerRecord) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *PeerRecord) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
+func (m *PeerRecord) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
+	}
+	return nil
+}
+
 type DHTMessage struct {
 	// Sender is the identity this was sent from and how to reach the peer
 	Sender *ID `protobuf:"bytes,1,opt,name=sender" json:"sender,omitempty"`
 	// Whatever data they want to send
-	Body                 []byte   `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+	Body []byte `protobuf:"bytes,2,opt,name=body,proto3" json:"body,omitempty"`
+	// The sender's current peer record
+	SenderRecord *PeerRecord `protobuf:"bytes,3,opt,name=senderRecord" json:"senderRecord,omitempty"`
+	// The type of the legion message this was sent in, the unix time in
+	// nanoseconds it was sent at, the network address of the peer it was sent
+	// to and a random nonce, so it can't be replayed
+	Type      string `protobuf:"bytes,4,opt,name=type,proto3" json:"type,omitempty"`
+	Timestamp int64  `protobuf:"varint,5,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Recipient string `protobuf:"bytes,6,opt,name=recipient,proto3" json:"recipient,omitempty"`
+	Nonce     []byte `protobuf:"bytes,7,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	// The body is encrypted to the recipient's public key with ECIES
+	Encrypted            bool     `protobuf:"varint,8,opt,name=encrypted,proto3" json:"encrypted,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
 }
@@ -143,7 +244,7 @@ func (m *DHTMessage) Reset()         { *m = DHTMessage{} }
 func (m *DHTMessage) String() string { return proto.CompactTextString(m) }
 func (*DHTMessage) ProtoMessage()    {}
 func (*DHTMessage) Descriptor() ([]byte, []int) {
-	return fileDescriptor_dhtmessages_3cd6fb7dcd5a169f, []int{2}
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{3}
 }
 func (m *DHTMessage) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -186,6 +287,48 @@ func (m *DHTMessage) GetBody() []byte {
 	return nil
 }
 
+func (m *DHTMessage) GetSenderRecord() *PeerRecord {
+	if m != nil {
+		return m.SenderRecord
+	}
+	return nil
+}
+
+func (m *DHTMessage) GetType() string {
+	if m != nil {
+		return m.Type
+	}
+	return ""
+}
+
+func (m *DHTMessage) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *DHTMessage) GetRecipient() string {
+	if m != nil {
+		return m.Recipient
+	}
+	return ""
+}
+
+func (m *DHTMessage) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+func (m *DHTMessage) GetEncrypted() bool {
+	if m != nil {
+		return m.Encrypted
+	}
+	return false
+}
+
 type LookupRequest struct {
 	Target               *ID      `protobuf:"bytes,1,opt,name=target" json:"target,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -196,7 +339,7 @@ func (m *LookupRequest) Reset()         { *m = LookupRequest{} }
 func (m *LookupRequest) String() string { return proto.CompactTextString(m) }
 func (*LookupRequest) ProtoMessage()    {}
 func (*LookupRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_dhtmessages_3cd6fb7dcd5a169f, []int{3}
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{4}
 }
 func (m *LookupRequest) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -233,16 +376,18 @@ func (m *LookupRequest) GetTarget() *ID {
 }
 
 type LookupResponse struct {
-	Peers                []*ID    `protobuf:"bytes,1,rep,name=peers" json:"peers,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	// Peers we have no record for, and records of the others
+	Peers                []*ID         `protobuf:"bytes,1,rep,name=peers" json:"peers,omitempty"`
+	Records              []*PeerRecord `protobuf:"bytes,2,rep,name=records" json:"records,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
 }
 
 func (m *LookupResponse) Reset()         { *m = LookupResponse{} }
 func (m *LookupResponse) String() string { return proto.CompactTextString(m) }
 func (*LookupResponse) ProtoMessage()    {}
 func (*LookupResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_dhtmessages_3cd6fb7dcd5a169f, []int{4}
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{5}
 }
 func (m *LookupResponse) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -278,6 +423,60 @@ func (m *LookupResponse) GetPeers() []*ID {
 	return nil
 }
 
+func (m *LookupResponse) GetRecords() []*PeerRecord {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
+// RequestError is the body of a reply to a request the handler failed
+type RequestError struct {
+	Message              string   `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RequestError) Reset()         { *m = RequestError{} }
+func (m *RequestError) String() string { return proto.CompactTextString(m) }
+func (*RequestError) ProtoMessage()    {}
+func (*RequestError) Descriptor() ([]byte, []int) {
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{6}
+}
+func (m *RequestError) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *RequestError) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_RequestError.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (dst *RequestError) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RequestError.Merge(dst, src)
+}
+func (m *RequestError) XXX_Size() int {
+	return m.Size()
+}
+func (m *RequestError) XXX_DiscardUnknown() {
+	xxx_messageInfo_RequestError.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RequestError proto.InternalMessageInfo
+
+func (m *RequestError) GetMessage() string {
+	if m != nil {
+		return m.Message
+	}
+	return ""
+}
+
 type Empty struct {
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -287,7 +486,7 @@ func (m *Empty) Reset()         { *m = Empty{} }
 func (m *Empty) String() string { return proto.CompactTextString(m) }
 func (*Empty) ProtoMessage()    {}
 func (*Empty) Descriptor() ([]byte, []int) {
-	return fileDescriptor_dhtmessages_3cd6fb7dcd5a169f, []int{5}
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{7}
 }
 func (m *Empty) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -316,137 +515,314 @@ func (m *Empty) XXX_DiscardUnknown() {
 
 var xxx_messageInfo_Empty proto.InternalMessageInfo
 
-func init() {
-	proto.RegisterType((*SignedDHTMessage)(nil), "protobuf.SignedDHTMessage")
-	proto.RegisterType((*ID)(nil), "protobuf.ID")
-	proto.RegisterType((*DHTMessage)(nil), "protobuf.DHTMessage")
-	proto.RegisterType((*LookupRequest)(nil), "protobuf.LookupRequest")
-	proto.RegisterType((*LookupResponse)(nil), "protobuf.LookupResponse")
-	proto.RegisterType((*Empty)(nil), "protobuf.Empty")
+// Value is a value stored in the DHT, signed by its publisher
+type Value struct {
+	Key  []byte `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Data []byte `protobuf:"bytes,2,opt,name=data,proto3" json:"data,omitempty"`
+	// Ethereum address of the publisher
+	Publisher []byte `protobuf:"bytes,3,opt,name=publisher,proto3" json:"publisher,omitempty"`
+	// Unix times in nanoseconds of when the value was published and when it
+	// expires
+	Published int64 `protobuf:"varint,4,opt,name=published,proto3" json:"published,omitempty"`
+	Expires   int64 `protobuf:"varint,5,opt,name=expires,proto3" json:"expires,omitempty"`
+	// Signature by the publisher of the value with an empty signature
+	Signature            []byte   `protobuf:"bytes,6,opt,name=signature,proto3" json:"signature,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
-func (m *SignedDHTMessage) Marshal() (dAtA []byte, err error) {
-	size := m.Size()
-	dAtA = make([]byte, size)
-	n, err := m.MarshalTo(dAtA)
-	if err != nil {
-		return nil, err
+
+func (m *Value) Reset()         { *m = Value{} }
+func (m *Value) String() string { return proto.CompactTextString(m) }
+func (*Value) ProtoMessage()    {}
+func (*Value) Descriptor() ([]byte, []int) {
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{8}
+}
+func (m *Value) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Value) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Value.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
 	}
-	return dAtA[:n], nil
+}
+func (dst *Value) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Value.Merge(dst, src)
+}
+func (m *Value) XXX_Size() int {
+	return m.Size()
+}
+func (m *Value) XXX_DiscardUnknown() {
+	xxx_messageInfo_Value.DiscardUnknown(m)
 }
 
-func (m *SignedDHTMessage) MarshalTo(dAtA []byte) (int, error) {
-	var i int
-	_ = i
-	var l int
-	_ = l
-	if len(m.Signature) > 0 {
-		dAtA[i] = 0xa
-		i++
-		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Signature)))
-		i += copy(dAtA[i:], m.Signature)
+var xxx_messageInfo_Value proto.InternalMessageInfo
+
+func (m *Value) GetKey() []byte {
+	if m != nil {
+		return m.Key
 	}
-	if len(m.DhtMessage) > 0 {
-		dAtA[i] = 0x12
-		i++
-		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.DhtMessage)))
-		i += copy(dAtA[i:], m.DhtMessage)
+	return nil
+}
+
+func (m *Value) GetData() []byte {
+	if m != nil {
+		return m.Data
 	}
-	return i, nil
+	return nil
 }
 
-func (m *ID) Marshal() (dAtA []byte, err error) {
-	size := m.Size()
-	dAtA = make([]byte, size)
-	n, err := m.MarshalTo(dAtA)
-	if err != nil {
-		return nil, err
+func (m *Value) GetPublisher() []byte {
+	if m != nil {
+		return m.Publisher
 	}
-	return dAtA[:n], nil
+	return nil
 }
 
-func (m *ID) MarshalTo(dAtA []byte) (int, error) {
-	var i int
-	_ = i
-	var l int
-	_ = l
-	if len(m.EthAddress) > 0 {
-		dAtA[i] = 0xa
-		i++
-		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.EthAddress)))
-		i += copy(dAtA[i:], m.EthAddress)
+func (m *Value) GetPublished() int64 {
+	if m != nil {
+		return m.Published
 	}
-	if len(m.NetworkAddress) > 0 {
-		dAtA[i] = 0x12
-		i++
-		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.NetworkAddress)))
-		i += copy(dAtA[i:], m.NetworkAddress)
+	return 0
+}
+
+func (m *Value) GetExpires() int64 {
+	if m != nil {
+		return m.Expires
 	}
-	return i, nil
+	return 0
 }
 
-func (m *DHTMessage) Marshal() (dAtA []byte, err error) {
-	size := m.Size()
-	dAtA = make([]byte, size)
-	n, err := m.MarshalTo(dAtA)
-	if err != nil {
-		return nil, err
+func (m *Value) GetSignature() []byte {
+	if m != nil {
+		return m.Signature
 	}
-	return dAtA[:n], nil
+	return nil
 }
 
-func (m *DHTMessage) MarshalTo(dAtA []byte) (int, error) {
-	var i int
-	_ = i
-	var l int
-	_ = l
-	if m.Sender != nil {
-		dAtA[i] = 0xa
-		i++
-		i = encodeVarintDhtmessages(dAtA, i, uint64(m.Sender.Size()))
-		n1, err := m.Sender.MarshalTo(dAtA[i:])
+type StoreRequest struct {
+	Value                *Value   `protobuf:"bytes,1,opt,name=value" json:"value,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StoreRequest) Reset()         { *m = StoreRequest{} }
+func (m *StoreRequest) String() string { return proto.CompactTextString(m) }
+func (*StoreRequest) ProtoMessage()    {}
+func (*StoreRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{9}
+}
+func (m *StoreRequest) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *StoreRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_StoreRequest.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		i += n1
-	}
-	if len(m.Body) > 0 {
-		dAtA[i] = 0x12
-		i++
-		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Body)))
-		i += copy(dAtA[i:], m.Body)
+		return b[:n], nil
 	}
-	return i, nil
+}
+func (dst *StoreRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StoreRequest.Merge(dst, src)
+}
+func (m *StoreRequest) XXX_Size() int {
+	return m.Size()
+}
+func (m *StoreRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_StoreRequest.DiscardUnknown(m)
 }
 
-func (m *LookupRequest) Marshal() (dAtA []byte, err error) {
-	size := m.Size()
-	dAtA = make([]byte, size)
-	n, err := m.MarshalTo(dAtA)
-	if err != nil {
-		return nil, err
+var xxx_messageInfo_StoreRequest proto.InternalMessageInfo
+
+func (m *StoreRequest) GetValue() *Value {
+	if m != nil {
+		return m.Value
 	}
-	return dAtA[:n], nil
+	return nil
 }
 
-func (m *LookupRequest) MarshalTo(dAtA []byte) (int, error) {
-	var i int
-	_ = i
-	var l int
-	_ = l
-	if m.Target != nil {
-		dAtA[i] = 0xa
-		i++
-		i = encodeVarintDhtmessages(dAtA, i, uint64(m.Target.Size()))
-		n2, err := m.Target.MarshalTo(dAtA[i:])
+type StoreResponse struct {
+	Stored               bool     `protobuf:"varint,1,opt,name=stored,proto3" json:"stored,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StoreResponse) Reset()         { *m = StoreResponse{} }
+func (m *StoreResponse) String() string { return proto.CompactTextString(m) }
+func (*StoreResponse) ProtoMessage()    {}
+func (*StoreResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{10}
+}
+func (m *StoreResponse) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *StoreResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_StoreResponse.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		i += n2
+		return b[:n], nil
 	}
-	return i, nil
+}
+func (dst *StoreResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StoreResponse.Merge(dst, src)
+}
+func (m *StoreResponse) XXX_Size() int {
+	return m.Size()
+}
+func (m *StoreResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_StoreResponse.DiscardUnknown(m)
 }
 
-func (m *LookupResponse) Marshal() (dAtA []byte, err error) {
+var xxx_messageInfo_StoreResponse proto.InternalMessageInfo
+
+func (m *StoreResponse) GetStored() bool {
+	if m != nil {
+		return m.Stored
+	}
+	return false
+}
+
+type FindValueRequest struct {
+	Key                  []byte   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FindValueRequest) Reset()         { *m = FindValueRequest{} }
+func (m *FindValueRequest) String() string { return proto.CompactTextString(m) }
+func (*FindValueRequest) ProtoMessage()    {}
+func (*FindValueRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{11}
+}
+func (m *FindValueRequest) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *FindValueRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_FindValueRequest.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (dst *FindValueRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FindValueRequest.Merge(dst, src)
+}
+func (m *FindValueRequest) XXX_Size() int {
+	return m.Size()
+}
+func (m *FindValueRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_FindValueRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FindValueRequest proto.InternalMessageInfo
+
+func (m *FindValueRequest) GetKey() []byte {
+	if m != nil {
+		return m.Key
+	}
+	return nil
+}
+
+type FindValueResponse struct {
+	// The values stored for the key, and the peers closest to it
+	Values               []*Value      `protobuf:"bytes,1,rep,name=values" json:"values,omitempty"`
+	Peers                []*ID         `protobuf:"bytes,2,rep,name=peers" json:"peers,omitempty"`
+	Records              []*PeerRecord `protobuf:"bytes,3,rep,name=records" json:"records,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
+}
+
+func (m *FindValueResponse) Reset()         { *m = FindValueResponse{} }
+func (m *FindValueResponse) String() string { return proto.CompactTextString(m) }
+func (*FindValueResponse) ProtoMessage()    {}
+func (*FindValueResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_dhtmessages_1c8965c5f5a3dcd2, []int{12}
+}
+func (m *FindValueResponse) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *FindValueResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_FindValueResponse.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (dst *FindValueResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FindValueResponse.Merge(dst, src)
+}
+func (m *FindValueResponse) XXX_Size() int {
+	return m.Size()
+}
+func (m *FindValueResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_FindValueResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FindValueResponse proto.InternalMessageInfo
+
+func (m *FindValueResponse) GetValues() []*Value {
+	if m != nil {
+		return m.Values
+	}
+	return nil
+}
+
+func (m *FindValueResponse) GetPeers() []*ID {
+	if m != nil {
+		return m.Peers
+	}
+	return nil
+}
+
+func (m *FindValueResponse) GetRecords() []*PeerRecord {
+	if m != nil {
+		return m.Records
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*SignedDHTMessage)(nil), "protobuf.SignedDHTMessage")
+	proto.RegisterType((*ID)(nil), "protobuf.ID")
+	proto.RegisterType((*PeerRecord)(nil), "protobuf.PeerRecord")
+	proto.RegisterType((*DHTMessage)(nil), "protobuf.DHTMessage")
+	proto.RegisterType((*LookupRequest)(nil), "protobuf.LookupRequest")
+	proto.RegisterType((*LookupResponse)(nil), "protobuf.LookupResponse")
+	proto.RegisterType((*RequestError)(nil), "protobuf.RequestError")
+	proto.RegisterType((*Empty)(nil), "protobuf.Empty")
+	proto.RegisterType((*Value)(nil), "protobuf.Value")
+	proto.RegisterType((*StoreRequest)(nil), "protobuf.StoreRequest")
+	proto.RegisterType((*StoreResponse)(nil), "protobuf.StoreResponse")
+	proto.RegisterType((*FindValueRequest)(nil), "protobuf.FindValueRequest")
+	proto.RegisterType((*FindValueResponse)(nil), "protobuf.FindValueResponse")
+}
+func (m *SignedDHTMessage) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
 	n, err := m.MarshalTo(dAtA)
@@ -456,27 +832,27 @@ func (m *LookupResponse) Marshal() (dAtA []byte, err error) {
 	return dAtA[:n], nil
 }
 
-func (m *LookupResponse) MarshalTo(dAtA []byte) (int, error) {
+func (m *SignedDHTMessage) MarshalTo(dAtA []byte) (int, error) {
 	var i int
 	_ = i
 	var l int
 	_ = l
-	if len(m.Peers) > 0 {
-		for _, msg := range m.Peers {
-			dAtA[i] = 0xa
-			i++
-			i = encodeVarintDhtmessages(dAtA, i, uint64(msg.Size()))
-			n, err := msg.MarshalTo(dAtA[i:])
-			if err != nil {
-				return 0, err
-			}
-			i += n
-		}
+	if len(m.Signature) > 0 {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Signature)))
+		i += copy(dAtA[i:], m.Signature)
+	}
+	if len(m.DhtMessage) > 0 {
+		dAtA[i] = 0x12
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.DhtMessage)))
+		i += copy(dAtA[i:], m.DhtMessage)
 	}
 	return i, nil
 }
 
-func (m *Empty) Marshal() (dAtA []byte, err error) {
+func (m *ID) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
 	n, err := m.MarshalTo(dAtA)
@@ -486,93 +862,701 @@ func (m *Empty) Marshal() (dAtA []byte, err error) {
 	return dAtA[:n], nil
 }
 
-func (m *Empty) MarshalTo(dAtA []byte) (int, error) {
+func (m *ID) MarshalTo(dAtA []byte) (int, error) {
 	var i int
 	_ = i
 	var l int
 	_ = l
+	if len(m.EthAddress) > 0 {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.EthAddress)))
+		i += copy(dAtA[i:], m.EthAddress)
+	}
+	if len(m.NetworkAddress) > 0 {
+		dAtA[i] = 0x12
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.NetworkAddress)))
+		i += copy(dAtA[i:], m.NetworkAddress)
+	}
 	return i, nil
 }
 
-func encodeVarintDhtmessages(dAtA []byte, offset int, v uint64) int {
-	for v >= 1<<7 {
-		dAtA[offset] = uint8(v&0x7f | 0x80)
-		v >>= 7
-		offset++
+func (m *PeerRecord) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
 	}
-	dAtA[offset] = uint8(v)
-	return offset + 1
+	return dAtA[:n], nil
 }
-func (m *SignedDHTMessage) Size() (n int) {
+
+func (m *PeerRecord) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
 	var l int
 	_ = l
-	l = len(m.Signature)
-	if l > 0 {
-		n += 1 + l + sovDhtmessages(uint64(l))
+	if len(m.EthAddress) > 0 {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.EthAddress)))
+		i += copy(dAtA[i:], m.EthAddress)
 	}
-	l = len(m.DhtMessage)
-	if l > 0 {
-		n += 1 + l + sovDhtmessages(uint64(l))
+	if len(m.NetworkAddresses) > 0 {
+		for _, s := range m.NetworkAddresses {
+			dAtA[i] = 0x12
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				dAtA[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			dAtA[i] = uint8(l)
+			i++
+			i += copy(dAtA[i:], s)
+		}
 	}
-	return n
-}
-
-func (m *ID) Size() (n int) {
-	var l int
-	_ = l
-	l = len(m.EthAddress)
-	if l > 0 {
-		n += 1 + l + sovDhtmessages(uint64(l))
+	if m.Seq != 0 {
+		dAtA[i] = 0x18
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(m.Seq))
 	}
-	l = len(m.NetworkAddress)
-	if l > 0 {
-		n += 1 + l + sovDhtmessages(uint64(l))
+	if m.Timestamp != 0 {
+		dAtA[i] = 0x20
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(m.Timestamp))
 	}
-	return n
-}
-
-func (m *DHTMessage) Size() (n int) {
-	var l int
-	_ = l
-	if m.Sender != nil {
-		l = m.Sender.Size()
-		n += 1 + l + sovDhtmessages(uint64(l))
+	if len(m.Capabilities) > 0 {
+		for _, s := range m.Capabilities {
+			dAtA[i] = 0x2a
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				dAtA[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			dAtA[i] = uint8(l)
+			i++
+			i += copy(dAtA[i:], s)
+		}
 	}
-	l = len(m.Body)
-	if l > 0 {
-		n += 1 + l + sovDhtmessages(uint64(l))
+	if len(m.Signature) > 0 {
+		dAtA[i] = 0x32
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Signature)))
+		i += copy(dAtA[i:], m.Signature)
 	}
-	return n
+	return i, nil
 }
 
-func (m *LookupRequest) Size() (n int) {
-	var l int
-	_ = l
-	if m.Target != nil {
-		l = m.Target.Size()
-		n += 1 + l + sovDhtmessages(uint64(l))
+func (m *DHTMessage) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
 	}
-	return n
+	return dAtA[:n], nil
 }
 
-func (m *LookupResponse) Size() (n int) {
+func (m *DHTMessage) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
 	var l int
 	_ = l
-	if len(m.Peers) > 0 {
-		for _, e := range m.Peers {
-			l = e.Size()
-			n += 1 + l + sovDhtmessages(uint64(l))
+	if m.Sender != nil {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(m.Sender.Size()))
+		n1, err := m.Sender.MarshalTo(dAtA[i:])
+		if err != nil {
+			return 0, err
 		}
+		i += n1
 	}
-	return n
-}
-
-func (m *Empty) Size() (n int) {
-	var l int
-	_ = l
-	return n
-}
-
+	if len(m.Body) > 0 {
+		dAtA[i] = 0x12
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Body)))
+		i += copy(dAtA[i:], m.Body)
+	}
+	if m.SenderRecord != nil {
+		dAtA[i] = 0x1a
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(m.SenderRecord.Size()))
+		n2, err := m.SenderRecord.MarshalTo(dAtA[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n2
+	}
+	if len(m.Type) > 0 {
+		dAtA[i] = 0x22
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Type)))
+		i += copy(dAtA[i:], m.Type)
+	}
+	if m.Timestamp != 0 {
+		dAtA[i] = 0x28
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(m.Timestamp))
+	}
+	if len(m.Recipient) > 0 {
+		dAtA[i] = 0x32
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Recipient)))
+		i += copy(dAtA[i:], m.Recipient)
+	}
+	if len(m.Nonce) > 0 {
+		dAtA[i] = 0x3a
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Nonce)))
+		i += copy(dAtA[i:], m.Nonce)
+	}
+	if m.Encrypted {
+		dAtA[i] = 0x40
+		i++
+		if m.Encrypted {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
+	return i, nil
+}
+
+func (m *LookupRequest) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *LookupRequest) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.Target != nil {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(m.Target.Size()))
+		n3, err := m.Target.MarshalTo(dAtA[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n3
+	}
+	return i, nil
+}
+
+func (m *LookupResponse) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *LookupResponse) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Peers) > 0 {
+		for _, msg := range m.Peers {
+			dAtA[i] = 0xa
+			i++
+			i = encodeVarintDhtmessages(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	if len(m.Records) > 0 {
+		for _, msg := range m.Records {
+			dAtA[i] = 0x12
+			i++
+			i = encodeVarintDhtmessages(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	return i, nil
+}
+
+func (m *RequestError) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *RequestError) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Message) > 0 {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Message)))
+		i += copy(dAtA[i:], m.Message)
+	}
+	return i, nil
+}
+
+func (m *Empty) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Empty) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	return i, nil
+}
+
+func (m *Value) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Value) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Key) > 0 {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Key)))
+		i += copy(dAtA[i:], m.Key)
+	}
+	if len(m.Data) > 0 {
+		dAtA[i] = 0x12
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Data)))
+		i += copy(dAtA[i:], m.Data)
+	}
+	if len(m.Publisher) > 0 {
+		dAtA[i] = 0x1a
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Publisher)))
+		i += copy(dAtA[i:], m.Publisher)
+	}
+	if m.Published != 0 {
+		dAtA[i] = 0x20
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(m.Published))
+	}
+	if m.Expires != 0 {
+		dAtA[i] = 0x28
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(m.Expires))
+	}
+	if len(m.Signature) > 0 {
+		dAtA[i] = 0x32
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Signature)))
+		i += copy(dAtA[i:], m.Signature)
+	}
+	return i, nil
+}
+
+func (m *StoreRequest) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *StoreRequest) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.Value != nil {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(m.Value.Size()))
+		n4, err := m.Value.MarshalTo(dAtA[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n4
+	}
+	return i, nil
+}
+
+func (m *StoreResponse) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *StoreResponse) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.Stored {
+		dAtA[i] = 0x8
+		i++
+		if m.Stored {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
+	return i, nil
+}
+
+func (m *FindValueRequest) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *FindValueRequest) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Key) > 0 {
+		dAtA[i] = 0xa
+		i++
+		i = encodeVarintDhtmessages(dAtA, i, uint64(len(m.Key)))
+		i += copy(dAtA[i:], m.Key)
+	}
+	return i, nil
+}
+
+func (m *FindValueResponse) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *FindValueResponse) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Values) > 0 {
+		for _, msg := range m.Values {
+			dAtA[i] = 0xa
+			i++
+			i = encodeVarintDhtmessages(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	if len(m.Peers) > 0 {
+		for _, msg := range m.Peers {
+			dAtA[i] = 0x12
+			i++
+			i = encodeVarintDhtmessages(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	if len(m.Records) > 0 {
+		for _, msg := range m.Records {
+			dAtA[i] = 0x1a
+			i++
+			i = encodeVarintDhtmessages(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	return i, nil
+}
+
+func encodeVarintDhtmessages(dAtA []byte, offset int, v uint64) int {
+	for v >= 1<<7 {
+		dAtA[offset] = uint8(v&0x7f | 0x80)
+		v >>= 7
+		offset++
+	}
+	dAtA[offset] = uint8(v)
+	return offset + 1
+}
+func (m *SignedDHTMessage) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Signature)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	l = len(m.DhtMessage)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	return n
+}
+
+func (m *ID) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.EthAddress)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	l = len(m.NetworkAddress)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	return n
+}
+
+func (m *PeerRecord) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.EthAddress)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	if len(m.NetworkAddresses) > 0 {
+		for _, s := range m.NetworkAddresses {
+			l = len(s)
+			n += 1 + l + sovDhtmessages(uint64(l))
+		}
+	}
+	if m.Seq != 0 {
+		n += 1 + sovDhtmessages(uint64(m.Seq))
+	}
+	if m.Timestamp != 0 {
+		n += 1 + sovDhtmessages(uint64(m.Timestamp))
+	}
+	if len(m.Capabilities) > 0 {
+		for _, s := range m.Capabilities {
+			l = len(s)
+			n += 1 + l + sovDhtmessages(uint64(l))
+		}
+	}
+	l = len(m.Signature)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	return n
+}
+
+func (m *DHTMessage) Size() (n int) {
+	var l int
+	_ = l
+	if m.Sender != nil {
+		l = m.Sender.Size()
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	l = len(m.Body)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	if m.SenderRecord != nil {
+		l = m.SenderRecord.Size()
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	l = len(m.Type)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	if m.Timestamp != 0 {
+		n += 1 + sovDhtmessages(uint64(m.Timestamp))
+	}
+	l = len(m.Recipient)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	l = len(m.Nonce)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	if m.Encrypted {
+		n += 2
+	}
+	return n
+}
+
+func (m *LookupRequest) Size() (n int) {
+	var l int
+	_ = l
+	if m.Target != nil {
+		l = m.Target.Size()
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	return n
+}
+
+func (m *LookupResponse) Size() (n int) {
+	var l int
+	_ = l
+	if len(m.Peers) > 0 {
+		for _, e := range m.Peers {
+			l = e.Size()
+			n += 1 + l + sovDhtmessages(uint64(l))
+		}
+	}
+	if len(m.Records) > 0 {
+		for _, e := range m.Records {
+			l = e.Size()
+			n += 1 + l + sovDhtmessages(uint64(l))
+		}
+	}
+	return n
+}
+
+func (m *RequestError) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Message)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	return n
+}
+
+func (m *Empty) Size() (n int) {
+	var l int
+	_ = l
+	return n
+}
+
+func (m *Value) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Key)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	l = len(m.Data)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	l = len(m.Publisher)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	if m.Published != 0 {
+		n += 1 + sovDhtmessages(uint64(m.Published))
+	}
+	if m.Expires != 0 {
+		n += 1 + sovDhtmessages(uint64(m.Expires))
+	}
+	l = len(m.Signature)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	return n
+}
+
+func (m *StoreRequest) Size() (n int) {
+	var l int
+	_ = l
+	if m.Value != nil {
+		l = m.Value.Size()
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	return n
+}
+
+func (m *StoreResponse) Size() (n int) {
+	var l int
+	_ = l
+	if m.Stored {
+		n += 2
+	}
+	return n
+}
+
+func (m *FindValueRequest) Size() (n int) {
+	var l int
+	_ = l
+	l = len(m.Key)
+	if l > 0 {
+		n += 1 + l + sovDhtmessages(uint64(l))
+	}
+	return n
+}
+
+func (m *FindValueResponse) Size() (n int) {
+	var l int
+	_ = l
+	if len(m.Values) > 0 {
+		for _, e := range m.Values {
+			l = e.Size()
+			n += 1 + l + sovDhtmessages(uint64(l))
+		}
+	}
+	if len(m.Peers) > 0 {
+		for _, e := range m.Peers {
+			l = e.Size()
+			n += 1 + l + sovDhtmessages(uint64(l))
+		}
+	}
+	if len(m.Records) > 0 {
+		for _, e := range m.Records {
+			l = e.Size()
+			n += 1 + l + sovDhtmessages(uint64(l))
+		}
+	}
+	return n
+}
+
 func sovDhtmessages(x uint64) (n int) {
 	for {
 		n++
@@ -581,12 +1565,991 @@ func sovDhtmessages(x uint64) (n int) {
 			break
 		}
 	}
-	return n
+	return n
+}
+func sozDhtmessages(x uint64) (n int) {
+	return sovDhtmessages(uint64((x << 1) ^ uint64((int64(x) >> 63))))
+}
+func (m *SignedDHTMessage) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowDhtmessages
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: SignedDHTMessage: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: SignedDHTMessage: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Signature", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Signature = append(m.Signature[:0], dAtA[iNdEx:postIndex]...)
+			if m.Signature == nil {
+				m.Signature = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field DhtMessage", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.DhtMessage = append(m.DhtMessage[:0], dAtA[iNdEx:postIndex]...)
+			if m.DhtMessage == nil {
+				m.DhtMessage = []byte{}
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipDhtmessages(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *ID) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowDhtmessages
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: ID: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: ID: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EthAddress", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.EthAddress = append(m.EthAddress[:0], dAtA[iNdEx:postIndex]...)
+			if m.EthAddress == nil {
+				m.EthAddress = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field NetworkAddress", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.NetworkAddress = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipDhtmessages(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *PeerRecord) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowDhtmessages
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: PeerRecord: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: PeerRecord: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field EthAddress", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.EthAddress = append(m.EthAddress[:0], dAtA[iNdEx:postIndex]...)
+			if m.EthAddress == nil {
+				m.EthAddress = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field NetworkAddresses", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.NetworkAddresses = append(m.NetworkAddresses, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Seq", wireType)
+			}
+			m.Seq = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Seq |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Timestamp", wireType)
+			}
+			m.Timestamp = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Timestamp |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Capabilities", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Capabilities = append(m.Capabilities, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Signature", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Signature = append(m.Signature[:0], dAtA[iNdEx:postIndex]...)
+			if m.Signature == nil {
+				m.Signature = []byte{}
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipDhtmessages(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *DHTMessage) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowDhtmessages
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: DHTMessage: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: DHTMessage: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Sender", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Sender == nil {
+				m.Sender = &ID{}
+			}
+			if err := m.Sender.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Body", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Body = append(m.Body[:0], dAtA[iNdEx:postIndex]...)
+			if m.Body == nil {
+				m.Body = []byte{}
+			}
+			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field SenderRecord", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.SenderRecord == nil {
+				m.SenderRecord = &PeerRecord{}
+			}
+			if err := m.SenderRecord.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Type = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Timestamp", wireType)
+			}
+			m.Timestamp = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Timestamp |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Recipient", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Recipient = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Nonce", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Nonce = append(m.Nonce[:0], dAtA[iNdEx:postIndex]...)
+			if m.Nonce == nil {
+				m.Nonce = []byte{}
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Encrypted", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Encrypted = bool(v != 0)
+		default:
+			iNdEx = preIndex
+			skippy, err := skipDhtmessages(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *LookupRequest) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowDhtmessages
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: LookupRequest: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: LookupRequest: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Target", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Target == nil {
+				m.Target = &ID{}
+			}
+			if err := m.Target.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipDhtmessages(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *LookupResponse) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowDhtmessages
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: LookupResponse: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: LookupResponse: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Peers", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Peers = append(m.Peers, &ID{})
+			if err := m.Peers[len(m.Peers)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Records", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Records = append(m.Records, &PeerRecord{})
+			if err := m.Records[len(m.Records)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipDhtmessages(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
 }
-func sozDhtmessages(x uint64) (n int) {
-	return sovDhtmessages(uint64((x << 1) ^ uint64((int64(x) >> 63))))
+func (m *RequestError) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowDhtmessages
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: RequestError: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: RequestError: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Message", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Message = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipDhtmessages(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
 }
-func (m *SignedDHTMessage) Unmarshal(dAtA []byte) error {
+func (m *Empty) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -609,15 +2572,127 @@ func (m *SignedDHTMessage) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: SignedDHTMessage: wiretype end group for non-group")
+			return fmt.Errorf("proto: Empty: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: SignedDHTMessage: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: Empty: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		default:
+			iNdEx = preIndex
+			skippy, err := skipDhtmessages(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *Value) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowDhtmessages
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: Value: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Value: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
 			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Signature", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Key", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Key = append(m.Key[:0], dAtA[iNdEx:postIndex]...)
+			if m.Key == nil {
+				m.Key = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Data", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Data = append(m.Data[:0], dAtA[iNdEx:postIndex]...)
+			if m.Data == nil {
+				m.Data = []byte{}
+			}
+			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Publisher", wireType)
 			}
 			var byteLen int
 			for shift := uint(0); ; shift += 7 {
@@ -641,14 +2716,52 @@ func (m *SignedDHTMessage) Unmarshal(dAtA []byte) error {
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			m.Signature = append(m.Signature[:0], dAtA[iNdEx:postIndex]...)
-			if m.Signature == nil {
-				m.Signature = []byte{}
+			m.Publisher = append(m.Publisher[:0], dAtA[iNdEx:postIndex]...)
+			if m.Publisher == nil {
+				m.Publisher = []byte{}
 			}
 			iNdEx = postIndex
-		case 2:
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Published", wireType)
+			}
+			m.Published = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Published |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Expires", wireType)
+			}
+			m.Expires = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Expires |= (int64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
 			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field DhtMessage", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Signature", wireType)
 			}
 			var byteLen int
 			for shift := uint(0); ; shift += 7 {
@@ -672,9 +2785,9 @@ func (m *SignedDHTMessage) Unmarshal(dAtA []byte) error {
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			m.DhtMessage = append(m.DhtMessage[:0], dAtA[iNdEx:postIndex]...)
-			if m.DhtMessage == nil {
-				m.DhtMessage = []byte{}
+			m.Signature = append(m.Signature[:0], dAtA[iNdEx:postIndex]...)
+			if m.Signature == nil {
+				m.Signature = []byte{}
 			}
 			iNdEx = postIndex
 		default:
@@ -698,7 +2811,7 @@ func (m *SignedDHTMessage) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *ID) Unmarshal(dAtA []byte) error {
+func (m *StoreRequest) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -721,17 +2834,17 @@ func (m *ID) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: ID: wiretype end group for non-group")
+			return fmt.Errorf("proto: StoreRequest: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: ID: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: StoreRequest: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
 			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field EthAddress", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Value", wireType)
 			}
-			var byteLen int
+			var msglen int
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowDhtmessages
@@ -741,51 +2854,24 @@ func (m *ID) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				byteLen |= (int(b) & 0x7F) << shift
+				msglen |= (int(b) & 0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if byteLen < 0 {
+			if msglen < 0 {
 				return ErrInvalidLengthDhtmessages
 			}
-			postIndex := iNdEx + byteLen
+			postIndex := iNdEx + msglen
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			m.EthAddress = append(m.EthAddress[:0], dAtA[iNdEx:postIndex]...)
-			if m.EthAddress == nil {
-				m.EthAddress = []byte{}
-			}
-			iNdEx = postIndex
-		case 2:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field NetworkAddress", wireType)
-			}
-			var stringLen uint64
-			for shift := uint(0); ; shift += 7 {
-				if shift >= 64 {
-					return ErrIntOverflowDhtmessages
-				}
-				if iNdEx >= l {
-					return io.ErrUnexpectedEOF
-				}
-				b := dAtA[iNdEx]
-				iNdEx++
-				stringLen |= (uint64(b) & 0x7F) << shift
-				if b < 0x80 {
-					break
-				}
-			}
-			intStringLen := int(stringLen)
-			if intStringLen < 0 {
-				return ErrInvalidLengthDhtmessages
+			if m.Value == nil {
+				m.Value = &Value{}
 			}
-			postIndex := iNdEx + intStringLen
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
+			if err := m.Value.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
 			}
-			m.NetworkAddress = string(dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
@@ -808,7 +2894,7 @@ func (m *ID) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *DHTMessage) Unmarshal(dAtA []byte) error {
+func (m *StoreResponse) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -831,50 +2917,17 @@ func (m *DHTMessage) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: DHTMessage: wiretype end group for non-group")
+			return fmt.Errorf("proto: StoreResponse: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: DHTMessage: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: StoreResponse: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Sender", wireType)
-			}
-			var msglen int
-			for shift := uint(0); ; shift += 7 {
-				if shift >= 64 {
-					return ErrIntOverflowDhtmessages
-				}
-				if iNdEx >= l {
-					return io.ErrUnexpectedEOF
-				}
-				b := dAtA[iNdEx]
-				iNdEx++
-				msglen |= (int(b) & 0x7F) << shift
-				if b < 0x80 {
-					break
-				}
-			}
-			if msglen < 0 {
-				return ErrInvalidLengthDhtmessages
-			}
-			postIndex := iNdEx + msglen
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			if m.Sender == nil {
-				m.Sender = &ID{}
-			}
-			if err := m.Sender.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
-				return err
-			}
-			iNdEx = postIndex
-		case 2:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Body", wireType)
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Stored", wireType)
 			}
-			var byteLen int
+			var v int
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowDhtmessages
@@ -884,23 +2937,12 @@ func (m *DHTMessage) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				byteLen |= (int(b) & 0x7F) << shift
+				v |= (int(b) & 0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if byteLen < 0 {
-				return ErrInvalidLengthDhtmessages
-			}
-			postIndex := iNdEx + byteLen
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			m.Body = append(m.Body[:0], dAtA[iNdEx:postIndex]...)
-			if m.Body == nil {
-				m.Body = []byte{}
-			}
-			iNdEx = postIndex
+			m.Stored = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipDhtmessages(dAtA[iNdEx:])
@@ -922,7 +2964,7 @@ func (m *DHTMessage) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *LookupRequest) Unmarshal(dAtA []byte) error {
+func (m *FindValueRequest) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -945,17 +2987,17 @@ func (m *LookupRequest) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: LookupRequest: wiretype end group for non-group")
+			return fmt.Errorf("proto: FindValueRequest: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: LookupRequest: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: FindValueRequest: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
 			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Target", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Key", wireType)
 			}
-			var msglen int
+			var byteLen int
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowDhtmessages
@@ -965,23 +3007,21 @@ func (m *LookupRequest) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				msglen |= (int(b) & 0x7F) << shift
+				byteLen |= (int(b) & 0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if msglen < 0 {
+			if byteLen < 0 {
 				return ErrInvalidLengthDhtmessages
 			}
-			postIndex := iNdEx + msglen
+			postIndex := iNdEx + byteLen
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			if m.Target == nil {
-				m.Target = &ID{}
-			}
-			if err := m.Target.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
-				return err
+			m.Key = append(m.Key[:0], dAtA[iNdEx:postIndex]...)
+			if m.Key == nil {
+				m.Key = []byte{}
 			}
 			iNdEx = postIndex
 		default:
@@ -1005,7 +3045,7 @@ func (m *LookupRequest) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *LookupResponse) Unmarshal(dAtA []byte) error {
+func (m *FindValueResponse) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1028,15 +3068,15 @@ func (m *LookupResponse) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: LookupResponse: wiretype end group for non-group")
+			return fmt.Errorf("proto: FindValueResponse: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: LookupResponse: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: FindValueResponse: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
 			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Peers", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Values", wireType)
 			}
 			var msglen int
 			for shift := uint(0); ; shift += 7 {
@@ -1060,61 +3100,73 @@ func (m *LookupResponse) Unmarshal(dAtA []byte) error {
 			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			m.Peers = append(m.Peers, &ID{})
-			if err := m.Peers[len(m.Peers)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+			m.Values = append(m.Values, &Value{})
+			if err := m.Values[len(m.Values)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
 				return err
 			}
 			iNdEx = postIndex
-		default:
-			iNdEx = preIndex
-			skippy, err := skipDhtmessages(dAtA[iNdEx:])
-			if err != nil {
-				return err
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Peers", wireType)
 			}
-			if skippy < 0 {
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
 				return ErrInvalidLengthDhtmessages
 			}
-			if (iNdEx + skippy) > l {
+			postIndex := iNdEx + msglen
+			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			iNdEx += skippy
-		}
-	}
-
-	if iNdEx > l {
-		return io.ErrUnexpectedEOF
-	}
-	return nil
-}
-func (m *Empty) Unmarshal(dAtA []byte) error {
-	l := len(dAtA)
-	iNdEx := 0
-	for iNdEx < l {
-		preIndex := iNdEx
-		var wire uint64
-		for shift := uint(0); ; shift += 7 {
-			if shift >= 64 {
-				return ErrIntOverflowDhtmessages
+			m.Peers = append(m.Peers, &ID{})
+			if err := m.Peers[len(m.Peers)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
 			}
-			if iNdEx >= l {
+			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Records", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowDhtmessages
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthDhtmessages
+			}
+			postIndex := iNdEx + msglen
+			if postIndex > l {
 				return io.ErrUnexpectedEOF
 			}
-			b := dAtA[iNdEx]
-			iNdEx++
-			wire |= (uint64(b) & 0x7F) << shift
-			if b < 0x80 {
-				break
+			m.Records = append(m.Records, &PeerRecord{})
+			if err := m.Records[len(m.Records)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
 			}
-		}
-		fieldNum := int32(wire >> 3)
-		wireType := int(wire & 0x7)
-		if wireType == 4 {
-			return fmt.Errorf("proto: Empty: wiretype end group for non-group")
-		}
-		if fieldNum <= 0 {
-			return fmt.Errorf("proto: Empty: illegal tag %d (wire type %d)", fieldNum, wire)
-		}
-		switch fieldNum {
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipDhtmessages(dAtA[iNdEx:])
@@ -1242,27 +3294,48 @@ var (
 )
 
 func init() {
-	proto.RegisterFile("frameworks/ethpool/protobuf/dhtmessages.proto", fileDescriptor_dhtmessages_3cd6fb7dcd5a169f)
-}
-
-var fileDescriptor_dhtmessages_3cd6fb7dcd5a169f = []byte{
-	// 287 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x8f, 0x5d, 0x4a, 0xf3, 0x40,
-	0x14, 0x86, 0xbf, 0xf4, 0xb3, 0xd5, 0x1e, 0x6b, 0x29, 0x73, 0xd5, 0x0b, 0x09, 0x32, 0x88, 0x78,
-	0x63, 0x03, 0xfe, 0x2c, 0x40, 0x89, 0x62, 0xa1, 0x82, 0x44, 0x37, 0x90, 0x30, 0xa7, 0x49, 0xa9,
-	0xc9, 0x8c, 0x73, 0x4e, 0x90, 0xee, 0xc2, 0x65, 0x79, 0xe9, 0x12, 0x24, 0x6e, 0x44, 0xf2, 0x87,
-	0x41, 0xbd, 0x1b, 0xde, 0xf7, 0x99, 0x87, 0xf7, 0xc0, 0xc9, 0xd2, 0x86, 0x29, 0xbe, 0x68, 0xbb,
-	0x26, 0x0f, 0x39, 0x31, 0x5a, 0x3f, 0x79, 0xc6, 0x6a, 0xd6, 0x51, 0xbe, 0xf4, 0x54, 0xc2, 0x29,
-	0x12, 0x85, 0x31, 0xd2, 0xac, 0x0a, 0xc5, 0x4e, 0xdb, 0xc9, 0x7b, 0x98, 0x3c, 0xac, 0xe2, 0x0c,
-	0x95, 0x7f, 0xfb, 0x78, 0x57, 0x43, 0x62, 0x1f, 0x86, 0xb4, 0x8a, 0xb3, 0x90, 0x73, 0x8b, 0x53,
-	0xe7, 0xc0, 0x39, 0x1e, 0x05, 0xdf, 0x81, 0x70, 0x01, 0x54, 0xc2, 0x0d, 0x3b, 0xed, 0x55, 0x75,
-	0x27, 0x91, 0x0b, 0xe8, 0xcd, 0xfd, 0x92, 0x42, 0x4e, 0x2e, 0x95, 0xb2, 0x48, 0xd4, 0x48, 0x3a,
-	0x89, 0x38, 0x82, 0x71, 0x86, 0x5c, 0x0e, 0x6e, 0x99, 0xd2, 0x34, 0x0c, 0x7e, 0xa4, 0xf2, 0x06,
-	0xa0, 0xb3, 0xec, 0x10, 0x06, 0x84, 0x99, 0x42, 0x5b, 0x19, 0x77, 0x4f, 0x47, 0xb3, 0xf6, 0x90,
-	0xd9, 0xdc, 0x0f, 0x9a, 0x4e, 0x08, 0xd8, 0x8a, 0xb4, 0xda, 0x34, 0xdb, 0xaa, 0xb7, 0xbc, 0x80,
-	0xbd, 0x85, 0xd6, 0xeb, 0xdc, 0x04, 0xf8, 0x9c, 0x23, 0x71, 0xa9, 0xe2, 0xd0, 0xc6, 0xc8, 0x7f,
-	0xab, 0xea, 0x4e, 0x9e, 0xc3, 0xb8, 0xfd, 0x46, 0x46, 0x67, 0x84, 0x42, 0x42, 0xdf, 0x20, 0xda,
-	0xf2, 0xa6, 0xff, 0xbf, 0xbe, 0xd5, 0x95, 0xdc, 0x86, 0xfe, 0x75, 0x6a, 0x78, 0x73, 0x35, 0x79,
-	0x2b, 0x5c, 0xe7, 0xbd, 0x70, 0x9d, 0x8f, 0xc2, 0x75, 0x5e, 0x3f, 0xdd, 0x7f, 0xd1, 0xa0, 0xc2,
-	0xcf, 0xbe, 0x02, 0x00, 0x00, 0xff, 0xff, 0xa3, 0x02, 0xa4, 0x9d, 0xb1, 0x01, 0x00, 0x00,
+	proto.RegisterFile("frameworks/ethpool/protobuf/dhtmessages.proto", fileDescriptor_dhtmessages_1c8965c5f5a3dcd2)
+}
+
+var fileDescriptor_dhtmessages_1c8965c5f5a3dcd2 = []byte{
+	// 616 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x53, 0xc1, 0x6e, 0xd3, 0x4c,
+	0x10, 0xfe, 0x9d, 0xd4, 0x49, 0x3c, 0x75, 0xfb, 0x87, 0x55, 0x85, 0x7c, 0xa8, 0xa2, 0x68, 0x55,
+	0x68, 0x84, 0x44, 0x2a, 0x15, 0x55, 0xe2, 0x0a, 0x6a, 0x11, 0x95, 0x8a, 0x54, 0x6d, 0x11, 0x77,
+	0x27, 0x3b, 0x4d, 0xac, 0x26, 0xde, 0xed, 0xee, 0x1a, 0xc8, 0x9d, 0x07, 0xe8, 0x2b, 0xf0, 0x36,
+	0x88, 0x13, 0x8f, 0x80, 0xca, 0x8b, 0xa0, 0x5d, 0xaf, 0x71, 0xd2, 0x80, 0xda, 0xdb, 0xec, 0xf7,
+	0xcd, 0x8c, 0xe7, 0xfb, 0x66, 0x0c, 0xcf, 0x2f, 0x55, 0x3a, 0xc7, 0x4f, 0x42, 0x5d, 0xe9, 0x03,
+	0x34, 0x53, 0x29, 0xc4, 0xec, 0x40, 0x2a, 0x61, 0xc4, 0xa8, 0xb8, 0x3c, 0xe0, 0x53, 0x33, 0x47,
+	0xad, 0xd3, 0x09, 0xea, 0xa1, 0x03, 0x49, 0xa7, 0xe2, 0xe8, 0x39, 0x74, 0x2f, 0xb2, 0x49, 0x8e,
+	0xfc, 0xf8, 0xed, 0xfb, 0x77, 0x65, 0x12, 0xd9, 0x85, 0x48, 0x67, 0x93, 0x3c, 0x35, 0x85, 0xc2,
+	0x24, 0xe8, 0x07, 0x83, 0x98, 0xd5, 0x00, 0xe9, 0x01, 0xf0, 0xa9, 0xf1, 0xb9, 0x49, 0xc3, 0xd1,
+	0x4b, 0x08, 0x3d, 0x83, 0xc6, 0xe9, 0xb1, 0xcd, 0x42, 0x33, 0x7d, 0xc5, 0xb9, 0x42, 0xad, 0x7d,
+	0x93, 0x25, 0x84, 0x3c, 0x85, 0xed, 0x1c, 0x8d, 0x1d, 0xb8, 0xca, 0xb1, 0x9d, 0x22, 0x76, 0x07,
+	0xa5, 0xdf, 0x03, 0x80, 0x73, 0x44, 0xc5, 0x70, 0x2c, 0x14, 0xbf, 0xb7, 0xed, 0x33, 0xe8, 0xae,
+	0x36, 0x40, 0xdb, 0xb8, 0x39, 0x88, 0xd8, 0x1a, 0x4e, 0xba, 0xd0, 0xd4, 0x78, 0x9d, 0x34, 0xfb,
+	0xc1, 0x60, 0x83, 0xd9, 0xd0, 0x0a, 0x37, 0xd9, 0x1c, 0xb5, 0x49, 0xe7, 0x32, 0xd9, 0xe8, 0x07,
+	0x83, 0x26, 0xab, 0x01, 0x42, 0x21, 0x1e, 0xa7, 0x32, 0x1d, 0x65, 0xb3, 0xcc, 0x64, 0xa8, 0x93,
+	0xd0, 0xf5, 0x5d, 0xc1, 0x56, 0xad, 0x6b, 0xdd, 0xb1, 0x8e, 0x7e, 0x69, 0x00, 0x2c, 0xf9, 0xbc,
+	0x07, 0x2d, 0x8d, 0x39, 0x47, 0xe5, 0x84, 0x6c, 0x1e, 0xc6, 0xc3, 0x6a, 0x2d, 0xc3, 0xd3, 0x63,
+	0xe6, 0x39, 0x42, 0x60, 0x63, 0x24, 0xf8, 0xc2, 0x3b, 0xed, 0x62, 0xf2, 0x12, 0xe2, 0x92, 0x2d,
+	0x6d, 0x71, 0x1a, 0x36, 0x0f, 0x77, 0xea, 0xfa, 0xda, 0x32, 0xb6, 0x92, 0x69, 0xbb, 0x99, 0x85,
+	0x44, 0xa7, 0x2e, 0x62, 0x2e, 0x5e, 0x95, 0x1d, 0xde, 0x95, 0xbd, 0x0b, 0x91, 0xc2, 0x71, 0x26,
+	0x33, 0xcc, 0x8d, 0x93, 0x14, 0xb1, 0x1a, 0x20, 0x3b, 0x10, 0xe6, 0x22, 0x1f, 0x63, 0xd2, 0x76,
+	0xe3, 0x95, 0x0f, 0x5b, 0x83, 0xf9, 0x58, 0x2d, 0xa4, 0x41, 0x9e, 0x74, 0xfa, 0xc1, 0xa0, 0xc3,
+	0x6a, 0x80, 0x1e, 0xc1, 0xd6, 0x99, 0x10, 0x57, 0x85, 0x64, 0x78, 0x5d, 0xa0, 0x36, 0xd6, 0x08,
+	0x93, 0xaa, 0x09, 0x9a, 0xbf, 0x1b, 0x51, 0x72, 0x94, 0xc3, 0x76, 0x55, 0xa6, 0xa5, 0xc8, 0x35,
+	0x12, 0x0a, 0xa1, 0x44, 0x54, 0xf6, 0x10, 0x9a, 0x6b, 0x65, 0x25, 0x45, 0x86, 0xd0, 0x56, 0x4e,
+	0x7a, 0x79, 0x08, 0xff, 0x72, 0xa9, 0x4a, 0xa2, 0x03, 0x88, 0xfd, 0x58, 0x27, 0x4a, 0x09, 0x45,
+	0x12, 0x68, 0xfb, 0x9f, 0xc7, 0x0d, 0x17, 0xb1, 0xea, 0x49, 0xdb, 0x10, 0x9e, 0xcc, 0xa5, 0x59,
+	0xd0, 0xaf, 0x01, 0x84, 0x1f, 0xd2, 0x59, 0x81, 0xf6, 0xa4, 0xae, 0x70, 0xe1, 0xef, 0xd2, 0x86,
+	0xd6, 0x6f, 0x9e, 0x9a, 0xb4, 0xda, 0x9e, 0x8d, 0xad, 0x3b, 0xb2, 0x18, 0xcd, 0x32, 0x3d, 0x45,
+	0xe5, 0x56, 0x17, 0xb3, 0x1a, 0x58, 0x66, 0x79, 0x75, 0x84, 0x7f, 0x00, 0x3b, 0x0e, 0x7e, 0x96,
+	0x99, 0x72, 0xf7, 0x67, 0xb9, 0xea, 0x79, 0xcf, 0xe9, 0x1d, 0x41, 0x7c, 0x61, 0x84, 0xc2, 0xca,
+	0xf2, 0x27, 0x10, 0x7e, 0xb4, 0x23, 0x7b, 0xc7, 0xff, 0xaf, 0x4d, 0x71, 0x4a, 0x58, 0xc9, 0xd2,
+	0x7d, 0xd8, 0xf2, 0x65, 0xde, 0xf2, 0xc7, 0xd0, 0xd2, 0x16, 0xe0, 0xae, 0xb0, 0xc3, 0xfc, 0x8b,
+	0xee, 0x41, 0xf7, 0x4d, 0x96, 0xf3, 0xb2, 0xd8, 0x7f, 0x63, 0xcd, 0x0d, 0x7a, 0x13, 0xc0, 0xa3,
+	0xa5, 0x34, 0xdf, 0x73, 0x1f, 0x5a, 0xee, 0x6b, 0xd5, 0x1e, 0xd7, 0x86, 0xf1, 0x74, 0xbd, 0xef,
+	0xc6, 0x83, 0xf6, 0xdd, 0x7c, 0xc0, 0xbe, 0x5f, 0x77, 0xbf, 0xdd, 0xf6, 0x82, 0x1f, 0xb7, 0xbd,
+	0xe0, 0xe7, 0x6d, 0x2f, 0xb8, 0xf9, 0xd5, 0xfb, 0x6f, 0xd4, 0x72, 0xf9, 0x2f, 0x7e, 0x0f, 0x00,
+	0x6c, 0x82, 0x10, 0x28, 0x54, 0x05, 0x00, 0x00,
 }
@@ -0,0 +1,202 @@
+package ethpool
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gladiusio/legion/frameworks/ethpool/protobuf"
+	"github.com/gladiusio/legion/network/transport"
+)
+
+// maxRecordClockSkew is how far in the future a peer record's timestamp can
+// be before it's rejected
+const maxRecordClockSkew = time.Minute
+
+// newPeerRecord signs a record of how to reach us at the address, the
+// sequence number must be higher than any record we made before
+func (f *Framework) newPeerRecord(networkAddress string, seq uint64) (*protobuf.PeerRecord, error) {
+	r := &protobuf.PeerRecord{
+		EthAddress:       crypto.PubkeyToAddress(f.key.PublicKey).Bytes(),
+		NetworkAddresses: []string{networkAddress},
+		Seq:              seq,
+		Timestamp:        time.Now().UnixNano(),
+		Capabilities:     f.config.Capabilities,
+	}
+
+	b, err := r.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	r.Signature, err = crypto.Sign(crypto.Keccak256(b), f.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// selfRecord returns our current peer record
+func (f *Framework) selfRecord() *protobuf.PeerRecord {
+	f.selfMux.RLock()
+	defer f.selfMux.RUnlock()
+	return f.record
+}
+
+// PeerRecord returns the newest verified record we have for a peer in the
+// routing table
+func (f *Framework) PeerRecord(address common.Address) (*protobuf.PeerRecord, bool) {
+	return f.router.Record(ID{EthAddress: address.Bytes()})
+}
+
+// verifyPeerRecord makes sure the record is signed by the address in it, has
+// somewhere to reach the peer and isn't from the future
+func verifyPeerRecord(r *protobuf.PeerRecord) error {
+	if len(r.Signature) != 65 {
+		return errors.New("ethpool: record signature has the wrong length")
+	}
+	if len(r.NetworkAddresses) == 0 || r.NetworkAddresses[0] == "" {
+		return errors.New("ethpool: record has no network address")
+	}
+	if time.Unix(0, r.Timestamp).After(time.Now().Add(maxRecordClockSkew)) {
+		return errors.New("ethpool: record timestamp is in the future")
+	}
+
+	unsigned := *r
+	unsigned.Signature = nil
+	b, err := unsigned.Marshal()
+	if err != nil {
+		return err
+	}
+	hash := crypto.Keccak256(b)
+
+	pubKey, err := crypto.SigToPub(hash, r.Signature)
+	if err != nil {
+		return err
+	}
+	addr := crypto.PubkeyToAddress(*pubKey)
+	if !bytes.Equal(addr.Bytes(), r.EthAddress) || !crypto.VerifySignature(crypto.CompressPubkey(pubKey), hash, r.Signature[:64]) {
+		return errors.New("ethpool: record is not signed by its address")
+	}
+
+	return nil
+}
+
+// checkPeerRecord is verifyPeerRecord, except a record identical to the one
+// we already verified for the peer isn't checked again
+func (f *Framework) checkPeerRecord(r *protobuf.PeerRecord) error {
+	if len(r.EthAddress) == len(f.selfID().EthAddress) {
+		if known, ok := f.router.Record(ID{EthAddress: r.EthAddress}); ok && known.Seq == r.Seq && sameRecord(known, r) {
+			return nil
+		}
+	}
+	return verifyPeerRecord(r)
+}
+
+// sameRecord returns true if both records have the same contents
+func sameRecord(a, b *protobuf.PeerRecord) bool {
+	if a.Timestamp != b.Timestamp || !bytes.Equal(a.Signature, b.Signature) || !bytes.Equal(a.EthAddress, b.EthAddress) ||
+		len(a.NetworkAddresses) != len(b.NetworkAddresses) || len(a.Capabilities) != len(b.Capabilities) {
+		return false
+	}
+	for i := range a.NetworkAddresses {
+		if a.NetworkAddresses[i] != b.NetworkAddresses[i] {
+			return false
+		}
+	}
+	for i := range a.Capabilities {
+		if a.Capabilities[i] != b.Capabilities[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// recordID returns the ID to reach the peer in the record at
+func recordID(r *protobuf.PeerRecord) ID {
+	return ID{EthAddress: r.EthAddress, NetworkAddress: r.NetworkAddresses[0]}
+}
+
+// updatePeerRecord adds the peer in a verified record to the routing table
+// like updatePeer, a newer record than the one we have replaces its address
+func (f *Framework) updatePeerRecord(r *protobuf.PeerRecord) {
+	oldest, full := f.router.UpdateRecord(r)
+	if full {
+		go f.pingOrEvict(oldest)
+	}
+}
+
+// updateSender adds the sender of a signed message to the routing table,
+// using its peer record if it sent a valid one
+func (f *Framework) updateSender(m *protobuf.DHTMessage, signer common.Address) {
+	if r := m.SenderRecord; r != nil && bytes.Equal(r.EthAddress, signer.Bytes()) && f.checkPeerRecord(r) == nil {
+		f.updatePeerRecord(r)
+		return
+	}
+	f.updatePeer(ID(*m.Sender))
+}
+
+// closestPeers returns the peers closest to the target for a response, as
+// records where we have them and IDs otherwise
+func (f *Framework) closestPeers(target ID) (peers []*protobuf.ID, records []*protobuf.PeerRecord) {
+	for _, peer := range f.router.FindClosestPeers(target, SearchSzie) {
+		if r, ok := f.router.Record(peer); ok {
+			records = append(records, r)
+			continue
+		}
+		id := protobuf.ID(peer)
+		peers = append(peers, &id)
+	}
+	return peers, records
+}
+
+// mergePeers returns the peers in a response, taking addresses from the
+// records that verify and from the IDs of peers without one
+func (f *Framework) mergePeers(peers []*protobuf.ID, records []*protobuf.PeerRecord) []*ID {
+	merged := make([]*ID, 0, len(peers)+len(records))
+	seen := make(map[string]bool)
+	for _, r := range records {
+		if f.checkPeerRecord(r) != nil {
+			continue
+		}
+		id := recordID(r)
+		if !seen[id.AddressHex()] {
+			seen[id.AddressHex()] = true
+			merged = append(merged, &id)
+		}
+	}
+	for _, p := range peers {
+		id := (*ID)(p)
+		if !seen[id.AddressHex()] {
+			seen[id.AddressHex()] = true
+			merged = append(merged, id)
+		}
+	}
+	return merged
+}
+
+// decodeReply decodes a signed reply from the peer, making sure the peer we
+// asked is the one that signed it and it isn't a replay, and learns the
+// peer's current record
+func (f *Framework) decodeReply(reply *transport.Message, from ID) (*protobuf.DHTMessage, error) {
+	m, pubKey, err := recoverSignedMessage(reply.Body)
+	if err != nil {
+		return nil, err
+	}
+	signer := crypto.PubkeyToAddress(*pubKey)
+	if !bytes.Equal(signer.Bytes(), from.EthAddress) {
+		return nil, errors.New("ethpool: reply was not signed by the peer asked")
+	}
+	if err := f.checkEnvelope(m, signer, reply.Type); err != nil {
+		return nil, err
+	}
+	f.keys.add(signer, pubKey)
+
+	if r := m.SenderRecord; r != nil && bytes.Equal(r.EthAddress, signer.Bytes()) && f.checkPeerRecord(r) == nil {
+		f.updatePeerRecord(r)
+	}
+
+	return m, nil
+}
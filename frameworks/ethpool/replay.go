@@ -0,0 +1,151 @@
+package ethpool
+
+import (
+	"container/heap"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gladiusio/legion/frameworks/ethpool/protobuf"
+)
+
+// Errors for signed messages that fail the replay checks
+var (
+	ErrWrongType      = errors.New("ethpool: message was signed for another type")
+	ErrWrongRecipient = errors.New("ethpool: message was signed for another recipient")
+	ErrStale          = errors.New("ethpool: message is outside the freshness window")
+	ErrReplayed       = errors.New("ethpool: message was already received")
+
+	// ErrReplayCacheFull is returned when more messages arrived within the
+	// freshness window than the replay cache can remember
+	ErrReplayCacheFull = errors.New("ethpool: too many recent messages to check for replays")
+)
+
+// nonceSize is how many random bytes are in a message nonce
+const nonceSize = 16
+
+// checkEnvelope makes sure a signed message was meant for us as the given
+// type, was sent within the freshness window and hasn't been seen before
+func (f *Framework) checkEnvelope(m *protobuf.DHTMessage, signer common.Address, messageType string) error {
+	if m.Type != messageType {
+		return ErrWrongType
+	}
+	if !f.isRecipient(m.Recipient) {
+		return ErrWrongRecipient
+	}
+
+	now := time.Now()
+	sent := time.Unix(0, m.Timestamp)
+	if sent.Before(now.Add(-f.config.FreshnessWindow)) || sent.After(now.Add(f.config.FreshnessWindow)) {
+		return ErrStale
+	}
+
+	if len(m.Nonce) != nonceSize {
+		return ErrReplayed
+	}
+
+	// Once the message is outside the freshness window it is rejected as
+	// stale, so its nonce only has to be remembered until then
+	return f.replays.check(signer.Hex(), hex.EncodeToString(m.Nonce), sent.Add(f.config.FreshnessWindow), now)
+}
+
+// isRecipient returns true if the recipient a message was signed for is us,
+// either our Ethereum address or a network address we've had within the
+// freshness window
+func (f *Framework) isRecipient(recipient string) bool {
+	if common.IsHexAddress(recipient) {
+		return common.HexToAddress(recipient) == f.Address()
+	}
+
+	f.selfMux.RLock()
+	defer f.selfMux.RUnlock()
+	if recipient == f.self.NetworkAddress {
+		return true
+	}
+	changed, ok := f.previousAddresses[recipient]
+	return ok && time.Since(changed) <= f.config.FreshnessWindow
+}
+
+// recipientOf returns the recipient to sign a message to the peer for, its
+// Ethereum address when we know it so the message is bound to its key, and
+// its network address if not
+func recipientOf(id ID) string {
+	if len(id.EthAddress) == common.AddressLength {
+		return common.BytesToAddress(id.EthAddress).Hex()
+	}
+	return id.NetworkAddress
+}
+
+func newReplayCache(size, perSigner int) *replayCache {
+	return &replayCache{
+		size:      size,
+		perSigner: perSigner,
+		seen:      make(map[string]struct{}, size),
+		signers:   make(map[string]int),
+	}
+}
+
+// replayCache remembers the nonces of messages until they leave the freshness
+// window. If it is full of nonces that are still fresh new messages are
+// rejected, since forgetting a fresh nonce would let its message be replayed.
+// Each signer can only use perSigner of the entries.
+type replayCache struct {
+	size      int
+	perSigner int
+	seen      map[string]struct{}
+	signers   map[string]int
+	expiries  replayExpiries
+	mux       sync.Mutex
+}
+
+// check returns ErrReplayed if the signer's nonce is in the cache, or
+// ErrReplayCacheFull if there's no room for it. Otherwise the nonce is
+// remembered until expires.
+func (c *replayCache) check(signer, nonce string, expires time.Time, now time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	for len(c.expiries) > 0 && !c.expiries[0].expires.After(now) {
+		e := heap.Pop(&c.expiries).(replayEntry)
+		delete(c.seen, e.signer+e.nonce)
+		if c.signers[e.signer]--; c.signers[e.signer] == 0 {
+			delete(c.signers, e.signer)
+		}
+	}
+
+	key := signer + nonce
+	if _, ok := c.seen[key]; ok {
+		return ErrReplayed
+	}
+	if len(c.seen) >= c.size || c.signers[signer] >= c.perSigner {
+		return ErrReplayCacheFull
+	}
+
+	c.seen[key] = struct{}{}
+	c.signers[signer]++
+	heap.Push(&c.expiries, replayEntry{signer: signer, nonce: nonce, expires: expires})
+	return nil
+}
+
+// replayEntry is a signer's nonce and when it can be forgotten
+type replayEntry struct {
+	signer  string
+	nonce   string
+	expires time.Time
+}
+
+// replayExpiries is a heap of entries with the soonest to expire first
+type replayExpiries []replayEntry
+
+func (h replayExpiries) Len() int            { return len(h) }
+func (h replayExpiries) Less(i, j int) bool  { return h[i].expires.Before(h[j].expires) }
+func (h replayExpiries) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *replayExpiries) Push(x interface{}) { *h = append(*h, x.(replayEntry)) }
+func (h *replayExpiries) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,118 @@
+package ethpool
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gladiusio/legion/frameworks/ethpool/protobuf"
+	"github.com/gladiusio/legion/utils"
+	"github.com/gogo/protobuf/proto"
+
+	log "github.com/gladiusio/legion/logger"
+)
+
+// RequestHandler answers requests of a type, the reply is sent back signed
+// as the request type with "_response" appended. If it returns an error the
+// requester gets it instead.
+type RequestHandler func(req *IncomingMessage) (proto.Message, error)
+
+// RemoteError is returned by Request when the recipient's handler failed
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "ethpool: request failed on the peer: " + e.Message
+}
+
+// HandleRequest registers the handler to answer requests of the message type,
+// replacing any handler already registered for it with HandleRequest or
+// Handle. Requests are queued and handled like the messages passed to Handle.
+// Requests without a handler are delivered like any other message and never
+// answered.
+func (f *Framework) HandleRequest(messageType string, handler RequestHandler) {
+	if handler == nil {
+		f.Handle(messageType, nil)
+		return
+	}
+	f.Handle(messageType, func(req *IncomingMessage) { f.answerRequest(req, handler) })
+}
+
+// Request sends a signed request to the recipient and waits for its signed
+// reply until the context is done, or RequestTimeout if it has no deadline.
+// The recipient is found with a lookup if it isn't in the routing table. The
+// reply has to be signed by the recipient, and its body can be decoded with
+// IncomingMessage.Decode. The reply has no Context, since it is returned by
+// legion's request rather than received as a message.
+func (f *Framework) Request(ctx context.Context, recipient common.Address, messageType string, body proto.Message) (*IncomingMessage, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.config.RequestTimeout)
+		defer cancel()
+	}
+
+	id, err := f.resolve(ctx, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	bodyBytes, err := proto.Marshal(body)
+	if err != nil {
+		return nil, errors.New("ethpool: could not marshal request body")
+	}
+
+	la := utils.LegionAddressFromString(id.NetworkAddress)
+	m, err := f.makeLegionSignedMessage(messageType, recipientOf(id), bodyBytes)
+	if err != nil {
+		return nil, errors.New("ethpool: could not make legion signed message")
+	}
+
+	reply, err := f.l.RequestContext(ctx, m, la)
+	if err != nil {
+		return nil, err
+	}
+	dhtMessage, err := f.decodeReply(reply, id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch reply.Type {
+	case messageType + "_response":
+		return &IncomingMessage{Sender: dhtMessage.Sender, Body: dhtMessage.Body, Type: reply.Type, Signer: recipient}, nil
+	case messageType + "_error":
+		reqErr := &protobuf.RequestError{}
+		if err := reqErr.Unmarshal(dhtMessage.Body); err != nil {
+			return nil, errors.New("ethpool: could not decode request error")
+		}
+		return nil, &RemoteError{Message: reqErr.Message}
+	default:
+		return nil, errors.New("ethpool: request was answered with an unexpected type")
+	}
+}
+
+// answerRequest replies to the request with what the handler returns
+func (f *Framework) answerRequest(req *IncomingMessage, handler RequestHandler) {
+	replyType := req.Type + "_response"
+	reply, err := handler(req)
+	if err != nil {
+		replyType = req.Type + "_error"
+		reply = &protobuf.RequestError{Message: err.Error()}
+	} else if reply == nil {
+		reply = &protobuf.Empty{}
+	}
+
+	replyBytes, err := proto.Marshal(reply)
+	if err != nil {
+		log.Warn().Field("type", req.Type).Field("err", err.Error()).Log("ethpool: could not marshal reply")
+		return
+	}
+
+	m, err := f.makeLegionSignedMessage(replyType, req.Signer.Hex(), replyBytes)
+	if err != nil {
+		return
+	}
+	if err := req.Context.Reply(m); err != nil {
+		log.Debug().Field("type", req.Type).Field("err", err.Error()).Log("ethpool: could not send reply")
+	}
+}
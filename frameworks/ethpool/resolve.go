@@ -0,0 +1,96 @@
+package ethpool
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// resolveCall is a lookup for a peer that callers resolving the same address
+// wait on together
+type resolveCall struct {
+	done chan struct{}
+	id   ID
+	err  error
+}
+
+// resolve returns the ID of the peer with the address, looking it up if it
+// isn't in the routing table. Concurrent calls for the same address share one
+// lookup, and addresses that weren't found fail straight away for
+// ResolveNegativeTTL. The lookup isn't cancelled with the context, so the
+// other callers still get its result.
+func (f *Framework) resolve(ctx context.Context, recipient common.Address) (ID, error) {
+	if id, ok := f.routedPeer(recipient); ok {
+		return id, nil
+	}
+
+	f.resolveMux.Lock()
+	if failed, ok := f.notFound[recipient]; ok {
+		if time.Since(failed) < f.config.ResolveNegativeTTL {
+			f.resolveMux.Unlock()
+			return ID{}, ErrPeerNotFound
+		}
+		delete(f.notFound, recipient)
+	}
+
+	call, pending := f.resolving[recipient]
+	if !pending {
+		call = &resolveCall{done: make(chan struct{})}
+		f.resolving[recipient] = call
+		go f.resolveLookup(recipient, call)
+	}
+	f.resolveMux.Unlock()
+
+	select {
+	case <-call.done:
+		return call.id, call.err
+	case <-ctx.Done():
+		return ID{}, ctx.Err()
+	}
+}
+
+// resolveLookup looks up the peer for the call and remembers if it wasn't found
+func (f *Framework) resolveLookup(recipient common.Address, call *resolveCall) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.config.ResolveTimeout)
+	defer cancel()
+
+	call.err = ErrPeerNotFound
+	result, err := f.lookupPeer(ctx, recipient, f.config.ResolveDepth)
+	if err == nil {
+		for _, peer := range result.Closest {
+			if bytes.Equal(peer.EthAddress, recipient.Bytes()) {
+				call.id, call.err = peer, nil
+				break
+			}
+		}
+	} else if err != ErrPeerNotFound {
+		call.err = err
+	}
+
+	f.resolveMux.Lock()
+	delete(f.resolving, recipient)
+	if call.err == ErrPeerNotFound && f.config.ResolveNegativeTTL > 0 {
+		// Forget the failures that have expired so the cache stays small
+		for addr, failed := range f.notFound {
+			if time.Since(failed) >= f.config.ResolveNegativeTTL {
+				delete(f.notFound, addr)
+			}
+		}
+		f.notFound[recipient] = time.Now()
+	}
+	f.resolveMux.Unlock()
+
+	close(call.done)
+}
+
+// routedPeer returns the peer with the address if it's in the routing table
+func (f *Framework) routedPeer(addr common.Address) (ID, bool) {
+	toFind := ID{EthAddress: addr.Bytes()}
+	peers := f.router.FindClosestPeers(toFind, 1)
+	if len(peers) != 1 || !bytes.Equal(peers[0].EthAddress, toFind.EthAddress) {
+		return ID{}, false
+	}
+	return peers[0], true
+}
@@ -7,40 +7,81 @@ package ethpool
 import (
 	"bytes"
 	"container/list"
+	"math/rand"
 	"sort"
 	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/frameworks/ethpool/protobuf"
 )
 
 // SearchSzie is how many nodes we want to ask for in lookups
 const SearchSzie = 16
 
+// DefaultBucketSize is K, the most peers kept in each bucket when no size is
+// given
+const DefaultBucketSize = 20
+
 // RoutingTable contains one bucket list for lookups.
 type RoutingTable struct {
 	// Current node's ID.
 	self ID
 
+	// The most peers kept in a bucket and in its replacement cache
+	bucketSize      int
+	replacementSize int
+
 	buckets []*Bucket
 }
 
-// Bucket holds a list of contacts of this node.
+// Bucket holds a list of contacts of this node, the most recently seen at the
+// front.
 type Bucket struct {
 	*list.List
+
+	// replacements holds recently seen peers that didn't fit in the bucket,
+	// the most recently seen at the front
+	replacements *list.List
+
+	// lastSeen is when each peer in the bucket was last seen, and records
+	// holds the newest verified record of the peers we have one for, both by
+	// address
+	lastSeen map[string]time.Time
+	records  map[string]*protobuf.PeerRecord
+
+	// touched is when a peer in the bucket was last seen or a lookup for an
+	// ID in its range was last made
+	touched time.Time
+
 	mutex *sync.RWMutex
 }
 
 // NewBucket is a Factory method of Bucket, contains an empty list.
 func NewBucket() *Bucket {
 	return &Bucket{
-		List:  list.New(),
-		mutex: &sync.RWMutex{},
+		List:         list.New(),
+		replacements: list.New(),
+		lastSeen:     make(map[string]time.Time),
+		records:      make(map[string]*protobuf.PeerRecord),
+		touched:      time.Now(),
+		mutex:        &sync.RWMutex{},
 	}
 }
 
-// CreateRoutingTable is a Factory method of RoutingTable containing empty buckets.
+// CreateRoutingTable is a Factory method of RoutingTable containing empty
+// buckets of DefaultBucketSize.
 func CreateRoutingTable(self ID) *RoutingTable {
+	return CreateRoutingTableWithSize(self, DefaultBucketSize, DefaultBucketSize)
+}
+
+// CreateRoutingTableWithSize creates a RoutingTable whose buckets hold at most
+// k peers, and remember up to replacements peers to replace ones that fail.
+func CreateRoutingTableWithSize(self ID, k, replacements int) *RoutingTable {
 	table := &RoutingTable{
-		self:    self,
-		buckets: make([]*Bucket, len(self.EthAddress)*8),
+		self:            self,
+		bucketSize:      k,
+		replacementSize: replacements,
+		buckets:         make([]*Bucket, len(self.EthAddress)*8),
 	}
 	for i := 0; i < len(self.EthAddress)*8; i++ {
 		table.buckets[i] = NewBucket()
@@ -56,38 +97,107 @@ func (t *RoutingTable) Self() []byte {
 	return t.self.EthAddress
 }
 
-// Update moves a peer to the front of a bucket in the routing table.
-func (t *RoutingTable) Update(target ID) {
+// Update moves a peer to the front of a bucket in the routing table, or adds
+// it if the bucket has room. If the bucket is full the peer is put in the
+// bucket's replacement cache instead, and the least recently seen peer in the
+// bucket is returned with full set so the caller can check that it's alive.
+// Peers are matched by ethereum address, a peer already in the table keeps
+// the network address it has.
+func (t *RoutingTable) Update(target ID) (oldest ID, full bool) {
+	return t.update(target, nil)
+}
+
+// UpdateRecord is like Update for the peer in a verified record. The record
+// is kept while the peer is in the table, and replaces the peer's network
+// address unless we already have a record with a higher sequence number.
+func (t *RoutingTable) UpdateRecord(r *protobuf.PeerRecord) (oldest ID, full bool) {
+	return t.update(recordID(r), r)
+}
+
+func (t *RoutingTable) update(target ID, record *protobuf.PeerRecord) (oldest ID, full bool) {
 	if len(t.self.EthAddress) != len(target.EthAddress) {
-		return
+		return ID{}, false
 	}
 
 	if bytes.Equal(target.EthAddress, t.Self()) {
-		return
+		return ID{}, false
 	}
 
 	bucketID := target.Xor(t.self).PrefixLen()
 	bucket := t.Bucket(bucketID)
 
-	var element *list.Element
-
 	// Find current node in bucket.
 	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
 
-	for e := bucket.Front(); e != nil; e = e.Next() {
-		if e.Value.(ID).Equals(target) {
-			element = e
-			break
+	if element := find(bucket.List, target); element != nil {
+		if record != nil {
+			key := target.AddressHex()
+			if existing, ok := bucket.records[key]; !ok || existing.Seq < record.Seq {
+				element.Value = target
+				bucket.records[key] = record
+			}
 		}
+		bucket.MoveToFront(element)
+		bucket.seen(target)
+		return ID{}, false
 	}
 
-	if element == nil {
+	if bucket.Len() < t.bucketSize {
 		bucket.PushFront(target)
-	} else {
-		bucket.MoveToFront(element)
+		bucket.seen(target)
+		if record != nil {
+			bucket.records[target.AddressHex()] = record
+		}
+		if element := find(bucket.replacements, target); element != nil {
+			bucket.replacements.Remove(element)
+		}
+		return ID{}, false
 	}
 
-	bucket.mutex.Unlock()
+	// The bucket is full, so remember the peer in case one in the bucket fails
+	if element := find(bucket.replacements, target); element != nil {
+		element.Value = target
+		bucket.replacements.MoveToFront(element)
+	} else if t.replacementSize > 0 {
+		bucket.replacements.PushFront(target)
+		if bucket.replacements.Len() > t.replacementSize {
+			bucket.replacements.Remove(bucket.replacements.Back())
+		}
+	}
+
+	return bucket.Back().Value.(ID), true
+}
+
+// Record returns the newest verified record of a peer in the table
+func (t *RoutingTable) Record(target ID) (*protobuf.PeerRecord, bool) {
+	if len(t.self.EthAddress) != len(target.EthAddress) {
+		return nil, false
+	}
+
+	bucket := t.Bucket(target.Xor(t.self).PrefixLen())
+	bucket.mutex.RLock()
+	defer bucket.mutex.RUnlock()
+	r, ok := bucket.records[target.AddressHex()]
+	return r, ok
+}
+
+// seen records that the peer in the bucket was just seen, the bucket's lock
+// must be held
+func (b *Bucket) seen(id ID) {
+	b.touched = time.Now()
+	b.lastSeen[id.AddressHex()] = b.touched
+}
+
+// find returns the element of the list holding the peer with the target's
+// ethereum address, or nil
+func find(l *list.List, target ID) *list.Element {
+	for e := l.Front(); e != nil; e = e.Next() {
+		if bytes.Equal(e.Value.(ID).EthAddress, target.EthAddress) {
+			return e
+		}
+	}
+	return nil
 }
 
 // GetPeers returns a randomly-ordered, unique list of all peers within the routing network (excluding itself).
@@ -134,25 +244,123 @@ func (t *RoutingTable) GetPeerAddresses() (peers []string) {
 	return
 }
 
-// RemovePeer removes a peer from the routing table with O(bucket_size) time complexity.
+// RemovePeer removes a peer from the routing table with O(bucket_size) time
+// complexity. The most recently seen peer in the bucket's replacement cache
+// takes its place.
 func (t *RoutingTable) RemovePeer(target ID) bool {
 	bucketID := target.Xor(t.self).PrefixLen()
 	bucket := t.Bucket(bucketID)
+	if bucket == nil {
+		return false
+	}
 
 	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
 
-	for e := bucket.Front(); e != nil; e = e.Next() {
-		if e.Value.(ID).Equals(target) {
-			bucket.Remove(e)
+	if element := find(bucket.replacements, target); element != nil {
+		bucket.replacements.Remove(element)
+	}
 
-			bucket.mutex.Unlock()
-			return true
-		}
+	element := find(bucket.List, target)
+	if element == nil {
+		return false
+	}
+	bucket.Remove(element)
+	delete(bucket.lastSeen, target.AddressHex())
+	delete(bucket.records, target.AddressHex())
+
+	if replacement := bucket.replacements.Front(); replacement != nil {
+		id := bucket.replacements.Remove(replacement).(ID)
+		bucket.PushFront(id)
+		bucket.seen(id)
+	}
+
+	return true
+}
+
+// Replacements returns the peers in a bucket's replacement cache, the most
+// recently seen first.
+func (t *RoutingTable) Replacements(bucketID int) (peers []ID) {
+	bucket := t.Bucket(bucketID)
+	if bucket == nil {
+		return nil
+	}
+
+	bucket.mutex.RLock()
+	defer bucket.mutex.RUnlock()
+
+	for e := bucket.replacements.Front(); e != nil; e = e.Next() {
+		peers = append(peers, e.Value.(ID))
+	}
+
+	return peers
+}
+
+// Touch marks the bucket the target falls in as recently looked up
+func (t *RoutingTable) Touch(target ID) {
+	if len(t.self.EthAddress) != len(target.EthAddress) {
+		return
 	}
 
+	bucket := t.Bucket(target.Xor(t.self).PrefixLen())
+	bucket.mutex.Lock()
+	bucket.touched = time.Now()
 	bucket.mutex.Unlock()
+}
 
-	return false
+// StaleBuckets returns the buckets that haven't been touched since the
+// cutoff. Only buckets up to the deepest one holding a peer are returned,
+// since the ranges of deeper buckets are too small to hold any peers yet.
+func (t *RoutingTable) StaleBuckets(cutoff time.Time) (buckets []int) {
+	deepest := -1
+	for i, bucket := range t.buckets {
+		bucket.mutex.RLock()
+		if bucket.Len() > 0 {
+			deepest = i
+		}
+		bucket.mutex.RUnlock()
+	}
+
+	for i := 0; i <= deepest; i++ {
+		bucket := t.buckets[i]
+		bucket.mutex.RLock()
+		if bucket.touched.Before(cutoff) {
+			buckets = append(buckets, i)
+		}
+		bucket.mutex.RUnlock()
+	}
+
+	return buckets
+}
+
+// StalePeers returns the peers that haven't been seen since the cutoff
+func (t *RoutingTable) StalePeers(cutoff time.Time) (peers []ID) {
+	for _, bucket := range t.buckets {
+		bucket.mutex.RLock()
+		for e := bucket.Front(); e != nil; e = e.Next() {
+			id := e.Value.(ID)
+			if bucket.lastSeen[id.AddressHex()].Before(cutoff) {
+				peers = append(peers, id)
+			}
+		}
+		bucket.mutex.RUnlock()
+	}
+
+	return peers
+}
+
+// RandomID returns a random ID that falls in the range of the bucket
+func (t *RoutingTable) RandomID(bucketID int) ID {
+	addr := make([]byte, len(t.self.EthAddress))
+	rand.Read(addr)
+
+	// Keep our own prefix up to the bucket's bit, then flip that bit
+	index, bit := bucketID/8, uint(7-bucketID%8)
+	copy(addr, t.self.EthAddress[:index])
+	high := byte(0xff) << (bit + 1)
+	addr[index] = (t.self.EthAddress[index] & high) | (^t.self.EthAddress[index] & (1 << bit)) | (addr[index] &^ high &^ (1 << bit))
+
+	return ID{EthAddress: addr}
 }
 
 // PeerExists checks if a peer exists in the routing table with O(bucket_size) time complexity.
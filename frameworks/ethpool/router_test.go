@@ -2,6 +2,7 @@ package ethpool
 
 import (
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
 )
@@ -51,3 +52,100 @@ func TestDuplicateEntry(t *testing.T) {
 		t.Error("incorrect number of peers")
 	}
 }
+
+// bucketZeroID returns an ID in bucket 0 of a routing table for the zero ID
+func bucketZeroID(i byte) ID {
+	addr := make([]byte, 20)
+	addr[0] = 0x80
+	addr[19] = i
+	return ID{EthAddress: addr, NetworkAddress: "localhost:6000"}
+}
+
+func TestBucketSize(t *testing.T) {
+	router := CreateRoutingTableWithSize(ID{EthAddress: make([]byte, 20)}, 2, 2)
+
+	a, b, c, d, e := bucketZeroID(1), bucketZeroID(2), bucketZeroID(3), bucketZeroID(4), bucketZeroID(5)
+	router.Update(a)
+	if _, full := router.Update(b); full {
+		t.Fatal("bucket should have room for two peers")
+	}
+
+	// A full bucket returns the least recently seen peer
+	oldest, full := router.Update(c)
+	if !full || !oldest.Equals(a) {
+		t.Fatalf("expected the oldest peer to be returned, got: %v", oldest)
+	}
+	if router.Bucket(0).Len() != 2 {
+		t.Error("bucket should not grow past its size")
+	}
+
+	// The replacement cache keeps the most recently seen peers
+	router.Update(d)
+	router.Update(e)
+	replacements := router.Replacements(0)
+	if len(replacements) != 2 || !replacements[0].Equals(e) || !replacements[1].Equals(d) {
+		t.Errorf("unexpected replacement cache: %v", replacements)
+	}
+
+	// Seeing a peer moves it to the front, so the other becomes the oldest
+	router.Update(a)
+	if oldest, _ := router.Update(c); !oldest.Equals(b) {
+		t.Errorf("expected b to be the oldest, got: %v", oldest)
+	}
+
+	// Removing a peer promotes the most recently seen replacement, which is
+	// now c
+	router.RemovePeer(b)
+	if !router.PeerExists(c) || router.PeerExists(b) {
+		t.Error("the newest replacement should take the removed peer's place")
+	}
+	if replacements := router.Replacements(0); len(replacements) != 1 || !replacements[0].Equals(e) {
+		t.Errorf("only e should be left in the replacement cache, got: %v", replacements)
+	}
+}
+
+func TestRandomID(t *testing.T) {
+	self := makeID()
+	router := CreateRoutingTable(*self)
+	for i := 0; i < len(self.EthAddress)*8; i++ {
+		if got := router.RandomID(i).Xor(*self).PrefixLen(); got != i {
+			t.Fatalf("random ID for bucket %d landed in bucket %d", i, got)
+		}
+	}
+}
+
+func TestStaleEntries(t *testing.T) {
+	router := CreateRoutingTable(ID{EthAddress: make([]byte, 20)})
+	if len(router.StaleBuckets(time.Now().Add(time.Hour))) != 0 {
+		t.Error("an empty table has no buckets to refresh")
+	}
+
+	a := bucketZeroID(1)
+	router.Update(a)
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+
+	if len(router.StalePeers(cutoff)) != 1 || len(router.StaleBuckets(cutoff)) != 1 {
+		t.Error("the peer and its bucket should be stale")
+	}
+
+	// Seeing the peer again makes it fresh
+	router.Update(a)
+	if len(router.StalePeers(cutoff)) != 0 {
+		t.Error("a peer that was just seen should not be stale")
+	}
+
+	// Buckets up to the deepest one holding a peer can be refreshed
+	b := bucketZeroID(2)
+	b.EthAddress[0] = 0x01
+	router.Update(b)
+	if buckets := router.StaleBuckets(time.Now().Add(time.Hour)); len(buckets) != 8 {
+		t.Errorf("expected buckets 0 to 7 to be stale, got: %v", buckets)
+	}
+	cutoff = time.Now()
+	time.Sleep(time.Millisecond)
+	router.Touch(router.RandomID(3))
+	if buckets := router.StaleBuckets(cutoff); len(buckets) != 7 {
+		t.Errorf("touched buckets should not be stale, got: %v", buckets)
+	}
+}
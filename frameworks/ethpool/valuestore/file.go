@@ -0,0 +1,139 @@
+package valuestore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// NewFileStore returns a store that is loaded from and saved to a JSON file
+// at the path. Records we published are written before Put returns, records
+// from other publishers are written in batches by DeleteExpired, which the
+// framework calls on every maintenance run, and by Close.
+func NewFileStore(path string) (*FileStore, error) {
+	return NewFileStoreWithLimits(path, Limits{})
+}
+
+// NewFileStoreWithLimits is the same as NewFileStore, but rejects new records
+// once a limit is reached. Loaded records over the limits are dropped.
+func NewFileStoreWithLimits(path string, limits Limits) (*FileStore, error) {
+	f := &FileStore{MemoryStore: NewMemoryStoreWithLimits(limits), path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]Record, 0)
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		f.MemoryStore.put(r)
+	}
+	return f, nil
+}
+
+// FileStore is a Store that persists to a local JSON file
+type FileStore struct {
+	*MemoryStore
+	path string
+
+	// Set when there are changes that haven't been saved
+	dirty atomic.Bool
+
+	// Makes sure only one save happens at a time
+	saveMux sync.Mutex
+}
+
+// Assert the type is correct
+var _ Store = (*FileStore)(nil)
+
+// Put stores the record, it's written to disk before returning if it's one
+// we published, otherwise with the next save
+func (f *FileStore) Put(r Record) error {
+	if err := f.MemoryStore.Put(r); err != nil {
+		return err
+	}
+	if !r.Local {
+		f.dirty.Store(true)
+		return nil
+	}
+	// Save even if another save is running, it may have copied the records
+	// before this one was stored
+	f.dirty.Store(false)
+	return f.saveDirty()
+}
+
+// DeleteExpired removes the expired records and writes the store to disk if
+// there were any or there are unsaved changes
+func (f *FileStore) DeleteExpired(now time.Time) error {
+	f.mux.Lock()
+	if f.deleteExpired(now) > 0 {
+		f.dirty.Store(true)
+	}
+	f.mux.Unlock()
+	return f.flush()
+}
+
+// Close writes any unsaved changes to disk
+func (f *FileStore) Close() error {
+	return f.flush()
+}
+
+// flush saves the store if there are unsaved changes
+func (f *FileStore) flush() error {
+	if !f.dirty.Swap(false) {
+		return nil
+	}
+	return f.saveDirty()
+}
+
+// saveDirty saves the store and marks it as having unsaved changes again if
+// that fails
+func (f *FileStore) saveDirty() error {
+	if err := f.save(); err != nil {
+		f.dirty.Store(true)
+		return err
+	}
+	return nil
+}
+
+// save writes to a temporary file and renames it so the store is never left
+// half written. The records are copied under the store lock but written
+// without it, so a slow disk doesn't block the store.
+func (f *FileStore) save() error {
+	f.saveMux.Lock()
+	defer f.saveMux.Unlock()
+
+	f.mux.RLock()
+	b, err := json.Marshal(f.all())
+	f.mux.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,217 @@
+/*
+Package valuestore holds the values a node stores for the ethpool DHT.
+*/
+package valuestore
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrStoreFull is returned by Put when storing a new record would go over
+// one of the store's limits
+var ErrStoreFull = errors.New("valuestore: store is full")
+
+// Record is a value stored for a key by one publisher
+type Record struct {
+	// Key is the key the value is stored under
+	Key []byte `json:"key"`
+
+	// Publisher is the ethereum address of the publisher
+	Publisher []byte `json:"publisher"`
+
+	// Value is the marshalled signed value, served as is to peers
+	Value []byte `json:"value"`
+
+	// Published is when the publisher created the value, and Expires is
+	// when it should be dropped
+	Published time.Time `json:"published"`
+	Expires   time.Time `json:"expires"`
+
+	// Local is true if we published the value, so it's republished by us
+	Local bool `json:"local"`
+}
+
+// Expired returns true if the record has expired at the time
+func (r Record) Expired(now time.Time) bool {
+	return !now.Before(r.Expires)
+}
+
+// Store holds records, at most one for each key and publisher
+type Store interface {
+	// Put stores the record, replacing any with the same key and publisher
+	Put(r Record) error
+
+	// Get returns the records stored under the key
+	Get(key []byte) ([]Record, error)
+
+	// All returns every record
+	All() ([]Record, error)
+
+	// DeleteExpired removes the records that have expired at the time
+	DeleteExpired(now time.Time) error
+
+	// Close releases the store
+	Close() error
+}
+
+// Limits caps how many records a store holds, a zero field doesn't limit.
+// Records we published ourselves are always stored and don't count.
+type Limits struct {
+	// MaxRecords is how many records are stored in total
+	MaxRecords int
+
+	// MaxRecordsPerPublisher is how many records are stored for a single
+	// publisher, across all keys
+	MaxRecordsPerPublisher int
+}
+
+// NewMemoryStore returns a store that only lives in memory
+func NewMemoryStore() *MemoryStore {
+	return NewMemoryStoreWithLimits(Limits{})
+}
+
+// NewMemoryStoreWithLimits is the same as NewMemoryStore, but rejects new
+// records once a limit is reached
+func NewMemoryStoreWithLimits(limits Limits) *MemoryStore {
+	return &MemoryStore{
+		records:     make(map[string]map[string]Record),
+		limits:      limits,
+		byPublisher: make(map[string]int),
+	}
+}
+
+// MemoryStore is an in memory Store
+type MemoryStore struct {
+	// Records by key and then publisher
+	records map[string]map[string]Record
+	mux     sync.RWMutex
+
+	// The limits, and how many records that count against them are stored
+	// in total and for each publisher
+	limits      Limits
+	counted     int
+	byPublisher map[string]int
+}
+
+// Assert the type is correct
+var _ Store = (*MemoryStore)(nil)
+
+// Put stores the record
+func (m *MemoryStore) Put(r Record) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.put(r)
+}
+
+// put stores the record if it is within the limits, the lock must be held
+func (m *MemoryStore) put(r Record) error {
+	key := hex.EncodeToString(r.Key)
+	publisher := hex.EncodeToString(r.Publisher)
+
+	// Replacing a record that counts doesn't change the totals
+	existing, replacing := m.records[key][publisher]
+	wasCounted := replacing && !existing.Local
+	if !r.Local && !wasCounted && m.full(publisher) {
+		return ErrStoreFull
+	}
+	if wasCounted {
+		m.uncount(publisher)
+	}
+	if !r.Local {
+		m.count(publisher)
+	}
+
+	if m.records[key] == nil {
+		m.records[key] = make(map[string]Record)
+	}
+	m.records[key][publisher] = r
+	return nil
+}
+
+// full returns true if another record from the publisher would go over a
+// limit, the lock must be held
+func (m *MemoryStore) full(publisher string) bool {
+	if m.limits.MaxRecords > 0 && m.counted >= m.limits.MaxRecords {
+		return true
+	}
+	return m.limits.MaxRecordsPerPublisher > 0 && m.byPublisher[publisher] >= m.limits.MaxRecordsPerPublisher
+}
+
+// count and uncount track the records that count against the limits, the
+// lock must be held
+func (m *MemoryStore) count(publisher string) {
+	m.counted++
+	m.byPublisher[publisher]++
+}
+
+func (m *MemoryStore) uncount(publisher string) {
+	m.counted--
+	m.byPublisher[publisher]--
+	if m.byPublisher[publisher] == 0 {
+		delete(m.byPublisher, publisher)
+	}
+}
+
+// Get returns the records stored under the key
+func (m *MemoryStore) Get(key []byte) ([]Record, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	records := make([]Record, 0)
+	for _, r := range m.records[hex.EncodeToString(key)] {
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// All returns every record
+func (m *MemoryStore) All() ([]Record, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return m.all(), nil
+}
+
+// all returns every record, the lock must be held
+func (m *MemoryStore) all() []Record {
+	records := make([]Record, 0)
+	for _, byPublisher := range m.records {
+		for _, r := range byPublisher {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// DeleteExpired removes the records that have expired
+func (m *MemoryStore) DeleteExpired(now time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.deleteExpired(now)
+	return nil
+}
+
+// deleteExpired removes the expired records and returns how many there
+// were, the lock must be held
+func (m *MemoryStore) deleteExpired(now time.Time) int {
+	deleted := 0
+	for key, byPublisher := range m.records {
+		for publisher, r := range byPublisher {
+			if r.Expired(now) {
+				delete(byPublisher, publisher)
+				if !r.Local {
+					m.uncount(publisher)
+				}
+				deleted++
+			}
+		}
+		if len(byPublisher) == 0 {
+			delete(m.records, key)
+		}
+	}
+	return deleted
+}
+
+// Close does nothing for a memory store
+func (m *MemoryStore) Close() error { return nil }
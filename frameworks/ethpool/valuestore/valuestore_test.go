@@ -0,0 +1,161 @@
+package valuestore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	s.Put(Record{Key: []byte("a"), Publisher: []byte{1}, Value: []byte{1}, Expires: now.Add(time.Hour)})
+	s.Put(Record{Key: []byte("a"), Publisher: []byte{1}, Value: []byte{2}, Expires: now.Add(time.Hour)})
+	s.Put(Record{Key: []byte("a"), Publisher: []byte{2}, Expires: now.Add(time.Second)})
+	s.Put(Record{Key: []byte("b"), Publisher: []byte{1}, Expires: now.Add(time.Hour)})
+
+	records, _ := s.Get([]byte("a"))
+	if len(records) != 2 {
+		t.Fatalf("expected one record per publisher, got %d", len(records))
+	}
+	for _, r := range records {
+		if r.Publisher[0] == 1 && !bytes.Equal(r.Value, []byte{2}) {
+			t.Error("a publisher's record should be replaced")
+		}
+	}
+
+	s.DeleteExpired(now.Add(time.Minute))
+	if records, _ := s.Get([]byte("a")); len(records) != 1 {
+		t.Error("expired record was not deleted")
+	}
+	if all, _ := s.All(); len(all) != 2 {
+		t.Errorf("expected two records left, got %d", len(all))
+	}
+}
+
+func TestMemoryStoreLimits(t *testing.T) {
+	s := NewMemoryStoreWithLimits(Limits{MaxRecords: 3, MaxRecordsPerPublisher: 2})
+	now := time.Now()
+	record := func(key string, publisher byte) Record {
+		return Record{Key: []byte(key), Publisher: []byte{publisher}, Expires: now.Add(time.Hour)}
+	}
+
+	if s.Put(record("a", 1)) != nil || s.Put(record("b", 1)) != nil {
+		t.Fatal("records within the limits should be stored")
+	}
+	if s.Put(record("c", 1)) != ErrStoreFull {
+		t.Error("a publisher over its limit should be rejected")
+	}
+	if s.Put(record("a", 1)) != nil {
+		t.Error("replacing a record should not count against the limits")
+	}
+	if s.Put(record("a", 2)) != nil {
+		t.Fatal("another publisher should have room")
+	}
+	if s.Put(record("b", 3)) != ErrStoreFull {
+		t.Error("a record over the total limit should be rejected")
+	}
+
+	// Our own records are always stored
+	local := record("c", 1)
+	local.Local = true
+	if s.Put(local) != nil {
+		t.Error("local records should not be limited")
+	}
+
+	// Expired records free up room
+	expiring := record("d", 3)
+	s.DeleteExpired(now.Add(2 * time.Hour))
+	expiring.Expires = now.Add(3 * time.Hour)
+	if s.Put(expiring) != nil {
+		t.Error("deleting expired records should make room")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "valuestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "values.json")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Record{Key: []byte("a"), Publisher: []byte{1}, Value: []byte{1, 2, 3}, Expires: time.Now().Add(time.Hour).Round(time.Second), Local: true}
+	s.Put(r)
+	s.Put(Record{Key: []byte("b"), Publisher: []byte{1}})
+	s.DeleteExpired(time.Now())
+
+	// No Close, DeleteExpired should have saved every change
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := s.All()
+	if len(all) != 1 {
+		t.Fatalf("expected one record after reloading, got %d", len(all))
+	}
+	got := all[0]
+	if !bytes.Equal(got.Key, r.Key) || !bytes.Equal(got.Value, r.Value) || !got.Expires.Equal(r.Expires) || !got.Local {
+		t.Errorf("reloaded record does not match: %+v", got)
+	}
+}
+
+func TestFileStoreBatchesRemoteValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "valuestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "values.json")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func() int {
+		loaded, err := NewFileStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, _ := loaded.All()
+		return len(all)
+	}
+	expires := time.Now().Add(time.Hour)
+
+	// Values from other publishers wait for the next save
+	s.Put(Record{Key: []byte("a"), Publisher: []byte{1}, Expires: expires})
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("remote value should not be written on Put")
+	}
+	if err := s.DeleteExpired(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("expected one record after DeleteExpired, got %d", n)
+	}
+
+	// Ours are written straight away, along with anything unsaved
+	s.Put(Record{Key: []byte("b"), Publisher: []byte{2}, Expires: expires})
+	s.Put(Record{Key: []byte("c"), Publisher: []byte{3}, Expires: expires, Local: true})
+	if n := count(); n != 3 {
+		t.Fatalf("expected three records after a local Put, got %d", n)
+	}
+
+	s.Put(Record{Key: []byte("d"), Publisher: []byte{4}, Expires: expires})
+	if n := count(); n != 3 {
+		t.Fatalf("expected three records before Close, got %d", n)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 4 {
+		t.Fatalf("expected four records after Close, got %d", n)
+	}
+}
@@ -0,0 +1,234 @@
+package network
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/network/config"
+	"github.com/gladiusio/legion/network/outbox"
+	"github.com/gladiusio/legion/network/transport"
+	"github.com/gladiusio/legion/utils"
+
+	log "github.com/gladiusio/legion/logger"
+)
+
+// ackType is the message type of an acknowledgement, the message ID it acks
+// is in the MessageId field
+const ackType = "legion.ack"
+
+// ErrNotAcked is returned when a message wasn't acknowledged after the
+// configured attempts or before it expired
+var ErrNotAcked = errors.New("legion: message was not acknowledged")
+
+// errStoppedBeforeAck is returned to senders still waiting when legion stops,
+// the message stays in the outbox
+var errStoppedBeforeAck = errors.New("legion: stopped before the message was acknowledged")
+
+// SendAcked sends the message to the address and waits until the remote
+// acknowledges it, retransmitting it after a timeout or if the connection is
+// lost. The message is stored in the outbox until it is acked, so with a
+// persistent outbox delivery continues after a restart.
+//
+// The ack is sent once the remote has rate limited and validated the message
+// and is passing it to the framework, a message it drops is never acked. If the context finishes first its error is returned, and
+// the message keeps being retransmitted in the background.
+func (l *Legion) SendAcked(ctx context.Context, message *transport.Message, address utils.LegionAddress) error {
+	l.Started()
+
+	m := *message
+	m.MessageId = newMessageID()
+	m.AckRequested = true
+
+	b, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+
+	e := outbox.Entry{ID: m.MessageId, Address: address, Message: b, Created: time.Now()}
+	if err := l.outbox.Put(e); err != nil {
+		return err
+	}
+
+	d := l.startDelivery(e)
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newMessageID returns a random message ID
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// deliveryKey identifies a delivery by the address it is sent to and the
+// message ID, so only the recipient can ack it
+type deliveryKey struct {
+	address utils.LegionAddress
+	id      string
+}
+
+// delivery tracks a message being sent until it is acked
+type delivery struct {
+	acked   chan struct{}
+	ackOnce sync.Once
+
+	// done is closed when delivery finishes, err is set before that
+	done chan struct{}
+	err  error
+}
+
+// ackSettings returns the ack config with the defaults filled in
+func (l *Legion) ackSettings() config.AckConfig {
+	conf := config.AckConfig{}
+	if l.config.Ack != nil {
+		conf = *l.config.Ack
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = config.DefaultAckTimeout
+	}
+	if conf.DedupWindow == 0 {
+		conf.DedupWindow = config.DefaultDedupWindow
+	}
+	return conf
+}
+
+// startDelivery starts sending the entry in the background
+func (l *Legion) startDelivery(e outbox.Entry) *delivery {
+	d := &delivery{acked: make(chan struct{}), done: make(chan struct{})}
+	if existing, loaded := l.deliveries.LoadOrStore(deliveryKey{e.Address, e.ID}, d); loaded {
+		return existing.(*delivery)
+	}
+	go l.deliver(e, d)
+	return d
+}
+
+// deliver sends the entry until it is acked, gives up or legion stops
+func (l *Legion) deliver(e outbox.Entry, d *delivery) {
+	defer close(d.done)
+	defer l.deliveries.Delete(deliveryKey{e.Address, e.ID})
+
+	m := &transport.Message{}
+	if err := m.Unmarshal(e.Message); err != nil {
+		d.err = err
+		l.removeFromOutbox(e.ID)
+		return
+	}
+
+	conf := l.ackSettings()
+	for attempt := 0; conf.MaxAttempts == 0 || attempt < conf.MaxAttempts; attempt++ {
+		if conf.TTL != 0 && time.Since(e.Created) > conf.TTL {
+			break
+		}
+
+		p, err := l.requestPeer(e.Address)
+		if err != nil {
+			select {
+			case <-time.After(conf.Timeout):
+				continue
+			case <-l.stopped:
+				d.err = errStoppedBeforeAck
+				return
+			}
+		}
+
+		// Each attempt gets a copy, the peer may still be writing the last
+		toSend := *m
+		p.QueueMessage(&toSend)
+
+		select {
+		case <-d.acked:
+			l.removeFromOutbox(e.ID)
+			return
+		case <-time.After(conf.Timeout):
+			log.Debug().Field("id", e.ID).Field("remote", e.Address.String()).Log("legion: message was not acked in time, retransmitting")
+		case <-p.closed:
+			// Reconnect and send it again
+		case <-l.stopped:
+			d.err = errStoppedBeforeAck
+			return
+		}
+	}
+
+	d.err = ErrNotAcked
+	l.removeFromOutbox(e.ID)
+}
+
+func (l *Legion) removeFromOutbox(id string) {
+	if err := l.outbox.Delete(id); err != nil {
+		log.Warn().Field("err", err).Log("legion: error removing message from outbox")
+	}
+}
+
+// resumeOutbox restarts delivery of everything left in the outbox
+func (l *Legion) resumeOutbox() {
+	entries, err := l.outbox.All()
+	if err != nil {
+		log.Warn().Field("err", err).Log("legion: could not load outbox")
+		return
+	}
+	for _, e := range entries {
+		l.startDelivery(e)
+	}
+}
+
+// handleAck marks the delivery the ack is for as acknowledged, acks from
+// anyone but the message's recipient are ignored
+func (l *Legion) handleAck(p *Peer, m *transport.Message) {
+	if v, ok := l.deliveries.Load(deliveryKey{p.Remote(), m.MessageId}); ok {
+		d := v.(*delivery)
+		d.ackOnce.Do(func() { close(d.acked) })
+	}
+}
+
+// acknowledge acks a message that asked for it, and returns true if it is a
+// duplicate that should be dropped
+func (p *Peer) acknowledge(m *transport.Message) bool {
+	sender := ""
+	if p.local != nil {
+		sender = p.local().String()
+	}
+	p.QueueMessage(&transport.Message{Type: ackType, MessageId: m.MessageId, Sender: sender})
+
+	return p.isDuplicate != nil && p.isDuplicate(m.MessageId)
+}
+
+// newDedupWindow returns a window that remembers the last size IDs
+func newDedupWindow(size int) *dedupWindow {
+	return &dedupWindow{ids: make([]string, size), seen: make(map[string]struct{}, size)}
+}
+
+// dedupWindow remembers recently received message IDs
+type dedupWindow struct {
+	ids  []string
+	next int
+	seen map[string]struct{}
+	mux  sync.Mutex
+}
+
+// check returns true if the ID is in the window, otherwise it is added and
+// the oldest ID is forgotten
+func (w *dedupWindow) check(id string) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if _, ok := w.seen[id]; ok {
+		return true
+	}
+
+	if old := w.ids[w.next]; old != "" {
+		delete(w.seen, old)
+	}
+	w.ids[w.next] = id
+	w.seen[id] = struct{}{}
+	w.next = (w.next + 1) % len(w.ids)
+	return false
+}
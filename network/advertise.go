@@ -0,0 +1,145 @@
+package network
+
+import (
+	"net"
+
+	"github.com/gladiusio/legion/network/events"
+	"github.com/gladiusio/legion/network/transport"
+	"github.com/gladiusio/legion/utils"
+
+	log "github.com/gladiusio/legion/logger"
+)
+
+// defaultObservedAddressQuorum is used when the config doesn't set one
+const defaultObservedAddressQuorum = 2
+
+// maxObservations caps how many peers' observations we keep
+const maxObservations = 256
+
+// observation is the host a peer observed us at, seq orders observations so
+// ties between hosts are broken the same way every time
+type observation struct {
+	host string
+	seq  uint64
+}
+
+// defaultAdvertiseAddress picks an address to advertise when one isn't
+// configured. It is the bind address, unless that is bound to all interfaces
+// in which case the first non loopback interface address is used.
+func defaultAdvertiseAddress(bind utils.LegionAddress) utils.LegionAddress {
+	if bind.Network() != utils.SchemeTCP {
+		return bind
+	}
+
+	ip := net.ParseIP(bind.Host)
+	if bind.Host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return bind
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return bind
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return utils.NewLegionAddress(ipNet.IP.String(), bind.Port)
+		}
+	}
+
+	return bind
+}
+
+// setAdvertiseAddress changes the address we advertise and fires an event
+func (l *Legion) setAdvertiseAddress(address utils.LegionAddress) {
+	l.advertiseMu.Lock()
+	old := l.advertise
+	l.advertise = address
+	l.advertiseMu.Unlock()
+
+	log.Info().Field("old_addr", old.String()).Field("new_addr", address.String()).Log("legion: advertise address changed")
+	go l.FireNetworkEvent(events.AddressChangeEvent)
+}
+
+// handleHandshake is called when a peer sends us its handshake
+func (l *Legion) handleHandshake(p *Peer, hs *transport.Handshake) {
+	// A relayed peer observes the relay's side of the circuit, not us
+	if hs.ObservedAddress != "" && !p.relayedAs.IsValid() {
+		l.recordObservedAddress(p, hs.ObservedAddress)
+	}
+}
+
+// recordObservedAddress stores the host a peer sees us connecting from, and
+// if enough distinct peers agree on a host that we don't advertise, switches
+// our advertise address to it
+func (l *Legion) recordObservedAddress(p *Peer, observed string) {
+	if !l.config.DiscoverAdvertiseAddress {
+		return
+	}
+
+	// Only TCP connections have meaningful hosts to compare
+	remote, ok := p.session.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+
+	observedAddress, err := utils.ParseLegionAddress(observed)
+	if err != nil || net.ParseIP(observedAddress.Host) == nil {
+		return
+	}
+
+	quorum := l.config.ObservedAddressQuorum
+	if quorum <= 0 {
+		quorum = defaultObservedAddressQuorum
+	}
+
+	// Observations are keyed by the observer's host, so many connections from
+	// one host only count once. The oldest is forgotten to make room.
+	l.observationsMu.Lock()
+	observer := remote.IP.String()
+	previous, exists := l.observations[observer]
+	if !exists && len(l.observations) >= maxObservations {
+		oldest := ""
+		for k, o := range l.observations {
+			if oldest == "" || o.seq < l.observations[oldest].seq {
+				oldest = k
+			}
+		}
+		delete(l.observations, oldest)
+	}
+	if !exists || previous.host != observedAddress.Host {
+		l.observations[observer] = observation{host: observedAddress.Host, seq: l.observationSeq}
+		l.observationSeq++
+	}
+
+	// The host with the most votes wins, ties go to the host that was
+	// observed first
+	votes := make(map[string]int)
+	first := make(map[string]uint64)
+	for _, o := range l.observations {
+		votes[o.host]++
+		if seq, ok := first[o.host]; !ok || o.seq < seq {
+			first[o.host] = o.seq
+		}
+	}
+	consensus := ""
+	for host, count := range votes {
+		if count < quorum {
+			continue
+		}
+		if consensus == "" || count > votes[consensus] || (count == votes[consensus] && first[host] < first[consensus]) {
+			consensus = host
+		}
+	}
+	l.observationsMu.Unlock()
+
+	if consensus == "" {
+		return
+	}
+
+	me := l.Me()
+	if me.Network() != utils.SchemeTCP || me.MatchesHost(consensus) {
+		return
+	}
+
+	l.setAdvertiseAddress(utils.NewLegionAddress(consensus, me.Port))
+}
@@ -0,0 +1,107 @@
+package network
+
+import (
+	"sync"
+
+	"github.com/gladiusio/legion/network/transport"
+)
+
+// newMemoryBudget returns a budget of limit bytes, a limit of zero or less
+// returns nil which never limits
+func newMemoryBudget(limit int64) *memoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &memoryBudget{limit: limit, wake: make(chan struct{})}
+}
+
+// memoryBudget limits how many bytes can be allocated for messages being read
+// from a peer at once, readers wait for memory to be released if it's used up
+type memoryBudget struct {
+	limit int64
+	used  int64
+
+	// wake is closed and replaced whenever memory is released
+	wake chan struct{}
+	mux  sync.Mutex
+}
+
+// acquire reserves n bytes, waiting until they are available or done is
+// closed. It returns false if done was closed or n is larger than the limit.
+func (b *memoryBudget) acquire(n int64, done <-chan struct{}) bool {
+	if b == nil {
+		return true
+	}
+	if n > b.limit {
+		return false
+	}
+
+	for {
+		b.mux.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mux.Unlock()
+			return true
+		}
+		wake := b.wake
+		b.mux.Unlock()
+
+		select {
+		case <-wake:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// reserveUpTo reserves as much of max bytes as is free without waiting, and
+// returns how many it reserved. A nil budget always reserves max.
+func (b *memoryBudget) reserveUpTo(max int64) int64 {
+	if b == nil {
+		return max
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	n := b.limit - b.used
+	if n > max {
+		n = max
+	}
+	if n < 0 {
+		n = 0
+	}
+	b.used += n
+	return n
+}
+
+// release returns n bytes to the budget
+func (b *memoryBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.used -= n
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// holdMessage keeps n more bytes of the budget reserved for the message until
+// it is released
+func (p *Peer) holdMessage(m *transport.Message, n int64) {
+	if p.budget == nil || n == 0 {
+		return
+	}
+	if held, ok := p.reservations.Load(m); ok {
+		n += held.(int64)
+	}
+	p.reservations.Store(m, n)
+}
+
+// releaseMessage returns the memory held for the message to the budget
+func (p *Peer) releaseMessage(m *transport.Message) {
+	if held, ok := p.reservations.Load(m); ok {
+		p.reservations.Delete(m)
+		p.budget.release(held.(int64))
+	}
+}
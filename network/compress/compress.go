@@ -0,0 +1,123 @@
+/*
+Package compress contains a registry of codecs that legion can use to
+compress message bodies, peers negotiate which codec to use when they connect.
+*/
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Names of the built in codecs
+const (
+	Gzip    = "gzip"
+	Deflate = "deflate"
+)
+
+// ErrTooLarge is returned when a body decompresses to more than the allowed size
+var ErrTooLarge = errors.New("compress: decompressed body is too large")
+
+// Codec compresses and decompresses message bodies
+type Codec interface {
+	// Name is what the codec is registered and negotiated as
+	Name() string
+
+	Compress(data []byte) ([]byte, error)
+
+	// Decompress should return ErrTooLarge if the output would be
+	// larger than maxSize
+	Decompress(data []byte, maxSize int) ([]byte, error)
+}
+
+var (
+	codecs   = map[string]Codec{Gzip: &gzipCodec{}, Deflate: &deflateCodec{}}
+	codecsMu sync.RWMutex
+)
+
+// Register makes a codec available by its name, registering a name twice
+// replaces the previous codec
+func Register(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name()] = c
+}
+
+// Get returns the codec registered with the name
+func Get(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("compress: no codec registered with name: %s", name)
+	}
+	return c, nil
+}
+
+// readLimited reads all of r, erroring if there is more than maxSize bytes
+func readLimited(r io.Reader, maxSize int) ([]byte, error) {
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxSize {
+		return nil, ErrTooLarge
+	}
+	return out, nil
+}
+
+type gzipCodec struct{}
+
+func (*gzipCodec) Name() string { return Gzip }
+
+func (*gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (*gzipCodec) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
+
+type deflateCodec struct{}
+
+func (*deflateCodec) Name() string { return Deflate }
+
+func (*deflateCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (*deflateCodec) Decompress(data []byte, maxSize int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return readLimited(r, maxSize)
+}
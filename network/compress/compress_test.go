@@ -0,0 +1,43 @@
+package compress
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("legion"), 1000)
+	for _, name := range []string{Gzip, Deflate} {
+		c, err := Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		compressed, err := c.Compress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("%s did not compress the data", name)
+		}
+
+		out, err := c.Decompress(compressed, len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s round trip did not match", name)
+		}
+
+		_, err = c.Decompress(compressed, len(data)-1)
+		if err != ErrTooLarge {
+			t.Errorf("%s should have errored on a body over the max size, got: %v", name, err)
+		}
+	}
+}
+
+func TestUnknownCodec(t *testing.T) {
+	if _, err := Get("nope"); err == nil {
+		t.Error("expected an error for an unregistered codec")
+	}
+}
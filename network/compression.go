@@ -0,0 +1,106 @@
+package network
+
+import (
+	"github.com/gladiusio/legion/logger"
+	"github.com/gladiusio/legion/network/compress"
+	"github.com/gladiusio/legion/network/config"
+	"github.com/gladiusio/legion/network/transport"
+)
+
+// negotiateCompression picks the first of our codecs that the remote supports
+func (p *Peer) negotiateCompression(remoteCodecs []string) {
+	if p.compression == nil {
+		return
+	}
+
+	supported := make(map[string]bool, len(remoteCodecs))
+	for _, name := range remoteCodecs {
+		supported[name] = true
+	}
+
+	for _, name := range p.compression.Codecs {
+		if supported[name] {
+			if _, err := compress.Get(name); err == nil {
+				p.codec.Store(name)
+				return
+			}
+		}
+	}
+}
+
+// compressMessage returns a compressed copy of the message if a codec has
+// been negotiated and the body is over the threshold, if not it returns the
+// message as is. A copy is made since the same message may be sent to many peers.
+func (p *Peer) compressMessage(m *transport.Message) *transport.Message {
+	name := p.codec.Load()
+	if name == "" || m.Compression != "" {
+		return m
+	}
+
+	threshold := p.compression.Threshold
+	if threshold == 0 {
+		threshold = config.DefaultCompressionThreshold
+	}
+	if len(m.Body) < threshold {
+		return m
+	}
+
+	codec, err := compress.Get(name)
+	if err != nil {
+		return m
+	}
+
+	body, err := codec.Compress(m.Body)
+	if err != nil || len(body) >= len(m.Body) {
+		// Not worth sending compressed
+		return m
+	}
+
+	compressed := *m
+	compressed.Body = body
+	compressed.Compression = name
+	return &compressed
+}
+
+// inflate decompresses the message without using more memory than is left in
+// the peer's budget, the memory for the body stays reserved until the message
+// is released
+func (p *Peer) inflate(m *transport.Message) error {
+	if m.Compression == "" {
+		return nil
+	}
+
+	reserved := p.budget.reserveUpTo(int64(p.maxMessageSize))
+	if err := decompressMessage(m, int(reserved)); err != nil {
+		p.budget.release(reserved)
+		return err
+	}
+
+	used := int64(len(m.Body))
+	p.budget.release(reserved - used)
+	p.holdMessage(m, used)
+	return nil
+}
+
+// decompressMessage decompresses the body of the message in place, it must
+// not decompress to more than maxSize bytes
+func decompressMessage(m *transport.Message, maxSize int) error {
+	if m.Compression == "" {
+		return nil
+	}
+
+	codec, err := compress.Get(m.Compression)
+	if err != nil {
+		return err
+	}
+
+	body, err := codec.Decompress(m.Body, maxSize)
+	if err != nil {
+		logger.Debug().Field("codec", m.Compression).Field("err", err.Error()).Log("peer: could not decompress message")
+		return err
+	}
+
+	m.Body = body
+	m.Compression = ""
+	return nil
+}
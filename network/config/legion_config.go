@@ -1,6 +1,10 @@
 package config
 
 import (
+	"time"
+
+	"github.com/gladiusio/legion/network/outbox"
+	"github.com/gladiusio/legion/network/peerstore"
 	"github.com/gladiusio/legion/utils"
 )
 
@@ -8,4 +12,305 @@ import (
 type LegionConfig struct {
 	BindAddress      utils.LegionAddress
 	AdvertiseAddress utils.LegionAddress
+
+	// Session tunes the multiplexed session opened with each peer, if nil
+	// the multiplexer defaults are used
+	Session *SessionConfig
+
+	// Multiplexer is the name of the registered stream multiplexer to use,
+	// defaults to yamux. Both sides of a connection must use the same one.
+	Multiplexer string
+
+	// StreamReuse sends all outgoing messages to a peer over one persistent
+	// stream instead of opening a new stream per message. Messages on that
+	// stream are written and read in the order the send loop dequeues them,
+	// but since QueueMessage is asynchronous, messages queued concurrently
+	// have no defined order, and delivery to the framework is concurrent.
+	StreamReuse bool
+
+	// Compression enables compressing message bodies to peers that support
+	// it, if nil messages are always sent uncompressed
+	Compression *CompressionConfig
+
+	// DiscoverAdvertiseAddress updates the advertise address at runtime
+	// to the host our peers observe us connecting from, once enough of
+	// them agree. If AdvertiseAddress is empty the bind address is used to
+	// start with, or a local interface address if bound to all interfaces.
+	DiscoverAdvertiseAddress bool
+
+	// ObservedAddressQuorum is how many distinct peers must report the same
+	// host before the advertise address is changed, zero uses 2
+	ObservedAddressQuorum int
+
+	// SenderMismatchPolicy decides what happens when the host a message says
+	// it was sent from isn't the host of the connection it came from
+	SenderMismatchPolicy MismatchPolicy
+
+	// RelayEnabled lets peers that can't accept connections register with
+	// us, and relays connections from other peers to them. A peer uses a
+	// relay by setting its AdvertiseAddress to a relay address like
+	// "relay://relayhost:port/ourhost:port".
+	RelayEnabled bool
+
+	// RelayRetryInterval is how long a peer that advertises a relay address
+	// waits to register again after its session to the relay fails or
+	// drops. Zero uses DefaultRelayRetryInterval.
+	RelayRetryInterval time.Duration
+
+	// PeerStore records the peers we connect to, their last seen time,
+	// connection results and bans. If nil nothing is recorded. Legion
+	// doesn't close the store when stopped.
+	PeerStore peerstore.PeerStore
+
+	// RedialPeers is how many known-good peers from the PeerStore are dialed
+	// when Listen is called, zero dials none
+	RedialPeers int
+
+	// RedialMaxAge skips peers that haven't been seen for longer than this
+	// when redialing, zero redials peers of any age
+	RedialMaxAge time.Duration
+
+	// RateLimit limits the messages each peer can send us, messages are
+	// checked before they are passed to the framework's ValidateMessage and
+	// each connection has its own buckets. If nil messages aren't limited.
+	RateLimit *RateLimitConfig
+
+	// Ack configures acknowledged delivery with Legion.SendAcked, if nil
+	// the defaults are used
+	Ack *AckConfig
+
+	// Priorities decides which outgoing messages a peer's send loop services
+	// first, if nil the default classes and weights are used
+	Priorities *PriorityConfig
+
+	// Heartbeat configures the pings used to measure each peer's latency
+	// and liveness, if nil the defaults are used
+	Heartbeat *HeartbeatConfig
+
+	// Capabilities are advertised to peers in the handshake along with
+	// legion's own, so frameworks can tell which protocols a peer speaks
+	Capabilities []string
+
+	// MaxMessageSize is the largest message in bytes we accept from a peer,
+	// zero uses DefaultMaxMessageSize. Compressed bodies are also limited to
+	// this size once decompressed.
+	MaxMessageSize int
+
+	// MaxPeerMemory is how many bytes a single peer's messages can hold
+	// across all of its streams, from when they're read until they are
+	// handed to the framework or dropped. Reads wait for memory to free up
+	// once it's used, and a message larger than the whole budget is
+	// rejected, so raise it along with MaxMessageSize to accept messages
+	// larger than DefaultMaxPeerMemory. A compressed body is only inflated into the
+	// memory left in the budget, and is rejected if it doesn't fit. Zero
+	// uses DefaultMaxPeerMemory, and a negative value doesn't limit memory.
+	MaxPeerMemory int64
+}
+
+// Defaults used when the message size limits are zero
+const (
+	DefaultMaxMessageSize       = 1e+8
+	DefaultMaxPeerMemory  int64 = 16 << 20
+)
+
+// DefaultRelayRetryInterval is used when RelayRetryInterval is zero
+const DefaultRelayRetryInterval = 5 * time.Second
+
+// Defaults used when the HeartbeatConfig fields are zero
+const (
+	DefaultHeartbeatInterval = 10 * time.Second
+	DefaultHeartbeatTimeout  = 5 * time.Second
+	DefaultDegradedAfter     = 3
+)
+
+// HeartbeatConfig configures the pings sent to every peer
+type HeartbeatConfig struct {
+	// Disabled turns off the pings, peer stats will have no samples
+	Disabled bool
+
+	// Interval is how often a peer is pinged
+	Interval time.Duration
+
+	// Timeout is how long to wait for a pong before the ping is missed
+	Timeout time.Duration
+
+	// DegradedAfter is how many pings in a row can be missed before the
+	// peer is marked as degraded, it recovers on the next pong
+	DegradedAfter int
+}
+
+// Priority is the class of an outgoing message
+type Priority int
+
+// The available priority classes
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+	PriorityBulk
+
+	// NumPriorities is the number of priority classes
+	NumPriorities = 3
+)
+
+// DefaultMaxConcurrentSends is used when MaxConcurrentSends is zero
+const DefaultMaxConcurrentSends = 8
+
+// PriorityConfig configures the send loop scheduler. Replies to requests and
+// legion's internal messages are always high priority, and a framework can
+// set the priority of its own message types.
+type PriorityConfig struct {
+	// Classes maps a message type prefix to its priority, the longest
+	// matching prefix wins and anything unmatched is PriorityNormal. They
+	// take precedence over the classes set by the framework.
+	Classes map[string]Priority
+
+	// MaxConcurrentSends is how many messages are written to a peer at once
+	// when each message gets its own stream, the rest wait in the priority
+	// queues. Zero uses DefaultMaxConcurrentSends.
+	MaxConcurrentSends int
+
+	// Weights is how many messages of each class are sent, relative to the
+	// others, when every class has messages waiting. A class missing from the
+	// map uses its default weight: 8 high, 4 normal and 1 bulk.
+	Weights map[Priority]int
+}
+
+// Defaults used when the AckConfig fields are zero
+const (
+	DefaultAckTimeout  = 2 * time.Second
+	DefaultDedupWindow = 4096
+)
+
+// AckConfig configures acknowledged delivery
+type AckConfig struct {
+	// Timeout is how long to wait for an ack before retransmitting
+	Timeout time.Duration
+
+	// MaxAttempts is how many times a message is sent before giving up,
+	// zero retransmits until it is acked or expires
+	MaxAttempts int
+
+	// TTL is how long a message is retransmitted for, zero never expires
+	TTL time.Duration
+
+	// DedupWindow is how many received message IDs are remembered so
+	// retransmitted duplicates are dropped
+	DedupWindow int
+
+	// Outbox stores the messages waiting for an ack, use a persistent one so
+	// they are retransmitted after a restart. If nil an in memory outbox is
+	// used. Legion doesn't close the outbox when stopped.
+	Outbox outbox.Outbox
+}
+
+// RateLimitAction is what to do with a message that is over the rate limit
+type RateLimitAction int
+
+// The available actions
+const (
+	// RateLimitDrop drops the message
+	RateLimitDrop RateLimitAction = iota
+
+	// RateLimitDelay holds the message until it is within the limit, unless
+	// that would take longer than MaxDelay in which case it is dropped
+	RateLimitDelay
+
+	// RateLimitDisconnect drops the message and disconnects the peer
+	RateLimitDisconnect
+
+	// RateLimitPenalize drops the message and adds to the peer's penalty
+	// score, once the score reaches PenaltyThreshold the peer is banned if
+	// there is a PeerStore, or disconnected if not
+	RateLimitPenalize
+)
+
+// Defaults used when the RateLimitConfig fields are zero
+const (
+	DefaultRateLimitMaxDelay  = time.Second
+	DefaultPenaltyThreshold   = 10
+	DefaultPenaltyBanDuration = 10 * time.Minute
+)
+
+// RateLimitConfig configures the token buckets that limit incoming messages.
+// The buckets and penalty score are kept per remote host, so every connection
+// from a host shares them, and are forgotten once the host has been idle for
+// a while.
+type RateLimitConfig struct {
+	// PerPeer limits all messages from a peer, if nil there is no overall limit
+	PerPeer *Limit
+
+	// PerType limits messages of a type from a peer, keyed by message type
+	PerType map[string]Limit
+
+	// Action is what to do with a message over a limit
+	Action RateLimitAction
+
+	// MaxDelay is the longest a message is held with RateLimitDelay
+	MaxDelay time.Duration
+
+	// PenaltyThreshold is how many messages over the limit a peer can send
+	// before it is banned with RateLimitPenalize
+	PenaltyThreshold int
+
+	// PenaltyBanDuration is how long a penalized peer is banned for
+	PenaltyBanDuration time.Duration
+}
+
+// Limit is a token bucket, Rate tokens are added per second up to Burst and
+// each message takes one. A Burst of zero uses the rate.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// MismatchPolicy is what to do with a message whose reported sender host
+// differs from the host of the connection it arrived on
+type MismatchPolicy int
+
+// The available policies
+const (
+	// MismatchDisconnect drops the message and disconnects the peer
+	MismatchDisconnect MismatchPolicy = iota
+
+	// MismatchDrop drops the message but keeps the connection open
+	MismatchDrop
+
+	// MismatchAllow accepts the message, useful when peers are behind NAT
+	MismatchAllow
+)
+
+// DefaultCompressionThreshold is used when CompressionConfig.Threshold is zero
+const DefaultCompressionThreshold = 1024
+
+// CompressionConfig configures which codecs are negotiated with peers
+type CompressionConfig struct {
+	// Codecs are the names of registered codecs in order of preference,
+	// the first one the remote also supports is used
+	Codecs []string
+
+	// Threshold is the body size in bytes below which messages are sent
+	// uncompressed, zero uses DefaultCompressionThreshold
+	Threshold int
+}
+
+// SessionConfig tunes the multiplexed session that is opened with a peer.
+// Any field left as its zero value will use the multiplexer's default.
+type SessionConfig struct {
+	// AcceptBacklog is how many incoming streams can be waiting to be
+	// accepted before new streams are blocked
+	AcceptBacklog int
+
+	// DisableKeepAlive turns off the keepalive pings sent over the session
+	DisableKeepAlive bool
+
+	// KeepAliveInterval is how often a keepalive ping is sent to the remote
+	KeepAliveInterval time.Duration
+
+	// ConnectionWriteTimeout is how long a write to the underlying connection
+	// can block before the session is considered dead
+	ConnectionWriteTimeout time.Duration
+
+	// MaxStreamWindowSize is the maximum receive window of a single stream,
+	// raising it helps throughput on links with a high bandwidth delay product
+	MaxStreamWindowSize uint32
 }
@@ -13,6 +13,10 @@ type MessageContext struct {
 	Sender  utils.LegionAddress
 	Message *transport.Message
 	Legion  *Legion
+
+	// Peer is the peer the message arrived from, nil if the event wasn't
+	// fired for a message from a peer
+	Peer *Peer
 }
 
 // Reply is a helper method to reply to an incoming message
@@ -21,7 +25,7 @@ func (mc *MessageContext) Reply(msg *transport.Message) error {
 	if mc.Message.IsRequest {
 		p, exists := mc.Legion.peers.Load(mc.Sender)
 		if exists {
-			p.(*Peer).QueueReply(mc.Message.RpcId, msg)
+			p.QueueReply(mc.Message.RpcId, msg)
 		} else {
 			return errors.New("legion: error sending reply to peer")
 		}
@@ -0,0 +1,23 @@
+package network
+
+import (
+	"net"
+
+	"github.com/gladiusio/legion/utils"
+)
+
+// listen listens on the address using the transport its scheme specifies
+func listen(address utils.LegionAddress) (net.Listener, error) {
+	if address.Network() == utils.SchemeMem {
+		return memListen(address.DialString())
+	}
+	return net.Listen(address.Network(), address.DialString())
+}
+
+// dial connects to the address using the transport its scheme specifies
+func dial(address utils.LegionAddress) (net.Conn, error) {
+	if address.Network() == utils.SchemeMem {
+		return memDial(address.DialString())
+	}
+	return net.Dial(address.Network(), address.DialString())
+}
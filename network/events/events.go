@@ -28,4 +28,5 @@ type NetworkEvent int
 const (
 	StartupEvent NetworkEvent = iota
 	CloseEvent
+	AddressChangeEvent
 )
@@ -1,5 +1,7 @@
 package network
 
+import "github.com/gladiusio/legion/network/config"
+
 // Framework is an interface that allows you to modify the underlying communication
 // of legion
 type Framework interface {
@@ -18,6 +20,21 @@ type Framework interface {
 	Close(*NetworkContext)
 }
 
+// AddressFramework can be implemented by a framework to be told when the
+// address returned by Legion.Me() changes
+type AddressFramework interface {
+	Framework
+	AddressChanged(*NetworkContext)
+}
+
+// PriorityFramework can be implemented by a framework to set the send
+// priority of its message types by prefix, the config's PriorityConfig takes
+// precedence for any prefix it also maps
+type PriorityFramework interface {
+	Framework
+	MessagePriorities() map[string]config.Priority
+}
+
 // GenericFramework is a type used to expose methods so a framework doesn't need
 // to have all of the required methods (it is also used as the default framework)
 type GenericFramework struct{}
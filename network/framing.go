@@ -0,0 +1,85 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/gladiusio/legion/network/config"
+	"github.com/gladiusio/legion/network/transport"
+	"github.com/gogo/protobuf/proto"
+)
+
+// errOverBudget is returned when a message is larger than the peer's whole
+// memory budget, or the peer closed while waiting for memory
+var errOverBudget = errors.New("framing: message does not fit in the memory budget")
+
+// writeMessage writes a message to the writer prefixed by its length
+func writeMessage(w io.Writer, m *transport.Message) error {
+	messageBytes, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+
+	buffer := make([]byte, 4, 4+len(messageBytes))
+	binary.BigEndian.PutUint32(buffer, uint32(len(messageBytes)))
+
+	buffer = append(buffer, messageBytes...)
+
+	bw := bufio.NewWriter(w)
+	_, err = bw.Write(buffer)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readMessage reads a single length prefixed message from the reader with the
+// default size limit, it returns io.EOF if the reader is closed before a new
+// message starts
+func readMessage(r io.Reader) (*transport.Message, error) {
+	m, _, err := readMessageLimited(r, config.DefaultMaxMessageSize, nil, nil)
+	return m, err
+}
+
+// readMessageLimited reads a single length prefixed message of at most
+// maxSize bytes. The memory for the message is taken from the budget, and on
+// success stays reserved until the caller releases the returned size, done
+// stops the wait for memory.
+func readMessageLimited(r io.Reader, maxSize int, budget *memoryBudget, done <-chan struct{}) (*transport.Message, int64, error) {
+	// Read the message size header
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Convert it into an int
+	size := binary.BigEndian.Uint32(header)
+	if size == 0 || uint64(size) > uint64(maxSize) {
+		return nil, 0, errors.New("framing: invalid message size")
+	}
+
+	if !budget.acquire(int64(size), done) {
+		return nil, 0, errOverBudget
+	}
+
+	// Allocate the message size and read into the buffer
+	buffer := make([]byte, size)
+	_, err = io.ReadFull(r, buffer)
+	if err != nil {
+		budget.release(int64(size))
+		return nil, 0, err
+	}
+
+	// Unmarshal the message
+	m := &transport.Message{}
+	err = proto.Unmarshal(buffer, m)
+	if err != nil {
+		budget.release(int64(size))
+		return nil, 0, err
+	}
+
+	return m, int64(size), nil
+}
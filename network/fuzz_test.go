@@ -0,0 +1,88 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/gladiusio/legion/network/transport"
+)
+
+func frame(body []byte) []byte {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(body)))
+	return append(header, body...)
+}
+
+func FuzzReadMessage(f *testing.F) {
+	var buf bytes.Buffer
+	writeMessage(&buf, &transport.Message{Type: "test", Sender: "localhost:6000", Body: []byte("body"), RpcId: 1})
+	f.Add(buf.Bytes())
+	f.Add(frame(nil))
+	f.Add(frame([]byte{0xff, 0xff, 0xff}))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		budget := newMemoryBudget(1 << 16)
+		m, size, err := readMessageLimited(bytes.NewReader(data), 1<<16, budget, nil)
+		if err != nil {
+			if budget.used != 0 {
+				t.Fatalf("budget leaked %d bytes", budget.used)
+			}
+			return
+		}
+		budget.release(size)
+
+		// Anything we read must survive being written and read again
+		var out bytes.Buffer
+		if err := writeMessage(&out, m); err != nil {
+			t.Fatal(err)
+		}
+		if out.Len() > 4 {
+			_, size, err := readMessageLimited(&out, 1<<16, budget, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			budget.release(size)
+		}
+
+		if budget.used != 0 {
+			t.Fatalf("budget leaked %d bytes", budget.used)
+		}
+	})
+}
+
+func FuzzMessageUnmarshal(f *testing.F) {
+	b, _ := (&transport.Message{Type: "test", Sender: "localhost:6000", Body: []byte("body"), MessageId: "id", AckRequested: true}).Marshal()
+	f.Add(b)
+	b, _ = (&transport.Handshake{Capabilities: []string{CapabilityAck, CapabilityPing}}).Marshal()
+	f.Add(b)
+	f.Add([]byte{0x0a, 0xff, 0xff, 0xff, 0xff, 0x0f})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := &transport.Message{}
+		if err := m.Unmarshal(data); err != nil {
+			return
+		}
+		b, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		again := &transport.Message{}
+		if err := again.Unmarshal(b); err != nil {
+			t.Fatal(err)
+		}
+		b2, err := again.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, b2) {
+			t.Fatal("message changed after a round trip")
+		}
+
+		// Handshakes are decoded from the body of a message
+		h := &transport.Handshake{}
+		h.Unmarshal(m.Body)
+	})
+}
@@ -0,0 +1,71 @@
+package network
+
+import (
+	"github.com/gladiusio/legion/logger"
+	"github.com/gladiusio/legion/network/config"
+	"github.com/gladiusio/legion/network/transport"
+)
+
+// handshakeType is the message type of the handshake both sides of a
+// session send when it is established, it is never passed to the framework
+const handshakeType = "legion.handshake"
+
+// buildHandshake creates the handshake we send to every peer
+func buildHandshake(conf *config.LegionConfig) *transport.Handshake {
+	hs := &transport.Handshake{Capabilities: capabilities(conf)}
+	if conf.Compression != nil {
+		hs.Compression = conf.Compression.Codecs
+	}
+	return hs
+}
+
+// sendHandshake queues our handshake to the remote if we have one
+func (p *Peer) sendHandshake() {
+	if p.handshake == nil {
+		return
+	}
+
+	// Tell the remote what address we see it at
+	hs := *p.handshake
+	hs.ObservedAddress = p.session.RemoteAddr().String()
+
+	body, err := hs.Marshal()
+	if err != nil {
+		logger.Warn().Field("err", err.Error()).Log("peer: error marshalling handshake")
+		return
+	}
+	sender := ""
+	if p.local != nil {
+		sender = p.local().String()
+	}
+	p.QueueMessage(&transport.Message{Type: handshakeType, Body: body, Sender: sender})
+}
+
+// handleControl handles any messages that are internal to legion, it returns
+// true if the message was consumed
+func (p *Peer) handleControl(m *transport.Message) bool {
+	switch m.Type {
+	case handshakeType:
+		hs := &transport.Handshake{}
+		if err := hs.Unmarshal(m.Body); err != nil {
+			logger.Debug().Field("err", err.Error()).Log("peer: could not decode handshake")
+			return true
+		}
+		p.setCapabilities(hs.Capabilities)
+		p.negotiateCompression(hs.Compression)
+		if p.onHandshake != nil {
+			p.onHandshake(p, hs)
+		}
+		return true
+	case pingType:
+		p.handlePing(m)
+		return true
+	case ackType:
+		if p.onAck != nil {
+			p.onAck(p, m)
+		}
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,209 @@
+package network
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/network/config"
+	"github.com/gladiusio/legion/network/transport"
+	"github.com/gladiusio/legion/utils"
+)
+
+// The message types of the heartbeat, a ping is sent as a request and the
+// pong is its reply
+const (
+	pingType = "legion.ping"
+	pongType = "legion.pong"
+)
+
+// How much each new sample moves the averages, the same gains TCP uses
+const (
+	rttGain    = 0.125
+	jitterGain = 0.25
+)
+
+// PeerStats is the latency and liveness of a peer measured by the heartbeat
+type PeerStats struct {
+	// RTT is the moving average of the round trip time, and Jitter is the
+	// moving average of how much it varies between pings
+	RTT    time.Duration
+	Jitter time.Duration
+
+	// LastRTT is the most recent round trip time
+	LastRTT time.Duration
+
+	// LastPong is when the peer last answered a ping
+	LastPong time.Time
+
+	// Samples is how many pongs have been received
+	Samples int
+
+	// MissedPings is how many pings in a row the peer hasn't answered
+	MissedPings int
+
+	// Degraded is true once too many pings in a row were missed
+	Degraded bool
+}
+
+// Measured returns true if the peer has answered a ping and isn't degraded.
+// Unlike the Healthy filter it excludes peers that haven't been pinged yet.
+func (s PeerStats) Measured() bool {
+	return s.Samples > 0 && !s.Degraded
+}
+
+// peerStats holds the live stats of a peer
+type peerStats struct {
+	stats PeerStats
+	mux   sync.RWMutex
+}
+
+// Stats returns the latency and liveness of the peer
+func (p *Peer) Stats() PeerStats {
+	p.stats.mux.RLock()
+	defer p.stats.mux.RUnlock()
+	return p.stats.stats
+}
+
+// recordPong adds a round trip time to the stats
+func (p *Peer) recordPong(rtt time.Duration) {
+	p.stats.mux.Lock()
+	s := &p.stats.stats
+	changed := s.Degraded
+	if s.Samples == 0 {
+		s.RTT = rtt
+		s.Jitter = rtt / 2
+	} else {
+		diff := rtt - s.LastRTT
+		if diff < 0 {
+			diff = -diff
+		}
+		s.Jitter += time.Duration(jitterGain * float64(diff-s.Jitter))
+		s.RTT += time.Duration(rttGain * float64(rtt-s.RTT))
+	}
+	s.LastRTT = rtt
+	s.LastPong = time.Now()
+	s.Samples++
+	s.MissedPings = 0
+	s.Degraded = false
+	p.stats.mux.Unlock()
+
+	if changed {
+		p.healthChanged()
+	}
+}
+
+// recordMissedPing counts a ping that wasn't answered in time
+func (p *Peer) recordMissedPing(degradedAfter int) {
+	p.stats.mux.Lock()
+	s := &p.stats.stats
+	s.MissedPings++
+	changed := !s.Degraded && s.MissedPings >= degradedAfter
+	if changed {
+		s.Degraded = true
+	}
+	p.stats.mux.Unlock()
+
+	if changed {
+		p.healthChanged()
+	}
+}
+
+// healthChanged is called without the stats lock held once the peer became
+// degraded or recovered
+func (p *Peer) healthChanged() {
+	if p.onHealthChange != nil {
+		p.onHealthChange(p)
+	}
+}
+
+// startHeartbeat pings the remote until the peer is closed
+func (p *Peer) startHeartbeat() {
+	conf := p.heartbeat
+	if conf == nil || conf.Disabled {
+		return
+	}
+
+	interval, timeout, degradedAfter := conf.Interval, conf.Timeout, conf.DegradedAfter
+	if interval == 0 {
+		interval = config.DefaultHeartbeatInterval
+	}
+	if timeout == 0 {
+		timeout = config.DefaultHeartbeatTimeout
+	}
+	if degradedAfter == 0 {
+		degradedAfter = config.DefaultDegradedAfter
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.ping(timeout, degradedAfter)
+			case <-p.closed:
+				return
+			}
+		}
+	}()
+}
+
+// ping sends a single ping and records the result
+func (p *Peer) ping(timeout time.Duration, degradedAfter int) {
+	sender := ""
+	if p.local != nil {
+		sender = p.local().String()
+	}
+
+	start := time.Now()
+	_, err := p.Request(timeout, &transport.Message{Type: pingType, Sender: sender})
+	if err != nil {
+		select {
+		case <-p.closed:
+		default:
+			p.recordMissedPing(degradedAfter)
+		}
+		return
+	}
+	p.recordPong(time.Since(start))
+}
+
+// handlePing answers a ping from the remote
+func (p *Peer) handlePing(m *transport.Message) {
+	sender := ""
+	if p.local != nil {
+		sender = p.local().String()
+	}
+	p.QueueReply(m.RpcId, &transport.Message{Type: pongType, Sender: sender})
+}
+
+// PeerStats returns the stats of the connected peer at the address
+func (l *Legion) PeerStats(address utils.LegionAddress) (PeerStats, bool) {
+	p, ok := l.peers.Load(address)
+	if !ok {
+		return PeerStats{}, false
+	}
+	return p.Stats(), true
+}
+
+// LowestLatencyPeers returns up to n measured peers with the lowest average
+// round trip time, lowest first. A negative n returns all of them.
+func (l *Legion) LowestLatencyPeers(n int) []*Peer {
+	peers := make([]*Peer, 0)
+	stats := make(map[*Peer]PeerStats)
+	l.DoAllPeers(func(p *Peer) {
+		s := p.Stats()
+		if s.Measured() {
+			peers = append(peers, p)
+			stats[p] = s
+		}
+	})
+
+	sort.Slice(peers, func(i, j int) bool { return stats[peers[i]].RTT < stats[peers[j]].RTT })
+
+	if n >= 0 && len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
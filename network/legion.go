@@ -1,14 +1,16 @@
 package network
 
 import (
+	"context"
 	"errors"
-	"math/rand"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/gladiusio/legion/network/config"
 	"github.com/gladiusio/legion/network/events"
+	"github.com/gladiusio/legion/network/mux"
+	"github.com/gladiusio/legion/network/outbox"
 	"github.com/gladiusio/legion/network/transport"
 	"github.com/gladiusio/legion/utils"
 
@@ -23,18 +25,52 @@ func NewLegion(conf *config.LegionConfig, f Framework) *Legion {
 		log.Warn().Log("legion: using generic framework for validation")
 		f = &GenericFramework{}
 	}
-	return &Legion{
-		peers:     &sync.Map{},
-		config:    conf,
-		started:   make(chan struct{}),
-		framework: f,
+
+	muxName := conf.Multiplexer
+	if muxName == "" {
+		muxName = mux.Yamux
+	}
+	m, err := mux.Get(muxName)
+	if err != nil {
+		log.Warn().Field("err", err).Log("legion: using yamux multiplexer")
+		m, _ = mux.Get(mux.Yamux)
+	}
+
+	advertise := conf.AdvertiseAddress
+	if advertise == (utils.LegionAddress{}) {
+		advertise = defaultAdvertiseAddress(conf.BindAddress)
 	}
+
+	ob := outbox.Outbox(outbox.NewMemoryOutbox())
+	if conf.Ack != nil && conf.Ack.Outbox != nil {
+		ob = conf.Ack.Outbox
+	}
+
+	l := &Legion{
+		peers:        NewPeerSet(),
+		config:       conf,
+		started:      make(chan struct{}),
+		stopped:      make(chan struct{}),
+		framework:    f,
+		muxer:        m,
+		advertise:    advertise,
+		observations: make(map[string]observation),
+		relayTargets: make(map[utils.LegionAddress]*Peer),
+		limiters:     make(map[string]*rateLimiter),
+		rateLimitMetrics: rateLimitMetrics{
+			byType: make(map[string]uint64),
+		},
+		outbox: ob,
+	}
+	l.dedup = newDedupWindow(l.ackSettings().DedupWindow)
+
+	return l
 }
 
 // Legion is a type with methods to interface with the network
 type Legion struct {
-	// All connected peers stored as: [LegionAddress -> Peer]
-	peers *sync.Map
+	// All connected peers
+	peers *PeerSet
 
 	// Which framework legion is using
 	framework Framework
@@ -42,16 +78,55 @@ type Legion struct {
 	// Our config type
 	config *config.LegionConfig
 
+	// The multiplexer used for all peer sessions
+	muxer mux.Muxer
+
+	// The address we advertise to peers, it can change at runtime
+	advertise   utils.LegionAddress
+	advertiseMu sync.RWMutex
+
+	// The host each peer has observed us at, keyed by the peer's host, and
+	// the sequence number of the next observation
+	observations   map[string]observation
+	observationSeq uint64
+	observationsMu sync.Mutex
+
+	// Peers we relay connections to, and the session to the relay we
+	// registered with if we are only reachable through one
+	relayTargets map[utils.LegionAddress]*Peer
+	relayPeer    *Peer
+	relayMux     sync.Mutex
+
+	// The rate limiter of each host peers connect from, when they were last
+	// swept for idle hosts, and counters for messages that went through them
+	limiters         map[string]*rateLimiter
+	limitersSwept    time.Time
+	limitersMux      sync.Mutex
+	rateLimitMetrics rateLimitMetrics
+
+	// Messages waiting for an ack, the deliveries in progress by recipient
+	// and message ID, and the IDs of messages we've recently received
+	outbox     outbox.Outbox
+	deliveries sync.Map
+	dedup      *dedupWindow
+
 	// started is a channel that blocks until Listen() completes
 	started chan struct{}
 
+	// stopped is closed when Stop() is called so the accept loop can exit
+	stopped  chan struct{}
+	stopOnce sync.Once
+
 	// listener is the network listener that legion listens for new connections on
 	listener net.Listener
 }
 
-// Me returns the local bindaddress
+// Me returns the address we advertise to peers, this starts as the configured
+// advertise address but can change if address discovery is enabled
 func (l *Legion) Me() utils.LegionAddress {
-	return l.config.AdvertiseAddress
+	l.advertiseMu.RLock()
+	defer l.advertiseMu.RUnlock()
+	return l.advertise
 }
 
 // Broadcast sends the message to all peers, unless a
@@ -62,26 +137,21 @@ func (l *Legion) Broadcast(message *transport.Message, addresses ...utils.Legion
 
 	// Send to all peers
 	if len(addresses) == 0 {
-		l.peers.Range(func(k, v interface{}) bool { v.(*Peer).QueueMessage(message); return true })
+		l.peers.Range(func(p *Peer) bool { p.QueueMessage(message); return true })
 		return
 	}
 
 	// If they provided addresses, we can send to those
 	for _, address := range addresses {
 		if p, ok := l.peers.Load(address); ok {
-			p.(*Peer).QueueMessage(message)
+			p.QueueMessage(message)
 		} else {
 			err := l.AddPeer(address)
 			if err != nil {
 				log.Warn().Field("err", err).Log("Error adding new peer in from broadcast call")
 			}
-			p, exists := l.peers.Load(address)
-			if !exists {
-				log.Warn().Log("Error sending message to peer, it may have disconnected")
-			}
-
-			toSend, ok := p.(*Peer)
-			if ok {
+			toSend, exists := l.peers.Load(address)
+			if exists {
 				toSend.QueueMessage(message)
 			} else {
 				log.Warn().Log("Error sending message to peer, it may have disconnected")
@@ -92,11 +162,30 @@ func (l *Legion) Broadcast(message *transport.Message, addresses ...utils.Legion
 
 // Request sends a request message to the specified peer
 func (l *Legion) Request(message *transport.Message, timeout time.Duration, address utils.LegionAddress) (*transport.Message, error) {
+	p, err := l.requestPeer(address)
+	if err != nil {
+		return nil, err
+	}
+	return p.Request(timeout, message)
+}
+
+// RequestContext sends a request message to the specified peer and waits for
+// the reply until the context is done
+func (l *Legion) RequestContext(ctx context.Context, message *transport.Message, address utils.LegionAddress) (*transport.Message, error) {
+	p, err := l.requestPeer(address)
+	if err != nil {
+		return nil, err
+	}
+	return p.RequestContext(ctx, message)
+}
+
+// requestPeer returns the peer at the address, dialing it if needed
+func (l *Legion) requestPeer(address utils.LegionAddress) (*Peer, error) {
 	// Wait until we're listening
 	l.Started()
 
 	if p, ok := l.peers.Load(address); ok {
-		return p.(*Peer).Request(timeout, message)
+		return p, nil
 	}
 
 	err := l.AddPeer(address)
@@ -106,7 +195,7 @@ func (l *Legion) Request(message *transport.Message, timeout time.Duration, addr
 	}
 	p, exists := l.peers.Load(address)
 	if exists {
-		return p.(*Peer).Request(timeout, message)
+		return p, nil
 	}
 
 	// We couldn't find the peer (could have disconnected etc)
@@ -118,32 +207,42 @@ func (l *Legion) BroadcastRandom(message *transport.Message, n int) {
 	// Wait until we're listening
 	l.Started()
 
-	// sync.Map doesn't store length, so we get n random like this
-	addrs := make([]utils.LegionAddress, 0, 100)
-	l.peers.Range(func(key, value interface{}) bool { addrs = append(addrs, key.(utils.LegionAddress)); return true })
-
-	if n > len(addrs) || n <= 1 {
+	if n > l.peers.Len() || n <= 1 {
 		l.Broadcast(message)
 		return
 	}
 
-	// addrs contains all peers addresses now, lets select N random
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	for i := 0; i < n; i++ {
-		rn := r.Intn(len(addrs) - 1)
-		l.Broadcast(message, addrs[rn])
-		addrs = append(addrs[:rn], addrs[rn+1:]...) // Cut out i to stop repeat broadcasts
+	// Peers that are missing pings are only picked if there aren't enough others
+	for _, p := range l.peers.sampleHealthyFirst(n) {
+		p.QueueMessage(message)
 	}
 }
 
 // AddPeer adds the specified peer(s) to the network by dialing it and
 // opening a stream, as well as adding it to the list of all peers.
 func (l *Legion) AddPeer(addresses ...utils.LegionAddress) error {
+	return l.AddPeerWithConfig(nil, addresses...)
+}
+
+// AddPeerWithConfig is the same as AddPeer, but the session with the peer(s)
+// is tuned with the provided config instead of the one in the LegionConfig.
+// A nil config falls back to the LegionConfig session settings.
+func (l *Legion) AddPeerWithConfig(sessionConfig *config.SessionConfig, addresses ...utils.LegionAddress) error {
+	if sessionConfig == nil {
+		sessionConfig = l.config.Session
+	}
+
 	var result *multierror.Error
 	for _, address := range addresses {
 		// Make sure the peer isn't already added or ourselves
 		if _, ok := l.peers.Load(address); !ok && address != l.Me() {
-			p, err := l.createAndDialPeer(address)
+			if l.isBanned(address) {
+				result = multierror.Append(result, ErrPeerBanned)
+				continue
+			}
+
+			p, err := l.createAndDialPeer(address, sessionConfig)
+			l.recordDial(address, err)
 			if err != nil {
 				log.Warn().Field("err", err).Log("Error adding peer")
 				result = multierror.Append(result, err)
@@ -163,12 +262,11 @@ func (l *Legion) DeletePeer(addresses ...utils.LegionAddress) error {
 	var result *multierror.Error
 
 	for _, address := range addresses {
-		if p, ok := l.peers.Load(address); ok {
-			err := p.(*Peer).Close()
+		if p, ok := l.peers.Delete(address); ok {
+			err := p.Close()
 			if err != nil {
 				result = multierror.Append(result, err)
 			}
-			l.peers.Delete(address)
 		}
 	}
 
@@ -181,15 +279,15 @@ func (l *Legion) PeerExists(address utils.LegionAddress) bool {
 	return ok
 }
 
-// DoAllPeers runs the function f on all peers
+// Peers returns the set of connected peers
+func (l *Legion) Peers() *PeerSet {
+	return l.peers
+}
+
+// DoAllPeers runs the function f on all peers, it is the same as ranging over
+// Peers() and is kept for compatibility
 func (l *Legion) DoAllPeers(f func(p *Peer)) {
-	l.peers.Range(func(key, value interface{}) bool {
-		p, ok := value.(*Peer)
-		if ok {
-			f(p)
-		}
-		return true
-	})
+	l.peers.Range(func(p *Peer) bool { f(p); return true })
 }
 
 // Listen will listen on the configured address for incoming connections, it will
@@ -201,7 +299,7 @@ func (l *Legion) Listen() error {
 		return err
 	}
 
-	l.listener, err = net.Listen("tcp", l.config.BindAddress.String())
+	l.listener, err = listen(l.config.BindAddress)
 	if err != nil {
 		return err
 	}
@@ -211,21 +309,38 @@ func (l *Legion) Listen() error {
 	log.Info().Field("addr", l.config.BindAddress.String()).Log("Listening on: " + l.config.BindAddress.String())
 	l.FireNetworkEvent(events.StartupEvent)
 
+	// Reconnect to the peers we knew about last time, and retransmit anything
+	// that wasn't acked
+	go l.redialKnownPeers()
+	go l.resumeOutbox()
+
+	// If we can only be reached through a relay, let it know about us
+	if l.Me().Scheme == utils.SchemeRelay {
+		go l.registerWithRelay()
+	}
+
 	// Accept incoming TCP connections
 	for {
 		conn, err := l.listener.Accept()
 		if err != nil {
-			continue
+			select {
+			case <-l.stopped:
+				return nil
+			default:
+				continue
+			}
 		}
 
 		// Handle the incoming connection and create a peer
-		go l.handleNewConnection(conn)
+		go l.acceptPeer(conn, utils.LegionAddress{})
 	}
 }
 
-// Stop closes the listener and fires the plugin stop event
+// Stop closes the listener and fires the plugin stop event, it is safe to
+// call more than once
 func (l *Legion) Stop() error {
 	defer l.FireNetworkEvent(events.CloseEvent)
+	l.stopOnce.Do(func() { close(l.stopped) })
 	return l.listener.Close()
 }
 
@@ -237,9 +352,14 @@ func (l *Legion) Started() {
 // FireMessageEvent fires a new message event and sends context to the correct plugin
 // methods based on the event type
 func (l *Legion) FireMessageEvent(eventType events.MessageEvent, message *transport.Message) {
+	l.fireMessageEvent(eventType, message, nil)
+}
+
+// fireMessageEvent is FireMessageEvent with the peer the message came from
+func (l *Legion) fireMessageEvent(eventType events.MessageEvent, message *transport.Message, p *Peer) {
 	go func() {
 		if eventType == events.NewMessageEvent {
-			messageContext := &MessageContext{Legion: l, Message: message, Sender: utils.LegionAddressFromString(message.GetSender())} // Create some context for our plugin
+			messageContext := &MessageContext{Legion: l, Message: message, Sender: utils.LegionAddressFromString(message.GetSender()), Peer: p} // Create some context for our plugin
 			go l.framework.NewMessage(messageContext)
 		}
 	}()
@@ -259,7 +379,9 @@ func (l *Legion) FirePeerEvent(eventType events.PeerEvent, peer *Peer, isIncomin
 		if eventType == events.PeerAddEvent {
 			go l.framework.PeerAdded(peerContext)
 		} else if eventType == events.PeerDisconnectEvent {
-			go l.framework.PeerDisconnect(peerContext)
+			// Attachments are kept until the framework is done with them
+			l.framework.PeerDisconnect(peerContext)
+			peer.clearAttachments()
 		}
 
 	}()
@@ -274,6 +396,10 @@ func (l *Legion) FireNetworkEvent(eventType events.NetworkEvent) {
 		l.framework.Startup(netContext)
 	} else if eventType == events.CloseEvent {
 		l.framework.Close(netContext)
+	} else if eventType == events.AddressChangeEvent {
+		if af, ok := l.framework.(AddressFramework); ok {
+			af.AddressChanged(netContext)
+		}
 	}
 }
 
@@ -283,42 +409,118 @@ func (l *Legion) addMessageListener(p *Peer, incoming bool) {
 		var once sync.Once
 		storePeer := func(sender utils.LegionAddress) func() {
 			return func() {
-				p.remote = sender
+				p.setRemote(sender)
+				if l.isPeerBanned(p) {
+					log.Debug().Field("remote", sender.String()).Log("legion: disconnecting banned peer")
+					p.Close()
+					return
+				}
 				l.storePeer(p)
 				l.FirePeerEvent(events.PeerAddEvent, p, true)
 			}
 		}
+		// handle passes the message to the framework if it is allowed, and
+		// returns false once the peer is closed
+		handle := func(m *transport.Message) bool {
+			if !l.allowMessage(p, m) {
+				return true
+			}
+
+			// Call the framework validator to see if the message should be sent to plugins
+			ctx := &MessageContext{Legion: l, Message: m, Sender: utils.LegionAddressFromString(m.GetSender()), Peer: p}
+			if l.framework.ValidateMessage(ctx) {
+				// Only store the peer on the first message if it is an incoming connection
+				// this is so we can get a the actual sender and store it
+				if incoming {
+					once.Do(storePeer(utils.LegionAddressFromString(m.GetSender())))
+				} else {
+					once.Do(func() { l.FirePeerEvent(events.PeerAddEvent, p, false) })
+				}
+
+				// A banned peer is closed when it is stored
+				select {
+				case <-p.closed:
+					return false
+				default:
+				}
+
+				// Ack only messages we accepted, and hand each one to
+				// the framework once
+				if m.AckRequested && p.acknowledge(m) {
+					return true
+				}
+
+				l.fireMessageEvent(events.NewMessageEvent, m, p)
+				l.recordSeen(p, false)
+			}
+			return true
+		}
+
 		// Get our reveive channel
 		receiveChan := p.IncomingMessages()
 		for {
 			select {
-			case m, open := <-receiveChan:
+			case <-p.closed:
+				return
+			case m := <-receiveChan:
+				// The message's memory is returned to the peer's budget
+				// once it is handed to the framework or dropped
+				open := handle(m)
+				p.releaseMessage(m)
 				if !open {
 					return
 				}
-
-				// Call the framework validator to see if the message should be sent to plugins
-				ctx := &MessageContext{Legion: l, Message: m, Sender: utils.LegionAddressFromString(m.GetSender())}
-				if l.framework.ValidateMessage(ctx) {
-					l.FireMessageEvent(events.NewMessageEvent, m)
-					// Only store the peer on the first message if it is an incoming connection
-					// this is so we can get a the actual sender and store it
-					if incoming {
-						once.Do(storePeer(utils.LegionAddressFromString(m.GetSender())))
-					} else {
-						once.Do(func() { l.FirePeerEvent(events.PeerAddEvent, p, false) })
-					}
-				}
 			}
-
 		}
 	}()
 }
 
-func (l *Legion) createAndDialPeer(address utils.LegionAddress) (*Peer, error) {
-	p := NewPeer(address)
+// newPeer creates a peer that uses the configured multiplexer and send mode
+func (l *Legion) newPeer(address utils.LegionAddress, sessionConfig *config.SessionConfig) *Peer {
+	p := NewPeerWithConfig(address, sessionConfig)
+	p.muxer = l.muxer
+	p.streamReuse = l.config.StreamReuse
+	p.compression = l.config.Compression
+	p.handshake = buildHandshake(l.config)
+	p.local = l.Me
+	p.onHandshake = l.handleHandshake
+	p.onRelay = l.handleRelay
+	p.mismatchPolicy = l.config.SenderMismatchPolicy
+	p.onAck = l.handleAck
+	var frameworkClasses map[string]config.Priority
+	if pf, ok := l.framework.(PriorityFramework); ok {
+		frameworkClasses = pf.MessagePriorities()
+	}
+	p.scheduler = newScheduler(l.config.Priorities, frameworkClasses)
+	if l.config.Priorities != nil && l.config.Priorities.MaxConcurrentSends > 0 {
+		p.sendSlots = make(chan struct{}, l.config.Priorities.MaxConcurrentSends)
+	}
+	if l.config.MaxMessageSize != 0 {
+		p.maxMessageSize = l.config.MaxMessageSize
+	}
+	if l.config.MaxPeerMemory != 0 {
+		p.budget = newMemoryBudget(l.config.MaxPeerMemory)
+	}
+	p.heartbeat = l.config.Heartbeat
+	if p.heartbeat == nil {
+		p.heartbeat = &config.HeartbeatConfig{}
+	}
+	p.isDuplicate = l.dedup.check
+	p.onHealthChange = l.peers.updateHealth
+	return p
+}
+
+func (l *Legion) createAndDialPeer(address utils.LegionAddress, sessionConfig *config.SessionConfig) (*Peer, error) {
+	p := l.newPeer(address, sessionConfig)
 
-	conn, err := net.Dial("tcp", address.String())
+	var conn net.Conn
+	var err error
+	if address.Scheme == utils.SchemeRelay {
+		p.relayedAs = address
+		conn, err = l.dialRelay(address)
+	} else {
+		conn, err = dial(address)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -337,16 +539,27 @@ func (l *Legion) NewMessage(messageType string, body []byte) *transport.Message
 	return &transport.Message{Type: messageType, Body: body, Sender: l.Me().String()}
 }
 
-func (l *Legion) handleNewConnection(conn net.Conn) {
+// acceptPeer creates a server session over an incoming connection,
+// relayedFrom is the address our relay says the dialer has if the connection
+// is a stream relayed to us, and empty otherwise
+func (l *Legion) acceptPeer(conn net.Conn, relayedFrom utils.LegionAddress) {
 	// Create a new peer that's not yet stored, it will be registered with the network
 	// later in the message listener once we receive a message from it.
-	p := NewPeer(utils.LegionAddress{})
+	p := l.newPeer(utils.LegionAddress{}, l.config.Session)
+	p.relayedAs = relayedFrom
 	err := p.CreateServer(conn)
 	if err != nil {
 		conn.Close()
 		return
 	}
 
+	// Hosts can be banned before the peer says who it is
+	if l.isPeerBanned(p) {
+		log.Debug().Field("addr", conn.RemoteAddr().String()).Log("legion: refusing connection from banned host")
+		p.Close()
+		return
+	}
+
 	// Listen to new messages from that peer
 	l.addMessageListener(p, true)
 
@@ -355,7 +568,7 @@ func (l *Legion) handleNewConnection(conn net.Conn) {
 
 func (l *Legion) storePeer(p *Peer) {
 	// If it is already stored, don't add a cleanup handler
-	if _, stored := l.peers.LoadOrStore(p.remote, p); stored {
+	if _, stored := l.peers.LoadOrStore(p.Remote(), p); stored {
 		return
 	}
 
@@ -365,10 +578,11 @@ func (l *Legion) storePeer(p *Peer) {
 
 		p.Close()
 
-		// Cleanup the peer map
-		l.peers.Delete(p.remote)
+		// Cleanup the peer set
+		l.peers.deletePeer(p.Remote(), p)
+		l.recordSeen(p, true)
 
-		l.FirePeerEvent(events.PeerDisconnectEvent, p, true)
+		l.FirePeerEvent(events.PeerDisconnectEvent, p, p.Direction() == Inbound)
 		log.Debug().Field("remote_addr", p.Remote().String()).Log("Peer disconnected")
 	}()
 }
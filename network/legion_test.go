@@ -1,13 +1,21 @@
 package network
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gladiusio/legion/network/compress"
 	"github.com/gladiusio/legion/network/config"
 	"github.com/gladiusio/legion/network/events"
+	"github.com/gladiusio/legion/network/mux"
+	"github.com/gladiusio/legion/network/outbox"
+	"github.com/gladiusio/legion/network/peerstore"
 	"github.com/gladiusio/legion/network/transport"
 	"github.com/gladiusio/legion/utils"
 )
@@ -49,10 +57,10 @@ func (m *MessageFramework) NewMessage(ctx *MessageContext) {
 }
 
 func TestFireMessageEvent(t *testing.T) {
-	failed := true
+	var fired int32
 
 	f := &MessageFramework{callback: func(ctx *MessageContext) {
-		failed = false
+		atomic.StoreInt32(&fired, 1)
 	}}
 	l := NewLegion(makeConfig(6000), f)
 
@@ -60,14 +68,29 @@ func TestFireMessageEvent(t *testing.T) {
 
 	time.Sleep(50 * time.Millisecond)
 
-	if failed {
+	if atomic.LoadInt32(&fired) == 0 {
 		t.Error("message event never fired")
 	}
 }
 
+func TestStopTwice(t *testing.T) {
+	l := NewLegion(makeConfig(6190), nil)
+	go l.Listen()
+	l.Started()
+
+	l.Stop()
+	l.Stop()
+}
+
 func newLegionGroup(n int) *legionGroup {
+	return newConfiguredLegionGroup(n, nil)
+}
+
+// newConfiguredLegionGroup is like newLegionGroup, but configure can change
+// each legion's config and pick its framework before it starts listening
+func newConfiguredLegionGroup(n int, configure func(i int, conf *config.LegionConfig) Framework) *legionGroup {
 	l := &legionGroup{legions: make([]*Legion, n)}
-	l.makeLegions(n)
+	l.makeLegions(n, configure)
 	return l
 }
 
@@ -75,10 +98,15 @@ type legionGroup struct {
 	legions []*Legion
 }
 
-func (lg *legionGroup) makeLegions(n int) {
+func (lg *legionGroup) makeLegions(n int, configure func(i int, conf *config.LegionConfig) Framework) {
 	legions := make([]*Legion, 0, n)
 	for i := 0; i < n; i++ {
-		l := NewLegion(makeConfig(6000+uint16(i)), nil)
+		conf := makeConfig(6000 + uint16(i))
+		var f Framework
+		if configure != nil {
+			f = configure(i, conf)
+		}
+		l := NewLegion(conf, f)
 		go func() {
 			err := l.Listen()
 			if err != nil {
@@ -132,7 +160,7 @@ func TestPeerConnection(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	peerCount := 0
-	lg.legions[0].peers.Range(func(key, value interface{}) bool { peerCount++; return true })
+	lg.legions[0].peers.Range(func(p *Peer) bool { peerCount++; return true })
 	if peerCount != 1 {
 		t.Errorf("local number of peers is incorrect, there should have been 1, there were: %d", peerCount)
 	}
@@ -143,7 +171,7 @@ func TestPeerConnection(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	peerCount = 0
-	lg.legions[1].peers.Range(func(key, value interface{}) bool { peerCount++; return true })
+	lg.legions[1].peers.Range(func(p *Peer) bool { peerCount++; return true })
 	if peerCount != 1 {
 		t.Errorf("remote number of peers is incorrect, there should have been 1, there were: %d", peerCount)
 	}
@@ -159,7 +187,7 @@ func TestPeerConnectionWhenMessageRecieved(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	peerCount := 0
-	lg.legions[0].peers.Range(func(key, value interface{}) bool { peerCount++; return true })
+	lg.legions[0].peers.Range(func(p *Peer) bool { peerCount++; return true })
 	if peerCount != 1 {
 		t.Errorf("local number of peers is incorrect, there should have been 1, there were: %d", peerCount)
 	}
@@ -170,57 +198,58 @@ func TestPeerConnectionWhenMessageRecieved(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	peerCount = 0
-	lg.legions[1].peers.Range(func(key, value interface{}) bool { peerCount++; return true })
+	lg.legions[1].peers.Range(func(p *Peer) bool { peerCount++; return true })
 	if peerCount != 1 {
 		t.Errorf("remote number of peers is incorrect, there should have been 1, there were: %d", peerCount)
 	}
 }
 
 func TestBroadcast(t *testing.T) {
-	failed := true
+	var received int32
 
-	f := &MessageFramework{callback: func(ctx *MessageContext) {
-		if ctx.Message.GetType() == "test" {
-			failed = false
+	lg := newConfiguredLegionGroup(2, func(i int, conf *config.LegionConfig) Framework {
+		if i != 1 {
+			return nil
 		}
-	}}
-
-	lg := newLegionGroup(2)
+		return &MessageFramework{callback: func(ctx *MessageContext) {
+			if ctx.Message.GetType() == "test" {
+				atomic.StoreInt32(&received, 1)
+			}
+		}}
+	})
 	lg.waitUntilStarted()
 
 	lg.connect()
 	defer lg.stop()
 
-	lg.legions[1].framework = f
-
 	lg.legions[0].Broadcast(lg.legions[0].NewMessage("intro", []byte{}))
 
 	lg.legions[0].Broadcast(lg.legions[0].NewMessage("test", []byte{}))
 
 	time.Sleep(200 * time.Millisecond)
 
-	if failed {
+	if atomic.LoadInt32(&received) == 0 {
 		t.Error("peer never received message")
 	}
 }
 
 func TestBroadcastRandomNGreaterThanPeers(t *testing.T) {
-	lg := newLegionGroup(10)
-	lg.waitUntilStarted()
-
-	lg.connect()
-	defer lg.stop()
-
 	var count uint64
 	f := &MessageFramework{callback: func(ctx *MessageContext) {
 		if ctx.Message.GetType() == "test" {
 			atomic.AddUint64(&count, 1)
 		}
 	}}
+	lg := newConfiguredLegionGroup(10, func(i int, conf *config.LegionConfig) Framework {
+		if i == 0 {
+			return nil
+		}
+		return f
+	})
+	lg.waitUntilStarted()
 
-	for _, leg := range lg.legions[1:] {
-		leg.framework = f
-	}
+	lg.connect()
+	defer lg.stop()
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -228,27 +257,28 @@ func TestBroadcastRandomNGreaterThanPeers(t *testing.T) {
 
 	time.Sleep(300 * time.Millisecond)
 
-	if count != 9 {
+	if count := atomic.LoadUint64(&count); count != 9 {
 		t.Errorf("random broadcast was not sent to all peers, should have been 9, was: %d", count)
 	}
 }
 
 func TestBroadcastRandom(t *testing.T) {
-	lg := newLegionGroup(10)
-	lg.waitUntilStarted()
-
-	lg.connect()
-	defer lg.stop()
-
 	var count uint64
 	f := &MessageFramework{callback: func(ctx *MessageContext) {
 		if ctx.Message.GetType() == "test" {
 			atomic.AddUint64(&count, 1)
 		}
 	}}
-	for _, leg := range lg.legions[1:] {
-		leg.framework = f
-	}
+	lg := newConfiguredLegionGroup(10, func(i int, conf *config.LegionConfig) Framework {
+		if i == 0 {
+			return nil
+		}
+		return f
+	})
+	lg.waitUntilStarted()
+
+	lg.connect()
+	defer lg.stop()
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -256,7 +286,7 @@ func TestBroadcastRandom(t *testing.T) {
 
 	time.Sleep(300 * time.Millisecond)
 
-	if count != 5 {
+	if count := atomic.LoadUint64(&count); count != 5 {
 		t.Errorf("random broadcast was not sent to all peers, should have been 5, was: %d", count)
 	}
 }
@@ -293,7 +323,7 @@ func TestSingleConnectionOpened(t *testing.T) {
 	time.Sleep(300 * time.Millisecond)
 
 	peerCount := 0
-	lg.legions[1].peers.Range(func(key, value interface{}) bool { peerCount++; return true })
+	lg.legions[1].peers.Range(func(p *Peer) bool { peerCount++; return true })
 	if peerCount != 1 {
 		t.Errorf("remote number of peers is incorrect after intro message, there should have been 1, there were: %d", peerCount)
 	}
@@ -304,27 +334,19 @@ func TestSingleConnectionOpened(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	peerCount = 0
-	lg.legions[0].peers.Range(func(key, value interface{}) bool { peerCount++; return true })
+	lg.legions[0].peers.Range(func(p *Peer) bool { peerCount++; return true })
 	if peerCount != 1 {
 		t.Errorf("local number of peers is incorrect, there should have been 1, there were: %d", peerCount)
 	}
 
 	peerCount = 0
-	lg.legions[1].peers.Range(func(key, value interface{}) bool { peerCount++; return true })
+	lg.legions[1].peers.Range(func(p *Peer) bool { peerCount++; return true })
 	if peerCount != 1 {
 		t.Errorf("remote number of peers is incorrect, there should have been 1, there were: %d", peerCount)
 	}
 }
 
 func TestRPCMessage(t *testing.T) {
-	lg := newLegionGroup(2)
-	lg.waitUntilStarted()
-
-	lg.connect()
-	defer lg.stop()
-
-	time.Sleep(100 * time.Millisecond)
-
 	var count uint64
 	f := &MessageFramework{callback: func(ctx *MessageContext) {
 		atomic.AddUint64(&count, 1)
@@ -336,10 +358,13 @@ func TestRPCMessage(t *testing.T) {
 			t.Error("Reply should not be seen by NewMessage")
 		}
 	}}
+	lg := newConfiguredLegionGroup(2, func(i int, conf *config.LegionConfig) Framework { return f })
+	lg.waitUntilStarted()
 
-	for _, leg := range lg.legions {
-		leg.framework = f
-	}
+	lg.connect()
+	defer lg.stop()
+
+	time.Sleep(100 * time.Millisecond)
 
 	resp, err := lg.legions[0].Request(lg.legions[0].NewMessage("test", []byte{}), 10*time.Millisecond, lg.legions[1].config.BindAddress)
 
@@ -352,8 +377,1653 @@ func TestRPCMessage(t *testing.T) {
 		t.Error("Response type not correct")
 	}
 
-	if count != 1 {
+	if count := atomic.LoadUint64(&count); count != 1 {
 		t.Errorf("Should have been 1 message processed by framework, was: %d", count)
 	}
 
 }
+
+func TestAddPeerWithSessionConfig(t *testing.T) {
+	lg := newLegionGroup(2)
+	lg.waitUntilStarted()
+	defer lg.stop()
+
+	// A window smaller than the yamux minimum should be rejected
+	bad := &config.SessionConfig{MaxStreamWindowSize: 1024}
+	if err := lg.legions[0].AddPeerWithConfig(bad, lg.legions[1].config.BindAddress); err == nil {
+		t.Error("invalid session config should have errored")
+	}
+
+	good := &config.SessionConfig{
+		KeepAliveInterval:   5 * time.Second,
+		MaxStreamWindowSize: 1024 * 1024,
+		AcceptBacklog:       512,
+	}
+	if err := lg.legions[0].AddPeerWithConfig(good, lg.legions[1].config.BindAddress); err != nil {
+		t.Error(err)
+	}
+
+	c := mux.YamuxConfig(good)
+	if c.KeepAliveInterval != good.KeepAliveInterval || c.MaxStreamWindowSize != good.MaxStreamWindowSize || c.AcceptBacklog != good.AcceptBacklog {
+		t.Error("session config was not applied to yamux config")
+	}
+}
+
+func benchmarkSend(b *testing.B, streamReuse bool) {
+	received := make(chan struct{}, 1024)
+	lg := newConfiguredLegionGroup(2, func(i int, conf *config.LegionConfig) Framework {
+		conf.StreamReuse = streamReuse
+		return &MessageFramework{callback: func(ctx *MessageContext) {
+			if i == 1 && ctx.Message.GetType() == "bench" {
+				received <- struct{}{}
+			}
+		}}
+	})
+	lg.waitUntilStarted()
+	lg.connect()
+	defer lg.stop()
+
+	// Introduce ourselves so the remote stores us
+	lg.legions[0].Broadcast(lg.legions[0].NewMessage("intro", []byte{}))
+	time.Sleep(100 * time.Millisecond)
+
+	body := make([]byte, 100)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		lg.legions[0].Broadcast(lg.legions[0].NewMessage("bench", body))
+	}
+	for n := 0; n < b.N; n++ {
+		<-received
+	}
+}
+
+func BenchmarkSendStreamPerMessage(b *testing.B) { benchmarkSend(b, false) }
+
+func BenchmarkSendStreamReuse(b *testing.B) { benchmarkSend(b, true) }
+
+func TestStreamReuse(t *testing.T) {
+	var count uint64
+	lg := newConfiguredLegionGroup(2, func(i int, conf *config.LegionConfig) Framework {
+		conf.StreamReuse = true
+		return &MessageFramework{callback: func(ctx *MessageContext) {
+			if i == 1 && ctx.Message.GetType() == "test" {
+				atomic.AddUint64(&count, 1)
+			}
+		}}
+	})
+	lg.waitUntilStarted()
+	lg.connect()
+	defer lg.stop()
+
+	for i := 0; i < 50; i++ {
+		lg.legions[0].Broadcast(lg.legions[0].NewMessage("test", []byte{}))
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if c := atomic.LoadUint64(&count); c != 50 {
+		t.Errorf("not all messages were received over the reused stream, should have been 50, was: %d", c)
+	}
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	body := bytes.Repeat([]byte("compress me "), 1000)
+	received := make(chan []byte, 1)
+	lg := newConfiguredLegionGroup(2, func(i int, conf *config.LegionConfig) Framework {
+		conf.Compression = &config.CompressionConfig{Codecs: []string{"gzip"}, Threshold: 64}
+		return &MessageFramework{callback: func(ctx *MessageContext) {
+			if i == 1 && ctx.Message.GetType() == "test" {
+				received <- ctx.Message.Body
+			}
+		}}
+	})
+	lg.waitUntilStarted()
+	lg.connect()
+	defer lg.stop()
+
+	// Wait for the handshakes to be exchanged
+	time.Sleep(100 * time.Millisecond)
+
+	p, ok := lg.legions[0].peers.Load(lg.legions[1].config.BindAddress)
+	if !ok {
+		t.Fatal("peer was not stored")
+	}
+	if codec := p.codec.Load(); codec != "gzip" {
+		t.Errorf("gzip should have been negotiated, got: %q", codec)
+	}
+
+	lg.legions[0].Broadcast(lg.legions[0].NewMessage("test", body))
+
+	select {
+	case b := <-received:
+		if !bytes.Equal(b, body) {
+			t.Error("decompressed body did not match what was sent")
+		}
+	case <-time.After(time.Second):
+		t.Error("message was never received")
+	}
+}
+
+func TestMemTransport(t *testing.T) {
+	received := make(chan struct{}, 1)
+	legions := make([]*Legion, 2)
+	for i := range legions {
+		addr := utils.LegionAddress{Scheme: utils.SchemeMem, Host: fmt.Sprintf("node%d", i)}
+		var f Framework
+		if i == 1 {
+			f = &MessageFramework{callback: func(ctx *MessageContext) {
+				if ctx.Message.GetType() == "test" {
+					received <- struct{}{}
+				}
+			}}
+		}
+		legions[i] = NewLegion(&config.LegionConfig{BindAddress: addr, AdvertiseAddress: addr}, f)
+		go legions[i].Listen()
+		legions[i].Started()
+		defer legions[i].Stop()
+	}
+
+	if err := legions[0].AddPeer(legions[1].Me()); err != nil {
+		t.Fatal(err)
+	}
+	legions[0].Broadcast(legions[0].NewMessage("test", []byte{}))
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Error("message was never received over the in memory transport")
+	}
+}
+
+// fakeSession is a session that only reports a remote address and never closes
+type fakeSession struct {
+	mux.Session
+	remote net.Addr
+}
+
+func (s *fakeSession) RemoteAddr() net.Addr { return s.remote }
+
+// CloseChan never closes
+func (s *fakeSession) CloseChan() <-chan struct{} { return nil }
+
+type addressFramework struct {
+	GenericFramework
+	changed chan utils.LegionAddress
+}
+
+func (f *addressFramework) AddressChanged(ctx *NetworkContext) {
+	f.changed <- ctx.Legion.Me()
+}
+
+func TestObservedAddressConsensus(t *testing.T) {
+	f := &addressFramework{changed: make(chan utils.LegionAddress, 1)}
+	conf := &config.LegionConfig{
+		BindAddress:              utils.NewLegionAddress("0.0.0.0", 6000),
+		AdvertiseAddress:         utils.NewLegionAddress("10.0.0.1", 6000),
+		DiscoverAdvertiseAddress: true,
+	}
+	l := NewLegion(conf, f)
+
+	observe := func(observer, observed string) {
+		p := NewPeer(utils.LegionAddress{})
+		p.session = &fakeSession{remote: &net.TCPAddr{IP: net.ParseIP(observer), Port: 5000}}
+		l.handleHandshake(p, &transport.Handshake{ObservedAddress: observed})
+	}
+
+	observe("1.1.1.1", "5.5.5.5:41000")
+	if l.Me().Host != "10.0.0.1" {
+		t.Error("advertise address should not change with a single observation")
+	}
+
+	// The same observer again shouldn't count twice
+	observe("1.1.1.1", "5.5.5.5:41001")
+	if l.Me().Host != "10.0.0.1" {
+		t.Error("advertise address should not change with observations from one host")
+	}
+
+	observe("2.2.2.2", "5.5.5.5:41002")
+	expected := utils.NewLegionAddress("5.5.5.5", 6000)
+	if l.Me() != expected {
+		t.Errorf("advertise address should have changed to %s, was %s", expected, l.Me())
+	}
+
+	select {
+	case addr := <-f.changed:
+		if addr != expected {
+			t.Errorf("address change event had the wrong address: %s", addr)
+		}
+	case <-time.After(time.Second):
+		t.Error("address change event never fired")
+	}
+}
+
+func TestObservedAddressTie(t *testing.T) {
+	// Map order is random, so check the tie is broken the same way each time
+	for i := 0; i < 20; i++ {
+		conf := &config.LegionConfig{
+			BindAddress:              utils.NewLegionAddress("0.0.0.0", 6000),
+			AdvertiseAddress:         utils.NewLegionAddress("10.0.0.1", 6000),
+			DiscoverAdvertiseAddress: true,
+		}
+		l := NewLegion(conf, nil)
+
+		for _, o := range [][2]string{{"1.1.1.1", "5.5.5.5:1"}, {"2.2.2.2", "6.6.6.6:1"}, {"3.3.3.3", "6.6.6.6:1"}, {"4.4.4.4", "5.5.5.5:1"}} {
+			p := NewPeer(utils.LegionAddress{})
+			p.session = &fakeSession{remote: &net.TCPAddr{IP: net.ParseIP(o[0]), Port: 5000}}
+			l.handleHandshake(p, &transport.Handshake{ObservedAddress: o[1]})
+		}
+
+		// Both hosts have two votes, 5.5.5.5 was observed first
+		if l.Me().Host != "5.5.5.5" {
+			t.Fatalf("tied hosts should go to the first observed, got %s", l.Me().Host)
+		}
+	}
+}
+func TestDefaultAdvertiseAddress(t *testing.T) {
+	l := NewLegion(&config.LegionConfig{BindAddress: utils.NewLegionAddress("localhost", 6000)}, nil)
+	if l.Me() != utils.NewLegionAddress("localhost", 6000) {
+		t.Errorf("advertise address should default to the bind address, was: %s", l.Me())
+	}
+}
+
+func TestRelay(t *testing.T) {
+	relay := NewLegion(makeConfig(6100), nil)
+	relay.config.RelayEnabled = true
+
+	// The hidden peer is only reachable through the relay
+	hiddenConf := makeConfig(6101)
+	hiddenConf.AdvertiseAddress = utils.NewRelayAddress(relay.Me(), hiddenConf.BindAddress)
+	received := make(chan string, 1)
+	hidden := NewLegion(hiddenConf, &MessageFramework{callback: func(ctx *MessageContext) {
+		if ctx.Message.GetType() == "test" {
+			received <- ctx.Message.Sender
+		}
+	}})
+
+	dialer := NewLegion(makeConfig(6102), nil)
+
+	for _, l := range []*Legion{relay, hidden, dialer} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+
+	// Wait for the hidden peer to register with the relay
+	time.Sleep(100 * time.Millisecond)
+
+	dialer.Broadcast(dialer.NewMessage("test", []byte{}), hidden.Me())
+
+	select {
+	case sender := <-received:
+		if sender != dialer.Me().String() {
+			t.Errorf("relayed message had the wrong sender: %s", sender)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message was never relayed to the hidden peer")
+	}
+
+	if !dialer.PeerExists(hidden.Me()) {
+		t.Error("relayed peer should be stored under its relay address")
+	}
+}
+
+func TestRelayRegistrationHijack(t *testing.T) {
+	relay := NewLegion(makeConfig(6200), nil)
+	relay.config.RelayEnabled = true
+
+	hiddenConf := makeConfig(6201)
+	hiddenConf.AdvertiseAddress = utils.NewRelayAddress(relay.Me(), hiddenConf.BindAddress)
+	received := make(chan struct{}, 1)
+	hidden := NewLegion(hiddenConf, &MessageFramework{callback: func(ctx *MessageContext) {
+		if ctx.Message.GetType() == "test" {
+			received <- struct{}{}
+		}
+	}})
+
+	attacker := NewLegion(makeConfig(6202), nil)
+	dialer := NewLegion(makeConfig(6203), nil)
+
+	for _, l := range []*Legion{relay, hidden, attacker, dialer} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+
+	// Wait for the hidden peer to register with the relay
+	time.Sleep(100 * time.Millisecond)
+
+	if err := attacker.AddPeer(relay.Me()); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := attacker.peers.Load(relay.Me())
+
+	// Try to take over the hidden peer's address, and to register for a
+	// relay that isn't this one
+	other := utils.NewRelayAddress(utils.NewLegionAddress("localhost", 6299), attacker.Me())
+	p.QueueMessage(&transport.Message{Type: relayRegisterType, Sender: hidden.Me().String()})
+	p.QueueMessage(&transport.Message{Type: relayRegisterType, Sender: other.String()})
+	time.Sleep(100 * time.Millisecond)
+
+	if _, ok := relay.relayTarget(other); ok {
+		t.Error("relay accepted a registration for another relay")
+	}
+
+	dialer.Broadcast(dialer.NewMessage("test", []byte{}), hidden.Me())
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("registration for a connected target was taken over")
+	}
+}
+
+func TestRelayIncomingOnlyFromRelay(t *testing.T) {
+	victim := NewLegion(makeConfig(6204), nil)
+	attacker := NewLegion(makeConfig(6205), nil)
+	for _, l := range []*Legion{victim, attacker} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+
+	if err := attacker.AddPeer(victim.Me()); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := attacker.peers.Load(victim.Me())
+
+	// Pretend to be a relay handing the victim a connection from a peer we
+	// want to impersonate
+	spoofed := utils.NewLegionAddress("localhost", 6298)
+	stream, err := p.session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeMessage(stream, &transport.Message{Type: relayIncomingType, Sender: attacker.Me().String(), Body: []byte(spoofed.String())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := attacker.newPeer(spoofed, nil)
+	if err := fake.CreateClient(stream); err == nil {
+		fake.QueueMessage(&transport.Message{Type: "test", Sender: spoofed.String()})
+		defer fake.Close()
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if victim.PeerExists(spoofed) {
+		t.Error("relayed connection from a peer that isn't our relay was accepted")
+	}
+}
+
+func TestRelaySpoofing(t *testing.T) {
+	relayConf := makeConfig(6221)
+	relayConf.RelayEnabled = true
+	// The relay checks its control messages whatever the policy is
+	relayConf.SenderMismatchPolicy = config.MismatchAllow
+	relay := NewLegion(relayConf, nil)
+
+	hiddenConf := makeConfig(6222)
+	hiddenConf.AdvertiseAddress = utils.NewRelayAddress(relay.Me(), hiddenConf.BindAddress)
+	hiddenConf.RelayRetryInterval = 300 * time.Millisecond
+	hidden := NewLegion(hiddenConf, nil)
+
+	attacker := NewLegion(makeConfig(6223), nil)
+
+	for _, l := range []*Legion{relay, hidden, attacker} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The attacker connects to the relay from another host
+	dialRelay := func() *Peer {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}}
+		conn, err := d.Dial("tcp", net.JoinHostPort("127.0.0.1", "6221"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := attacker.newPeer(relay.Me(), nil)
+		if err := p.CreateClient(conn); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	registered := func() bool {
+		_, ok := relay.relayTarget(hidden.Me())
+		return ok
+	}
+	for i := 0; i < 50 && !registered(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	current, ok := relay.relayTarget(hidden.Me())
+	if !ok {
+		t.Fatal("hidden peer did not register with the relay")
+	}
+
+	// Register the hidden peer's address while it is reconnecting
+	current.Close()
+	for i := 0; i < 50 && registered(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	p := dialRelay()
+	defer p.Close()
+	p.QueueMessage(&transport.Message{Type: relayRegisterType, Sender: hidden.Me().String()})
+	time.Sleep(500 * time.Millisecond)
+
+	target, ok := relay.relayTarget(hidden.Me())
+	if !ok {
+		t.Fatal("hidden peer did not register with the relay again")
+	}
+	if target.observedHost() == "127.0.0.2" {
+		t.Error("registration was taken over by a peer on another host")
+	}
+
+	// Ask for a circuit to the hidden peer as someone else
+	spoofed := utils.NewLegionAddress("localhost", 6298)
+	stream, err := p.session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeMessage(stream, &transport.Message{Type: relayConnectType, Sender: spoofed.String(), Body: []byte(hidden.Me().String())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	status, err := readMessage(stream)
+	if err == nil && status.Type == relayStatusType && len(status.Body) == 0 {
+		t.Error("relay opened a circuit for a spoofed sender")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if hidden.PeerExists(spoofed) {
+		t.Error("hidden peer accepted a connection from a spoofed sender")
+	}
+}
+
+func TestRelayReregister(t *testing.T) {
+	relay := NewLegion(makeConfig(6206), nil)
+	relay.config.RelayEnabled = true
+
+	hiddenConf := makeConfig(6207)
+	hiddenConf.AdvertiseAddress = utils.NewRelayAddress(relay.Me(), hiddenConf.BindAddress)
+	hiddenConf.RelayRetryInterval = 20 * time.Millisecond
+	received := make(chan struct{}, 1)
+	hidden := NewLegion(hiddenConf, &MessageFramework{callback: func(ctx *MessageContext) {
+		if ctx.Message.GetType() == "test" {
+			received <- struct{}{}
+		}
+	}})
+
+	dialer := NewLegion(makeConfig(6208), nil)
+
+	for _, l := range []*Legion{relay, hidden, dialer} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Drop the session to the hidden peer, it should come back and register
+	current, ok := relay.relayTarget(hidden.Me())
+	if !ok {
+		t.Fatal("hidden peer did not register with the relay")
+	}
+	current.Close()
+	time.Sleep(200 * time.Millisecond)
+	if again, ok := relay.relayTarget(hidden.Me()); !ok || again == current {
+		t.Fatal("hidden peer did not register with the relay again")
+	}
+
+	dialer.Broadcast(dialer.NewMessage("test", []byte{}), hidden.Me())
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("hidden peer did not register with the relay again")
+	}
+}
+
+func TestPeerStoreRedial(t *testing.T) {
+	store := peerstore.NewMemoryStore()
+
+	remote := NewLegion(makeConfig(6110), nil)
+	go remote.Listen()
+	remote.Started()
+	defer remote.Stop()
+
+	first := makeConfig(6111)
+	first.PeerStore = store
+	l := NewLegion(first, nil)
+	go l.Listen()
+	l.Started()
+	if err := l.AddPeer(remote.Me()); err != nil {
+		t.Fatal(err)
+	}
+
+	r, ok := store.Get(remote.Me())
+	if !ok || r.Successes != 1 || r.LastSeen.IsZero() {
+		t.Fatalf("successful dial was not recorded: %+v", r)
+	}
+	l.Stop()
+
+	// A new node with the same store should reconnect on its own
+	second := makeConfig(6112)
+	second.PeerStore = store
+	second.RedialPeers = 5
+	l = NewLegion(second, nil)
+	go l.Listen()
+	l.Started()
+	defer l.Stop()
+
+	for i := 0; i < 20 && !l.PeerExists(remote.Me()); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !l.PeerExists(remote.Me()) {
+		t.Error("known peer was not redialed on startup")
+	}
+}
+
+func TestPeerStoreBan(t *testing.T) {
+	conf := makeConfig(6113)
+	conf.PeerStore = peerstore.NewMemoryStore()
+	l := NewLegion(conf, nil)
+	go l.Listen()
+	l.Started()
+	defer l.Stop()
+
+	banned := utils.NewLegionAddress("localhost", 6114)
+	if err := l.BanPeer(banned, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.AddPeer(banned); err == nil {
+		t.Error("adding a banned peer should fail")
+	}
+
+	// A failed dial should count as a failure
+	l.UnbanPeer(banned)
+	l.AddPeer(banned)
+	if r, _ := conf.PeerStore.Get(banned); r.Failures != 1 {
+		t.Errorf("failed dial was not recorded, failures: %d", r.Failures)
+	}
+}
+
+func TestPeerStoreBanHost(t *testing.T) {
+	conf := makeConfig(6218)
+	conf.PeerStore = peerstore.NewMemoryStore()
+	l := NewLegion(conf, nil)
+	go l.Listen()
+	l.Started()
+	defer l.Stop()
+
+	first := NewLegion(makeConfig(6219), nil)
+	go first.Listen()
+	first.Started()
+	defer first.Stop()
+	if err := first.AddPeer(l.Me()); err != nil {
+		t.Fatal(err)
+	}
+	first.Broadcast(first.NewMessage("hello", []byte{}))
+	for i := 0; i < 50 && !l.PeerExists(first.Me()); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !l.PeerExists(first.Me()) {
+		t.Fatal("peer did not connect")
+	}
+	if err := l.BanPeer(first.Me(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another address from the same host is refused too
+	second := NewLegion(makeConfig(6220), nil)
+	go second.Listen()
+	second.Started()
+	defer second.Stop()
+	second.AddPeer(l.Me())
+	second.Broadcast(second.NewMessage("hello", []byte{}))
+	time.Sleep(100 * time.Millisecond)
+	if l.PeerExists(second.Me()) {
+		t.Error("peer from a banned host should be refused")
+	}
+
+	// Inbound peers don't get records of their own
+	if _, ok := conf.PeerStore.Get(second.Me()); ok {
+		t.Error("refused peer should not be recorded")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var received int32
+	conf := makeConfig(6120)
+	conf.RateLimit = &config.RateLimitConfig{
+		PerType: map[string]config.Limit{"limited": {Rate: 0.001, Burst: 2}},
+		Action:  config.RateLimitDrop,
+	}
+	l := NewLegion(conf, &MessageFramework{callback: func(ctx *MessageContext) {
+		atomic.AddInt32(&received, 1)
+	}})
+
+	sender := NewLegion(makeConfig(6121), nil)
+	for _, l := range []*Legion{l, sender} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+
+	for i := 0; i < 5; i++ {
+		sender.Broadcast(sender.NewMessage("limited", []byte{}), l.Me())
+	}
+	sender.Broadcast(sender.NewMessage("unlimited", []byte{}), l.Me())
+	time.Sleep(100 * time.Millisecond)
+
+	if r := atomic.LoadInt32(&received); r != 3 {
+		t.Errorf("expected 3 messages to get through the limit, got %d", r)
+	}
+
+	metrics := l.RateLimitMetrics()
+	if metrics.Allowed != 3 || metrics.Dropped != 3 || metrics.LimitedByType["limited"] != 3 {
+		t.Errorf("wrong rate limit metrics: %+v", metrics)
+	}
+}
+
+func TestRateLimitDisconnect(t *testing.T) {
+	conf := makeConfig(6122)
+	conf.RateLimit = &config.RateLimitConfig{
+		PerPeer: &config.Limit{Rate: 0.001, Burst: 1},
+		Action:  config.RateLimitDisconnect,
+	}
+	l := NewLegion(conf, nil)
+
+	sender := NewLegion(makeConfig(6123), nil)
+	for _, l := range []*Legion{l, sender} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+
+	for i := 0; i < 3; i++ {
+		sender.Broadcast(sender.NewMessage("test", []byte{}), l.Me())
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if sender.PeerExists(l.Me()) {
+		t.Error("peer over the rate limit should have been disconnected")
+	}
+	if l.RateLimitMetrics().Disconnected != 1 {
+		t.Error("disconnect was not counted")
+	}
+}
+
+func TestRateLimitSharedByHost(t *testing.T) {
+	var received int32
+	conf := makeConfig(6215)
+	conf.RateLimit = &config.RateLimitConfig{
+		PerPeer: &config.Limit{Rate: 0.001, Burst: 2},
+		Action:  config.RateLimitDrop,
+	}
+	l := NewLegion(conf, &MessageFramework{callback: func(ctx *MessageContext) {
+		atomic.AddInt32(&received, 1)
+	}})
+
+	// Both senders connect from the same host
+	senders := []*Legion{NewLegion(makeConfig(6216), nil), NewLegion(makeConfig(6217), nil)}
+	for _, l := range append([]*Legion{l}, senders...) {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+
+	for _, sender := range senders {
+		for i := 0; i < 2; i++ {
+			sender.Broadcast(sender.NewMessage("test", []byte{}), l.Me())
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if r := atomic.LoadInt32(&received); r != 2 {
+		t.Errorf("connections from one host should share a limit of 2 messages, got %d", r)
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	r := newRateLimiter(&config.RateLimitConfig{
+		PerPeer: &config.Limit{Rate: 0.001, Burst: 3},
+		PerType: map[string]config.Limit{"limited": {Rate: 0.001, Burst: 1}},
+	})
+
+	limited := &transport.Message{Type: "limited"}
+	if _, ok := r.reserve(limited); !ok {
+		t.Fatal("first limited message should be allowed")
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := r.reserve(limited); ok {
+			t.Fatal("limited message over its type's burst should be rejected")
+		}
+	}
+
+	// Rejected messages don't use up the per peer bucket
+	other := &transport.Message{Type: "other"}
+	for i := 0; i < 2; i++ {
+		if _, ok := r.reserve(other); !ok {
+			t.Fatalf("message %d should fit in what's left of the per peer burst", i)
+		}
+	}
+	if _, ok := r.reserve(other); ok {
+		t.Error("message over the per peer burst should be rejected")
+	}
+}
+
+func TestRateLimiterExpiry(t *testing.T) {
+	conf := makeConfig(6000)
+	conf.RateLimit = &config.RateLimitConfig{PerPeer: &config.Limit{Rate: 1, Burst: 1}}
+	l := NewLegion(conf, nil)
+
+	peerFrom := func(ip string, port int) *Peer {
+		p := NewPeer(utils.LegionAddress{})
+		p.session = &fakeSession{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: port}}
+		return p
+	}
+
+	r := l.rateLimiterFor(peerFrom("10.0.0.1", 1000))
+	if l.rateLimiterFor(peerFrom("10.0.0.1", 2000)) != r {
+		t.Error("connections from the same host should share a rate limiter")
+	}
+
+	// An idle host is forgotten the next time the limiters are swept
+	l.limitersMux.Lock()
+	r.lastUsed = time.Now().Add(-2 * rateLimiterIdleExpiry)
+	l.limitersSwept = time.Time{}
+	l.limitersMux.Unlock()
+	l.rateLimiterFor(peerFrom("10.0.0.2", 1000))
+
+	l.limitersMux.Lock()
+	_, kept := l.limiters["10.0.0.1"]
+	l.limitersMux.Unlock()
+	if kept {
+		t.Error("idle host's rate limiter should have expired")
+	}
+}
+
+func replyFramework(delay time.Duration) *MessageFramework {
+	return &MessageFramework{callback: func(ctx *MessageContext) {
+		if ctx.Message.GetType() == "test" {
+			time.Sleep(delay)
+			ctx.Reply(ctx.Legion.NewMessage("test_reply", []byte{}))
+		}
+	}}
+}
+
+func TestRequestAnyAndAll(t *testing.T) {
+	lg := newConfiguredLegionGroup(3, func(i int, conf *config.LegionConfig) Framework {
+		switch i {
+		case 1:
+			return replyFramework(0)
+		case 2:
+			return replyFramework(200 * time.Millisecond)
+		}
+		return nil
+	})
+	lg.waitUntilStarted()
+	defer lg.stop()
+
+	l := lg.legions[0]
+	addresses := []utils.LegionAddress{lg.legions[1].Me(), lg.legions[2].Me()}
+
+	start := time.Now()
+	reply, err := l.RequestAny(l.NewMessage("test", []byte{}), addresses, RequestOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.From != lg.legions[1].Me() || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("the first reply should win, got one from %s after %s", reply.From, time.Since(start))
+	}
+
+	replies, err := l.RequestAll(l.NewMessage("test", []byte{}), addresses, RequestOptions{})
+	if err != nil || len(replies) != 2 {
+		t.Errorf("expected a reply from both peers, got %d: %v", len(replies), err)
+	}
+
+	// One peer that never answers, with a quorum of one
+	unreachable := append(addresses, utils.NewLegionAddress("localhost", 6130))
+	replies, err = l.RequestAll(l.NewMessage("test", []byte{}), unreachable, RequestOptions{Quorum: 1})
+	if err != nil || len(replies) != 1 {
+		t.Errorf("quorum of one should return a single reply, got %d: %v", len(replies), err)
+	}
+
+	replies, err = l.RequestAll(l.NewMessage("test", []byte{}), unreachable, RequestOptions{})
+	if err != ErrQuorumNotReached || len(replies) != 2 {
+		t.Errorf("expected the quorum to fail with two replies, got %d: %v", len(replies), err)
+	}
+}
+
+func TestRequestRetry(t *testing.T) {
+	// Ignore the first request
+	var attempts int32
+	lg := newConfiguredLegionGroup(2, func(i int, conf *config.LegionConfig) Framework {
+		return &MessageFramework{callback: func(ctx *MessageContext) {
+			if i == 1 && atomic.AddInt32(&attempts, 1) > 1 {
+				ctx.Reply(ctx.Legion.NewMessage("test_reply", []byte{}))
+			}
+		}}
+	})
+	lg.waitUntilStarted()
+	defer lg.stop()
+
+	l := lg.legions[0]
+	opts := RequestOptions{Timeout: 50 * time.Millisecond, Retry: RetryPolicy{Attempts: 3, Backoff: 10 * time.Millisecond}}
+	if _, err := l.RequestAny(l.NewMessage("test", []byte{}), []utils.LegionAddress{lg.legions[1].Me()}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if a := atomic.LoadInt32(&attempts); a != 2 {
+		t.Errorf("expected 2 attempts, got %d", a)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	r := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	expected := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond}
+	for i, e := range expected {
+		if b := r.backoff(i + 1); b != e {
+			t.Errorf("retry %d should back off %s, was %s", i+1, e, b)
+		}
+	}
+}
+
+func TestSendAcked(t *testing.T) {
+	var received int32
+	receiver := NewLegion(makeConfig(6140), &MessageFramework{callback: func(ctx *MessageContext) {
+		if ctx.Message.GetType() == "test" {
+			atomic.AddInt32(&received, 1)
+		}
+	}})
+	sender := NewLegion(makeConfig(6141), nil)
+	for _, l := range []*Legion{receiver, sender} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sender.SendAcked(ctx, sender.NewMessage("test", []byte{}), receiver.Me()); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := sender.outbox.All(); len(entries) != 0 {
+		t.Error("acked message should be removed from the outbox")
+	}
+
+	// A retransmitted message with the same ID is acked but not delivered twice
+	m := sender.NewMessage("test", []byte{})
+	m.MessageId = "duplicate"
+	m.AckRequested = true
+	sender.Broadcast(m, receiver.Me())
+	sender.Broadcast(m, receiver.Me())
+	time.Sleep(100 * time.Millisecond)
+
+	if r := atomic.LoadInt32(&received); r != 2 {
+		t.Errorf("expected 2 messages to be delivered, got %d", r)
+	}
+}
+
+func TestSendAckedGivesUp(t *testing.T) {
+	conf := makeConfig(6142)
+	conf.Ack = &config.AckConfig{Timeout: 20 * time.Millisecond, MaxAttempts: 2}
+	l := NewLegion(conf, nil)
+	go l.Listen()
+	l.Started()
+	defer l.Stop()
+
+	err := l.SendAcked(context.Background(), l.NewMessage("test", []byte{}), utils.NewLegionAddress("localhost", 6143))
+	if err != ErrNotAcked {
+		t.Errorf("expected ErrNotAcked, got: %v", err)
+	}
+	if entries, _ := l.outbox.All(); len(entries) != 0 {
+		t.Error("message should be removed from the outbox after giving up")
+	}
+}
+
+// rejectFramework fails validation for messages of one type
+type rejectFramework struct {
+	MessageFramework
+	reject string
+}
+
+func (f *rejectFramework) ValidateMessage(ctx *MessageContext) bool {
+	return ctx.Message.GetType() != f.reject
+}
+
+func TestSendAckedRejected(t *testing.T) {
+	var received int32
+	receiver := NewLegion(makeConfig(6209), &rejectFramework{reject: "rejected", MessageFramework: MessageFramework{callback: func(ctx *MessageContext) {
+		atomic.AddInt32(&received, 1)
+	}}})
+	conf := makeConfig(6210)
+	conf.Ack = &config.AckConfig{Timeout: 50 * time.Millisecond, MaxAttempts: 2}
+	sender := NewLegion(conf, nil)
+	for _, l := range []*Legion{receiver, sender} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+
+	err := sender.SendAcked(context.Background(), sender.NewMessage("rejected", []byte{}), receiver.Me())
+	if err != ErrNotAcked {
+		t.Errorf("a message that failed validation should not be acked, got: %v", err)
+	}
+	if r := atomic.LoadInt32(&received); r != 0 {
+		t.Errorf("rejected message was delivered %d times", r)
+	}
+
+	// An accepted message is still acked
+	if err := sender.SendAcked(context.Background(), sender.NewMessage("test", []byte{}), receiver.Me()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSendAckedForgedAck(t *testing.T) {
+	receiver := NewLegion(makeConfig(6224), &rejectFramework{reject: "test"})
+	conf := makeConfig(6225)
+	conf.Ack = &config.AckConfig{Timeout: 50 * time.Millisecond, MaxAttempts: 3}
+	sender := NewLegion(conf, nil)
+	forger := NewLegion(makeConfig(6226), nil)
+	for _, l := range []*Legion{receiver, sender, forger} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+
+	// The receiver never acks the message, so only the forger does
+	m := &transport.Message{Type: "test", Sender: sender.Me().String(), MessageId: "forged", AckRequested: true}
+	b, _ := m.Marshal()
+	d := sender.startDelivery(outbox.Entry{ID: m.MessageId, Address: receiver.Me(), Message: b, Created: time.Now()})
+	for i := 0; i < 5; i++ {
+		forger.Broadcast(&transport.Message{Type: ackType, MessageId: m.MessageId, Sender: forger.Me().String()}, sender.Me())
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	<-d.done
+	if d.err != ErrNotAcked {
+		t.Errorf("an ack from another peer should be ignored, got: %v", d.err)
+	}
+}
+
+func TestOutboxResumed(t *testing.T) {
+	received := make(chan struct{}, 1)
+	receiver := NewLegion(makeConfig(6144), &MessageFramework{callback: func(ctx *MessageContext) {
+		if ctx.Message.GetType() == "test" {
+			received <- struct{}{}
+		}
+	}})
+	go receiver.Listen()
+	receiver.Started()
+	defer receiver.Stop()
+
+	// A message left over from a previous run
+	conf := makeConfig(6145)
+	ob := outbox.NewMemoryOutbox()
+	m := &transport.Message{Type: "test", Sender: conf.AdvertiseAddress.String(), MessageId: "left-over", AckRequested: true}
+	b, _ := m.Marshal()
+	ob.Put(outbox.Entry{ID: m.MessageId, Address: receiver.Me(), Message: b, Created: time.Now()})
+	conf.Ack = &config.AckConfig{Outbox: ob}
+
+	sender := NewLegion(conf, nil)
+	go sender.Listen()
+	sender.Started()
+	defer sender.Stop()
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("message in the outbox was never delivered")
+	}
+
+	for i := 0; i < 20; i++ {
+		if entries, _ := ob.All(); len(entries) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("delivered message was not removed from the outbox")
+}
+
+func TestPriorityClassify(t *testing.T) {
+	s := newScheduler(&config.PriorityConfig{Classes: map[string]config.Priority{
+		"bulk.":         config.PriorityBulk,
+		"bulk.urgent.":  config.PriorityHigh,
+		"dht.transfer.": config.PriorityBulk,
+	}}, map[string]config.Priority{"dht.": config.PriorityHigh, "bulk.": config.PriorityHigh})
+
+	tests := []struct {
+		m        *transport.Message
+		expected config.Priority
+	}{
+		{&transport.Message{Type: "test"}, config.PriorityNormal},
+		{&transport.Message{Type: "test", IsReply: true}, config.PriorityHigh},
+		{&transport.Message{Type: handshakeType}, config.PriorityHigh},
+		{&transport.Message{Type: "dht.ping"}, config.PriorityHigh},
+		{&transport.Message{Type: "dht.transfer.chunk"}, config.PriorityBulk},
+		{&transport.Message{Type: "bulk.file"}, config.PriorityBulk},
+		{&transport.Message{Type: "bulk.urgent.file"}, config.PriorityHigh},
+		{&transport.Message{Type: "other.dht.ping"}, config.PriorityNormal},
+	}
+	for _, test := range tests {
+		if p := s.classify(test.m); p != test.expected {
+			t.Errorf("%s should have priority %d, had %d", test.m.Type, test.expected, p)
+		}
+	}
+}
+
+func TestPriorityWeights(t *testing.T) {
+	s := newScheduler(&config.PriorityConfig{Weights: map[config.Priority]int{config.PriorityHigh: 3}}, nil)
+
+	high, normal, bulk := config.PriorityHigh, config.PriorityNormal, config.PriorityBulk
+
+	// Every round interleaves the classes by weight in the same order, and
+	// the classes after the scheduled one are tried by rank
+	expected := []config.Priority{normal, high, normal, high, bulk, normal, high, normal}
+	if len(s.slots) != len(expected) {
+		t.Fatalf("a round should have %d slots, had %d", len(expected), len(s.slots))
+	}
+	for round := 0; round < 3; round++ {
+		for i, class := range expected {
+			order := s.order()
+			if order[0] != class {
+				t.Errorf("round %d slot %d should be class %d, was %d", round, i, class, order[0])
+			}
+			for j, rest := 1, 0; j < len(order); j++ {
+				for priorityRank[rest] == class {
+					rest++
+				}
+				if order[j] != priorityRank[rest] {
+					t.Errorf("round %d slot %d should fall back by rank, got %v", round, i, order)
+				}
+				rest++
+			}
+		}
+	}
+
+	// With the default weights bulk still gets a slot in every round
+	s = newScheduler(nil, nil)
+	for round := 0; round < 3; round++ {
+		bulkSlots := 0
+		for i := 0; i < len(s.slots); i++ {
+			if s.order()[0] == bulk {
+				bulkSlots++
+			}
+		}
+		if bulkSlots != 1 {
+			t.Errorf("bulk should have 1 slot in round %d, had %d", round, bulkSlots)
+		}
+	}
+}
+
+func TestPrioritySendOrder(t *testing.T) {
+	p := NewPeer(utils.LegionAddress{})
+	p.session = &fakeSession{}
+	p.scheduler = newScheduler(&config.PriorityConfig{Weights: map[config.Priority]int{
+		config.PriorityHigh:   2,
+		config.PriorityNormal: 1,
+		config.PriorityBulk:   1,
+	}}, nil)
+
+	// Fill every queue before anything is sent
+	for i := 0; i < 10; i++ {
+		p.QueueMessageWithPriority(&transport.Message{Type: "high"}, config.PriorityHigh)
+		p.QueueMessageWithPriority(&transport.Message{Type: "normal"}, config.PriorityNormal)
+		p.QueueMessageWithPriority(&transport.Message{Type: "bulk"}, config.PriorityBulk)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		m, _ := p.nextMessage()
+		counts[m.Type]++
+	}
+	if counts["high"] != 4 || counts["normal"] != 2 || counts["bulk"] != 2 {
+		t.Errorf("messages were not sent by weight: %v", counts)
+	}
+}
+
+// priorityFramework marks "urgent." messages as high priority
+type priorityFramework struct {
+	GenericFramework
+}
+
+func (*priorityFramework) MessagePriorities() map[string]config.Priority {
+	return map[string]config.Priority{"urgent.": config.PriorityHigh}
+}
+
+func TestPriorityUnderLoad(t *testing.T) {
+	var arrivals []string
+	var mux sync.Mutex
+	done := make(chan struct{})
+	receiver := NewLegion(makeConfig(6213), &MessageFramework{callback: func(ctx *MessageContext) {
+		mux.Lock()
+		defer mux.Unlock()
+		arrivals = append(arrivals, ctx.Message.GetType())
+		if len(arrivals) == 45 {
+			close(done)
+		}
+	}})
+
+	conf := makeConfig(6214)
+	conf.Priorities = &config.PriorityConfig{
+		Classes:            map[string]config.Priority{"bulk.": config.PriorityBulk},
+		MaxConcurrentSends: 1,
+	}
+	sender := NewLegion(conf, &priorityFramework{})
+	for _, l := range []*Legion{receiver, sender} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+	if err := sender.AddPeer(receiver.Me()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flood the peer with bulk messages, urgent ones queued after them
+	// should overtake most of the flood
+	for i := 0; i < 40; i++ {
+		sender.Broadcast(sender.NewMessage("bulk.chunk", make([]byte, 512<<10)), receiver.Me())
+	}
+	for i := 0; i < 5; i++ {
+		sender.Broadcast(sender.NewMessage("urgent.chunk", make([]byte, 512<<10)), receiver.Me())
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not all messages arrived")
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	last := 0
+	for i, messageType := range arrivals {
+		if messageType == "urgent.chunk" {
+			last = i
+		}
+	}
+	if last >= 20 {
+		t.Errorf("urgent messages should overtake the bulk flood, the last arrived at %d: %v", last, arrivals)
+	}
+}
+
+func TestPeerStats(t *testing.T) {
+	p := NewPeer(utils.LegionAddress{})
+	p.recordPong(100 * time.Millisecond)
+	s := p.Stats()
+	if s.RTT != 100*time.Millisecond || s.Samples != 1 || !s.Measured() {
+		t.Errorf("first sample should set the RTT: %+v", s)
+	}
+
+	p.recordPong(200 * time.Millisecond)
+	s = p.Stats()
+	if s.RTT != 112500*time.Microsecond || s.LastRTT != 200*time.Millisecond {
+		t.Errorf("RTT should move an eighth of the way to the new sample: %+v", s)
+	}
+	if s.Jitter != 62500*time.Microsecond {
+		t.Errorf("jitter should move a quarter of the way to the new difference: %+v", s)
+	}
+
+	p.recordMissedPing(2)
+	if p.Stats().Degraded {
+		t.Error("peer should not be degraded after one missed ping")
+	}
+	p.recordMissedPing(2)
+	if !p.Stats().Degraded || p.Stats().Measured() {
+		t.Error("peer should be degraded after two missed pings")
+	}
+
+	p.recordPong(100 * time.Millisecond)
+	if p.Stats().Degraded || p.Stats().MissedPings != 0 {
+		t.Error("a pong should recover the peer")
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	legions := make([]*Legion, 2)
+	for i := range legions {
+		conf := makeConfig(6150 + uint16(i))
+		conf.Heartbeat = &config.HeartbeatConfig{Interval: 20 * time.Millisecond}
+		legions[i] = NewLegion(conf, nil)
+		go legions[i].Listen()
+		legions[i].Started()
+		defer legions[i].Stop()
+	}
+
+	if err := legions[0].AddPeer(legions[1].Me()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	s, ok := legions[0].PeerStats(legions[1].Me())
+	if !ok || s.Samples == 0 || !s.Measured() || s.RTT == 0 {
+		t.Errorf("peer should have been pinged: %+v", s)
+	}
+
+	if peers := legions[0].LowestLatencyPeers(5); len(peers) != 1 {
+		t.Errorf("expected one low latency peer, got %d", len(peers))
+	}
+}
+
+func TestBroadcastRandomPrefersHealthy(t *testing.T) {
+	counts := make([]uint64, 10)
+	lg := newConfiguredLegionGroup(10, func(i int, conf *config.LegionConfig) Framework {
+		return &MessageFramework{callback: func(ctx *MessageContext) {
+			if ctx.Message.GetType() == "test" {
+				atomic.AddUint64(&counts[i], 1)
+			}
+		}}
+	})
+	lg.waitUntilStarted()
+
+	lg.connect()
+	defer lg.stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Mark half of the peers as degraded
+	for _, leg := range lg.legions[5:] {
+		p, _ := lg.legions[0].peers.Load(leg.Me())
+		p.recordMissedPing(1)
+	}
+
+	lg.legions[0].BroadcastRandom(lg.legions[0].NewMessage("test", []byte{}), 4)
+	time.Sleep(300 * time.Millisecond)
+
+	for i := range lg.legions[5:] {
+		if atomic.LoadUint64(&counts[i+5]) != 0 {
+			t.Errorf("degraded peer %d should not have been picked", i+5)
+		}
+	}
+}
+
+func TestPeerSet(t *testing.T) {
+	s := NewPeerSet()
+	peers := make([]*Peer, 5)
+	for i := range peers {
+		addr := utils.NewLegionAddress("localhost", uint16(7000+i))
+		peers[i] = NewPeer(addr)
+		if _, stored := s.LoadOrStore(addr, peers[i]); stored {
+			t.Fatal("peer should not already be stored")
+		}
+	}
+	if s.Len() != 5 {
+		t.Errorf("expected 5 peers, got %d", s.Len())
+	}
+
+	s.Tag(peers[0].Remote(), "bootstrap", "trusted")
+	s.Tag(peers[1].Remote(), "trusted")
+	if trusted := s.Select(WithTag("trusted")); len(trusted) != 2 {
+		t.Errorf("expected 2 trusted peers, got %d", len(trusted))
+	}
+	if others := s.Select(Not(WithTag("trusted"))); len(others) != 3 {
+		t.Errorf("expected 3 untrusted peers, got %d", len(others))
+	}
+	s.Untag(peers[0].Remote(), "trusted")
+	if tags := s.Tags(peers[0].Remote()); len(tags) != 1 || tags[0] != "bootstrap" {
+		t.Errorf("wrong tags after untagging: %v", tags)
+	}
+
+	s.SetIdentity(peers[2].Remote(), "0xabc")
+	if p, ok := s.ByIdentity("0xabc"); !ok || p != peers[2] {
+		t.Error("peer was not indexed by identity")
+	}
+
+	// Removing a peer in the middle keeps the rest sampleable
+	s.Delete(peers[2].Remote())
+	if _, ok := s.ByIdentity("0xabc"); ok {
+		t.Error("identity index should be cleaned up when the peer is removed")
+	}
+	if s.Len() != 4 {
+		t.Errorf("expected 4 peers, got %d", s.Len())
+	}
+
+	for i := 0; i < 20; i++ {
+		sample := s.Sample(3)
+		seen := make(map[*Peer]bool)
+		for _, p := range sample {
+			if p == peers[2] || seen[p] {
+				t.Fatal("sample should only have distinct peers in the set")
+			}
+			seen[p] = true
+		}
+		if len(sample) != 3 {
+			t.Fatalf("expected a sample of 3, got %d", len(sample))
+		}
+	}
+	if len(s.Sample(10)) != 4 {
+		t.Error("sample larger than the set should return the whole set")
+	}
+	if sample := s.Sample(10, WithTag("bootstrap")); len(sample) != 1 || sample[0] != peers[0] {
+		t.Error("filtered sample should only return matching peers")
+	}
+
+	// Peers can be removed while ranging
+	s.Range(func(p *Peer) bool { s.Delete(p.Remote()); return true })
+	if s.Len() != 0 {
+		t.Error("every peer should have been removed")
+	}
+
+	// Degraded peers are kept apart so healthy ones can be sampled quickly
+	health := NewPeerSet()
+	for i := range peers {
+		peers[i].onHealthChange = health.updateHealth
+		health.LoadOrStore(peers[i].Remote(), peers[i])
+	}
+	checkHealth := func() {
+		for i, e := range health.list {
+			if e.index != i || (i < health.healthy) == e.peer.Stats().Degraded {
+				t.Fatalf("entry %d is out of place, healthy boundary %d", i, health.healthy)
+			}
+		}
+	}
+	peers[1].recordMissedPing(1)
+	peers[3].recordMissedPing(1)
+	checkHealth()
+	for i := 0; i < 20; i++ {
+		for _, p := range health.sampleHealthyFirst(3) {
+			if p.Stats().Degraded {
+				t.Fatal("degraded peer picked while there were enough healthy ones")
+			}
+		}
+	}
+	if sample := health.sampleHealthyFirst(5); len(sample) != 5 {
+		t.Errorf("degraded peers should fill the sample, got %d", len(sample))
+	}
+	health.Delete(peers[0].Remote())
+	health.Delete(peers[3].Remote())
+	checkHealth()
+	peers[1].recordPong(time.Millisecond)
+	checkHealth()
+	if health.healthy != 3 {
+		t.Errorf("expected 3 healthy peers, got %d", health.healthy)
+	}
+
+	// Entries kept by a filter can be read while the set is changed
+	s.LoadOrStore(peers[0].Remote(), peers[0])
+	var kept *PeerEntry
+	s.Select(func(e *PeerEntry) bool { kept = e; return true })
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.Tag(peers[0].Remote(), "busy")
+			s.Untag(peers[0].Remote(), "busy")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		kept.HasTag("busy")
+	}
+	<-done
+	s.Delete(peers[0].Remote())
+
+	// Cleanup of an old connection doesn't remove a new one
+	old, current := NewPeer(peers[0].Remote()), NewPeer(peers[0].Remote())
+	s.LoadOrStore(current.Remote(), current)
+	s.deletePeer(old.Remote(), old)
+	if _, ok := s.Load(current.Remote()); !ok {
+		t.Error("new connection should not be removed by the old one's cleanup")
+	}
+}
+
+type disconnectFramework struct {
+	GenericFramework
+	key          *AttachmentKey
+	disconnected chan interface{}
+}
+
+func (f *disconnectFramework) PeerDisconnect(ctx *PeerContext) {
+	value, _ := ctx.Peer.Attachment(f.key)
+	f.disconnected <- value
+}
+
+func TestPeerMetadata(t *testing.T) {
+	key := NewAttachmentKey("test")
+	f := &disconnectFramework{key: key, disconnected: make(chan interface{}, 1)}
+
+	conf := makeConfig(6160)
+	conf.Capabilities = []string{"test/1"}
+	dialer := NewLegion(conf, f)
+	listener := NewLegion(makeConfig(6161), nil)
+	for _, l := range []*Legion{dialer, listener} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+
+	before := time.Now()
+	if err := dialer.AddPeer(listener.Me()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Incoming peers are stored on their first message
+	dialer.Broadcast(dialer.NewMessage("test", []byte{}))
+	time.Sleep(50 * time.Millisecond)
+
+	p, _ := dialer.Peers().Load(listener.Me())
+	if p.Direction() != Outbound || p.ConnectedAt().Before(before) {
+		t.Errorf("wrong direction or connect time: %s %s", p.Direction(), p.ConnectedAt())
+	}
+	if p.ObservedAddress().String() != "127.0.0.1:6161" {
+		t.Errorf("wrong observed address: %s", p.ObservedAddress())
+	}
+	if !p.HasCapability(CapabilityPing) {
+		t.Errorf("peer should advertise legion's capabilities: %v", p.Capabilities())
+	}
+
+	var incoming *Peer
+	listener.Peers().Range(func(p *Peer) bool { incoming = p; return false })
+	if incoming == nil || incoming.Direction() != Inbound || !incoming.HasCapability("test/1") {
+		t.Error("listener should see an inbound peer with the dialer's capabilities")
+	}
+
+	p.Attach(key, "value")
+	if v, ok := p.Attachment(key); !ok || v != "value" {
+		t.Error("attachment was not stored")
+	}
+	if _, ok := p.Attachment(NewAttachmentKey("test")); ok {
+		t.Error("keys with the same name should not collide")
+	}
+
+	// The framework can still see attachments when the peer disconnects
+	dialer.DeletePeer(listener.Me())
+	select {
+	case v := <-f.disconnected:
+		if v != "value" {
+			t.Errorf("attachment should be visible in PeerDisconnect, got: %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("disconnect event never fired")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := p.Attachment(key); ok {
+		t.Error("attachments should be cleared after the peer disconnects")
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	b := newMemoryBudget(100)
+	if b.acquire(101, nil) {
+		t.Error("should not acquire more than the limit")
+	}
+	if !b.acquire(60, nil) {
+		t.Fatal("should acquire within the limit")
+	}
+
+	// A second acquire waits until the first is released
+	acquired := make(chan bool)
+	go func() { acquired <- b.acquire(60, nil) }()
+	select {
+	case <-acquired:
+		t.Fatal("acquire should wait while the budget is used")
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.release(60)
+	if !<-acquired {
+		t.Fatal("acquire should succeed once memory is released")
+	}
+
+	// Closing done stops the wait
+	done := make(chan struct{})
+	go func() { acquired <- b.acquire(60, done) }()
+	close(done)
+	if <-acquired {
+		t.Error("acquire should fail once done is closed")
+	}
+
+	if newMemoryBudget(0) != nil || !newMemoryBudget(-1).acquire(1e9, nil) {
+		t.Error("a budget with no limit should never block")
+	}
+}
+
+func TestInflateWithinBudget(t *testing.T) {
+	p := NewPeer(utils.NewLegionAddress("localhost", 6000))
+	p.maxMessageSize = 1 << 20
+	p.budget = newMemoryBudget(1000)
+
+	gzip, _ := compress.Get(compress.Gzip)
+	compressed := func(size int) *transport.Message {
+		body, _ := gzip.Compress(make([]byte, size))
+		return &transport.Message{Type: "test", Body: body, Compression: compress.Gzip}
+	}
+
+	// A body that inflates past the free memory is rejected before it's all
+	// allocated, and nothing stays reserved
+	p.budget.acquire(400, nil)
+	if err := p.inflate(compressed(800)); err == nil {
+		t.Error("message inflating past the budget should be rejected")
+	}
+	if p.budget.used != 400 {
+		t.Errorf("rejected message should release its memory, %d bytes used", p.budget.used)
+	}
+
+	// An accepted body is held until the message is released
+	m := compressed(500)
+	if err := p.inflate(m); err != nil {
+		t.Fatal(err)
+	}
+	if p.budget.used != 900 {
+		t.Errorf("inflated body should be held, %d bytes used", p.budget.used)
+	}
+	p.releaseMessage(m)
+	p.budget.release(400)
+	if p.budget.used != 0 {
+		t.Errorf("budget should be empty after release, %d bytes used", p.budget.used)
+	}
+}
+
+// gatedFramework holds messages of one type in ValidateMessage until the gate
+// is closed
+type gatedFramework struct {
+	MessageFramework
+	gated     string
+	gate      chan struct{}
+	validated int32
+	peer      atomic.Value
+}
+
+func (f *gatedFramework) ValidateMessage(ctx *MessageContext) bool {
+	if ctx.Message.GetType() == f.gated {
+		f.peer.Store(ctx.Peer)
+		atomic.AddInt32(&f.validated, 1)
+		<-f.gate
+	}
+	return true
+}
+
+func TestPeerMemoryHeldUntilDispatch(t *testing.T) {
+	var delivered, rejected int32
+	f := &gatedFramework{gated: "big", gate: make(chan struct{}), MessageFramework: MessageFramework{callback: func(ctx *MessageContext) {
+		switch ctx.Message.GetType() {
+		case "big":
+			atomic.AddInt32(&delivered, 1)
+		case "huge", "bomb":
+			atomic.AddInt32(&rejected, 1)
+		}
+	}}}
+	conf := makeConfig(6211)
+	conf.MaxPeerMemory = 1 << 20
+	receiver := NewLegion(conf, f)
+	sender := NewLegion(makeConfig(6212), nil)
+	for _, l := range []*Legion{receiver, sender} {
+		go l.Listen()
+		l.Started()
+		defer l.Stop()
+	}
+
+	// Large messages on parallel streams, one larger than the whole budget,
+	// and one that inflates past what's left of it
+	for i := 0; i < 4; i++ {
+		sender.Broadcast(sender.NewMessage("big", make([]byte, 600<<10)), receiver.Me())
+	}
+	sender.Broadcast(sender.NewMessage("huge", make([]byte, 2<<20)), receiver.Me())
+	gzip, _ := compress.Get(compress.Gzip)
+	body, _ := gzip.Compress(make([]byte, 8<<20))
+	bomb := sender.NewMessage("bomb", body)
+	bomb.Compression = compress.Gzip
+	sender.Broadcast(bomb, receiver.Me())
+
+	time.Sleep(300 * time.Millisecond)
+
+	// Only one large message fits while it waits to be validated
+	if v := atomic.LoadInt32(&f.validated); v != 1 {
+		t.Errorf("expected 1 large message to be read while validation was blocked, got %d", v)
+	}
+	p, _ := f.peer.Load().(*Peer)
+	if p == nil {
+		t.Fatal("no message reached validation")
+	}
+	p.budget.mux.Lock()
+	used := p.budget.used
+	p.budget.mux.Unlock()
+	if used > conf.MaxPeerMemory || used < 600<<10 {
+		t.Errorf("budget should hold the message being validated, %d bytes used", used)
+	}
+
+	close(f.gate)
+	time.Sleep(300 * time.Millisecond)
+
+	if d := atomic.LoadInt32(&delivered); d != 4 {
+		t.Errorf("expected all 4 large messages to be delivered once memory was released, got %d", d)
+	}
+	if r := atomic.LoadInt32(&rejected); r != 0 {
+		t.Errorf("messages that don't fit in the budget should be rejected, %d were delivered", r)
+	}
+	p.budget.mux.Lock()
+	used = p.budget.used
+	p.budget.mux.Unlock()
+	if used != 0 {
+		t.Errorf("budget should be empty once messages are delivered, %d bytes used", used)
+	}
+}
+
+func TestReadMessageLimited(t *testing.T) {
+	var buf bytes.Buffer
+	writeMessage(&buf, &transport.Message{Type: "test", Body: make([]byte, 100)})
+	b := buf.Bytes()
+
+	if _, _, err := readMessageLimited(bytes.NewReader(b), 50, nil, nil); err == nil {
+		t.Error("message over the max size should be rejected")
+	}
+	if _, _, err := readMessageLimited(bytes.NewReader(b), 1000, newMemoryBudget(50), nil); err != errOverBudget {
+		t.Errorf("message over the budget should be rejected, got: %v", err)
+	}
+
+	budget := newMemoryBudget(1000)
+	m, size, err := readMessageLimited(bytes.NewReader(b), 1000, budget, nil)
+	if err != nil || m.Type != "test" {
+		t.Fatalf("message should be read, got: %v", err)
+	}
+	if budget.used != size || size != int64(len(b)-4) {
+		t.Errorf("message should stay reserved until released, %d bytes used for a %d byte message", budget.used, size)
+	}
+	budget.release(size)
+
+	// A truncated message gives its memory back
+	if _, _, err := readMessageLimited(bytes.NewReader(b[:50]), 1000, budget, nil); err == nil || budget.used != 0 {
+		t.Errorf("truncated message should fail and release its memory, got: %v with %d bytes used", err, budget.used)
+	}
+}
@@ -0,0 +1,228 @@
+package network
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/network/config"
+	"github.com/gladiusio/legion/network/ratelimit"
+	"github.com/gladiusio/legion/network/transport"
+	"go.uber.org/atomic"
+
+	log "github.com/gladiusio/legion/logger"
+)
+
+// RateLimitMetrics counts what happened to incoming messages that went through
+// the rate limiter
+type RateLimitMetrics struct {
+	// Allowed messages were within the limits
+	Allowed uint64
+
+	// Limited messages were over a limit, they are also counted as one of
+	// delayed, dropped or disconnected below
+	Limited uint64
+
+	Delayed      uint64
+	Dropped      uint64
+	Disconnected uint64
+
+	// Banned is how many peers were banned after too many penalties
+	Banned uint64
+
+	// LimitedByType is the number of limited messages of each type
+	LimitedByType map[string]uint64
+}
+
+// rateLimitMetrics is the live version of RateLimitMetrics
+type rateLimitMetrics struct {
+	allowed, limited, delayed, dropped, disconnected, banned atomic.Uint64
+
+	byType    map[string]uint64
+	byTypeMux sync.Mutex
+}
+
+func (m *rateLimitMetrics) limitedType(messageType string) {
+	m.limited.Inc()
+	m.byTypeMux.Lock()
+	m.byType[messageType]++
+	m.byTypeMux.Unlock()
+}
+
+// RateLimitMetrics returns a snapshot of the rate limiter metrics
+func (l *Legion) RateLimitMetrics() RateLimitMetrics {
+	m := &l.rateLimitMetrics
+	snapshot := RateLimitMetrics{
+		Allowed:       m.allowed.Load(),
+		Limited:       m.limited.Load(),
+		Delayed:       m.delayed.Load(),
+		Dropped:       m.dropped.Load(),
+		Disconnected:  m.disconnected.Load(),
+		Banned:        m.banned.Load(),
+		LimitedByType: make(map[string]uint64),
+	}
+
+	m.byTypeMux.Lock()
+	defer m.byTypeMux.Unlock()
+	for t, count := range m.byType {
+		snapshot.LimitedByType[t] = count
+	}
+	return snapshot
+}
+
+// rateLimiterIdleExpiry is how long a host's rate limit state is kept after
+// its last message
+const rateLimiterIdleExpiry = 10 * time.Minute
+
+// rateLimiterFor returns the rate limiter shared by every connection from the
+// peer's host, or nil if there are no limits configured. Hosts that have been
+// idle for longer than rateLimiterIdleExpiry are forgotten.
+func (l *Legion) rateLimiterFor(p *Peer) *rateLimiter {
+	if l.config.RateLimit == nil {
+		return nil
+	}
+
+	host := p.observedHost()
+	now := time.Now()
+
+	l.limitersMux.Lock()
+	defer l.limitersMux.Unlock()
+
+	if now.Sub(l.limitersSwept) > rateLimiterIdleExpiry/10 {
+		for h, r := range l.limiters {
+			if now.Sub(r.lastUsed) > rateLimiterIdleExpiry {
+				delete(l.limiters, h)
+			}
+		}
+		l.limitersSwept = now
+	}
+
+	r, ok := l.limiters[host]
+	if !ok {
+		r = newRateLimiter(l.config.RateLimit)
+		l.limiters[host] = r
+	}
+	r.lastUsed = now
+	return r
+}
+
+// newRateLimiter returns the buckets for a single host, or nil if there are
+// no limits configured
+func newRateLimiter(conf *config.RateLimitConfig) *rateLimiter {
+	if conf == nil {
+		return nil
+	}
+
+	r := &rateLimiter{conf: conf, perType: make(map[string]*ratelimit.Bucket)}
+	if conf.PerPeer != nil {
+		r.perPeer = ratelimit.NewBucket(conf.PerPeer.Rate, conf.PerPeer.Burst)
+	}
+	for t, limit := range conf.PerType {
+		r.perType[t] = ratelimit.NewBucket(limit.Rate, limit.Burst)
+	}
+	return r
+}
+
+// rateLimiter holds the token buckets for one host, it is shared by the
+// message listeners of all of the host's connections
+type rateLimiter struct {
+	conf    *config.RateLimitConfig
+	perPeer *ratelimit.Bucket
+	perType map[string]*ratelimit.Bucket
+
+	// How many times the host has gone over the limit
+	penalty atomic.Int32
+
+	// When the host last sent a message, guarded by the legion's limitersMux
+	lastUsed time.Time
+}
+
+// reserve takes a token from each bucket the message counts against, and
+// returns how long to wait before handling it or false if it is over a limit.
+// Tokens are only kept if every bucket allows the message.
+func (r *rateLimiter) reserve(m *transport.Message) (time.Duration, bool) {
+	var max time.Duration
+	if r.conf.Action == config.RateLimitDelay {
+		max = r.conf.MaxDelay
+		if max == 0 {
+			max = config.DefaultRateLimitMaxDelay
+		}
+	}
+
+	var wait time.Duration
+	var taken []*ratelimit.Bucket
+	for _, b := range []*ratelimit.Bucket{r.perPeer, r.perType[m.Type]} {
+		if b == nil {
+			continue
+		}
+		w, ok := b.Reserve(max)
+		if !ok {
+			for _, t := range taken {
+				t.Cancel()
+			}
+			return 0, false
+		}
+		taken = append(taken, b)
+		if w > wait {
+			wait = w
+		}
+	}
+	return wait, true
+}
+
+// allowMessage applies the rate limit to a message from the peer and returns
+// true if it should be handled
+func (l *Legion) allowMessage(p *Peer, m *transport.Message) bool {
+	r := l.rateLimiterFor(p)
+	if r == nil {
+		return true
+	}
+
+	metrics := &l.rateLimitMetrics
+	wait, ok := r.reserve(m)
+	if ok {
+		if wait > 0 {
+			metrics.delayed.Inc()
+			select {
+			case <-time.After(wait):
+			case <-p.closed:
+				return false
+			}
+		}
+		metrics.allowed.Inc()
+		return true
+	}
+
+	metrics.limitedType(m.Type)
+	logger := log.Debug().Field("remote", p.Remote().String()).Field("type", m.Type)
+
+	switch r.conf.Action {
+	case config.RateLimitDisconnect:
+		metrics.disconnected.Inc()
+		logger.Log("legion: peer went over the rate limit, disconnecting")
+		p.Close()
+	case config.RateLimitPenalize:
+		metrics.dropped.Inc()
+		penalty := r.penalty.Inc()
+
+		threshold := r.conf.PenaltyThreshold
+		if threshold == 0 {
+			threshold = config.DefaultPenaltyThreshold
+		}
+		if int(penalty) < threshold {
+			return false
+		}
+
+		duration := r.conf.PenaltyBanDuration
+		if duration == 0 {
+			duration = config.DefaultPenaltyBanDuration
+		}
+		metrics.banned.Inc()
+		logger.Log("legion: peer went over the rate limit too many times, banning")
+		if err := l.banPeer(p, duration); err != nil {
+			log.Warn().Field("err", err.Error()).Log("legion: could not ban peer")
+		}
+	default:
+		metrics.dropped.Inc()
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// memnet is an in process transport used for "mem://" addresses, each
+// listener is registered by name and dialing it creates a pipe
+
+var (
+	memListeners   = make(map[string]*memListener)
+	memListenersMu sync.Mutex
+)
+
+type memAddr string
+
+func (memAddr) Network() string  { return "mem" }
+func (a memAddr) String() string { return string(a) }
+
+// memConn overrides the addresses of a pipe so they are meaningful
+type memConn struct {
+	net.Conn
+	local, remote memAddr
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+type memListener struct {
+	name   string
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func memListen(name string) (net.Listener, error) {
+	memListenersMu.Lock()
+	defer memListenersMu.Unlock()
+	if _, exists := memListeners[name]; exists {
+		return nil, errors.New("memnet: address already in use")
+	}
+
+	l := &memListener{name: name, conns: make(chan net.Conn), closed: make(chan struct{})}
+	memListeners[name] = l
+	return l, nil
+}
+
+func memDial(name string) (net.Conn, error) {
+	memListenersMu.Lock()
+	l, exists := memListeners[name]
+	memListenersMu.Unlock()
+	if !exists {
+		return nil, errors.New("memnet: connection refused")
+	}
+
+	local, remote := net.Pipe()
+	select {
+	case l.conns <- &memConn{Conn: remote, local: memAddr(name), remote: memAddr("dialer")}:
+		return &memConn{Conn: local, local: memAddr("dialer"), remote: memAddr(name)}, nil
+	case <-l.closed:
+		return nil, errors.New("memnet: connection refused")
+	}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("memnet: listener closed")
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		memListenersMu.Lock()
+		delete(memListeners, l.name)
+		memListenersMu.Unlock()
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr { return memAddr(l.name) }
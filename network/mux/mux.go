@@ -0,0 +1,64 @@
+/*
+Package mux abstracts the stream multiplexer legion runs over each peer
+connection, so a different multiplexer can be swapped in by name.
+*/
+package mux
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/gladiusio/legion/network/config"
+)
+
+// Yamux is the name of the default multiplexer
+const Yamux = "yamux"
+
+// Session is a multiplexed connection to a remote that streams can be
+// opened and accepted on
+type Session interface {
+	// Open opens a new outgoing stream
+	Open() (net.Conn, error)
+
+	// Accept blocks until the remote opens a new stream
+	Accept() (net.Conn, error)
+
+	// CloseChan returns a channel that is closed when the session closes
+	CloseChan() <-chan struct{}
+
+	IsClosed() bool
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// Muxer creates the client and server sides of a session from a connection
+type Muxer interface {
+	Client(conn net.Conn, conf *config.SessionConfig) (Session, error)
+	Server(conn net.Conn, conf *config.SessionConfig) (Session, error)
+}
+
+var (
+	muxers   = map[string]Muxer{Yamux: &yamuxMuxer{}}
+	muxersMu sync.RWMutex
+)
+
+// Register makes a muxer available by name, registering a name twice
+// replaces the previous muxer
+func Register(name string, m Muxer) {
+	muxersMu.Lock()
+	defer muxersMu.Unlock()
+	muxers[name] = m
+}
+
+// Get returns the muxer registered with the name
+func Get(name string) (Muxer, error) {
+	muxersMu.RLock()
+	defer muxersMu.RUnlock()
+	m, ok := muxers[name]
+	if !ok {
+		return nil, fmt.Errorf("mux: no multiplexer registered with name: %s", name)
+	}
+	return m, nil
+}
@@ -0,0 +1,56 @@
+package mux
+
+import (
+	"net"
+
+	"github.com/gladiusio/legion/logger"
+	"github.com/gladiusio/legion/network/config"
+	"github.com/hashicorp/yamux"
+)
+
+type yamuxMuxer struct{}
+
+// Client sets up the client side of a yamux session
+func (*yamuxMuxer) Client(conn net.Conn, conf *config.SessionConfig) (Session, error) {
+	return yamux.Client(conn, YamuxConfig(conf))
+}
+
+// Server sets up the server side of a yamux session
+func (*yamuxMuxer) Server(conn net.Conn, conf *config.SessionConfig) (Session, error) {
+	return yamux.Server(conn, YamuxConfig(conf))
+}
+
+// YamuxConfig builds a yamux config from the defaults, overriding anything
+// that is set in the session config
+func YamuxConfig(sc *config.SessionConfig) *yamux.Config {
+	c := yamux.DefaultConfig()
+	c.LogOutput = &logWriter{}
+	if sc == nil {
+		return c
+	}
+
+	if sc.AcceptBacklog != 0 {
+		c.AcceptBacklog = sc.AcceptBacklog
+	}
+	if sc.DisableKeepAlive {
+		c.EnableKeepAlive = false
+	}
+	if sc.KeepAliveInterval != 0 {
+		c.KeepAliveInterval = sc.KeepAliveInterval
+	}
+	if sc.ConnectionWriteTimeout != 0 {
+		c.ConnectionWriteTimeout = sc.ConnectionWriteTimeout
+	}
+	if sc.MaxStreamWindowSize != 0 {
+		c.MaxStreamWindowSize = sc.MaxStreamWindowSize
+	}
+
+	return c
+}
+
+type logWriter struct{}
+
+func (*logWriter) Write(p []byte) (int, error) {
+	logger.Debug().Field("yamux_message", string(p))
+	return len(p), nil
+}
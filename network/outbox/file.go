@@ -0,0 +1,111 @@
+package outbox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NewFileOutbox returns an outbox that is loaded from and saved to a JSON file
+// at the path. Every change is synced to disk before it returns, so queued
+// messages survive a crash.
+func NewFileOutbox(path string) (*FileOutbox, error) {
+	f := &FileOutbox{MemoryOutbox: NewMemoryOutbox(), path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0)
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		f.MemoryOutbox.entries[e.ID] = e
+	}
+	return f, nil
+}
+
+// FileOutbox is an Outbox that persists to a local JSON file
+type FileOutbox struct {
+	*MemoryOutbox
+	path string
+}
+
+// Assert the type is correct
+var _ Outbox = (*FileOutbox)(nil)
+
+// Put stores the entry and writes the outbox to disk
+func (f *FileOutbox) Put(e Entry) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.entries[e.ID] = e
+	return f.save()
+}
+
+// Delete removes the entry and writes the outbox to disk
+func (f *FileOutbox) Delete(id string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if _, ok := f.entries[id]; !ok {
+		return nil
+	}
+	delete(f.entries, id)
+	return f.save()
+}
+
+// save writes to a temporary file and renames it so the outbox is never
+// left half written, the lock must be held
+func (f *FileOutbox) save() error {
+	entries := make([]Entry, 0, len(f.entries))
+	for _, e := range f.entries {
+		entries = append(entries, e)
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Sync before renaming, otherwise a crash can leave the renamed file
+	// empty
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(f.path))
+	return nil
+}
+
+// syncDir flushes the directory so a rename in it is on disk. Not every
+// platform can sync a directory, so errors are ignored.
+func syncDir(path string) {
+	d, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,88 @@
+/*
+Package outbox stores messages that are waiting to be acknowledged by a peer,
+so they can be retransmitted until they are.
+*/
+package outbox
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/utils"
+)
+
+// Entry is a message waiting to be acknowledged
+type Entry struct {
+	// ID is the message ID the remote acks
+	ID string `json:"id"`
+
+	// Address is the peer the message is sent to
+	Address utils.LegionAddress `json:"address"`
+
+	// Message is the marshalled message
+	Message []byte `json:"message"`
+
+	// Created is when the message was first queued
+	Created time.Time `json:"created"`
+}
+
+// Outbox stores unacknowledged messages
+type Outbox interface {
+	// Put stores the entry, replacing any with the same ID
+	Put(e Entry) error
+
+	// Delete removes the entry with the ID
+	Delete(id string) error
+
+	// All returns every entry, oldest first
+	All() ([]Entry, error)
+
+	// Close releases the outbox
+	Close() error
+}
+
+// NewMemoryOutbox returns an outbox that only lives in memory
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{entries: make(map[string]Entry)}
+}
+
+// MemoryOutbox is an in memory Outbox
+type MemoryOutbox struct {
+	entries map[string]Entry
+	mux     sync.RWMutex
+}
+
+// Assert the type is correct
+var _ Outbox = (*MemoryOutbox)(nil)
+
+// Put stores the entry
+func (m *MemoryOutbox) Put(e Entry) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.entries[e.ID] = e
+	return nil
+}
+
+// Delete removes the entry with the ID
+func (m *MemoryOutbox) Delete(id string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	delete(m.entries, id)
+	return nil
+}
+
+// All returns every entry, oldest first
+func (m *MemoryOutbox) All() ([]Entry, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	all := make([]Entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		all = append(all, e)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Created.Before(all[j].Created) })
+	return all, nil
+}
+
+// Close does nothing for a memory outbox
+func (m *MemoryOutbox) Close() error { return nil }
@@ -0,0 +1,60 @@
+package outbox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/legion/utils"
+)
+
+func TestMemoryOutbox(t *testing.T) {
+	o := NewMemoryOutbox()
+	now := time.Now()
+	o.Put(Entry{ID: "b", Created: now.Add(time.Second)})
+	o.Put(Entry{ID: "a", Created: now})
+
+	all, _ := o.All()
+	if len(all) != 2 || all[0].ID != "a" || all[1].ID != "b" {
+		t.Errorf("entries should be returned oldest first: %+v", all)
+	}
+
+	o.Delete("a")
+	if all, _ := o.All(); len(all) != 1 {
+		t.Error("entry was not deleted")
+	}
+}
+
+func TestFileOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox.json")
+
+	o, err := NewFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := Entry{ID: "a", Address: utils.NewLegionAddress("localhost", 7000), Message: []byte{1, 2, 3}, Created: time.Now().Round(time.Second)}
+	o.Put(e)
+	o.Put(Entry{ID: "b"})
+	o.Delete("b")
+
+	// No Close, every change should already be on disk
+	o, err = NewFileOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, _ := o.All()
+	if len(all) != 1 {
+		t.Fatalf("expected one entry after reloading, got %d", len(all))
+	}
+	if all[0].ID != e.ID || all[0].Address != e.Address || !bytes.Equal(all[0].Message, e.Message) || !all[0].Created.Equal(e.Created) {
+		t.Errorf("reloaded entry does not match: %+v", all[0])
+	}
+}
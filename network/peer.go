@@ -1,29 +1,46 @@
 package network
 
 import (
-	"bufio"
-	"encoding/binary"
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/gladiusio/legion/logger"
+	"github.com/gladiusio/legion/network/config"
+	"github.com/gladiusio/legion/network/mux"
 	"github.com/gladiusio/legion/network/transport"
 	"github.com/gladiusio/legion/utils"
-	"github.com/gogo/protobuf/proto"
-	"github.com/hashicorp/yamux"
 	"go.uber.org/atomic"
 )
 
 // NewPeer returns a new peer from the given remote. It also
 // sets up the reading and writing channels
 func NewPeer(remote utils.LegionAddress) *Peer {
+	return NewPeerWithConfig(remote, nil)
+}
+
+// NewPeerWithConfig returns a new peer from the given remote that will tune
+// its session with the provided config, a nil config uses the defaults
+func NewPeerWithConfig(remote utils.LegionAddress, sessionConfig *config.SessionConfig) *Peer {
+	muxer, _ := mux.Get(mux.Yamux)
 	p := &Peer{
-		remote:      remote,
-		sendQueue:   make(chan *transport.Message),
-		receiveChan: make(chan (*transport.Message)),
-		requests:    make(map[uint64]chan *transport.Message),
+		remote:         remote,
+		muxer:          muxer,
+		sessionConfig:  sessionConfig,
+		scheduler:      newScheduler(nil, nil),
+		sendSlots:      make(chan struct{}, config.DefaultMaxConcurrentSends),
+		maxMessageSize: config.DefaultMaxMessageSize,
+		budget:         newMemoryBudget(config.DefaultMaxPeerMemory),
+		receiveChan:    make(chan (*transport.Message)),
+		requests:       make(map[uint64]chan *transport.Message),
+		closed:         make(chan struct{}),
+	}
+
+	for i := range p.sendQueues {
+		p.sendQueues[i] = make(chan *transport.Message)
 	}
 
 	return p
@@ -32,18 +49,97 @@ func NewPeer(remote utils.LegionAddress) *Peer {
 // Peer is an type that allows easy communication with
 // a remote peer
 type Peer struct {
-	// The remote Address to dial
-	remote utils.LegionAddress
+	// The remote Address to dial, an incoming peer learns it from the
+	// first valid message so it is guarded by remoteMux
+	remote    utils.LegionAddress
+	remoteMux sync.RWMutex
 
-	// The internal channel we write to to send a new message
-	// to the remote
-	sendQueue chan *transport.Message
+	// The internal channels we write to to send a new message to the
+	// remote, one for each priority class
+	sendQueues [config.NumPriorities]chan *transport.Message
+
+	// Classifies outgoing messages and picks which queue to send from next,
+	// and limits how many messages are written at once without stream reuse
+	scheduler *scheduler
+	sendSlots chan struct{}
 
 	// The channel of incoming messages
 	receiveChan chan *transport.Message
 
+	// The multiplexer used to create the session
+	muxer mux.Muxer
+
 	// The session with the remote (either incoming or outgoing)
-	session *yamux.Session
+	session mux.Session
+
+	// Tuning for the session, nil uses the defaults
+	sessionConfig *config.SessionConfig
+
+	// If true all messages are written to a single persistent stream
+	// instead of opening a new stream for each message
+	streamReuse bool
+
+	// The persistent outgoing stream, only used with stream reuse
+	sendStream net.Conn
+
+	// The handshake we send when the session is established, the function
+	// to get the address we send it from, and what to call with the remote's
+	handshake   *transport.Handshake
+	local       func() utils.LegionAddress
+	onHandshake func(*Peer, *transport.Handshake)
+
+	// What to do when a message's sender doesn't match the connection
+	mismatchPolicy config.MismatchPolicy
+
+	// relayedAs is the address the remote must send as if the session runs
+	// over a circuit through a relay, and onRelay handles relay control
+	// messages, returning true if it takes ownership of the stream the
+	// message came on
+	relayedAs utils.LegionAddress
+	onRelay   func(*Peer, *transport.Message, net.Conn) bool
+
+	// The address the remote registered with us as its relay, guarded by
+	// the legion's relayMux
+	relayTarget utils.LegionAddress
+
+	// onAck is called with acks for messages we sent, and isDuplicate
+	// checks if a message that asked for an ack was already received
+	onAck       func(*Peer, *transport.Message)
+	isDuplicate func(id string) bool
+
+	// How the peer is pinged, nil doesn't ping, the measured results, and
+	// what to call when the peer becomes degraded or recovers
+	heartbeat      *config.HeartbeatConfig
+	stats          peerStats
+	onHealthChange func(*Peer)
+
+	// Which side opened the connection, and when the session was established
+	direction   Direction
+	connectedAt time.Time
+
+	// The capabilities the remote advertised and values frameworks attached
+	// to the peer
+	capabilities []string
+	attachments  map[*AttachmentKey]interface{}
+	infoMux      sync.RWMutex
+
+	// The largest message we read from the remote, the memory all of its
+	// streams can use for messages at once, and the memory held by each
+	// message until it is handed to the framework: [*transport.Message -> int64]
+	maxMessageSize int
+	budget         *memoryBudget
+	reservations   sync.Map
+
+	// Our compression settings, and the codec negotiated with the remote
+	compression *config.CompressionConfig
+	codec       atomic.String
+
+	// When the peer was last recorded as seen in the peer store, in unix nanoseconds
+	lastSeen atomic.Int64
+
+	// The last sender that was checked against the connection's host, so
+	// the check runs once per connection rather than once per message
+	verifiedSender atomic.String
 
 	// The current RPC id we're using
 	rcpID atomic.Uint64
@@ -52,40 +148,61 @@ type Peer struct {
 	requests    map[uint64]chan *transport.Message // Uint64 -> chan *transport.Message
 	requestsMux sync.Mutex
 
-	// The disconnected channel, closed when the peer disconnects
-	disconnected chan struct{}
+	// closed is closed when Close() is called or the session ends
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-type logWriter struct{}
-
-func (*logWriter) Write(p []byte) (int, error) {
-	logger.Debug().Field("yamux_message", string(p))
-	return len(p), nil
+// QueueMessage queues the specified message to be sent to the remote, its
+// priority is decided by its type
+func (p *Peer) QueueMessage(m *transport.Message) {
+	p.QueueMessageWithPriority(m, p.scheduler.classify(m))
 }
 
-// QueueMessage queues the specified message to be sent to the remote
-func (p *Peer) QueueMessage(m *transport.Message) {
-	go func() { p.sendQueue <- m }()
+// QueueMessageWithPriority queues the message to be sent to the remote with
+// the given priority
+func (p *Peer) QueueMessageWithPriority(m *transport.Message, priority config.Priority) {
+	if priority < 0 || int(priority) >= len(p.sendQueues) {
+		priority = config.PriorityNormal
+	}
+	go func() {
+		select {
+		case p.sendQueues[priority] <- m:
+		case <-p.closed:
+		}
+	}()
 }
 
 // QueueReply queues the specified message to be sent to the remote and appends the desired rpcid
 func (p *Peer) QueueReply(rpcID uint64, m *transport.Message) {
-	go func() {
-		m.RpcId = rpcID
-		m.IsReply = true
-		p.sendQueue <- m
-	}()
+	m.RpcId = rpcID
+	m.IsReply = true
+	p.QueueMessage(m)
 }
 
 // Request will ask a remote peer and wait for the response
 func (p *Peer) Request(timeout time.Duration, m *transport.Message) (*transport.Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	res, err := p.RequestContext(ctx, m)
+	if err == context.DeadlineExceeded {
+		return nil, fmt.Errorf("request timed out with timout: %s, request type: %s, request channel: %d, remote: %s", timeout.String(), m.Type, m.RpcId, p.Remote().String())
+	}
+	return res, err
+}
+
+// RequestContext will ask a remote peer and wait for the response until the
+// context is done, it returns the context's error if there is no response
+func (p *Peer) RequestContext(ctx context.Context, m *transport.Message) (*transport.Message, error) {
 	// Create and assign an ID
 	current := p.rcpID.Inc()
 	m.RpcId = current
 	m.IsRequest = true
 
-	// Make a channel to receive the message
-	receiveChan := make(chan *transport.Message)
+	// Make a channel to receive the message, it is buffered so a late reply
+	// never blocks
+	receiveChan := make(chan *transport.Message, 1)
 
 	// Store this so the reply message gets written to it
 	p.requestsMux.Lock()
@@ -97,20 +214,19 @@ func (p *Peer) Request(timeout time.Duration, m *transport.Message) (*transport.
 		p.requestsMux.Lock()
 		delete(p.requests, current)
 		p.requestsMux.Unlock()
-		close(receiveChan)
 	}()
 
-	// logger.Info().Field("type", m.Type).Field("is_reply", m.IsReply).Field("remote", p.remote.String()).Log("sent message")
-
 	// Send the message to the remote
 	p.QueueMessage(m)
 
-	// Wait for a response or timeout
+	// Wait for a response, the context to finish, or the peer to disconnect
 	select {
 	case res := <-receiveChan:
 		return res, nil
-	case <-time.After(timeout):
-		return nil, fmt.Errorf("request timed out with timout: %s, request type: %s, request channel: %d, remote: %s", timeout.String(), m.Type, m.RpcId, p.remote.String())
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.closed:
+		return nil, fmt.Errorf("request: peer %s disconnected", p.Remote().String())
 	}
 }
 
@@ -126,106 +242,181 @@ func (p *Peer) BlockUntilDisconnected() {
 
 // CreateClient takes an outgoing connection and creates a client session from it
 func (p *Peer) CreateClient(conn net.Conn) error {
-	// Setup client side of yamux
-	c := yamux.DefaultConfig()
-	c.LogOutput = &logWriter{}
-	session, err := yamux.Client(conn, c)
+	session, err := p.muxer.Client(conn, p.sessionConfig)
 	if err != nil {
 		return err
 	}
 
 	// Store this session so we can open streams and write messages to it
 	p.session = session
+	p.direction = Outbound
+	p.connectedAt = time.Now()
 
 	p.startSendLoop()
 	p.startRecieveLoop()
+	p.sendHandshake()
+	p.startHeartbeat()
 
 	return nil
 }
 
 // CreateServer takes an incoming connection and creates a server session from it
 func (p *Peer) CreateServer(conn net.Conn) error {
-	// Setup server side of yamux
-	c := yamux.DefaultConfig()
-	c.LogOutput = &logWriter{}
-	session, err := yamux.Server(conn, c)
+	session, err := p.muxer.Server(conn, p.sessionConfig)
 	if err != nil {
 		return err
 	}
 
 	// Store this session so we can open streams and write messages to it
 	p.session = session
+	p.direction = Inbound
+	p.connectedAt = time.Now()
 
 	p.startSendLoop()
 	p.startRecieveLoop()
+	p.sendHandshake()
+	p.startHeartbeat()
 
 	return nil
 }
 
-// Close closes the stream if it exists
+// Close closes the session with the remote, it is safe to call more than once
 func (p *Peer) Close() error {
-	close(p.receiveChan)
-	close(p.sendQueue)
-
+	p.closeOnce.Do(func() { close(p.closed) })
 	return p.session.Close()
 }
 
 // Remote returns the address of the remote peer
 func (p *Peer) Remote() utils.LegionAddress {
+	p.remoteMux.RLock()
+	defer p.remoteMux.RUnlock()
 	return p.remote
 }
 
+func (p *Peer) setRemote(remote utils.LegionAddress) {
+	p.remoteMux.Lock()
+	p.remote = remote
+	p.remoteMux.Unlock()
+}
+
 func (p *Peer) startSendLoop() {
 	go func() {
 		for {
-			select {
-			case m, open := <-p.sendQueue:
-				if p.session.IsClosed() || !open {
-					return
+			// Without stream reuse each message is written on its own
+			// stream, take a send slot first so messages keep waiting in the
+			// priority queues while the peer is busy
+			ok := p.streamReuse || p.acquireSendSlot()
+			var m *transport.Message
+			if ok {
+				m, ok = p.nextMessage()
+			}
+			if !ok {
+				// Make sure anything waiting on the peer is released
+				p.closeOnce.Do(func() { close(p.closed) })
+				if p.sendStream != nil {
+					p.sendStream.Close()
 				}
-				go p.sendMessage(m)
+				return
+			}
+
+			if p.streamReuse {
+				p.sendOnStream(m)
+			} else {
+				go func() {
+					p.sendMessage(m)
+					<-p.sendSlots
+				}()
 			}
 		}
 	}()
 }
 
-func (p *Peer) sendMessage(m *transport.Message) {
-	stream, err := p.session.OpenStream()
-	defer func() {
-		if stream != nil {
-			stream.Close()
+// acquireSendSlot waits until fewer than the maximum number of messages are
+// being sent, it returns false if the session closes first
+func (p *Peer) acquireSendSlot() bool {
+	select {
+	case p.sendSlots <- struct{}{}:
+		return true
+	case <-p.session.CloseChan():
+		return false
+	}
+}
+
+// nextMessage returns the next message to send, it tries the queues in the
+// order the scheduler gives and blocks on all of them if none are ready. It
+// returns false once the session is closed.
+func (p *Peer) nextMessage() (*transport.Message, bool) {
+	select {
+	case <-p.session.CloseChan():
+		return nil, false
+	default:
+	}
+
+	for _, class := range p.scheduler.order() {
+		select {
+		case m := <-p.sendQueues[class]:
+			return m, true
+		default:
 		}
-	}()
+	}
 
+	select {
+	case m := <-p.sendQueues[config.PriorityHigh]:
+		return m, true
+	case m := <-p.sendQueues[config.PriorityNormal]:
+		return m, true
+	case m := <-p.sendQueues[config.PriorityBulk]:
+		return m, true
+	case <-p.session.CloseChan():
+		return nil, false
+	}
+}
+
+// sendMessage opens a new stream, writes the message to it and closes it
+func (p *Peer) sendMessage(m *transport.Message) {
+	stream, err := p.session.Open()
 	if err != nil {
 		logger.Warn().Field("err", err.Error()).Log("peer: error opening connection")
 		return
 	}
+	defer stream.Close()
 
-	messageBytes, err := m.Marshal()
+	err = writeMessage(stream, p.compressMessage(m))
 	if err != nil {
-		logger.Warn().Field("err", err.Error()).Log("peer: error marshalling message")
-		return
+		logger.Warn().Field("err", err.Error()).Log("peer: error writing to stream")
 	}
+}
 
-	buffer := make([]byte, 4)
-	binary.BigEndian.PutUint32(buffer, uint32(len(messageBytes)))
+// sendOnStream writes the message to the persistent stream, opening it if
+// needed. It is only called from the send loop so writes are never concurrent,
+// and if the stream is broken a new one is opened and the write retried once.
+func (p *Peer) sendOnStream(m *transport.Message) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if p.sendStream == nil {
+			stream, err := p.session.Open()
+			if err != nil {
+				logger.Warn().Field("err", err.Error()).Log("peer: error opening connection")
+				return
+			}
+			p.sendStream = stream
+		}
 
-	buffer = append(buffer, messageBytes...)
+		err := writeMessage(p.sendStream, p.compressMessage(m))
+		if err == nil {
+			return
+		}
 
-	bw := bufio.NewWriter(stream)
-	_, err = bw.Write(buffer)
-	if err != nil {
-		logger.Warn().Field("err", err.Error()).Log("peer: error writing to stream")
-		return
+		logger.Debug().Field("err", err.Error()).Log("peer: error writing to persistent stream, reopening")
+		p.sendStream.Close()
+		p.sendStream = nil
 	}
-	bw.Flush()
+	logger.Warn().Field("remote", p.Remote().String()).Log("peer: could not write message to persistent stream")
 }
 
 func (p *Peer) startRecieveLoop() {
 	go func() {
 		for {
-			incomingStream, err := p.session.AcceptStream()
+			incomingStream, err := p.session.Accept()
 			if err != nil {
 				if p.session.IsClosed() {
 					return
@@ -235,76 +426,144 @@ func (p *Peer) startRecieveLoop() {
 				return
 			}
 
-			go p.readMessage(incomingStream)
+			go p.handleStream(incomingStream)
 		}
 	}()
 }
 
-func (p *Peer) readMessage(stream *yamux.Stream) {
-	var err error
-	buffer := make([]byte, 4)
-
-	// Close this message stream when we're done
-	defer stream.Close()
+// handleStream reads messages from the stream until the remote closes it, a
+// stream can carry a single message or many if the remote reuses streams
+func (p *Peer) handleStream(stream net.Conn) {
+	// Close this message stream when we're done, unless something else took it
+	owned := true
+	defer func() {
+		if owned {
+			stream.Close()
+		}
+	}()
 
-	// Read the message size header
-	numBytesRead := 0
-	for numBytesRead < 4 {
-		n, err := stream.Read(buffer)
+	for {
+		m, size, err := readMessageLimited(stream, p.maxMessageSize, p.budget, p.closed)
 		if err != nil {
-			logger.Debug().Field("err", err.Error()).Log("Error reading message header")
+			if err != io.EOF {
+				logger.Debug().Field("err", err.Error()).Field("remote_peer", stream.RemoteAddr().String()).Log("peer: could not read incoming message")
+			}
 			return
 		}
 
-		numBytesRead += n
-	}
-	// Convert it into an int
-	size := binary.BigEndian.Uint32(buffer)
-	if size == 0 || size > 1e+8 {
-		return
-	}
-
-	// Allocate the message size
-	buffer = make([]byte, size)
+		// The message's memory stays reserved until it is dropped, or the
+		// message listener hands it to the framework
+		p.holdMessage(m, size)
+
+		// The handshake is exempt since it is how peers behind NAT learn
+		// the address they should be reporting
+		if m.Type != handshakeType && !p.senderMatchesRemote(m.Sender) {
+			switch p.mismatchPolicy {
+			case config.MismatchAllow:
+			case config.MismatchDrop:
+				logger.Debug().Field("reported_address", m.Sender).Field("remote_address", stream.RemoteAddr().String()).Log("peer: mismatched reported address and actual remote, dropping message")
+				p.releaseMessage(m)
+				continue
+			default:
+				logger.Debug().Field("reported_address", m.Sender).Field("remote_address", stream.RemoteAddr().String()).Log("peer: mismatched reported address and actual remote, disconnecting...")
+				p.releaseMessage(m)
+				p.Close()
+				return
+			}
+		}
 
-	// Read into the buffer
-	numBytesRead = 0
-	for numBytesRead < int(size) {
-		n, err := stream.Read(buffer[numBytesRead:]) // Make sure we don't write over anything
-		if err != nil {
-			logger.Debug().Field("err", err).Log("Error reading message")
+		if p.session.IsClosed() {
+			p.releaseMessage(m)
 			return
 		}
-		numBytesRead += n
+
+		if p.inflate(m) != nil {
+			p.releaseMessage(m)
+			continue
+		}
+
+		if isRelayType(m.Type) {
+			taken := p.onRelay != nil && p.onRelay(p, m, stream)
+			p.releaseMessage(m)
+			if taken {
+				owned = false
+				return
+			}
+			continue
+		}
+
+		if p.handleControl(m) {
+			p.releaseMessage(m)
+			continue
+		}
+
+		p.dispatch(m)
+	}
+}
+
+// senderMatchesRemote checks that the host a message says it is from is the
+// host of the connection, this can only be checked on TCP connections
+func (p *Peer) senderMatchesRemote(sender string) bool {
+	// On a relayed circuit the connection is to the relay, which vouched
+	// for the address the remote has to use
+	if p.relayedAs.IsValid() {
+		senderAddress, err := utils.ParseLegionAddress(sender)
+		return err == nil && senderAddress == p.relayedAs
+	}
+
+	remote, ok := p.session.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	if sender != "" && sender == p.verifiedSender.Load() {
+		return true
 	}
-	// Unmarshal the message
-	m := &transport.Message{}
-	err = proto.Unmarshal(buffer, m)
+
+	senderAddress, err := utils.ParseLegionAddress(sender)
 	if err != nil {
-		logger.Debug().Field("remote_peer", stream.RemoteAddr().String()).Log("peer: could not decode incoming message")
-		return
+		return false
 	}
 
-	if utils.LegionAddressFromString(m.Sender).Host != utils.LegionAddressFromString(p.session.RemoteAddr().String()).Host {
-		logger.Debug().Field("reported_address", m.Sender).Field("remote_address", stream.RemoteAddr().String()).Log("peer: mismatched reported address and actual remote, disconnecting...")
-		p.Close()
-		return
+	// A peer reached through a relay has to connect from the host of the
+	// address the relay knows it by, so it can't claim another peer's
+	if senderAddress.Scheme == utils.SchemeRelay {
+		_, target, err := senderAddress.RelayParts()
+		if err != nil || target.Network() != utils.SchemeTCP {
+			return false
+		}
+		senderAddress = target
 	}
 
-	// If this is an RPC response pass it along  to the correct receive channel, if not send it to the
-	// regular message receive channels
-	if !p.session.IsClosed() {
-		if m.IsReply {
-			p.requestsMux.Lock()
-			respChan, exists := p.requests[m.RpcId]
-			p.requestsMux.Unlock()
-			if exists {
-				go func(c chan *transport.Message) { c <- m }(respChan)
-			} else {
-				logger.Warn().Field("type", m.Type).Field("local", p.session.LocalAddr().String()).Field("channel_id", m.RpcId).Field("remote", p.remote.String()).Log("Got response to nonexistant RPC channel")
+	if !senderAddress.MatchesHost(remote.IP.String()) {
+		return false
+	}
+	p.verifiedSender.Store(sender)
+	return true
+}
+
+// dispatch passes RPC responses along to the correct receive channel, and
+// everything else to the regular message receive channel
+func (p *Peer) dispatch(m *transport.Message) {
+	if m.IsReply {
+		defer p.releaseMessage(m)
+		p.requestsMux.Lock()
+		respChan, exists := p.requests[m.RpcId]
+		p.requestsMux.Unlock()
+		if exists {
+			select {
+			case respChan <- m:
+			default:
 			}
 		} else {
-			go func(c chan *transport.Message) { c <- m }(p.receiveChan)
+			logger.Warn().Field("type", m.Type).Field("local", p.session.LocalAddr().String()).Field("channel_id", m.RpcId).Field("remote", p.Remote().String()).Log("Got response to nonexistant RPC channel")
 		}
+	} else {
+		go func(c chan *transport.Message) {
+			select {
+			case c <- m:
+			case <-p.closed:
+				p.releaseMessage(m)
+			}
+		}(p.receiveChan)
 	}
 }
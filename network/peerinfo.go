@@ -0,0 +1,169 @@
+package network
+
+import (
+	"net"
+	"time"
+
+	"github.com/gladiusio/legion/network/config"
+	"github.com/gladiusio/legion/utils"
+)
+
+// Capabilities legion advertises in its handshake
+const (
+	CapabilityAck   = "legion.ack/1"
+	CapabilityPing  = "legion.ping/1"
+	CapabilityRelay = "legion.relay/1"
+)
+
+// capabilities returns everything we advertise to peers
+func capabilities(conf *config.LegionConfig) []string {
+	caps := []string{CapabilityAck, CapabilityPing}
+	if conf.RelayEnabled {
+		caps = append(caps, CapabilityRelay)
+	}
+	return append(caps, conf.Capabilities...)
+}
+
+// Direction is which side opened the connection to a peer
+type Direction int
+
+// The possible directions
+const (
+	// Inbound peers connected to us
+	Inbound Direction = iota
+
+	// Outbound peers were dialed by us
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Outbound {
+		return "outbound"
+	}
+	return "inbound"
+}
+
+// AttachmentKey identifies a value attached to a peer. Keys are compared by
+// identity, so two packages can't collide even if they use the same name.
+type AttachmentKey struct {
+	name string
+}
+
+// NewAttachmentKey returns a new unique key, the name is only for debugging
+func NewAttachmentKey(name string) *AttachmentKey {
+	return &AttachmentKey{name: name}
+}
+
+func (k *AttachmentKey) String() string { return k.name }
+
+// Attach stores the value on the peer under the key, attachments are removed
+// after the framework's PeerDisconnect returns
+func (p *Peer) Attach(key *AttachmentKey, value interface{}) {
+	p.infoMux.Lock()
+	defer p.infoMux.Unlock()
+	if p.attachments == nil {
+		p.attachments = make(map[*AttachmentKey]interface{})
+	}
+	p.attachments[key] = value
+}
+
+// Attachment returns the value stored on the peer under the key
+func (p *Peer) Attachment(key *AttachmentKey) (interface{}, bool) {
+	p.infoMux.RLock()
+	defer p.infoMux.RUnlock()
+	value, ok := p.attachments[key]
+	return value, ok
+}
+
+// Detach removes the value stored on the peer under the key
+func (p *Peer) Detach(key *AttachmentKey) {
+	p.infoMux.Lock()
+	defer p.infoMux.Unlock()
+	delete(p.attachments, key)
+}
+
+// clearAttachments removes every attachment
+func (p *Peer) clearAttachments() {
+	p.infoMux.Lock()
+	defer p.infoMux.Unlock()
+	p.attachments = nil
+}
+
+// Direction returns whether we dialed the peer or it connected to us
+func (p *Peer) Direction() Direction {
+	return p.direction
+}
+
+// ConnectedAt returns when the session with the peer was established
+func (p *Peer) ConnectedAt() time.Time {
+	return p.connectedAt
+}
+
+// ObservedAddress returns the address of the remote end of the connection,
+// which can differ from Remote() if the peer is behind NAT or relayed
+func (p *Peer) ObservedAddress() net.Addr {
+	return p.session.RemoteAddr()
+}
+
+// observedHost returns the host the connection to the peer comes from, or the
+// address our relay vouched for if the session is relayed. Unlike Remote() the
+// peer can't choose it, so limits and bans are keyed on it.
+func (p *Peer) observedHost() string {
+	host, ok := p.hostAddress()
+	if !ok {
+		return p.session.RemoteAddr().String()
+	}
+	if host.Network() == utils.SchemeTCP {
+		return host.Host
+	}
+	return host.String()
+}
+
+// hostAddress returns the observed host as an address with a zero port, which
+// is how bans on the host are stored. It returns false for connections over
+// transports without hosts, like mem and unix.
+func (p *Peer) hostAddress() (utils.LegionAddress, bool) {
+	if p.relayedAs.IsValid() {
+		if p.relayedAs.Network() == utils.SchemeTCP {
+			return utils.NewLegionAddress(p.relayedAs.Host, 0), true
+		}
+		return p.relayedAs, true
+	}
+
+	if tcp, ok := p.session.RemoteAddr().(*net.TCPAddr); ok {
+		return utils.NewLegionAddress(tcp.IP.String(), 0), true
+	}
+	return utils.LegionAddress{}, false
+}
+
+// Capabilities returns the capabilities the remote sent in its handshake, it
+// is empty until the handshake arrives
+func (p *Peer) Capabilities() []string {
+	p.infoMux.RLock()
+	defer p.infoMux.RUnlock()
+	return append([]string(nil), p.capabilities...)
+}
+
+// HasCapability returns true if the remote advertised the capability
+func (p *Peer) HasCapability(capability string) bool {
+	p.infoMux.RLock()
+	defer p.infoMux.RUnlock()
+	for _, c := range p.capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Compression returns the codec negotiated with the remote, empty if messages
+// are sent uncompressed
+func (p *Peer) Compression() string {
+	return p.codec.Load()
+}
+
+func (p *Peer) setCapabilities(caps []string) {
+	p.infoMux.Lock()
+	defer p.infoMux.Unlock()
+	p.capabilities = caps
+}
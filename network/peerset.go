@@ -0,0 +1,355 @@
+package network
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/utils"
+)
+
+// NewPeerSet returns an empty peer set
+func NewPeerSet() *PeerSet {
+	return &PeerSet{
+		byAddress:  make(map[utils.LegionAddress]*PeerEntry),
+		byIdentity: make(map[string]*PeerEntry),
+		list:       make([]*PeerEntry, 0),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// PeerSet is the set of connected peers, indexed by address and identity.
+// Peers can be tagged with labels like "bootstrap" or "trusted" and queried
+// with filters. All methods are safe for concurrent use.
+type PeerSet struct {
+	byAddress  map[utils.LegionAddress]*PeerEntry
+	byIdentity map[string]*PeerEntry
+
+	// list holds every entry so the set can be counted and sampled without
+	// ranging over the maps, each entry knows its index. The first healthy
+	// entries are the peers that aren't degraded, so they can be sampled on
+	// their own just as quickly.
+	list    []*PeerEntry
+	healthy int
+
+	rand *rand.Rand
+	mux  sync.RWMutex
+}
+
+// PeerEntry is a peer in the set and the metadata stored with it
+type PeerEntry struct {
+	peer    *Peer
+	address utils.LegionAddress
+	index   int
+
+	// The identity and tags can be read through an entry a filter kept after
+	// the set was unlocked, so they have their own lock. It is only taken
+	// after the set's lock.
+	identity string
+	tags     map[string]struct{}
+	mux      sync.RWMutex
+}
+
+// Peer returns the peer
+func (e *PeerEntry) Peer() *Peer { return e.peer }
+
+// Identity returns the identity the peer was indexed under, if any
+func (e *PeerEntry) Identity() string {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	return e.identity
+}
+
+// HasTag returns true if the peer has the tag
+func (e *PeerEntry) HasTag(tag string) bool {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	_, ok := e.tags[tag]
+	return ok
+}
+
+// PeerFilter decides if a peer is included in a query, it is called with the
+// set locked so it must not call methods on the set
+type PeerFilter func(e *PeerEntry) bool
+
+// WithTag matches peers with the tag
+func WithTag(tag string) PeerFilter {
+	return func(e *PeerEntry) bool { return e.HasTag(tag) }
+}
+
+// Healthy matches peers that aren't degraded, including ones that haven't
+// answered a ping yet
+func Healthy() PeerFilter {
+	return func(e *PeerEntry) bool { return !e.peer.Stats().Degraded }
+}
+
+// Not inverts a filter
+func Not(f PeerFilter) PeerFilter {
+	return func(e *PeerEntry) bool { return !f(e) }
+}
+
+// matches returns true if every filter matches the entry
+func matches(e *PeerEntry, filters []PeerFilter) bool {
+	for _, f := range filters {
+		if !f(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of peers in the set
+func (s *PeerSet) Len() int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return len(s.list)
+}
+
+// Load returns the peer at the address
+func (s *PeerSet) Load(address utils.LegionAddress) (*Peer, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	e, ok := s.byAddress[address]
+	if !ok {
+		return nil, false
+	}
+	return e.peer, true
+}
+
+// LoadOrStore returns the peer already stored at the address, or stores the
+// given one. The bool is true if the peer was already stored.
+func (s *PeerSet) LoadOrStore(address utils.LegionAddress, p *Peer) (*Peer, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if e, ok := s.byAddress[address]; ok {
+		return e.peer, true
+	}
+
+	e := &PeerEntry{peer: p, address: address, tags: make(map[string]struct{}), index: len(s.list)}
+	s.byAddress[address] = e
+	s.list = append(s.list, e)
+	s.setDegraded(e, p.Stats().Degraded)
+	return p, false
+}
+
+// Delete removes the peer at the address and returns it
+func (s *PeerSet) Delete(address utils.LegionAddress) (*Peer, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	e, ok := s.byAddress[address]
+	if !ok {
+		return nil, false
+	}
+	s.remove(e)
+	return e.peer, true
+}
+
+// deletePeer removes the address only if it is still stored with the peer, so
+// a peer that reconnected isn't removed by the old one's cleanup
+func (s *PeerSet) deletePeer(address utils.LegionAddress, p *Peer) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if e, ok := s.byAddress[address]; ok && e.peer == p {
+		s.remove(e)
+	}
+}
+
+// remove takes the entry out of every index, the lock must be held
+func (s *PeerSet) remove(e *PeerEntry) {
+	delete(s.byAddress, e.address)
+	if e.identity != "" && s.byIdentity[e.identity] == e {
+		delete(s.byIdentity, e.identity)
+	}
+
+	// Move it out of the healthy entries, then swap the last entry into
+	// its place
+	s.setDegraded(e, true)
+	s.swap(e.index, len(s.list)-1)
+	s.list = s.list[:len(s.list)-1]
+}
+
+// setDegraded moves the entry across the boundary between the healthy and
+// the degraded entries if needed, the lock must be held
+func (s *PeerSet) setDegraded(e *PeerEntry, degraded bool) {
+	if degraded && e.index < s.healthy {
+		s.swap(e.index, s.healthy-1)
+		s.healthy--
+	} else if !degraded && e.index >= s.healthy {
+		s.swap(e.index, s.healthy)
+		s.healthy++
+	}
+}
+
+// swap swaps two entries in the list, the lock must be held
+func (s *PeerSet) swap(i, j int) {
+	s.list[i], s.list[j] = s.list[j], s.list[i]
+	s.list[i].index = i
+	s.list[j].index = j
+}
+
+// updateHealth moves the peer between the healthy and the degraded entries
+// after its stats changed
+func (s *PeerSet) updateHealth(p *Peer) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if e, ok := s.byAddress[p.Remote()]; ok && e.peer == p {
+		s.setDegraded(e, p.Stats().Degraded)
+	}
+}
+
+// Tag adds the tags to the peer at the address, it returns false if there
+// is no peer at the address
+func (s *PeerSet) Tag(address utils.LegionAddress, tags ...string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	e, ok := s.byAddress[address]
+	if !ok {
+		return false
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	for _, tag := range tags {
+		e.tags[tag] = struct{}{}
+	}
+	return true
+}
+
+// Untag removes the tags from the peer at the address
+func (s *PeerSet) Untag(address utils.LegionAddress, tags ...string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if e, ok := s.byAddress[address]; ok {
+		e.mux.Lock()
+		defer e.mux.Unlock()
+		for _, tag := range tags {
+			delete(e.tags, tag)
+		}
+	}
+}
+
+// Tags returns the tags of the peer at the address
+func (s *PeerSet) Tags(address utils.LegionAddress) []string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	e, ok := s.byAddress[address]
+	if !ok {
+		return nil
+	}
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+	tags := make([]string, 0, len(e.tags))
+	for tag := range e.tags {
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// SetIdentity indexes the peer at the address under the identity, like a
+// public key a framework learned from its messages. An identity can only
+// belong to one peer, the last one set wins.
+func (s *PeerSet) SetIdentity(address utils.LegionAddress, identity string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	e, ok := s.byAddress[address]
+	if !ok {
+		return false
+	}
+	if e.identity != "" && s.byIdentity[e.identity] == e {
+		delete(s.byIdentity, e.identity)
+	}
+	e.mux.Lock()
+	e.identity = identity
+	e.mux.Unlock()
+	if identity != "" {
+		s.byIdentity[identity] = e
+	}
+	return true
+}
+
+// ByIdentity returns the peer indexed under the identity
+func (s *PeerSet) ByIdentity(identity string) (*Peer, bool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	e, ok := s.byIdentity[identity]
+	if !ok {
+		return nil, false
+	}
+	return e.peer, true
+}
+
+// Select returns the peers that match every filter
+func (s *PeerSet) Select(filters ...PeerFilter) []*Peer {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	peers := make([]*Peer, 0, len(s.list))
+	for _, e := range s.list {
+		if matches(e, filters) {
+			peers = append(peers, e.peer)
+		}
+	}
+	return peers
+}
+
+// Range calls f on a snapshot of the peers until it returns false, f can
+// safely add or remove peers from the set
+func (s *PeerSet) Range(f func(p *Peer) bool) {
+	for _, p := range s.Select() {
+		if !f(p) {
+			return
+		}
+	}
+}
+
+// Sample returns up to n random distinct peers that match every filter.
+// Without filters this takes time proportional to n, not the size of the set.
+func (s *PeerSet) Sample(n int, filters ...PeerFilter) []*Peer {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(filters) > 0 {
+		candidates := make([]*Peer, 0)
+		for _, e := range s.list {
+			if matches(e, filters) {
+				candidates = append(candidates, e.peer)
+			}
+		}
+		s.rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+		if len(candidates) > n {
+			candidates = candidates[:n]
+		}
+		return candidates
+	}
+
+	return s.sampleRange(make([]*Peer, 0, n), 0, len(s.list), n)
+}
+
+// sampleHealthyFirst returns up to n random distinct peers, peers that are
+// degraded are only picked if there aren't enough others. Like Sample
+// without filters it takes time proportional to n.
+func (s *PeerSet) sampleHealthyFirst(n int) []*Peer {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	peers := s.sampleRange(make([]*Peer, 0, n), 0, s.healthy, n)
+	return s.sampleRange(peers, s.healthy, len(s.list), n-len(peers))
+}
+
+// sampleRange appends up to n random distinct peers from list[start:end], the
+// lock must be held
+func (s *PeerSet) sampleRange(peers []*Peer, start, end, n int) []*Peer {
+	if n > end-start {
+		n = end - start
+	}
+
+	// Floyd's algorithm picks n distinct indexes with n random numbers
+	picked := make(map[int]struct{}, n)
+	for j := end - start - n; j < end-start; j++ {
+		i := s.rand.Intn(j + 1)
+		if _, ok := picked[i]; ok {
+			i = j
+		}
+		picked[i] = struct{}{}
+		peers = append(peers, s.list[start+i].peer)
+	}
+	return peers
+}
@@ -0,0 +1,163 @@
+package peerstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/utils"
+	"go.uber.org/atomic"
+)
+
+// DefaultFlushInterval is how often a FileStore writes changes to disk
+const DefaultFlushInterval = 5 * time.Second
+
+// NewFileStore returns a peer store that is loaded from and saved to a JSON
+// file at the path, changes are written every flushInterval and on Close. A
+// zero flushInterval uses DefaultFlushInterval. Up to DefaultMaxRecords
+// records are kept.
+func NewFileStore(path string, flushInterval time.Duration) (*FileStore, error) {
+	return NewFileStoreWithLimit(path, flushInterval, DefaultMaxRecords)
+}
+
+// NewFileStoreWithLimit is like NewFileStore, but keeps up to max records
+func NewFileStoreWithLimit(path string, flushInterval time.Duration, max int) (*FileStore, error) {
+	if flushInterval == 0 {
+		flushInterval = DefaultFlushInterval
+	}
+
+	f := &FileStore{
+		MemoryStore: NewMemoryStoreWithLimit(max),
+		path:        path,
+		closed:      make(chan struct{}),
+	}
+
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	go f.flushLoop(flushInterval)
+
+	return f, nil
+}
+
+// FileStore is a PeerStore that persists to a local JSON file
+type FileStore struct {
+	*MemoryStore
+
+	path  string
+	dirty atomic.Bool
+
+	// Makes sure only one save happens at a time
+	saveMux sync.Mutex
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Assert the type is correct
+var _ PeerStore = (*FileStore)(nil)
+
+// Update modifies the record for the address, creating it if needed
+func (f *FileStore) Update(address utils.LegionAddress, update func(r *Record)) error {
+	f.dirty.Store(true)
+	return f.MemoryStore.Update(address, update)
+}
+
+// Delete removes the record for the address
+func (f *FileStore) Delete(address utils.LegionAddress) error {
+	f.dirty.Store(true)
+	return f.MemoryStore.Delete(address)
+}
+
+// Flush writes the store to disk if it has changed, if writing fails the
+// changes are written again on the next flush
+func (f *FileStore) Flush() error {
+	if !f.dirty.Swap(false) {
+		return nil
+	}
+	if err := f.save(); err != nil {
+		f.dirty.Store(true)
+		return err
+	}
+	return nil
+}
+
+// Close writes any changes to disk and stops the flush loop
+func (f *FileStore) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return f.Flush()
+}
+
+func (f *FileStore) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.Flush()
+		case <-f.closed:
+			return
+		}
+	}
+}
+
+func (f *FileStore) load() error {
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	records := make([]Record, 0)
+	if err := json.Unmarshal(b, &records); err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		record := r
+		f.MemoryStore.records[record.Address] = &record
+	}
+
+	// The file may have been written with a higher limit
+	now := time.Now()
+	for f.max > 0 && len(f.MemoryStore.records) > f.max {
+		if !f.evict(now) {
+			break
+		}
+	}
+	return nil
+}
+
+// save writes to a temporary file and renames it so the store is never
+// left half written
+func (f *FileStore) save() error {
+	f.saveMux.Lock()
+	defer f.saveMux.Unlock()
+
+	b, err := json.MarshalIndent(f.All(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
@@ -0,0 +1,183 @@
+/*
+Package peerstore keeps a record of the peers legion has seen so they can be
+redialed after a restart.
+*/
+package peerstore
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gladiusio/legion/utils"
+)
+
+// DefaultMaxRecords is how many records a store keeps unless another limit
+// is given
+const DefaultMaxRecords = 4096
+
+// ErrStoreFull is returned when a record can't be added because the store is
+// full of banned peers
+var ErrStoreFull = errors.New("peerstore: store is full")
+
+// Record is what is known about a single peer
+type Record struct {
+	Address utils.LegionAddress `json:"address"`
+
+	// Identity is an optional identity set by a framework, like a public key
+	Identity string `json:"identity,omitempty"`
+
+	// LastSeen is when we last connected to or received a message from the peer
+	LastSeen time.Time `json:"last_seen"`
+
+	// Successes and Failures count the outgoing connection attempts
+	Successes int `json:"successes"`
+	Failures  int `json:"failures"`
+
+	// Banned peers are never dialed and are disconnected when seen, a zero
+	// BannedUntil means the ban doesn't expire. A record with a zero port
+	// bans every port on the host.
+	Banned      bool      `json:"banned,omitempty"`
+	BannedUntil time.Time `json:"banned_until,omitempty"`
+}
+
+// IsBanned returns true if the peer is banned at the given time
+func (r Record) IsBanned(now time.Time) bool {
+	return r.Banned && (r.BannedUntil.IsZero() || now.Before(r.BannedUntil))
+}
+
+// PeerStore stores records of peers
+type PeerStore interface {
+	// Get returns the record for the address if there is one
+	Get(address utils.LegionAddress) (Record, bool)
+
+	// All returns every record in the store
+	All() []Record
+
+	// Update calls the function with the record for the address so it can be
+	// modified, a new record is created if none exists
+	Update(address utils.LegionAddress, update func(r *Record)) error
+
+	// Delete removes the record for the address
+	Delete(address utils.LegionAddress) error
+
+	// Close flushes anything pending and releases the store
+	Close() error
+}
+
+// KnownGood returns up to max records of peers that aren't banned, have
+// connected successfully before and were seen within maxAge (zero allows any
+// age), most recently seen first
+func KnownGood(s PeerStore, max int, maxAge time.Duration) []Record {
+	now := time.Now()
+	good := make([]Record, 0)
+	for _, r := range s.All() {
+		if r.IsBanned(now) || r.Successes == 0 {
+			continue
+		}
+		if maxAge != 0 && now.Sub(r.LastSeen) > maxAge {
+			continue
+		}
+		good = append(good, r)
+	}
+
+	sort.Slice(good, func(i, j int) bool { return good[i].LastSeen.After(good[j].LastSeen) })
+
+	if max > 0 && len(good) > max {
+		good = good[:max]
+	}
+	return good
+}
+
+// NewMemoryStore returns a peer store that only lives in memory and keeps up
+// to DefaultMaxRecords records
+func NewMemoryStore() *MemoryStore {
+	return NewMemoryStoreWithLimit(DefaultMaxRecords)
+}
+
+// NewMemoryStoreWithLimit returns a memory store that keeps up to max
+// records, when it is full the peer seen longest ago that isn't banned is
+// forgotten to make room
+func NewMemoryStoreWithLimit(max int) *MemoryStore {
+	return &MemoryStore{records: make(map[utils.LegionAddress]*Record), max: max}
+}
+
+// MemoryStore is an in memory PeerStore
+type MemoryStore struct {
+	records map[utils.LegionAddress]*Record
+	max     int
+	mux     sync.RWMutex
+}
+
+// Assert the type is correct
+var _ PeerStore = (*MemoryStore)(nil)
+
+// Get returns the record for the address if there is one
+func (m *MemoryStore) Get(address utils.LegionAddress) (Record, bool) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	r, ok := m.records[address]
+	if !ok {
+		return Record{}, false
+	}
+	return *r, true
+}
+
+// All returns every record in the store
+func (m *MemoryStore) All() []Record {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	all := make([]Record, 0, len(m.records))
+	for _, r := range m.records {
+		all = append(all, *r)
+	}
+	return all
+}
+
+// Update modifies the record for the address, creating it if needed
+func (m *MemoryStore) Update(address utils.LegionAddress, update func(r *Record)) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	r, ok := m.records[address]
+	if !ok {
+		if m.max > 0 && len(m.records) >= m.max && !m.evict(time.Now()) {
+			return ErrStoreFull
+		}
+		r = &Record{Address: address}
+		m.records[address] = r
+	}
+	update(r)
+	r.Address = address
+	return nil
+}
+
+// Delete removes the record for the address
+func (m *MemoryStore) Delete(address utils.LegionAddress) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	delete(m.records, address)
+	return nil
+}
+
+// Close does nothing for a memory store
+func (m *MemoryStore) Close() error { return nil }
+
+// evict removes the record seen longest ago that isn't banned, it returns
+// false if every record is banned. The lock must be held.
+func (m *MemoryStore) evict(now time.Time) bool {
+	var oldest *Record
+	for _, r := range m.records {
+		if r.IsBanned(now) {
+			continue
+		}
+		if oldest == nil || r.LastSeen.Before(oldest.LastSeen) {
+			oldest = r
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(m.records, oldest.Address)
+	return true
+}
@@ -0,0 +1,178 @@
+package peerstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gladiusio/legion/utils"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	addr := utils.NewLegionAddress("localhost", 7000)
+
+	if _, ok := s.Get(addr); ok {
+		t.Fatal("empty store should not have a record")
+	}
+
+	s.Update(addr, func(r *Record) { r.Successes++ })
+	s.Update(addr, func(r *Record) { r.Failures++ })
+
+	r, ok := s.Get(addr)
+	if !ok || r.Successes != 1 || r.Failures != 1 || r.Address != addr {
+		t.Errorf("record was not updated correctly: %+v", r)
+	}
+
+	s.Delete(addr)
+	if len(s.All()) != 0 {
+		t.Error("record was not deleted")
+	}
+}
+
+func TestMemoryStoreLimit(t *testing.T) {
+	s := NewMemoryStoreWithLimit(2)
+	now := time.Now()
+	banned := utils.NewLegionAddress("localhost", 7000)
+	old := utils.NewLegionAddress("localhost", 7001)
+	s.Update(banned, func(r *Record) { r.Banned = true; r.LastSeen = now.Add(-time.Hour) })
+	s.Update(old, func(r *Record) { r.LastSeen = now.Add(-time.Minute) })
+
+	// The oldest peer that isn't banned makes room
+	added := utils.NewLegionAddress("localhost", 7002)
+	if err := s.Update(added, func(r *Record) { r.LastSeen = now }); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(old); ok {
+		t.Error("oldest unbanned record should be evicted")
+	}
+	if _, ok := s.Get(banned); !ok {
+		t.Error("banned record should be kept")
+	}
+
+	// Bans aren't forgotten to make room
+	s.Update(added, func(r *Record) { r.Banned = true })
+	if err := s.Update(old, func(r *Record) {}); err != ErrStoreFull {
+		t.Errorf("store full of bans should reject new records, got: %v", err)
+	}
+	if len(s.All()) != 2 {
+		t.Errorf("store should hold 2 records, has %d", len(s.All()))
+	}
+}
+
+func TestIsBanned(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		r        Record
+		expected bool
+	}{
+		{Record{}, false},
+		{Record{Banned: true}, true},
+		{Record{Banned: true, BannedUntil: now.Add(time.Minute)}, true},
+		{Record{Banned: true, BannedUntil: now.Add(-time.Minute)}, false},
+	}
+	for _, test := range tests {
+		if test.r.IsBanned(now) != test.expected {
+			t.Errorf("expected IsBanned to be %t for %+v", test.expected, test.r)
+		}
+	}
+}
+
+func TestKnownGood(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+	add := func(port uint16, update func(r *Record)) utils.LegionAddress {
+		addr := utils.NewLegionAddress("localhost", port)
+		s.Update(addr, update)
+		return addr
+	}
+
+	recent := add(7000, func(r *Record) { r.Successes = 1; r.LastSeen = now })
+	older := add(7001, func(r *Record) { r.Successes = 1; r.LastSeen = now.Add(-time.Hour) })
+	add(7002, func(r *Record) { r.Failures = 3; r.LastSeen = now })
+	add(7003, func(r *Record) { r.Successes = 1; r.LastSeen = now; r.Banned = true })
+	add(7004, func(r *Record) { r.Successes = 1; r.LastSeen = now.Add(-48 * time.Hour) })
+
+	good := KnownGood(s, 10, 24*time.Hour)
+	if len(good) != 2 || good[0].Address != recent || good[1].Address != older {
+		t.Errorf("wrong known good peers: %+v", good)
+	}
+
+	if len(KnownGood(s, 1, 0)) != 1 {
+		t.Error("known good peers should be limited to max")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peerstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.json")
+
+	s, err := NewFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := utils.LegionAddress{Scheme: utils.SchemeMem, Host: "node"}
+	seen := time.Now().Round(time.Second)
+	s.Update(addr, func(r *Record) {
+		r.Identity = "0xabc"
+		r.LastSeen = seen
+		r.Successes = 2
+		r.Banned = true
+	})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	r, ok := s.Get(addr)
+	if !ok {
+		t.Fatal("record was not loaded from the file")
+	}
+	if r.Identity != "0xabc" || !r.LastSeen.Equal(seen) || r.Successes != 2 || !r.Banned {
+		t.Errorf("loaded record does not match what was saved: %+v", r)
+	}
+}
+
+func TestFileStoreFlushError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peerstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "missing", "peers.json")
+
+	s, err := NewFileStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	addr := utils.NewLegionAddress("localhost", 7000)
+	s.Update(addr, func(r *Record) { r.Successes = 1 })
+	if err := s.Flush(); err == nil {
+		t.Fatal("flush into a missing directory should fail")
+	}
+
+	// The changes are written once the directory exists
+	if err := os.Mkdir(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("changes were not written after a failed flush: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"strings"
+
+	"github.com/gladiusio/legion/network/config"
+	"github.com/gladiusio/legion/network/transport"
+)
+
+// defaultPriorityClasses are used for any prefix not in the config or set by
+// the framework, internal messages are latency sensitive
+var defaultPriorityClasses = map[string]config.Priority{
+	"legion.": config.PriorityHigh,
+}
+
+// defaultPriorityWeights are used for any class not in the config
+var defaultPriorityWeights = map[config.Priority]int{
+	config.PriorityHigh:   8,
+	config.PriorityNormal: 4,
+	config.PriorityBulk:   1,
+}
+
+// priorityRank is the order classes are tried in when the scheduled class
+// has nothing waiting
+var priorityRank = []config.Priority{config.PriorityHigh, config.PriorityNormal, config.PriorityBulk}
+
+// newScheduler builds the classifier and send order from the classes the
+// framework set and the config, a nil config uses the defaults
+func newScheduler(conf *config.PriorityConfig, frameworkClasses map[string]config.Priority) *scheduler {
+	s := &scheduler{classes: make(map[string]config.Priority)}
+	for prefix, class := range defaultPriorityClasses {
+		s.classes[prefix] = class
+	}
+	for prefix, class := range frameworkClasses {
+		s.classes[prefix] = class
+	}
+
+	weights := make(map[config.Priority]int)
+	for class, weight := range defaultPriorityWeights {
+		weights[class] = weight
+	}
+
+	if conf != nil {
+		for prefix, class := range conf.Classes {
+			s.classes[prefix] = class
+		}
+		for class, weight := range conf.Weights {
+			if weight > 0 {
+				weights[class] = weight
+			}
+		}
+	}
+
+	s.slots = weightedSlots(weights)
+	return s
+}
+
+// scheduler decides the priority of outgoing messages and the order classes
+// are serviced in. classify is safe to call concurrently, next is only called
+// from the send loop.
+type scheduler struct {
+	classes map[string]config.Priority
+
+	// slots is one round of classes interleaved by weight
+	slots []config.Priority
+	next  int
+}
+
+// classify returns the priority of the message
+func (s *scheduler) classify(m *transport.Message) config.Priority {
+	if m.IsReply {
+		return config.PriorityHigh
+	}
+
+	class, longest := config.PriorityNormal, -1
+	for prefix, c := range s.classes {
+		if len(prefix) > longest && strings.HasPrefix(m.Type, prefix) {
+			class, longest = c, len(prefix)
+		}
+	}
+	return class
+}
+
+// order returns the classes to try for the next send, the scheduled class
+// first and then the rest by rank
+func (s *scheduler) order() [config.NumPriorities]config.Priority {
+	var order [config.NumPriorities]config.Priority
+	first := s.slots[s.next]
+	s.next = (s.next + 1) % len(s.slots)
+
+	order[0] = first
+	i := 1
+	for _, class := range priorityRank {
+		if class != first {
+			order[i] = class
+			i++
+		}
+	}
+	return order
+}
+
+// weightedSlots spreads the classes over a round in proportion to their
+// weights using smooth weighted round robin, so a busy class never gets a
+// long run of slots to itself
+func weightedSlots(weights map[config.Priority]int) []config.Priority {
+	total := 0
+	for _, class := range priorityRank {
+		total += weights[class]
+	}
+
+	current := make(map[config.Priority]int)
+	slots := make([]config.Priority, 0, total)
+	for len(slots) < total {
+		best := priorityRank[0]
+		for _, class := range priorityRank {
+			current[class] += weights[class]
+			if current[class] > current[best] {
+				best = class
+			}
+		}
+		current[best] -= total
+		slots = append(slots, best)
+	}
+	return slots
+}
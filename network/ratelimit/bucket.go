@@ -0,0 +1,85 @@
+/*
+Package ratelimit contains a token bucket used to limit incoming messages.
+*/
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// NewBucket returns a full bucket that refills at rate tokens per second and
+// holds at most burst tokens, a burst below one uses the rate rounded up
+func NewBucket(rate float64, burst int) *Bucket {
+	b := float64(burst)
+	if burst < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &Bucket{rate: rate, burst: b, tokens: b, last: time.Now(), now: time.Now}
+}
+
+// Bucket is a token bucket, it is safe for concurrent use
+type Bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// now is swapped out in tests
+	now func() time.Time
+
+	mux sync.Mutex
+}
+
+// Allow takes a token if one is available and returns true, or returns false
+// without taking one
+func (b *Bucket) Allow() bool {
+	_, ok := b.Reserve(0)
+	return ok
+}
+
+// Reserve takes a token and returns how long to wait before using it, if the
+// wait would be longer than max no token is taken and false is returned
+func (b *Bucket) Reserve(max time.Duration) (time.Duration, bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.refill()
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	if b.rate <= 0 {
+		return 0, false
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	if wait > max {
+		return 0, false
+	}
+
+	// The bucket goes negative so later reservations wait behind this one
+	b.tokens--
+	return wait, true
+}
+
+// Cancel gives back a token taken by Reserve that won't be used
+func (b *Bucket) Cancel() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.refill()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+func (b *Bucket) refill() {
+	now := b.now()
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+}
@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(10, 2)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("a full bucket should allow up to its burst")
+	}
+	if b.Allow() {
+		t.Fatal("an empty bucket should not allow a message")
+	}
+
+	// One token refills every 100ms
+	now = now.Add(100 * time.Millisecond)
+	if !b.Allow() {
+		t.Error("bucket should have refilled a token")
+	}
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatal("refilled bucket should allow up to its burst")
+		}
+	}
+	if b.Allow() {
+		t.Error("bucket should never hold more than its burst")
+	}
+}
+
+func TestBucketReserve(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(10, 1)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	if wait, ok := b.Reserve(time.Second); !ok || wait != 0 {
+		t.Fatalf("first reservation should not wait, waited %s", wait)
+	}
+	if wait, ok := b.Reserve(time.Second); !ok || wait != 100*time.Millisecond {
+		t.Errorf("second reservation should wait 100ms, waited %s", wait)
+	}
+	if wait, ok := b.Reserve(time.Second); !ok || wait != 200*time.Millisecond {
+		t.Errorf("third reservation should queue behind the second, waited %s", wait)
+	}
+	if _, ok := b.Reserve(50 * time.Millisecond); ok {
+		t.Error("reservation longer than the max should fail")
+	}
+}
+
+func TestBucketCancel(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(1, 1)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	if !b.Allow() {
+		t.Fatal("a full bucket should allow a message")
+	}
+	b.Cancel()
+	if !b.Allow() {
+		t.Error("a cancelled reservation should give its token back")
+	}
+
+	// Cancelling can't fill the bucket past its burst
+	b.Cancel()
+	b.Cancel()
+	if !b.Allow() || b.Allow() {
+		t.Error("bucket should hold at most its burst after cancelling")
+	}
+}
@@ -0,0 +1,300 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gladiusio/legion/network/config"
+	"github.com/gladiusio/legion/network/transport"
+	"github.com/gladiusio/legion/utils"
+
+	log "github.com/gladiusio/legion/logger"
+)
+
+// Control message types of the relay protocol, they are never passed to the
+// framework.
+//
+// A peer that can't accept connections advertises a relay address and sends
+// relayRegisterType to the relay over its outbound connection. A peer that
+// wants to reach it opens a stream to the relay and sends relayConnectType
+// with the target address, the relay opens a stream to the target, sends it
+// relayIncomingType, answers the dialer with relayStatusType and then copies
+// data between the two streams. Each side runs a normal session over its end.
+const (
+	relayRegisterType = "legion.relay.register"
+	relayConnectType  = "legion.relay.connect"
+	relayIncomingType = "legion.relay.incoming"
+	relayStatusType   = "legion.relay.status"
+)
+
+// relayDialTimeout is how long we wait for the relay to set up a circuit
+const relayDialTimeout = 10 * time.Second
+
+func isRelayType(messageType string) bool {
+	switch messageType {
+	case relayRegisterType, relayConnectType, relayIncomingType:
+		return true
+	}
+	return false
+}
+
+// handleRelay handles relay control messages, it returns true if it took
+// ownership of the stream
+func (l *Legion) handleRelay(p *Peer, m *transport.Message, stream net.Conn) bool {
+	switch m.Type {
+	case relayRegisterType:
+		l.registerRelayTarget(p, m)
+		return false
+	case relayConnectType:
+		if !l.config.RelayEnabled {
+			writeMessage(stream, &transport.Message{Type: relayStatusType, Body: []byte("relaying is disabled")})
+			return false
+		}
+		go l.relayCircuit(p, m, stream)
+		return true
+	case relayIncomingType:
+		// Only the relay we registered with can hand us connections, and
+		// it vouches for the address of the dialer
+		from, err := utils.ParseLegionAddress(string(m.Body))
+		if !l.isRelayPeer(p) || err != nil || !from.IsValid() {
+			log.Debug().Field("from", string(m.Body)).Field("relay", p.Remote().String()).Log("legion: refused relayed connection")
+			stream.Close()
+			return true
+		}
+		go l.acceptPeer(stream, from)
+		log.Debug().Field("from", from.String()).Log("legion: received relayed connection")
+		return true
+	}
+
+	return false
+}
+
+// registerRelayTarget stores a peer that wants us to relay connections to it.
+// The address has to name us as the relay and its inner address has to match
+// the host the session comes from, whatever the mismatch policy is. A session
+// can only register one address, and an address stays with its session until
+// that disconnects.
+func (l *Legion) registerRelayTarget(p *Peer, m *transport.Message) {
+	if !l.config.RelayEnabled {
+		return
+	}
+	if !p.senderMatchesRemote(m.Sender) {
+		log.Debug().Field("target", m.Sender).Field("remote", p.ObservedAddress().String()).Log("legion: refused relay registration from another host")
+		return
+	}
+
+	target, err := utils.ParseLegionAddress(m.Sender)
+	if err != nil {
+		return
+	}
+	relay, _, err := target.RelayParts()
+	if err != nil || relay != l.Me() {
+		log.Debug().Field("target", target.String()).Log("legion: refused relay registration for another relay")
+		return
+	}
+
+	l.relayMux.Lock()
+	defer l.relayMux.Unlock()
+
+	if p.relayTarget.IsValid() {
+		if p.relayTarget != target {
+			log.Debug().Field("target", target.String()).Field("registered", p.relayTarget.String()).Log("legion: refused second relay registration from a peer")
+		}
+		return
+	}
+	if current, ok := l.relayTargets[target]; ok && !current.session.IsClosed() {
+		log.Debug().Field("target", target.String()).Log("legion: refused relay registration for a connected target")
+		return
+	}
+
+	l.relayTargets[target] = p
+	p.relayTarget = target
+	log.Debug().Field("target", target.String()).Log("legion: registered relay target")
+
+	go func() {
+		p.BlockUntilDisconnected()
+		l.relayMux.Lock()
+		if l.relayTargets[target] == p {
+			delete(l.relayTargets, target)
+		}
+		l.relayMux.Unlock()
+	}()
+}
+
+// relayTarget returns the peer registered under the relay address
+func (l *Legion) relayTarget(target utils.LegionAddress) (*Peer, bool) {
+	l.relayMux.Lock()
+	defer l.relayMux.Unlock()
+	p, ok := l.relayTargets[target]
+	return p, ok
+}
+
+// isRelayPeer returns true if p is the session to the relay we registered with
+func (l *Legion) isRelayPeer(p *Peer) bool {
+	l.relayMux.Lock()
+	defer l.relayMux.Unlock()
+	return l.relayPeer != nil && l.relayPeer == p
+}
+
+// relayCircuit connects a dialer's stream to a stream opened to the target.
+// The target trusts the dialer address we pass along, so it has to match the
+// session the dialer opened the stream on.
+func (l *Legion) relayCircuit(p *Peer, m *transport.Message, stream net.Conn) {
+	fail := func(reason string) {
+		writeMessage(stream, &transport.Message{Type: relayStatusType, Body: []byte(reason)})
+		stream.Close()
+	}
+
+	if !p.senderMatchesRemote(m.Sender) {
+		log.Debug().Field("sender", m.Sender).Field("remote", p.ObservedAddress().String()).Log("legion: refused relay circuit from a mismatched sender")
+		fail("sender does not match the connection")
+		return
+	}
+
+	target, err := utils.ParseLegionAddress(string(m.Body))
+	if err != nil {
+		fail("invalid target address")
+		return
+	}
+
+	targetPeer, ok := l.relayTarget(target)
+	if !ok {
+		fail("target is not registered with this relay")
+		return
+	}
+
+	out, err := targetPeer.session.Open()
+	if err != nil {
+		fail("could not open stream to target")
+		return
+	}
+
+	err = writeMessage(out, &transport.Message{Type: relayIncomingType, Sender: l.Me().String(), Body: []byte(m.Sender)})
+	if err != nil {
+		out.Close()
+		fail("could not open stream to target")
+		return
+	}
+
+	err = writeMessage(stream, &transport.Message{Type: relayStatusType})
+	if err != nil {
+		out.Close()
+		stream.Close()
+		return
+	}
+
+	splice(stream, out)
+}
+
+// splice copies data between the two connections until either closes
+func splice(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	copyAndClose := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		dst.Close()
+		src.Close()
+		done <- struct{}{}
+	}
+
+	go copyAndClose(a, b)
+	go copyAndClose(b, a)
+	<-done
+	<-done
+}
+
+// dialRelay asks the relay in the address to open a circuit to its target,
+// and returns the stream to run a session over
+func (l *Legion) dialRelay(address utils.LegionAddress) (net.Conn, error) {
+	relay, _, err := address.RelayParts()
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure we have a connection to the relay
+	if err := l.AddPeer(relay); err != nil {
+		return nil, err
+	}
+	p, ok := l.peers.Load(relay)
+	if !ok {
+		return nil, errors.New("relay: could not connect to relay")
+	}
+
+	stream, err := p.session.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeMessage(stream, &transport.Message{Type: relayConnectType, Sender: l.Me().String(), Body: []byte(address.String())})
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	stream.SetReadDeadline(time.Now().Add(relayDialTimeout))
+	status, err := readMessage(stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	if status.Type != relayStatusType || len(status.Body) != 0 {
+		stream.Close()
+		return nil, errors.New("relay: " + string(status.Body))
+	}
+
+	return stream, nil
+}
+
+// registerWithRelay connects to the relay in our advertise address and asks
+// it to relay connections to us, registering again whenever the session to
+// the relay drops until we stop
+func (l *Legion) registerWithRelay() {
+	retry := l.config.RelayRetryInterval
+	if retry == 0 {
+		retry = config.DefaultRelayRetryInterval
+	}
+
+	for {
+		relay, _, err := l.Me().RelayParts()
+		if err != nil {
+			return
+		}
+
+		if p, err := l.connectToRelay(relay); err != nil {
+			log.Warn().Field("err", err).Field("relay", relay.String()).Log("legion: could not connect to relay")
+		} else {
+			l.relayMux.Lock()
+			l.relayPeer = p
+			l.relayMux.Unlock()
+			p.QueueMessage(&transport.Message{Type: relayRegisterType, Sender: l.Me().String()})
+
+			select {
+			case <-p.session.CloseChan():
+				log.Debug().Field("relay", relay.String()).Log("legion: lost session to relay")
+			case <-l.stopped:
+				return
+			}
+		}
+
+		select {
+		case <-time.After(retry):
+		case <-l.stopped:
+			return
+		}
+	}
+}
+
+// connectToRelay returns an open session to the relay
+func (l *Legion) connectToRelay(relay utils.LegionAddress) (*Peer, error) {
+	if err := l.AddPeer(relay); err != nil {
+		return nil, err
+	}
+	p, ok := l.peers.Load(relay)
+	if !ok || p.session.IsClosed() {
+		return nil, errors.New("relay: could not connect to relay")
+	}
+	return p, nil
+}
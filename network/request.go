@@ -0,0 +1,207 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gladiusio/legion/network/transport"
+	"github.com/gladiusio/legion/utils"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// DefaultRequestTimeout is used when RequestOptions.Timeout is zero
+const DefaultRequestTimeout = time.Second
+
+// ErrQuorumNotReached is returned by RequestAll when too few peers replied
+var ErrQuorumNotReached = errors.New("request: quorum not reached")
+
+// RequestOptions configures RequestAny and RequestAll
+type RequestOptions struct {
+	// Timeout is how long each attempt waits for a reply
+	Timeout time.Duration
+
+	// Deadline is how long the whole call can take including retries, zero
+	// only limits each attempt
+	Deadline time.Duration
+
+	// Quorum is how many replies RequestAll waits for, zero waits for a
+	// reply from every address
+	Quorum int
+
+	// Validate can reject a reply, which is then treated as a failed attempt
+	Validate func(*transport.Message) error
+
+	// Retry is how failed attempts to each peer are retried
+	Retry RetryPolicy
+}
+
+// RetryPolicy retries a request with exponential backoff
+type RetryPolicy struct {
+	// Attempts is the most times a request is sent to a peer, zero sends once
+	Attempts int
+
+	// Backoff is the wait before the first retry, it is multiplied by
+	// Multiplier (zero uses 2) after each retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Multiplier float64
+}
+
+// backoff returns how long to wait before the given retry, starting at one
+func (r RetryPolicy) backoff(retry int) time.Duration {
+	multiplier := r.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	wait := float64(r.Backoff)
+	for i := 1; i < retry; i++ {
+		wait *= multiplier
+		if r.MaxBackoff != 0 && wait > float64(r.MaxBackoff) {
+			return r.MaxBackoff
+		}
+	}
+	return time.Duration(wait)
+}
+
+// Reply is a reply to a request and the peer it came from
+type Reply struct {
+	From    utils.LegionAddress
+	Message *transport.Message
+}
+
+// RequestAny sends the message to all of the addresses and returns the first
+// successful reply, the requests still waiting are cancelled. Each peer gets
+// its own copy of the message.
+func (l *Legion) RequestAny(message *transport.Message, addresses []utils.LegionAddress, opts RequestOptions) (*Reply, error) {
+	ctx, cancel := opts.context()
+	defer cancel()
+
+	results := l.requestEach(ctx, message, addresses, opts)
+
+	var result *multierror.Error
+	for range addresses {
+		r := <-results
+		if r.err == nil {
+			return r.reply, nil
+		}
+		result = multierror.Append(result, r.err)
+	}
+
+	if result == nil {
+		return nil, errors.New("request: no addresses to send to")
+	}
+	return nil, result
+}
+
+// RequestAll sends the message to all of the addresses and gathers the replies
+// until the quorum is reached, every peer has replied or failed, or the
+// deadline passes. If fewer than the quorum replied the replies received are
+// returned along with ErrQuorumNotReached.
+func (l *Legion) RequestAll(message *transport.Message, addresses []utils.LegionAddress, opts RequestOptions) ([]*Reply, error) {
+	ctx, cancel := opts.context()
+	defer cancel()
+
+	quorum := opts.Quorum
+	if quorum == 0 || quorum > len(addresses) {
+		quorum = len(addresses)
+	}
+
+	results := l.requestEach(ctx, message, addresses, opts)
+
+	replies := make([]*Reply, 0, quorum)
+	for range addresses {
+		r := <-results
+		if r.err != nil {
+			continue
+		}
+
+		replies = append(replies, r.reply)
+		if len(replies) >= quorum {
+			return replies, nil
+		}
+	}
+
+	if len(replies) >= quorum {
+		return replies, nil
+	}
+	return replies, ErrQuorumNotReached
+}
+
+type requestResult struct {
+	reply *Reply
+	err   error
+}
+
+// requestEach starts a request to each address, every one sends exactly one
+// result to the returned channel
+func (l *Legion) requestEach(ctx context.Context, message *transport.Message, addresses []utils.LegionAddress, opts RequestOptions) chan requestResult {
+	results := make(chan requestResult, len(addresses))
+	for _, address := range addresses {
+		go func(address utils.LegionAddress) {
+			m, err := l.requestWithRetry(ctx, message, address, opts)
+			if err != nil {
+				results <- requestResult{err: fmt.Errorf("request to %s: %s", address, err)}
+				return
+			}
+			results <- requestResult{reply: &Reply{From: address, Message: m}}
+		}(address)
+	}
+	return results
+}
+
+// requestWithRetry requests from a single address, retrying with the policy
+// until an attempt succeeds or the context is done
+func (l *Legion) requestWithRetry(ctx context.Context, message *transport.Message, address utils.LegionAddress, opts RequestOptions) (*transport.Message, error) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = DefaultRequestTimeout
+	}
+
+	attempts := opts.Retry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(opts.Retry.backoff(attempt)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		// Each attempt gets its own copy since the request ID is set on it
+		m := *message
+
+		var reply *transport.Message
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		reply, err = l.RequestContext(attemptCtx, &m, address)
+		cancel()
+
+		if err == nil && opts.Validate != nil {
+			err = opts.Validate(reply)
+		}
+		if err == nil {
+			return reply, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
+
+// context returns the context limiting the whole call
+func (opts RequestOptions) context() (context.Context, context.CancelFunc) {
+	if opts.Deadline == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), opts.Deadline)
+}
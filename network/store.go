@@ -0,0 +1,206 @@
+package network
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gladiusio/legion/network/peerstore"
+	"github.com/gladiusio/legion/utils"
+
+	log "github.com/gladiusio/legion/logger"
+)
+
+// ErrPeerBanned is returned when adding a peer that is banned in the peer store
+var ErrPeerBanned = errors.New("legion: peer is banned")
+
+// seenInterval is how often a connected peer's last seen time is updated
+// in the peer store, so a busy peer doesn't cause constant writes
+const seenInterval = time.Minute
+
+// PeerStore returns the configured peer store, or nil if there isn't one
+func (l *Legion) PeerStore() peerstore.PeerStore {
+	return l.config.PeerStore
+}
+
+// BanPeer bans the peer in the peer store and disconnects it, a zero duration
+// bans it forever. If the peer is connected the host its connection comes
+// from is banned too, stored as the host with a zero port, so it can't come
+// back under another address. It returns an error if there is no peer store.
+func (l *Legion) BanPeer(address utils.LegionAddress, duration time.Duration) error {
+	addresses := []utils.LegionAddress{address}
+	if p, ok := l.peers.Load(address); ok {
+		if host, ok := p.hostAddress(); ok {
+			addresses = append(addresses, host)
+		}
+	}
+
+	if err := l.ban(duration, addresses...); err != nil {
+		return err
+	}
+
+	return l.DeletePeer(address)
+}
+
+// banPeer bans the address the peer reported and the host it connects from,
+// and disconnects it
+func (l *Legion) banPeer(p *Peer, duration time.Duration) error {
+	defer p.Close()
+
+	addresses := make([]utils.LegionAddress, 0, 2)
+	if p.Remote().IsValid() {
+		addresses = append(addresses, p.Remote())
+	}
+	if host, ok := p.hostAddress(); ok {
+		addresses = append(addresses, host)
+	}
+	return l.ban(duration, addresses...)
+}
+
+// ban marks the addresses as banned in the peer store
+func (l *Legion) ban(duration time.Duration, addresses ...utils.LegionAddress) error {
+	store := l.config.PeerStore
+	if store == nil {
+		return errors.New("legion: no peer store configured")
+	}
+
+	var until time.Time
+	if duration != 0 {
+		until = time.Now().Add(duration)
+	}
+	for _, address := range addresses {
+		err := store.Update(address, func(r *peerstore.Record) {
+			r.Banned = true
+			r.BannedUntil = until
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnbanPeer removes the ban on the peer, a ban on its host is removed by
+// passing the host with a zero port
+func (l *Legion) UnbanPeer(address utils.LegionAddress) error {
+	store := l.config.PeerStore
+	if store == nil {
+		return nil
+	}
+	return store.Update(address, func(r *peerstore.Record) {
+		r.Banned = false
+		r.BannedUntil = time.Time{}
+	})
+}
+
+// SetPeerIdentity sets an identity for the peer, like a public key learned by
+// the framework. The connected peer is indexed under it (see
+// PeerSet.ByIdentity) and it is recorded in the peer store if there is one.
+func (l *Legion) SetPeerIdentity(address utils.LegionAddress, identity string) {
+	l.peers.SetIdentity(address, identity)
+
+	store := l.config.PeerStore
+	if store == nil {
+		return
+	}
+	if r, ok := store.Get(address); ok && r.Identity == identity {
+		return
+	}
+	err := store.Update(address, func(r *peerstore.Record) { r.Identity = identity })
+	if err != nil {
+		log.Warn().Field("err", err).Log("legion: error updating peer store")
+	}
+}
+
+// isBanned returns true if the address or its host is banned in the peer
+// store
+func (l *Legion) isBanned(address utils.LegionAddress) bool {
+	store := l.config.PeerStore
+	if store == nil {
+		return false
+	}
+
+	now := time.Now()
+	if r, ok := store.Get(address); ok && r.IsBanned(now) {
+		return true
+	}
+	if address.Network() != utils.SchemeTCP || address.Port == 0 {
+		return false
+	}
+	r, ok := store.Get(utils.NewLegionAddress(address.Host, 0))
+	return ok && r.IsBanned(now)
+}
+
+// isPeerBanned returns true if the host the peer connects from is banned, or
+// the address it reported once it has sent one
+func (l *Legion) isPeerBanned(p *Peer) bool {
+	if host, ok := p.hostAddress(); ok && l.isBanned(host) {
+		return true
+	}
+	return p.Remote().IsValid() && l.isBanned(p.Remote())
+}
+
+// recordDial records the result of dialing a peer
+func (l *Legion) recordDial(address utils.LegionAddress, dialErr error) {
+	store := l.config.PeerStore
+	if store == nil {
+		return
+	}
+	err := store.Update(address, func(r *peerstore.Record) {
+		if dialErr != nil {
+			r.Failures++
+			return
+		}
+		r.Successes++
+		r.LastSeen = time.Now()
+	})
+	if err != nil {
+		log.Warn().Field("err", err).Log("legion: error updating peer store")
+	}
+}
+
+// recordSeen updates the last seen time of a connected peer, at most once
+// every seenInterval unless force is set. Only peers that already have a
+// record are updated, so peers can't fill the store by reporting new
+// addresses.
+func (l *Legion) recordSeen(p *Peer, force bool) {
+	store := l.config.PeerStore
+	if store == nil || !p.Remote().IsValid() {
+		return
+	}
+
+	now := time.Now()
+	last := p.lastSeen.Load()
+	if !force && now.Sub(time.Unix(0, last)) < seenInterval {
+		return
+	}
+	if !p.lastSeen.CAS(last, now.UnixNano()) {
+		return
+	}
+	if _, ok := store.Get(p.Remote()); !ok {
+		return
+	}
+
+	err := store.Update(p.Remote(), func(r *peerstore.Record) { r.LastSeen = now })
+	if err != nil {
+		log.Warn().Field("err", err).Log("legion: error updating peer store")
+	}
+}
+
+// redialKnownPeers dials the most recently seen known-good peers in the store
+func (l *Legion) redialKnownPeers() {
+	store := l.config.PeerStore
+	if store == nil || l.config.RedialPeers == 0 {
+		return
+	}
+
+	known := peerstore.KnownGood(store, l.config.RedialPeers, l.config.RedialMaxAge)
+	addresses := make([]utils.LegionAddress, 0, len(known))
+	for _, r := range known {
+		addresses = append(addresses, r.Address)
+	}
+
+	log.Debug().Field("count", len(addresses)).Log("legion: redialing known peers")
+	if err := l.AddPeer(addresses...); err != nil {
+		log.Debug().Field("err", err).Log("legion: could not redial all known peers")
+	}
+}
@@ -26,9 +26,15 @@ type Message struct {
 	Type   string `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
 	Body   []byte `protobuf:"bytes,3,opt,name=body,proto3" json:"body,omitempty"`
 	// Used to keep track of RPC messages
-	RpcId                uint64   `protobuf:"varint,4,opt,name=rpc_id,json=rpcId,proto3" json:"rpc_id,omitempty"`
-	IsRequest            bool     `protobuf:"varint,5,opt,name=is_request,json=isRequest,proto3" json:"is_request,omitempty"`
-	IsReply              bool     `protobuf:"varint,6,opt,name=is_reply,json=isReply,proto3" json:"is_reply,omitempty"`
+	RpcId     uint64 `protobuf:"varint,4,opt,name=rpc_id,json=rpcId,proto3" json:"rpc_id,omitempty"`
+	IsRequest bool   `protobuf:"varint,5,opt,name=is_request,json=isRequest,proto3" json:"is_request,omitempty"`
+	IsReply   bool   `protobuf:"varint,6,opt,name=is_reply,json=isReply,proto3" json:"is_reply,omitempty"`
+	// The codec the body is compressed with, empty if it is not compressed
+	Compression string `protobuf:"bytes,7,opt,name=compression,proto3" json:"compression,omitempty"`
+	// Used for acknowledged delivery, a message with ack_requested set is
+	// acked by the receiver and duplicates with the same message_id dropped
+	MessageId            string   `protobuf:"bytes,8,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	AckRequested         bool     `protobuf:"varint,9,opt,name=ack_requested,json=ackRequested,proto3" json:"ack_requested,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
 }
@@ -37,7 +43,7 @@ func (m *Message) Reset()         { *m = Message{} }
 func (m *Message) String() string { return proto.CompactTextString(m) }
 func (*Message) ProtoMessage()    {}
 func (*Message) Descriptor() ([]byte, []int) {
-	return fileDescriptor_message_3b7c9ae504b9d89a, []int{0}
+	return fileDescriptor_message_6b25637867ad37b0, []int{0}
 }
 func (m *Message) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -108,8 +114,96 @@ func (m *Message) GetIsReply() bool {
 	return false
 }
 
+func (m *Message) GetCompression() string {
+	if m != nil {
+		return m.Compression
+	}
+	return ""
+}
+
+func (m *Message) GetMessageId() string {
+	if m != nil {
+		return m.MessageId
+	}
+	return ""
+}
+
+func (m *Message) GetAckRequested() bool {
+	if m != nil {
+		return m.AckRequested
+	}
+	return false
+}
+
+// Handshake is sent by both sides of a session when it is established
+type Handshake struct {
+	// Compression codecs the sender can decompress, in order of preference
+	Compression []string `protobuf:"bytes,1,rep,name=compression" json:"compression,omitempty"`
+	// The address the sender sees the receiver connecting from
+	ObservedAddress string `protobuf:"bytes,2,opt,name=observed_address,json=observedAddress,proto3" json:"observed_address,omitempty"`
+	// Protocol features the sender supports, like "legion.ack/1"
+	Capabilities         []string `protobuf:"bytes,3,rep,name=capabilities" json:"capabilities,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Handshake) Reset()         { *m = Handshake{} }
+func (m *Handshake) String() string { return proto.CompactTextString(m) }
+func (*Handshake) ProtoMessage()    {}
+func (*Handshake) Descriptor() ([]byte, []int) {
+	return fileDescriptor_message_6b25637867ad37b0, []int{1}
+}
+func (m *Handshake) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Handshake) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Handshake.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (dst *Handshake) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Handshake.Merge(dst, src)
+}
+func (m *Handshake) XXX_Size() int {
+	return m.Size()
+}
+func (m *Handshake) XXX_DiscardUnknown() {
+	xxx_messageInfo_Handshake.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Handshake proto.InternalMessageInfo
+
+func (m *Handshake) GetCompression() []string {
+	if m != nil {
+		return m.Compression
+	}
+	return nil
+}
+
+func (m *Handshake) GetObservedAddress() string {
+	if m != nil {
+		return m.ObservedAddress
+	}
+	return ""
+}
+
+func (m *Handshake) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Message)(nil), "transport.Message")
+	proto.RegisterType((*Handshake)(nil), "transport.Handshake")
 }
 func (m *Message) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
@@ -169,6 +263,82 @@ func (m *Message) MarshalTo(dAtA []byte) (int, error) {
 		}
 		i++
 	}
+	if len(m.Compression) > 0 {
+		dAtA[i] = 0x3a
+		i++
+		i = encodeVarintMessage(dAtA, i, uint64(len(m.Compression)))
+		i += copy(dAtA[i:], m.Compression)
+	}
+	if len(m.MessageId) > 0 {
+		dAtA[i] = 0x42
+		i++
+		i = encodeVarintMessage(dAtA, i, uint64(len(m.MessageId)))
+		i += copy(dAtA[i:], m.MessageId)
+	}
+	if m.AckRequested {
+		dAtA[i] = 0x48
+		i++
+		if m.AckRequested {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i++
+	}
+	return i, nil
+}
+
+func (m *Handshake) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Handshake) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Compression) > 0 {
+		for _, s := range m.Compression {
+			dAtA[i] = 0xa
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				dAtA[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			dAtA[i] = uint8(l)
+			i++
+			i += copy(dAtA[i:], s)
+		}
+	}
+	if len(m.ObservedAddress) > 0 {
+		dAtA[i] = 0x12
+		i++
+		i = encodeVarintMessage(dAtA, i, uint64(len(m.ObservedAddress)))
+		i += copy(dAtA[i:], m.ObservedAddress)
+	}
+	if len(m.Capabilities) > 0 {
+		for _, s := range m.Capabilities {
+			dAtA[i] = 0x1a
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				dAtA[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			dAtA[i] = uint8(l)
+			i++
+			i += copy(dAtA[i:], s)
+		}
+	}
 	return i, nil
 }
 
@@ -205,6 +375,39 @@ func (m *Message) Size() (n int) {
 	if m.IsReply {
 		n += 2
 	}
+	l = len(m.Compression)
+	if l > 0 {
+		n += 1 + l + sovMessage(uint64(l))
+	}
+	l = len(m.MessageId)
+	if l > 0 {
+		n += 1 + l + sovMessage(uint64(l))
+	}
+	if m.AckRequested {
+		n += 2
+	}
+	return n
+}
+
+func (m *Handshake) Size() (n int) {
+	var l int
+	_ = l
+	if len(m.Compression) > 0 {
+		for _, s := range m.Compression {
+			l = len(s)
+			n += 1 + l + sovMessage(uint64(l))
+		}
+	}
+	l = len(m.ObservedAddress)
+	if l > 0 {
+		n += 1 + l + sovMessage(uint64(l))
+	}
+	if len(m.Capabilities) > 0 {
+		for _, s := range m.Capabilities {
+			l = len(s)
+			n += 1 + l + sovMessage(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -398,6 +601,221 @@ func (m *Message) Unmarshal(dAtA []byte) error {
 				}
 			}
 			m.IsReply = bool(v != 0)
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Compression", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthMessage
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Compression = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MessageId", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthMessage
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.MessageId = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field AckRequested", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.AckRequested = bool(v != 0)
+		default:
+			iNdEx = preIndex
+			skippy, err := skipMessage(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthMessage
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *Handshake) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowMessage
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= (uint64(b) & 0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: Handshake: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Handshake: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Compression", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthMessage
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Compression = append(m.Compression, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ObservedAddress", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthMessage
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ObservedAddress = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Capabilities", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowMessage
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthMessage
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Capabilities = append(m.Capabilities, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipMessage(dAtA[iNdEx:])
@@ -525,23 +943,29 @@ var (
 )
 
 func init() {
-	proto.RegisterFile("network/transport/message.proto", fileDescriptor_message_3b7c9ae504b9d89a)
-}
-
-var fileDescriptor_message_3b7c9ae504b9d89a = []byte{
-	// 209 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x92, 0xcf, 0x4b, 0x2d, 0x29,
-	0xcf, 0x2f, 0xca, 0xd6, 0x2f, 0x29, 0x4a, 0xcc, 0x2b, 0x2e, 0xc8, 0x2f, 0x2a, 0xd1, 0xcf, 0x4d,
-	0x2d, 0x2e, 0x4e, 0x4c, 0x4f, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x84, 0x4b, 0x28,
-	0xcd, 0x62, 0xe4, 0x62, 0xf7, 0x85, 0x48, 0x0a, 0x89, 0x71, 0xb1, 0x15, 0xa7, 0xe6, 0xa5, 0xa4,
-	0x16, 0x49, 0x30, 0x2a, 0x30, 0x6a, 0x70, 0x06, 0x41, 0x79, 0x42, 0x42, 0x5c, 0x2c, 0x25, 0x95,
-	0x05, 0xa9, 0x12, 0x4c, 0x60, 0x51, 0x30, 0x1b, 0x24, 0x96, 0x94, 0x9f, 0x52, 0x29, 0xc1, 0xac,
-	0xc0, 0xa8, 0xc1, 0x13, 0x04, 0x66, 0x0b, 0x89, 0x72, 0xb1, 0x15, 0x15, 0x24, 0xc7, 0x67, 0xa6,
-	0x48, 0xb0, 0x28, 0x30, 0x6a, 0xb0, 0x04, 0xb1, 0x16, 0x15, 0x24, 0x7b, 0xa6, 0x08, 0xc9, 0x72,
-	0x71, 0x65, 0x16, 0xc7, 0x17, 0xa5, 0x16, 0x96, 0xa6, 0x16, 0x97, 0x48, 0xb0, 0x2a, 0x30, 0x6a,
-	0x70, 0x04, 0x71, 0x66, 0x16, 0x07, 0x41, 0x04, 0x84, 0x24, 0xb9, 0x38, 0xc0, 0xd2, 0x05, 0x39,
-	0x95, 0x12, 0x6c, 0x60, 0x49, 0x76, 0x90, 0x64, 0x41, 0x4e, 0xa5, 0x93, 0xc0, 0x89, 0x47, 0x72,
-	0x8c, 0x17, 0x1e, 0xc9, 0x31, 0x3e, 0x78, 0x24, 0xc7, 0x38, 0xe1, 0xb1, 0x1c, 0x43, 0x12, 0x1b,
-	0xd8, 0x03, 0xc6, 0x80, 0x00, 0x00, 0x00, 0xff, 0xff, 0xd0, 0x0b, 0x25, 0x6a, 0xe3, 0x00, 0x00,
-	0x00,
+	proto.RegisterFile("network/transport/message.proto", fileDescriptor_message_6b25637867ad37b0)
+}
+
+var fileDescriptor_message_6b25637867ad37b0 = []byte{
+	// 309 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x5c, 0x91, 0x3d, 0x4e, 0xc3, 0x30,
+	0x14, 0x80, 0x71, 0x7f, 0xd2, 0xe6, 0x51, 0x44, 0x65, 0x09, 0x64, 0x06, 0x42, 0x54, 0x96, 0xb0,
+	0xd0, 0x81, 0x13, 0xc0, 0x44, 0x07, 0x96, 0x5c, 0xa0, 0x72, 0xec, 0x27, 0xb0, 0xd2, 0xc6, 0xc6,
+	0x36, 0xa0, 0x48, 0x0c, 0x1c, 0x81, 0x63, 0x31, 0x72, 0x04, 0x54, 0x2e, 0x82, 0xe2, 0x26, 0x08,
+	0xba, 0xbd, 0x7c, 0x5f, 0xf4, 0x3e, 0xd9, 0x86, 0xb3, 0x0a, 0xfd, 0x8b, 0xb6, 0xe5, 0xdc, 0x5b,
+	0x5e, 0x39, 0xa3, 0xad, 0x9f, 0xaf, 0xd1, 0x39, 0x7e, 0x8f, 0x97, 0xc6, 0x6a, 0xaf, 0x69, 0xfc,
+	0x2b, 0x66, 0x6f, 0x3d, 0x18, 0xdd, 0x6d, 0x25, 0x3d, 0x86, 0xc8, 0x61, 0x25, 0xd1, 0x32, 0x92,
+	0x92, 0x2c, 0xce, 0xdb, 0x2f, 0x4a, 0x61, 0xe0, 0x6b, 0x83, 0xac, 0x17, 0x68, 0x98, 0x1b, 0x56,
+	0x68, 0x59, 0xb3, 0x7e, 0x4a, 0xb2, 0x49, 0x1e, 0x66, 0x7a, 0x04, 0x91, 0x35, 0x62, 0xa9, 0x24,
+	0x1b, 0xa4, 0x24, 0x1b, 0xe4, 0x43, 0x6b, 0xc4, 0x42, 0xd2, 0x53, 0x00, 0xe5, 0x96, 0x16, 0x1f,
+	0x9f, 0xd0, 0x79, 0x36, 0x4c, 0x49, 0x36, 0xce, 0x63, 0xe5, 0xf2, 0x2d, 0xa0, 0x27, 0x30, 0x0e,
+	0xda, 0xac, 0x6a, 0x16, 0x05, 0x39, 0x6a, 0xa4, 0x59, 0xd5, 0x34, 0x85, 0x7d, 0xa1, 0xd7, 0xc6,
+	0xa2, 0x73, 0x4a, 0x57, 0x6c, 0x14, 0xfa, 0x7f, 0x51, 0xb3, 0xbb, 0x3d, 0x5a, 0x93, 0x1d, 0x87,
+	0x1f, 0xe2, 0x96, 0x2c, 0x24, 0x3d, 0x87, 0x03, 0x2e, 0xca, 0xae, 0x8d, 0x92, 0xc5, 0x21, 0x30,
+	0xe1, 0xa2, 0xcc, 0x3b, 0x36, 0x7b, 0x85, 0xf8, 0x96, 0x57, 0xd2, 0x3d, 0xf0, 0x12, 0x77, 0x93,
+	0x24, 0xed, 0xef, 0x26, 0x2f, 0x60, 0xaa, 0x0b, 0x87, 0xf6, 0x19, 0xe5, 0x92, 0x4b, 0xd9, 0xe0,
+	0xf6, 0x66, 0x0e, 0x3b, 0x7e, 0xbd, 0xc5, 0x74, 0x06, 0x13, 0xc1, 0x0d, 0x2f, 0xd4, 0x4a, 0x79,
+	0x85, 0x8e, 0xf5, 0xc3, 0xb6, 0x7f, 0xec, 0x66, 0xfa, 0xb1, 0x49, 0xc8, 0xe7, 0x26, 0x21, 0x5f,
+	0x9b, 0x84, 0xbc, 0x7f, 0x27, 0x7b, 0x45, 0x14, 0x1e, 0xe9, 0xea, 0x67, 0x00, 0xf6, 0xf8, 0xc2,
+	0x15, 0xc7, 0x01, 0x00, 0x00,
 }
@@ -1,52 +1,307 @@
 package utils
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-// NewLegionAddress returns a LegionAddress object
+// The schemes a LegionAddress can have, an address without a scheme is TCP
+const (
+	SchemeTCP  = "tcp"
+	SchemeUnix = "unix"
+	SchemeMem  = "mem"
+
+	// SchemeRelay addresses a peer through a relay, the host is the
+	// relay's address and the target's address split by a "/"
+	SchemeRelay = "relay"
+)
+
+// ErrNotTCP is returned when resolving an address that isn't TCP
+var ErrNotTCP = errors.New("address: only tcp addresses can be resolved")
+
+// NewLegionAddress returns a TCP LegionAddress object, the host is kept as is
+// so host names are resolved each time the address is dialed
 func NewLegionAddress(host string, port uint16) LegionAddress {
-	host = resolveHost(host)
 	return LegionAddress{Host: host, Port: port}
 }
 
-// LegionAddressFromString returns a LegionAddress from a string
+// LegionAddressFromString returns a LegionAddress from a string, if the string
+// can't be parsed an empty address is returned. Use ParseLegionAddress to get
+// the parsing error.
 func LegionAddressFromString(addrString string) LegionAddress {
-	split := strings.Split(addrString, ":")
-	if len(split) != 2 {
+	addr, err := ParseLegionAddress(addrString)
+	if err != nil {
 		return LegionAddress{}
 	}
-	host := split[0]
-	host = resolveHost(host)
-	port, _ := strconv.Atoi(split[1])
-	return LegionAddress{Host: host, Port: uint16(port)}
+	return addr
+}
+
+// NewRelayAddress returns an address that reaches the target through the relay
+func NewRelayAddress(relay, target LegionAddress) LegionAddress {
+	return LegionAddress{Scheme: SchemeRelay, Host: relay.String() + "/" + target.String()}
+}
+
+// ParseLegionAddress parses an address like "host:port", "[::1]:port",
+// "tcp://host:port", "unix:///path/to/socket", "mem://name" or
+// "relay://relayhost:port/targethost:port"
+func ParseLegionAddress(addrString string) (LegionAddress, error) {
+	scheme := SchemeTCP
+	rest := addrString
+	if i := strings.Index(addrString, "://"); i >= 0 {
+		scheme = strings.ToLower(addrString[:i])
+		rest = addrString[i+3:]
+	}
+
+	switch scheme {
+	case SchemeTCP:
+		host, portString, err := net.SplitHostPort(rest)
+		if err != nil {
+			return LegionAddress{}, fmt.Errorf("address: could not parse %q: %s", addrString, err)
+		}
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil {
+			return LegionAddress{}, fmt.Errorf("address: invalid port in %q", addrString)
+		}
+		return LegionAddress{Host: host, Port: uint16(port)}, nil
+	case SchemeUnix, SchemeMem:
+		if rest == "" {
+			return LegionAddress{}, fmt.Errorf("address: %q is missing a path", addrString)
+		}
+		return LegionAddress{Scheme: scheme, Host: rest}, nil
+	case SchemeRelay:
+		addr := LegionAddress{Scheme: scheme, Host: rest}
+		if _, _, err := addr.RelayParts(); err != nil {
+			return LegionAddress{}, err
+		}
+		return addr, nil
+	}
+
+	return LegionAddress{}, fmt.Errorf("address: unknown scheme %q", scheme)
 }
 
 //LegionAddress is a comparable type with a few convinience methods
 type LegionAddress struct {
-	Host string `json:"host"`
-	Port uint16 `json:"port"`
+	// Scheme is the transport to use, empty means TCP
+	Scheme string
+
+	// Host is the host name or IP for TCP, or the path or name of the
+	// socket for the other schemes
+	Host string
+
+	// Port is only used for TCP addresses
+	Port uint16
 }
 
-// String returns a formatted KCP address like "host:port"
+// String returns a formatted address like "host:port", or "scheme://path"
+// for addresses that aren't TCP
 func (k LegionAddress) String() string {
-	return k.Host + ":" + strconv.Itoa(int(k.Port))
+	if k.Scheme != "" && k.Scheme != SchemeTCP {
+		return k.Scheme + "://" + k.Host
+	}
+	return net.JoinHostPort(k.Host, strconv.Itoa(int(k.Port)))
+}
+
+// Network returns the network name of the address' transport
+func (k LegionAddress) Network() string {
+	if k.Scheme == "" {
+		return SchemeTCP
+	}
+	return k.Scheme
+}
+
+// DialString returns the address in the form used to dial or listen on it
+func (k LegionAddress) DialString() string {
+	if k.Network() == SchemeTCP {
+		return net.JoinHostPort(k.Host, strconv.Itoa(int(k.Port)))
+	}
+	return k.Host
 }
 
 // IsValid returns true if the address is valid, false if not
 func (k LegionAddress) IsValid() bool {
+	if k.Network() != SchemeTCP {
+		return k.Host != ""
+	}
 	if k.Host != "" && k.Port != 0 {
 		return true
 	}
 	return false
 }
 
-func resolveHost(host string) string {
-	addr, err := net.LookupHost(host)
-	if len(addr) == 0 || err != nil {
-		return host
+// RelayParts splits a relay address into the relay and the target addresses
+func (k LegionAddress) RelayParts() (relay LegionAddress, target LegionAddress, err error) {
+	if k.Scheme != SchemeRelay {
+		return relay, target, fmt.Errorf("address: %s is not a relay address", k)
+	}
+
+	split := strings.SplitN(k.Host, "/", 2)
+	if len(split) != 2 {
+		return relay, target, fmt.Errorf("address: relay address %q is missing a target", k.Host)
+	}
+
+	relay, err = ParseLegionAddress(split[0])
+	if err != nil {
+		return relay, target, err
+	}
+	target, err = ParseLegionAddress(split[1])
+	if err != nil {
+		return relay, target, err
+	}
+	if relay.Scheme == SchemeRelay || target.Scheme == SchemeRelay {
+		return relay, target, errors.New("address: relay addresses can't be nested")
+	}
+	return relay, target, nil
+}
+
+// MatchesHost returns true if the host (usually an IP seen on a connection)
+// is the host of this address or one of the IPs it resolves to. Lookups are
+// cached for hostCacheTTL, so checking many messages doesn't cause a lookup
+// for each.
+func (k LegionAddress) MatchesHost(host string) bool {
+	if k.Host == host {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	addrs, err := hosts.lookup(k.Host)
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ip.Equal(net.ParseIP(a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalText returns the address in its string form, an empty address
+// is encoded as an empty string
+func (k LegionAddress) MarshalText() ([]byte, error) {
+	if k == (LegionAddress{}) {
+		return []byte{}, nil
+	}
+	return []byte(k.String()), nil
+}
+
+// UnmarshalJSON parses an address encoded by MarshalText, or the object form
+// {"host": ..., "port": ...} addresses were encoded as before they had schemes
+func (k *LegionAddress) UnmarshalJSON(data []byte) error {
+	trimmed := strings.TrimSpace(string(data))
+	if trimmed == "null" {
+		return nil
+	}
+	if !strings.HasPrefix(trimmed, "{") {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		return k.UnmarshalText([]byte(text))
+	}
+
+	var old struct {
+		Scheme string `json:"scheme"`
+		Host   string `json:"host"`
+		Port   uint16 `json:"port"`
+	}
+	if err := json.Unmarshal(data, &old); err != nil {
+		return err
+	}
+	if old.Scheme == SchemeTCP {
+		old.Scheme = ""
+	}
+	*k = LegionAddress{Scheme: old.Scheme, Host: old.Host, Port: old.Port}
+	return nil
+}
+
+// UnmarshalText parses an address created by MarshalText
+func (k *LegionAddress) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*k = LegionAddress{}
+		return nil
+	}
+
+	addr, err := ParseLegionAddress(string(text))
+	if err != nil {
+		return err
+	}
+	*k = addr
+	return nil
+}
+
+// Resolve returns a copy of the address with the host resolved to an IP
+func (k LegionAddress) Resolve() (LegionAddress, error) {
+	if k.Network() != SchemeTCP {
+		return k, ErrNotTCP
+	}
+
+	addrs, err := net.LookupHost(k.Host)
+	if err != nil {
+		return k, err
+	}
+	if len(addrs) == 0 {
+		return k, fmt.Errorf("address: no addresses found for %s", k.Host)
+	}
+	return LegionAddress{Host: addrs[0], Port: k.Port}, nil
+}
+
+// How long host lookups are cached for MatchesHost, and how many are kept
+const (
+	hostCacheTTL  = time.Minute
+	hostCacheSize = 1024
+)
+
+var hosts = &hostCache{entries: make(map[string]hostCacheEntry)}
+
+// hostCache remembers the results of host lookups, failed ones included so
+// unresolvable names aren't looked up again either
+type hostCache struct {
+	entries map[string]hostCacheEntry
+	mux     sync.Mutex
+}
+
+type hostCacheEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+func (c *hostCache) lookup(host string) ([]string, error) {
+	now := time.Now()
+	c.mux.Lock()
+	e, ok := c.entries[host]
+	c.mux.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addrs, e.err
+	}
+
+	addrs, err := net.LookupHost(host)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.entries) >= hostCacheSize {
+		for h, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, h)
+			}
+		}
+	}
+	if len(c.entries) >= hostCacheSize {
+		for h := range c.entries {
+			delete(c.entries, h)
+			break
+		}
 	}
-	return addr[0]
+	c.entries[host] = hostCacheEntry{addrs: addrs, err: err, expires: now.Add(hostCacheTTL)}
+	return addrs, err
 }
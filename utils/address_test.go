@@ -1,6 +1,9 @@
 package utils
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+)
 
 func TestAddressEquality(t *testing.T) {
 	a1 := NewLegionAddress("localhost", 1234)
@@ -10,3 +13,114 @@ func TestAddressEquality(t *testing.T) {
 		t.Error("addresses not equal")
 	}
 }
+
+func TestParseAddress(t *testing.T) {
+	cases := map[string]LegionAddress{
+		"localhost:7946":          {Host: "localhost", Port: 7946},
+		"10.0.0.1:80":             {Host: "10.0.0.1", Port: 80},
+		"[::1]:7946":              {Host: "::1", Port: 7946},
+		"tcp://example.com:7946":  {Host: "example.com", Port: 7946},
+		"unix:///tmp/legion.sock": {Scheme: SchemeUnix, Host: "/tmp/legion.sock"},
+		"mem://node1":             {Scheme: SchemeMem, Host: "node1"},
+	}
+
+	for s, expected := range cases {
+		a, err := ParseLegionAddress(s)
+		if err != nil {
+			t.Errorf("error parsing %s: %s", s, err)
+			continue
+		}
+		if a != expected {
+			t.Errorf("parsed %s as %+v, expected %+v", s, a, expected)
+		}
+	}
+
+	if NewLegionAddress("::1", 7946).String() != "[::1]:7946" {
+		t.Error("ipv6 address was not formatted with brackets")
+	}
+}
+
+func TestParseAddressErrors(t *testing.T) {
+	for _, s := range []string{"", "localhost", "localhost:notaport", "localhost:70000", "::1:7946", "ftp://host:21", "mem://", "relay://10.0.0.1:7946", "relay://a:1/relay://b:2/c:3"} {
+		if _, err := ParseLegionAddress(s); err == nil {
+			t.Errorf("expected an error parsing %q", s)
+		}
+	}
+
+	if LegionAddressFromString("bad") != (LegionAddress{}) {
+		t.Error("invalid address should be empty")
+	}
+}
+
+func TestAddressMarshalling(t *testing.T) {
+	type wrapper struct {
+		Addr LegionAddress `json:"addr"`
+	}
+
+	for _, a := range []LegionAddress{NewLegionAddress("localhost", 1234), NewLegionAddress("::1", 1), {Scheme: SchemeMem, Host: "n"}, {}} {
+		b, err := json.Marshal(wrapper{a})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out wrapper
+		if err := json.Unmarshal(b, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out.Addr != a {
+			t.Errorf("address %+v did not round trip through json, got %+v", a, out.Addr)
+		}
+	}
+}
+
+func TestAddressUnmarshalOldForm(t *testing.T) {
+	var a LegionAddress
+	if err := json.Unmarshal([]byte(`{"host":"localhost","port":1234}`), &a); err != nil {
+		t.Fatal(err)
+	}
+	if a != NewLegionAddress("localhost", 1234) {
+		t.Errorf("old object form was not parsed, got %+v", a)
+	}
+
+	if err := json.Unmarshal([]byte(`"bad"`), &a); err == nil {
+		t.Error("invalid address string should fail to unmarshal")
+	}
+}
+
+func TestHostPreserved(t *testing.T) {
+	a := NewLegionAddress("localhost", 1234)
+	if a.Host != "localhost" {
+		t.Error("host name should not be resolved when creating an address")
+	}
+
+	if !a.MatchesHost("127.0.0.1") {
+		t.Error("localhost should match 127.0.0.1")
+	}
+
+	// The lookup is cached
+	hosts.mux.Lock()
+	_, cached := hosts.entries["localhost"]
+	hosts.mux.Unlock()
+	if !cached {
+		t.Error("lookup for localhost should be cached")
+	}
+}
+
+func TestRelayAddress(t *testing.T) {
+	relay := NewLegionAddress("10.0.0.1", 7946)
+	target := NewLegionAddress("192.168.1.2", 7000)
+	addr := NewRelayAddress(relay, target)
+
+	r, tg, err := addr.RelayParts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != relay || tg != target {
+		t.Errorf("relay parts were incorrect: %s, %s", r, tg)
+	}
+
+	parsed, err := ParseLegionAddress(addr.String())
+	if err != nil || parsed != addr {
+		t.Errorf("relay address did not round trip: %v", err)
+	}
+}